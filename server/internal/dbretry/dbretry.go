@@ -0,0 +1,87 @@
+// Package dbretry retries database calls that failed for transient reasons,
+// such as a connection dropped during a Postgres failover.
+package dbretry
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// Policy controls how often and how patiently a call is retried. The zero
+// Policy makes a single attempt.
+type Policy struct {
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+	// BaseDelay is the wait before the first retry; it doubles on each
+	// subsequent retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultPolicy = Policy{
+	MaxRetries: 3,
+	BaseDelay:  50 * time.Millisecond,
+	MaxDelay:   time.Second,
+}
+
+// Do runs fn, retrying while it returns a transient error and retries
+// remain. It stops early if ctx is done.
+func Do(ctx context.Context, policy Policy, fn func() error) error {
+	delay := policy.BaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxRetries || !IsTransient(err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// Serialization failures and deadlocks are safe to retry; Postgres aborts
+// the transaction and expects the client to try again.
+var transientSQLStates = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+// IsTransient reports whether err is worth retrying. Logical errors such as
+// sql.ErrNoRows or constraint violations never are.
+func IsTransient(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, sql.ErrNoRows),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+
+	// Both pgx and lib/pq errors expose the SQLSTATE this way.
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		return transientSQLStates[stateErr.SQLState()]
+	}
+	return false
+}
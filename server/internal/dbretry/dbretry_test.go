@@ -0,0 +1,105 @@
+package dbretry_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/dbretry"
+)
+
+// sqlStateError mimics the SQLSTATE accessor of pgx and lib/pq errors.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"canceled", context.Canceled, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"bad conn", driver.ErrBadConn, true},
+		{"conn done", sql.ErrConnDone, true},
+		{"connection reset", syscall.ECONNRESET, true},
+		{"connection refused", syscall.ECONNREFUSED, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"wrapped reset", fmt.Errorf("query users: %w", syscall.ECONNRESET), true},
+		{"serialization failure", sqlStateError("40001"), true},
+		{"deadlock", sqlStateError("40P01"), true},
+		{"unique violation", sqlStateError("23505"), false},
+		{"other error", errors.New("syntax error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dbretry.IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	errLogic := errors.New("constraint violation")
+
+	tests := []struct {
+		name      string
+		policy    dbretry.Policy
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", dbretry.Policy{MaxRetries: 3}, nil, 1, nil},
+		{"zero policy tries once", dbretry.Policy{}, []error{syscall.ECONNRESET}, 1, syscall.ECONNRESET},
+		{"recovers", dbretry.Policy{MaxRetries: 3}, []error{syscall.ECONNRESET, driver.ErrBadConn}, 3, nil},
+		{"gives up", dbretry.Policy{MaxRetries: 2}, []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET}, 3, syscall.ECONNRESET},
+		{"logical error not retried", dbretry.Policy{MaxRetries: 3}, []error{errLogic}, 1, errLogic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := dbretry.Do(context.Background(), tt.policy, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	// The hour-long delay would hang the test if cancellation were ignored.
+	err := dbretry.Do(ctx, dbretry.Policy{MaxRetries: 5, BaseDelay: time.Hour}, func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v, want the last attempt's error", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn ran %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,229 @@
+// Package integrity finds, and optionally repairs, inconsistencies between
+// the users and tokens tables that constraints do not rule out, such as
+// rows written before a constraint existed or by manual fixes.
+package integrity
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+type IssueKind string
+
+const (
+	// OrphanToken is a token whose user no longer exists.
+	OrphanToken IssueKind = "orphan_token"
+	// DanglingApprover is a user whose approved_by names a missing user.
+	DanglingApprover IssueKind = "dangling_approver"
+	// DuplicateTokens is a user holding more live tokens of a kind than the
+	// token service ever issues at once.
+	DuplicateTokens IssueKind = "duplicate_tokens"
+)
+
+// Issue is one problem found by DiagnoseIntegrity. Repairable issues are
+// fixed by RepairIntegrity; the rest need an operator's judgement.
+type Issue struct {
+	Kind       IssueKind `json:"kind"`
+	UserID     int64     `json:"user_id"`
+	TokenID    int64     `json:"token_id,omitempty"`
+	Detail     string    `json:"detail"`
+	Repairable bool      `json:"repairable"`
+}
+
+type IntegrityReport struct {
+	Issues []Issue `json:"issues"`
+}
+
+// Count returns how many issues of kind the report holds.
+func (r *IntegrityReport) Count(kind IssueKind) int {
+	n := 0
+	for _, issue := range r.Issues {
+		if issue.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// RepairResult counts the rows RepairIntegrity changed.
+type RepairResult struct {
+	OrphanTokensDeleted      int `json:"orphan_tokens_deleted"`
+	DanglingApproversCleared int `json:"dangling_approvers_cleared"`
+}
+
+type Checker struct {
+	db *sql.DB
+}
+
+func NewChecker(db *sql.DB) *Checker {
+	return &Checker{
+		db: db,
+	}
+}
+
+// singleTokenScopes are scopes the token service replaces on issue, so a
+// user never legitimately holds two live tokens of them. Deploy tokens are
+// checked per permission, since a user may hold one read and one write
+// token.
+var singleTokenScopes = []string{token.ScopeEmailVerify, token.ScopeSMSChallenge, token.ScopeElevated}
+
+// DiagnoseIntegrity reports integrity problems without modifying anything.
+func (c *Checker) DiagnoseIntegrity(ctx context.Context) (*IntegrityReport, error) {
+	report := &IntegrityReport{Issues: []Issue{}}
+
+	checks := []func(context.Context, *IntegrityReport) error{
+		c.findOrphanTokens,
+		c.findDanglingApprovers,
+		c.findDuplicateTokens,
+	}
+	for _, check := range checks {
+		if err := check(ctx, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func (c *Checker) findOrphanTokens(ctx context.Context, report *IntegrityReport) error {
+	query := `
+	SELECT t.id, t.user_id, t.scope
+	FROM tokens t
+	WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.user_id)
+	ORDER BY t.id
+	`
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("integrity: orphan tokens: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var issue Issue
+		var scope string
+		if err := rows.Scan(&issue.TokenID, &issue.UserID, &scope); err != nil {
+			return err
+		}
+		issue.Kind = OrphanToken
+		issue.Detail = fmt.Sprintf("%s token belongs to missing user %d", scope, issue.UserID)
+		issue.Repairable = true
+		report.Issues = append(report.Issues, issue)
+	}
+	return rows.Err()
+}
+
+func (c *Checker) findDanglingApprovers(ctx context.Context, report *IntegrityReport) error {
+	query := `
+	SELECT u.id, u.approved_by
+	FROM users u
+	WHERE u.approved_by IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM users a WHERE a.id = u.approved_by)
+	ORDER BY u.id
+	`
+	rows, err := c.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("integrity: dangling approvers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var issue Issue
+		var approverID int64
+		if err := rows.Scan(&issue.UserID, &approverID); err != nil {
+			return err
+		}
+		issue.Kind = DanglingApprover
+		issue.Detail = fmt.Sprintf("approved by missing user %d", approverID)
+		issue.Repairable = true
+		report.Issues = append(report.Issues, issue)
+	}
+	return rows.Err()
+}
+
+// findDuplicateTokens flags users over the per-kind live token limit. It
+// is report-only: deleting either token could cut off a client in use.
+func (c *Checker) findDuplicateTokens(ctx context.Context, report *IntegrityReport) error {
+	// Tokens from before permissions existed count as write tokens, as in
+	// token.Token.Allows. Other scopes carry no permission and so form one
+	// group per user.
+	query := `
+	SELECT user_id, scope, COALESCE(permission, $3), COUNT(*)
+	FROM tokens
+	WHERE expiry > NOW()
+		AND (scope = ANY($1::text[]) OR scope = $2)
+	GROUP BY user_id, scope, COALESCE(permission, $3)
+	HAVING COUNT(*) > 1
+	ORDER BY user_id, scope
+	`
+	scopes := "{" + strings.Join(singleTokenScopes, ",") + "}"
+	rows, err := c.db.QueryContext(ctx, query, scopes, token.ScopeDeploy, token.PermissionWrite)
+	if err != nil {
+		return fmt.Errorf("integrity: duplicate tokens: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var issue Issue
+		var scope, permission string
+		var count int
+		if err := rows.Scan(&issue.UserID, &scope, &permission, &count); err != nil {
+			return err
+		}
+		issue.Kind = DuplicateTokens
+		issue.Detail = fmt.Sprintf("%d live %s tokens", count, scope)
+		if scope == token.ScopeDeploy {
+			issue.Detail = fmt.Sprintf("%d live %s %s tokens", count, permission, scope)
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	return rows.Err()
+}
+
+// RepairIntegrity applies the safe fixes in one transaction: orphan tokens
+// are deleted and approved_by references to missing users are cleared,
+// leaving the users approved. Duplicate tokens are left for an operator.
+// Run DiagnoseIntegrity first to see what will change.
+func (c *Checker) RepairIntegrity(ctx context.Context) (*RepairResult, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+	DELETE FROM tokens t
+	WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = t.user_id)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("integrity: delete orphan tokens: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err = tx.ExecContext(ctx, `
+	UPDATE users u
+	SET approved_by = NULL, version = version + 1
+	WHERE u.approved_by IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM users a WHERE a.id = u.approved_by)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("integrity: clear dangling approvers: %w", err)
+	}
+	cleared, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &RepairResult{
+		OrphanTokensDeleted:      int(deleted),
+		DanglingApproversCleared: int(cleared),
+	}, nil
+}
@@ -0,0 +1,281 @@
+package integrity
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+// scriptedDB is a database/sql driver that answers each statement with the
+// first canned response whose match is a substring of the SQL. It stands in
+// for a database seeded with the anomalies under test.
+type scriptedDB struct {
+	queries []cannedQuery
+	execs   []cannedExec
+
+	args       map[string][]driver.NamedValue
+	committed  bool
+	rolledBack bool
+}
+
+type cannedQuery struct {
+	match string
+	rows  [][]driver.Value
+	err   error
+}
+
+type cannedExec struct {
+	match    string
+	affected int64
+	err      error
+}
+
+func (d *scriptedDB) Open(string) (driver.Conn, error) { return scriptedConn{d}, nil }
+
+func (d *scriptedDB) Connect(context.Context) (driver.Conn, error) { return scriptedConn{d}, nil }
+func (d *scriptedDB) Driver() driver.Driver                        { return d }
+
+type scriptedConn struct{ d *scriptedDB }
+
+func (c scriptedConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c scriptedConn) Close() error                        { return nil }
+func (c scriptedConn) Begin() (driver.Tx, error)           { return scriptedTx{c.d}, nil }
+
+func (c scriptedConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return scriptedTx{c.d}, nil
+}
+
+func (c scriptedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	for _, q := range c.d.queries {
+		if strings.Contains(query, q.match) {
+			c.d.args[q.match] = args
+			if q.err != nil {
+				return nil, q.err
+			}
+			return &scriptedRows{rows: q.rows}, nil
+		}
+	}
+	return &scriptedRows{}, nil
+}
+
+func (c scriptedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	for _, e := range c.d.execs {
+		if strings.Contains(query, e.match) {
+			if e.err != nil {
+				return nil, e.err
+			}
+			return driver.RowsAffected(e.affected), nil
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type scriptedTx struct{ d *scriptedDB }
+
+func (tx scriptedTx) Commit() error   { tx.d.committed = true; return nil }
+func (tx scriptedTx) Rollback() error { tx.d.rolledBack = true; return nil }
+
+type scriptedRows struct {
+	rows [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *scriptedRows) Close() error { return nil }
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newScriptedChecker(t *testing.T, d *scriptedDB) *Checker {
+	t.Helper()
+	d.args = make(map[string][]driver.NamedValue)
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { db.Close() })
+	return NewChecker(db)
+}
+
+const (
+	orphanQuery    = "SELECT t.id, t.user_id"
+	danglingQuery  = "SELECT u.id, u.approved_by"
+	duplicateQuery = "GROUP BY"
+)
+
+func TestDiagnoseIntegrity(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name       string
+		queries    []cannedQuery
+		wantCounts map[IssueKind]int
+		wantDetail []string
+		wantErr    error
+	}{
+		{
+			name:       "clean",
+			wantCounts: map[IssueKind]int{OrphanToken: 0, DanglingApprover: 0, DuplicateTokens: 0},
+		},
+		{
+			name: "seeded anomalies",
+			queries: []cannedQuery{
+				{match: orphanQuery, rows: [][]driver.Value{
+					{int64(10), int64(99), token.ScopeDeploy},
+					{int64(11), int64(99), token.ScopeAuth},
+				}},
+				{match: danglingQuery, rows: [][]driver.Value{
+					{int64(3), int64(98)},
+				}},
+				{match: duplicateQuery, rows: [][]driver.Value{
+					{int64(4), token.ScopeDeploy, token.PermissionRead, int64(2)},
+					{int64(5), token.ScopeEmailVerify, token.PermissionWrite, int64(3)},
+				}},
+			},
+			wantCounts: map[IssueKind]int{OrphanToken: 2, DanglingApprover: 1, DuplicateTokens: 2},
+			wantDetail: []string{
+				"deployment token belongs to missing user 99",
+				"approved by missing user 98",
+				"2 live read deployment tokens",
+				"3 live email_verification tokens",
+			},
+		},
+		{
+			name:    "query failure",
+			queries: []cannedQuery{{match: danglingQuery, err: errBoom}},
+			wantErr: errBoom,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &scriptedDB{queries: tt.queries}
+			c := newScriptedChecker(t, d)
+
+			report, err := c.DiagnoseIntegrity(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			for kind, want := range tt.wantCounts {
+				if got := report.Count(kind); got != want {
+					t.Errorf("Count(%s) = %d, want %d", kind, got, want)
+				}
+			}
+			for _, issue := range report.Issues {
+				if wantRepairable := issue.Kind != DuplicateTokens; issue.Repairable != wantRepairable {
+					t.Errorf("%s issue for user %d: Repairable = %v", issue.Kind, issue.UserID, issue.Repairable)
+				}
+			}
+			for _, detail := range tt.wantDetail {
+				if !hasDetail(report, detail) {
+					t.Errorf("no issue with detail %q in %+v", detail, report.Issues)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnoseIntegrityDuplicateScopes(t *testing.T) {
+	d := &scriptedDB{queries: []cannedQuery{{match: duplicateQuery}}}
+	c := newScriptedChecker(t, d)
+
+	if _, err := c.DiagnoseIntegrity(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	args := d.args[duplicateQuery]
+	if len(args) != 3 {
+		t.Fatalf("duplicate query got %d args, want 3", len(args))
+	}
+	scopes, _ := args[0].Value.(string)
+	for _, scope := range singleTokenScopes {
+		if !strings.Contains(scopes, scope) {
+			t.Errorf("scope array %q is missing %s", scopes, scope)
+		}
+	}
+	if args[1].Value != token.ScopeDeploy {
+		t.Errorf("deploy scope arg = %v, want %s", args[1].Value, token.ScopeDeploy)
+	}
+}
+
+func TestRepairIntegrity(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name         string
+		execs        []cannedExec
+		want         RepairResult
+		wantErr      error
+		wantCommit   bool
+		wantRollback bool
+	}{
+		{
+			name: "repairs",
+			execs: []cannedExec{
+				{match: "DELETE FROM tokens", affected: 2},
+				{match: "UPDATE users", affected: 1},
+			},
+			want:       RepairResult{OrphanTokensDeleted: 2, DanglingApproversCleared: 1},
+			wantCommit: true,
+		},
+		{
+			name:       "nothing to repair",
+			wantCommit: true,
+		},
+		{
+			name: "second fix fails",
+			execs: []cannedExec{
+				{match: "DELETE FROM tokens", affected: 2},
+				{match: "UPDATE users", err: errBoom},
+			},
+			wantErr:      errBoom,
+			wantRollback: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &scriptedDB{execs: tt.execs}
+			c := newScriptedChecker(t, d)
+
+			result, err := c.RepairIntegrity(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && *result != tt.want {
+				t.Errorf("result = %+v, want %+v", *result, tt.want)
+			}
+			if d.committed != tt.wantCommit {
+				t.Errorf("committed = %v, want %v", d.committed, tt.wantCommit)
+			}
+			if d.rolledBack != tt.wantRollback {
+				t.Errorf("rolled back = %v, want %v", d.rolledBack, tt.wantRollback)
+			}
+		})
+	}
+}
+
+func hasDetail(report *IntegrityReport, detail string) bool {
+	for _, issue := range report.Issues {
+		if issue.Detail == detail {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+// Package requestid carries a per-request correlation ID through a context so
+// log lines from different layers can be tied back to the request that
+// caused them.
+package requestid
+
+import (
+	"context"
+	"log/slog"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the correlation ID stored in ctx, if any.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(contextKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Logger returns logger annotated with the correlation ID from ctx. If ctx
+// has none, logger is returned unchanged.
+func Logger(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id, ok := FromContext(ctx); ok {
+		return logger.With("correlation_id", id)
+	}
+	return logger
+}
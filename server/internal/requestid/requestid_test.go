@@ -0,0 +1,46 @@
+package requestid_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+)
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		wantID string
+		wantOK bool
+	}{
+		{"no ID", context.Background(), "", false},
+		{"empty ID", requestid.NewContext(context.Background(), ""), "", false},
+		{"with ID", requestid.NewContext(context.Background(), "req-123"), "req-123", true},
+		{"innermost ID wins", requestid.NewContext(requestid.NewContext(context.Background(), "outer"), "inner"), "inner", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := requestid.FromContext(tt.ctx)
+			if id != tt.wantID || ok != tt.wantOK {
+				t.Fatalf("FromContext = %q, %v; want %q, %v", id, ok, tt.wantID, tt.wantOK)
+			}
+
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, nil))
+			requestid.Logger(tt.ctx, logger).Info("hello")
+
+			line := buf.String()
+			hasID := strings.Contains(line, "correlation_id=")
+			if hasID != tt.wantOK {
+				t.Fatalf("log line %q: correlation_id present = %v, want %v", line, hasID, tt.wantOK)
+			}
+			if tt.wantOK && !strings.Contains(line, "correlation_id="+tt.wantID) {
+				t.Errorf("log line %q does not carry %q", line, tt.wantID)
+			}
+		})
+	}
+}
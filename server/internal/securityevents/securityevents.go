@@ -0,0 +1,117 @@
+// Package securityevents keeps an append-only record of security-relevant
+// events per user, such as logins, password changes and token issuance, for
+// forensic review.
+package securityevents
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type Type string
+
+const (
+	LoginSucceeded  Type = "login_succeeded"
+	LoginFailed     Type = "login_failed"
+	PasswordChanged Type = "password_changed"
+	TokenIssued     Type = "token_issued"
+	TokenRevoked    Type = "token_revoked"
+)
+
+type Event struct {
+	ID         int64           `json:"id"`
+	UserID     int64           `json:"user_id"`
+	Type       Type            `json:"type"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+}
+
+// NewEvent builds an event, encoding metadata as JSON. A nil metadata map
+// leaves Metadata empty.
+func NewEvent(userID int64, typ Type, occurredAt time.Time, metadata map[string]any) (Event, error) {
+	event := Event{
+		UserID:     userID,
+		Type:       typ,
+		OccurredAt: occurredAt,
+	}
+	if metadata != nil {
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			return Event{}, err
+		}
+		event.Metadata = encoded
+	}
+	return event, nil
+}
+
+// EventRecorder appends security events. Services treat recording as best
+// effort: a failure is logged and never fails the operation being recorded.
+type EventRecorder interface {
+	Record(ctx context.Context, event Event) error
+}
+
+type NoopRecorder struct{}
+
+func (NoopRecorder) Record(ctx context.Context, event Event) error {
+	return nil
+}
+
+// Repo stores events in the security_events table. Rows are only ever
+// inserted; nothing in zdeploy updates or deletes them.
+type Repo struct {
+	db *sql.DB
+}
+
+func NewRepo(db *sql.DB) *Repo {
+	return &Repo{
+		db: db,
+	}
+}
+
+func (r *Repo) Record(ctx context.Context, event Event) error {
+	query := `
+	INSERT INTO security_events (user_id, event_type, occurred_at, metadata)
+	VALUES ($1, $2, $3, $4)
+	`
+	var metadata any
+	if len(event.Metadata) > 0 {
+		metadata = []byte(event.Metadata)
+	}
+	_, err := r.db.ExecContext(ctx, query, event.UserID, event.Type, event.OccurredAt, metadata)
+	return err
+}
+
+// ListSecurityEvents returns the user's events, most recent first.
+func (r *Repo) ListSecurityEvents(ctx context.Context, userID int64, limit, offset int) ([]*Event, error) {
+	query := `
+	SELECT id, user_id, event_type, occurred_at, metadata
+	FROM security_events
+	WHERE user_id = $1
+	ORDER BY occurred_at DESC, id DESC
+	LIMIT $2 OFFSET $3
+	`
+	rows, err := r.db.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		event := &Event{}
+		var metadata []byte
+		if err := rows.Scan(&event.ID, &event.UserID, &event.Type, &event.OccurredAt, &metadata); err != nil {
+			return nil, err
+		}
+		if len(metadata) > 0 {
+			event.Metadata = metadata
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,95 @@
+package securityevents_test
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/securityevents"
+	"github.com/samokw/zdeploy/server/internal/securityevents/securityeventstest"
+)
+
+func TestNewEvent(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		metadata     map[string]any
+		wantMetadata string
+		wantErr      bool
+	}{
+		{name: "no metadata"},
+		{name: "metadata", metadata: map[string]any{"scope": "deployment", "token_id": 7}, wantMetadata: `{"scope":"deployment","token_id":7}`},
+		{name: "unencodable metadata", metadata: map[string]any{"bad": math.Inf(1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := securityevents.NewEvent(3, securityevents.TokenIssued, at, tt.metadata)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if event.UserID != 3 || event.Type != securityevents.TokenIssued || !event.OccurredAt.Equal(at) {
+				t.Errorf("got %+v", event)
+			}
+			if string(event.Metadata) != tt.wantMetadata {
+				t.Errorf("Metadata = %s, want %s", event.Metadata, tt.wantMetadata)
+			}
+		})
+	}
+}
+
+func TestMemoryRecorderListSecurityEvents(t *testing.T) {
+	ctx := context.Background()
+	recorder := securityeventstest.NewMemoryRecorder()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	record := func(userID int64, typ securityevents.Type, at time.Time) {
+		t.Helper()
+		event, err := securityevents.NewEvent(userID, typ, at, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recorder.Record(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(1, securityevents.LoginSucceeded, start)
+	record(2, securityevents.LoginFailed, start.Add(time.Minute))
+	record(1, securityevents.PasswordChanged, start.Add(2*time.Minute))
+	// Same timestamp as the password change: the later insert sorts first.
+	record(1, securityevents.TokenRevoked, start.Add(2*time.Minute))
+
+	tests := []struct {
+		name          string
+		userID        int64
+		limit, offset int
+		want          []securityevents.Type
+	}{
+		{"newest first", 1, 10, 0, []securityevents.Type{securityevents.TokenRevoked, securityevents.PasswordChanged, securityevents.LoginSucceeded}},
+		{"limited", 1, 1, 0, []securityevents.Type{securityevents.TokenRevoked}},
+		{"offset", 1, 10, 2, []securityevents.Type{securityevents.LoginSucceeded}},
+		{"past the end", 1, 10, 3, nil},
+		{"other user", 2, 10, 0, []securityevents.Type{securityevents.LoginFailed}},
+		{"no events", 9, 10, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := recorder.ListSecurityEvents(ctx, tt.userID, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("listed %d events, want %d", len(events), len(tt.want))
+			}
+			for i, e := range events {
+				if e.Type != tt.want[i] || e.UserID != tt.userID {
+					t.Errorf("event %d = %s for user %d, want %s for user %d", i, e.Type, e.UserID, tt.want[i], tt.userID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Package securityeventstest provides an in-memory securityevents recorder
+// for tests that should not need a database.
+package securityeventstest
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/samokw/zdeploy/server/internal/securityevents"
+)
+
+var _ securityevents.EventRecorder = (*MemoryRecorder)(nil)
+
+// MemoryRecorder is a concurrency-safe, slice-backed event log that mirrors
+// securityevents.Repo.
+type MemoryRecorder struct {
+	mu     sync.Mutex
+	nextID int64
+	events []securityevents.Event
+}
+
+func NewMemoryRecorder() *MemoryRecorder {
+	return &MemoryRecorder{}
+}
+
+func (m *MemoryRecorder) Record(ctx context.Context, event securityevents.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	event.ID = m.nextID
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *MemoryRecorder) ListSecurityEvents(ctx context.Context, userID int64, limit, offset int) ([]*securityevents.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matched []*securityevents.Event
+	for _, event := range m.events {
+		if event.UserID == userID {
+			e := event
+			matched = append(matched, &e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].OccurredAt.Equal(matched[j].OccurredAt) {
+			return matched[i].ID > matched[j].ID
+		}
+		return matched[i].OccurredAt.After(matched[j].OccurredAt)
+	})
+
+	if offset >= len(matched) {
+		return nil, nil
+	}
+	matched = matched[offset:]
+	if limit < len(matched) {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
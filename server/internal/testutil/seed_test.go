@@ -0,0 +1,175 @@
+package testutil_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/token/tokentest"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestSeedUser checks that seeded users are what the services expect from
+// a real signup with the same settings.
+func TestSeedUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		opts      testutil.UserOptions
+		login     string
+		password  string
+		wantErr   error
+		wantRole  user.Role
+		wantState string
+	}{
+		{
+			name:      "defaults",
+			password:  testutil.DefaultPassword,
+			wantRole:  user.RoleUser,
+			wantState: "active",
+		},
+		{
+			name:      "custom credentials and role",
+			opts:      testutil.UserOptions{Username: "Seeded", Password: "x", Role: user.RoleSuperAdmin},
+			login:     "seeded",
+			password:  "x",
+			wantRole:  user.RoleSuperAdmin,
+			wantState: "active",
+		},
+		{
+			name:      "pending",
+			opts:      testutil.UserOptions{Pending: true},
+			password:  testutil.DefaultPassword,
+			wantErr:   user.ErrUserNotApproved,
+			wantRole:  user.RoleUser,
+			wantState: "pending",
+		},
+		{
+			name:      "disabled",
+			opts:      testutil.UserOptions{Disabled: true},
+			password:  testutil.DefaultPassword,
+			wantErr:   user.ErrUserDisabled,
+			wantRole:  user.RoleUser,
+			wantState: "active",
+		},
+		{
+			name:      "wrong password",
+			password:  "not-the-password",
+			wantErr:   user.ErrInvalidCredentials,
+			wantRole:  user.RoleUser,
+			wantState: "active",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := usertest.NewMemoryUserStore()
+			svc := user.NewUserService(store, user.WithLogger(discard))
+			seeded := testutil.SeedUser(ctx, store, tt.opts)
+
+			if seeded.ID == 0 {
+				t.Fatal("seeded user has no ID")
+			}
+			if seeded.Role != tt.wantRole {
+				t.Errorf("Role = %q, want %q", seeded.Role, tt.wantRole)
+			}
+			if seeded.Status != tt.wantState {
+				t.Errorf("Status = %q, want %q", seeded.Status, tt.wantState)
+			}
+
+			login := tt.login
+			if login == "" {
+				login = seeded.Username
+			}
+			_, err := svc.AuthenticateUser(ctx, login, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AuthenticateUser: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSeedUserUniqueNames(t *testing.T) {
+	store := usertest.NewMemoryUserStore()
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		u := testutil.SeedUser(context.Background(), store, testutil.UserOptions{})
+		if seen[u.Username] {
+			t.Fatalf("username %q seeded twice", u.Username)
+		}
+		seen[u.Username] = true
+	}
+}
+
+func TestSeedToken(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		opts    testutil.TokenOptions
+		scope   string
+		wantErr error
+	}{
+		{name: "deploy default", scope: token.ScopeDeploy},
+		{name: "auth", opts: testutil.TokenOptions{Scope: token.ScopeAuth}, scope: token.ScopeAuth},
+		{name: "expired", opts: testutil.TokenOptions{TTL: -time.Minute}, scope: token.ScopeDeploy, wantErr: token.ErrTokenExpired},
+		{name: "scope mismatch", opts: testutil.TokenOptions{Scope: token.ScopeAuth}, scope: token.ScopeDeploy, wantErr: token.ErrInvalidScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tokentest.NewMemoryTokenRepo()
+			svc := token.NewTokenService(repo, token.WithLogger(discard))
+
+			tt.opts.UserID = 7
+			seeded := testutil.SeedToken(ctx, repo, tt.opts)
+			if seeded.PlainText == "" {
+				t.Fatal("seeded token has no plaintext")
+			}
+
+			got, err := svc.ValidateToken(ctx, seeded.PlainText, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateToken: got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.UserID != 7 {
+				t.Errorf("UserID = %d, want 7", got.UserID)
+			}
+			if tt.scope == token.ScopeDeploy && got.Permission != token.PermissionWrite {
+				t.Errorf("Permission = %q, want %q", got.Permission, token.PermissionWrite)
+			}
+		})
+	}
+}
+
+func TestSeedTokenKeepsOtherTokens(t *testing.T) {
+	ctx := context.Background()
+	repo := tokentest.NewMemoryTokenRepo()
+
+	first := testutil.SeedToken(ctx, repo, testutil.TokenOptions{UserID: 7})
+	testutil.SeedToken(ctx, repo, testutil.TokenOptions{UserID: 7})
+
+	if _, err := repo.GetByHash(ctx, first.Hash); err != nil {
+		t.Fatalf("first token gone after seeding another: %v", err)
+	}
+}
+
+func TestSeedTokenRequiresUserID(t *testing.T) {
+	defer func() {
+		r := recover()
+		if msg, _ := r.(string); !strings.Contains(msg, "UserID") {
+			t.Fatalf("recovered %v, want a panic naming UserID", r)
+		}
+	}()
+	testutil.SeedToken(context.Background(), tokentest.NewMemoryTokenRepo(), testutil.TokenOptions{})
+}
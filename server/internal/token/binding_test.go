@@ -0,0 +1,103 @@
+package token_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestBoundDeployTokenFailsClosed(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+
+	bound, err := svc.CreateDeployTokenBoundToIP(ctx, 1, "app", "192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A read token, so creating it does not replace the bound write token.
+	unbound, err := svc.CreateDeployTokenWithPermission(ctx, 1, "app", token.PermissionRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		validate func() error
+		want     error
+	}{
+		{"ValidateToken refuses bound", func() error {
+			_, err := svc.ValidateToken(ctx, bound.PlainText, token.ScopeDeploy)
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"ValidateTokenScoped refuses bound", func() error {
+			_, err := svc.ValidateTokenScoped(ctx, bound.PlainText, token.ScopeDeploy)
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"ValidateDeployToken refuses bound", func() error {
+			_, err := svc.ValidateDeployToken(ctx, bound.PlainText, "app")
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"ValidateDeployTokenFor refuses bound", func() error {
+			_, err := svc.ValidateDeployTokenFor(ctx, bound.PlainText, "app", token.PermissionRead)
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"bound from its address", func() error {
+			_, err := svc.ValidateBoundDeployToken(ctx, bound.PlainText, "app", token.PermissionRead, "192.0.2.10")
+			return err
+		}, nil},
+		{"bound from mapped notation", func() error {
+			_, err := svc.ValidateTokenBound(ctx, bound.PlainText, token.ScopeDeploy, "::ffff:192.0.2.10")
+			return err
+		}, nil},
+		{"bound from another address", func() error {
+			_, err := svc.ValidateBoundDeployToken(ctx, bound.PlainText, "app", token.PermissionRead, "192.0.2.11")
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"bound without an address", func() error {
+			_, err := svc.ValidateTokenBound(ctx, bound.PlainText, token.ScopeDeploy, "")
+			return err
+		}, token.ErrTokenBindingMismatch},
+		{"unbound via ValidateDeployToken", func() error {
+			_, err := svc.ValidateDeployToken(ctx, unbound.PlainText, "app")
+			return err
+		}, nil},
+		{"unbound via ValidateBoundDeployToken", func() error {
+			_, err := svc.ValidateBoundDeployToken(ctx, unbound.PlainText, "app", token.PermissionRead, "198.51.100.1")
+			return err
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.validate(); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedTokenRoundTrip(t *testing.T) {
+	ip := "192.0.2.10"
+	tests := []struct {
+		name string
+		tok  token.Token
+	}{
+		{"device", token.Token{UserID: 1, Scope: token.ScopeRefresh, DeviceID: "laptop"}},
+		{"bound", token.Token{UserID: 2, Scope: token.ScopeDeploy, Resource: "app", Permission: token.PermissionWrite, BoundIP: &ip}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.tok.Cached().Token()
+			if got.DeviceID != tt.tok.DeviceID {
+				t.Errorf("DeviceID = %q, want %q", got.DeviceID, tt.tok.DeviceID)
+			}
+			if (got.BoundIP == nil) != (tt.tok.BoundIP == nil) || (got.BoundIP != nil && *got.BoundIP != *tt.tok.BoundIP) {
+				t.Errorf("BoundIP = %v, want %v", got.BoundIP, tt.tok.BoundIP)
+			}
+			if got.Resource != tt.tok.Resource || got.Permission != tt.tok.Permission {
+				t.Errorf("got %+v, want %+v", got, tt.tok)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package token_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestDevicesRefreshIndependently(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newService(t)
+
+	laptopAuth, laptopRefresh, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phoneAuth, phoneRefresh, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		device  string
+		refresh *token.Token
+	}{
+		{"laptop", laptopRefresh},
+		{"phone", phoneRefresh},
+		{"laptop", laptopRefresh},
+	}
+	for i := 0; i < len(tests); i++ {
+		tt := tests[i]
+		auth, err := svc.RefreshAuthToken(ctx, tt.refresh.PlainText, 0)
+		if err != nil {
+			t.Fatalf("refresh %d on %s: %v", i, tt.device, err)
+		}
+		stored, err := repo.GetByHash(ctx, hashOf(auth.PlainText))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.DeviceID != tt.device {
+			t.Errorf("refresh %d issued a token for device %q, want %q", i, stored.DeviceID, tt.device)
+		}
+	}
+
+	// Refreshing never disturbs another device's tokens.
+	for _, tok := range []struct {
+		name      string
+		plaintext string
+		scope     string
+	}{
+		{"laptop auth", laptopAuth.PlainText, token.ScopeAuth},
+		{"laptop refresh", laptopRefresh.PlainText, token.ScopeRefresh},
+		{"phone auth", phoneAuth.PlainText, token.ScopeAuth},
+		{"phone refresh", phoneRefresh.PlainText, token.ScopeRefresh},
+	} {
+		if _, err := svc.ValidateToken(ctx, tok.plaintext, tok.scope); err != nil {
+			t.Errorf("%s: %v", tok.name, err)
+		}
+	}
+}
+
+func TestLoginReplacesOnlyThatDevice(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+
+	_, oldLaptop, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, phone, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.ValidateToken(ctx, oldLaptop.PlainText, token.ScopeRefresh); !errors.Is(err, token.ErrTokenNotFound) {
+		t.Errorf("replaced laptop refresh token: got %v, want ErrTokenNotFound", err)
+	}
+	if _, err := svc.ValidateToken(ctx, phone.PlainText, token.ScopeRefresh); err != nil {
+		t.Errorf("phone refresh token: %v", err)
+	}
+}
+
+func TestRevokeDevice(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		userID      int
+		device      string
+		wantErr     error
+		wantDeleted int
+	}{
+		{name: "laptop", userID: 1, device: "laptop", wantDeleted: 2},
+		{name: "unknown device", userID: 1, device: "tablet"},
+		{name: "another user's device", userID: 2, device: "laptop"},
+		{name: "no device", userID: 1, wantErr: token.ErrDeviceIDRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+			laptopAuth, laptopRefresh, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "laptop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, phoneRefresh, err := svc.CreateAuthTokenWithRefreshForDevice(ctx, 1, "phone")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, err := svc.RevokeDevice(ctx, tt.userID, tt.device)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted %d tokens, want %d", deleted, tt.wantDeleted)
+			}
+
+			_, err = svc.ValidateToken(ctx, laptopAuth.PlainText, token.ScopeAuth)
+			if revoked := errors.Is(err, token.ErrTokenNotFound); revoked != (tt.wantDeleted > 0) {
+				t.Errorf("laptop auth token revoked = %v, want %v", revoked, tt.wantDeleted > 0)
+			}
+			_, err = svc.ValidateToken(ctx, laptopRefresh.PlainText, token.ScopeRefresh)
+			if revoked := errors.Is(err, token.ErrTokenNotFound); revoked != (tt.wantDeleted > 0) {
+				t.Errorf("laptop refresh token revoked = %v, want %v", revoked, tt.wantDeleted > 0)
+			}
+			if _, err := svc.ValidateToken(ctx, phoneRefresh.PlainText, token.ScopeRefresh); err != nil {
+				t.Errorf("phone refresh token: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateAuthTokenWithRefreshForDeviceRequiresDevice(t *testing.T) {
+	svc, _ := newService(t)
+	if _, _, err := svc.CreateAuthTokenWithRefreshForDevice(context.Background(), 1, ""); !errors.Is(err, token.ErrDeviceIDRequired) {
+		t.Fatalf("got %v, want ErrDeviceIDRequired", err)
+	}
+}
@@ -0,0 +1,62 @@
+package token_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestExtendTokenExpiryScopes(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		create func(*token.TokenService) (*token.Token, error)
+		want   error
+	}{
+		{"auth", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateAuthToken(ctx, 1, 0)
+		}, nil},
+		{"deploy", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateDeployToken(ctx, 1)
+		}, nil},
+		{"elevated", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateElevatedToken(ctx, 1)
+		}, token.ErrScopeNotExtendable},
+		{"email verification", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateEmailVerificationToken(ctx, 1)
+		}, token.ErrScopeNotExtendable},
+		{"IP-bound deploy", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateDeployTokenBoundToIP(ctx, 1, "", "203.0.113.7")
+		}, token.ErrTokenBindingMismatch},
+		{"unknown", func(s *token.TokenService) (*token.Token, error) {
+			return &token.Token{PlainText: "not-a-token"}, nil
+		}, token.ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+			created, err := tt.create(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extended, err := svc.ExtendTokenExpiry(ctx, created.PlainText, time.Minute)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if !extended.Expiry.Equal(created.Expiry.Add(time.Minute)) {
+				t.Errorf("Expiry = %v, want %v", extended.Expiry, created.Expiry.Add(time.Minute))
+			}
+			if extended.Hash != nil || extended.UserID != 0 || extended.Scope != "" {
+				t.Errorf("returned token was not sanitized: %+v", extended)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package token
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// fakeDriver is the database/sql driver the repository tests run against.
+// It records every query and statement it is sent and how transactions
+// ended. Queries are answered by query and statements by exec; left unset,
+// the tokens table looks empty: queries return no rows and statements
+// affect none.
+type fakeDriver struct {
+	query func(query string, args []driver.NamedValue) (driver.Rows, error)
+	exec  func(query string, args []driver.NamedValue) (driver.Result, error)
+
+	queries    []fakeStatement
+	execs      []fakeStatement
+	committed  bool
+	rolledBack bool
+}
+
+// fakeStatement is a query or statement as a fakeDriver received it.
+type fakeStatement struct {
+	query string
+	args  []driver.NamedValue
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error)             { return fakeConn{d}, nil }
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) { return fakeConn{d}, nil }
+func (d *fakeDriver) Driver() driver.Driver                        { return d }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)         { return c, nil }
+func (c fakeConn) Commit() error                     { c.d.committed = true; return nil }
+func (c fakeConn) Rollback() error                   { c.d.rolledBack = true; return nil }
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.queries = append(c.d.queries, fakeStatement{query, args})
+	if c.d.query != nil {
+		return c.d.query(query, args)
+	}
+	return rowsOf(nil), nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.execs = append(c.d.execs, fakeStatement{query, args})
+	if c.d.exec != nil {
+		return c.d.exec(query, args)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// fakeRows hands out rows one at a time under cols.
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func rowsOf(cols []string, rows ...[]driver.Value) *fakeRows {
+	return &fakeRows{cols: cols, rows: rows}
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
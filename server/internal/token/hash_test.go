@@ -0,0 +1,30 @@
+package token
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashesEqual(t *testing.T) {
+	a := bytes.Repeat([]byte{0xab}, 32)
+	flipped := bytes.Clone(a)
+	flipped[31] ^= 1
+
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{"same", a, bytes.Clone(a)},
+		{"last byte differs", a, flipped},
+		{"prefix", a, a[:16]},
+		{"empty", a, nil},
+		{"both empty", nil, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := hashesEqual(tt.a, tt.b), bytes.Equal(tt.a, tt.b); got != want {
+				t.Errorf("hashesEqual = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package token_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+var jwtSecret = []byte("jwt-test-secret")
+
+// signHS256 builds a JWT by hand so tests can issue claims CreateJWT never
+// would, such as an expiry in the past.
+func signHS256(t *testing.T, secret []byte, alg string, claims token.Claims) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidateJWT(t *testing.T) {
+	now := time.Now()
+	live := token.Claims{Subject: "7", Scope: token.ScopeAuth, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name    string
+		jwt     func(t *testing.T) string
+		wantErr error
+	}{
+		{
+			name:    "live",
+			jwt:     func(t *testing.T) string { return signHS256(t, jwtSecret, "HS256", live) },
+			wantErr: nil,
+		},
+		{
+			name: "expired",
+			jwt: func(t *testing.T) string {
+				expired := live
+				expired.IssuedAt = now.Add(-2 * time.Hour).Unix()
+				expired.ExpiresAt = now.Add(-time.Hour).Unix()
+				return signHS256(t, jwtSecret, "HS256", expired)
+			},
+			wantErr: token.ErrTokenExpired,
+		},
+		{
+			name: "expiring now",
+			jwt: func(t *testing.T) string {
+				expiring := live
+				expiring.ExpiresAt = now.Unix()
+				return signHS256(t, jwtSecret, "HS256", expiring)
+			},
+			wantErr: token.ErrTokenExpired,
+		},
+		{
+			name:    "wrong secret",
+			jwt:     func(t *testing.T) string { return signHS256(t, []byte("other-secret"), "HS256", live) },
+			wantErr: token.ErrInvalidJWT,
+		},
+		{
+			name:    "alg none",
+			jwt:     func(t *testing.T) string { return signHS256(t, jwtSecret, "none", live) },
+			wantErr: token.ErrInvalidJWT,
+		},
+		{
+			name: "tampered claims",
+			jwt: func(t *testing.T) string {
+				parts := strings.Split(signHS256(t, jwtSecret, "HS256", live), ".")
+				forged := live
+				forged.Subject = "1"
+				payload, err := json.Marshal(forged)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+			},
+			wantErr: token.ErrInvalidJWT,
+		},
+		{
+			name:    "malformed",
+			jwt:     func(t *testing.T) string { return "not-a-jwt" },
+			wantErr: token.ErrInvalidJWT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, token.WithJWTSecret(jwtSecret))
+
+			claims, err := svc.ValidateJWT(tt.jwt(t))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Subject != live.Subject {
+				t.Errorf("Subject = %q, want %q", claims.Subject, live.Subject)
+			}
+		})
+	}
+}
+
+func TestCreateJWT(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []token.Option
+		scope   string
+		ttl     time.Duration
+		wantErr error
+	}{
+		{name: "HS256", opts: []token.Option{token.WithJWTSecret(jwtSecret)}, scope: token.ScopeAuth, ttl: time.Minute},
+		{name: "RS256", opts: []token.Option{token.WithJWTKey(key)}, scope: token.ScopeAuth, ttl: time.Minute},
+		{name: "default ttl", opts: []token.Option{token.WithJWTSecret(jwtSecret)}, scope: token.ScopeDeploy},
+		{name: "unknown scope", opts: []token.Option{token.WithJWTSecret(jwtSecret)}, scope: "bogus", wantErr: token.ErrInvalidScope},
+		{name: "not configured", scope: token.ScopeAuth, wantErr: token.ErrJWTNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, tt.opts...)
+
+			jwt, err := svc.CreateJWT(ctx, 42, tt.scope, tt.ttl)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateJWT: got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			claims, err := svc.ValidateJWT(jwt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID, err := claims.UserID(); err != nil || userID != 42 {
+				t.Errorf("UserID() = %d, %v, want 42", userID, err)
+			}
+			if claims.Scope != tt.scope {
+				t.Errorf("Scope = %q, want %q", claims.Scope, tt.scope)
+			}
+			if claims.ExpiresAt <= claims.IssuedAt {
+				t.Errorf("ExpiresAt %d not after IssuedAt %d", claims.ExpiresAt, claims.IssuedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package token_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestDeployTokenPermissions(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+
+	read, err := svc.CreateDeployTokenWithPermission(ctx, 1, "app", token.PermissionRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write, err := svc.CreateDeployTokenWithPermission(ctx, 1, "app", token.PermissionWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		plaintext  string
+		permission string
+		want       error
+	}{
+		{"read token on read", read.PlainText, token.PermissionRead, nil},
+		{"read token on write", read.PlainText, token.PermissionWrite, token.ErrInsufficientPermission},
+		{"write token on read", write.PlainText, token.PermissionRead, nil},
+		{"write token on write", write.PlainText, token.PermissionWrite, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.ValidateDeployTokenFor(ctx, tt.plaintext, "app", tt.permission); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := svc.CreateDeployTokenWithPermission(ctx, 1, "app", "admin", 0); !errors.Is(err, token.ErrInvalidPermission) {
+		t.Fatalf("unknown permission: got %v, want ErrInvalidPermission", err)
+	}
+}
+
+func TestCreateDeployTokenPurgesExpired(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		expiredFor string
+		newFor     string
+	}{
+		{"expired read token, new write token", token.PermissionRead, token.PermissionWrite},
+		{"expired write token, new read token", token.PermissionWrite, token.PermissionRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+
+			expired, err := token.GenerateToken(1, time.Hour, token.ScopeDeploy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired.Permission = tt.expiredFor
+			expired.Expiry = time.Now().Add(-time.Minute)
+			if err := repo.Insert(ctx, expired); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := svc.CreateDeployTokenWithPermission(ctx, 1, "app", tt.newFor, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.GetByHash(ctx, expired.Hash); !errors.Is(err, token.ErrNotFound) {
+				t.Fatalf("expired token still stored: %v", err)
+			}
+		})
+	}
+}
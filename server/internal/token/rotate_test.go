@@ -0,0 +1,123 @@
+package token_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestRotateTokenKeepsExtensionBudget(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		before      time.Duration
+		after       time.Duration
+		wantErr     error
+		wantExtends time.Duration
+	}{
+		{"within cap", 20 * time.Minute, 30 * time.Minute, nil, 50 * time.Minute},
+		{"up to cap", 30 * time.Minute, 30 * time.Minute, nil, time.Hour},
+		{"past cap", 40 * time.Minute, 30 * time.Minute, token.ErrExtensionLimitExceeded, 40 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t, token.WithMaxTokenExtension(time.Hour))
+
+			session, err := svc.CreateAuthSession(ctx, 1, time.Hour, "test-agent/1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.ExtendTokenExpiry(ctx, session.PlainText, tt.before); err != nil {
+				t.Fatal(err)
+			}
+
+			rotated, err := svc.RotateToken(ctx, session.PlainText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.ExtendTokenExpiry(ctx, rotated.PlainText, tt.after); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("extend after rotation: got %v, want %v", err, tt.wantErr)
+			}
+
+			stored, err := repo.ListTokensForUser(ctx, 1, token.ScopeAuth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != 1 {
+				t.Fatalf("got %d auth tokens, want 1", len(stored))
+			}
+			if stored[0].ExtendedBy != tt.wantExtends {
+				t.Errorf("ExtendedBy = %v, want %v", stored[0].ExtendedBy, tt.wantExtends)
+			}
+			if stored[0].UserAgent != "test-agent/1.0" {
+				t.Errorf("UserAgent = %q, want %q", stored[0].UserAgent, "test-agent/1.0")
+			}
+		})
+	}
+}
+
+func TestRotateTokenRefusals(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		scope   string
+		create  func(*token.TokenService) (*token.Token, error)
+		wantErr error
+	}{
+		{"auth", token.ScopeAuth, func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateAuthToken(ctx, 1, 0)
+		}, nil},
+		{"deploy", token.ScopeDeploy, func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateDeployToken(ctx, 1)
+		}, nil},
+		{"refresh", token.ScopeRefresh, func(s *token.TokenService) (*token.Token, error) {
+			_, refresh, err := s.CreateAuthTokenWithRefresh(ctx, 1)
+			return refresh, err
+		}, nil},
+		{"elevated", token.ScopeElevated, func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateElevatedToken(ctx, 1)
+		}, token.ErrInvalidScope},
+		{"email verification", token.ScopeEmailVerify, func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateEmailVerificationToken(ctx, 1)
+		}, token.ErrInvalidScope},
+		{"IP-bound deploy", token.ScopeDeploy, func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateDeployTokenBoundToIP(ctx, 1, "", "203.0.113.7")
+		}, token.ErrTokenBindingMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			old, err := tt.create(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rotated, err := svc.RotateToken(ctx, old.PlainText)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			// A refused rotation leaves the old token as the only one.
+			stored, err := repo.ListTokensForUser(ctx, 1, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stored) != 1 {
+				t.Fatalf("got %d %s tokens, want 1", len(stored), tt.scope)
+			}
+			want := hashOf(old.PlainText)
+			if tt.wantErr == nil {
+				want = hashOf(rotated.PlainText)
+			}
+			if !bytes.Equal(stored[0].Hash, want) {
+				t.Errorf("stored token is not the expected one (rotation error %v)", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package token_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestRevokeSession(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		create func(*token.TokenService) (*token.Token, error)
+		userID int
+		want   error
+	}{
+		{"own session", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateAuthSession(ctx, 1, time.Hour, "agent")
+		}, 1, nil},
+		{"another user's session", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateAuthSession(ctx, 1, time.Hour, "agent")
+		}, 2, token.ErrTokenNotFound},
+		{"deploy token", func(s *token.TokenService) (*token.Token, error) {
+			return s.CreateDeployToken(ctx, 1)
+		}, 1, token.ErrTokenNotFound},
+		{"refresh token", func(s *token.TokenService) (*token.Token, error) {
+			_, refresh, err := s.CreateAuthTokenWithRefresh(ctx, 1)
+			return refresh, err
+		}, 1, token.ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			created, err := tt.create(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := repo.GetByHash(ctx, hashOf(created.PlainText))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.RevokeSession(ctx, tt.userID, stored.ID); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+
+			_, err = repo.GetByHash(ctx, stored.Hash)
+			if revoked := errors.Is(err, token.ErrNotFound); revoked != (tt.want == nil) {
+				t.Errorf("token revoked = %v, want %v", revoked, tt.want == nil)
+			}
+		})
+	}
+}
+
+func TestRevokeSessionByID(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		userID int
+		want   error
+	}{
+		{"owner", 1, nil},
+		{"other user", 2, token.ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			session, err := svc.CreateAuthSession(ctx, 1, time.Hour, "agent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions, err := svc.ListAuthSessions(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 {
+				t.Fatalf("got %d sessions, want 1", len(sessions))
+			}
+
+			if err := svc.RevokeSessionByID(ctx, sessions[0].ID, tt.userID); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+
+			_, err = repo.GetByHash(ctx, hashOf(session.PlainText))
+			if revoked := errors.Is(err, token.ErrNotFound); revoked != (tt.want == nil) {
+				t.Errorf("session revoked = %v, want %v", revoked, tt.want == nil)
+			}
+		})
+	}
+}
@@ -3,7 +3,11 @@ package token
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
 	"time"
 )
 
@@ -11,24 +15,230 @@ const (
 	ScopeAuth    = "authentication"
 	ScopeDeploy  = "deployment"
 	ScopeRefresh = "refresh"
+
+	ScopeEmailVerify        = "email_verification"
+	ScopeEmailAddressVerify = "email_address_verification"
+	ScopeSMSChallenge       = "sms_challenge"
+	ScopeElevated           = "elevated"
 )
 
+var (
+	scopesMu sync.RWMutex
+	scopes   = map[string]bool{
+		ScopeAuth:    true,
+		ScopeDeploy:  true,
+		ScopeRefresh: true,
+
+		ScopeEmailVerify:        true,
+		ScopeEmailAddressVerify: true,
+		ScopeSMSChallenge:       true,
+		ScopeElevated:           true,
+	}
+)
+
+// RegisterScope makes scope acceptable to GenerateToken. It is meant to be
+// called during initialization by packages that define their own scopes.
+func RegisterScope(scope string) {
+	scopesMu.Lock()
+	defer scopesMu.Unlock()
+	scopes[scope] = true
+}
+
+// IsKnownScope reports whether scope is built in or has been registered.
+func IsKnownScope(scope string) bool {
+	scopesMu.RLock()
+	defer scopesMu.RUnlock()
+	return scopes[scope]
+}
+
 // Token duration constants
 const (
 	AuthTokenDuration    = 2 * time.Hour      // 2 hours for regular auth
 	DeployTokenDuration  = 4 * time.Hour      // 4 hours for deployments (static sites deploy quickly)
 	RefreshTokenDuration = 7 * 24 * time.Hour // 7 days for refresh tokens
+
+	EmailVerifyTokenDuration = 24 * time.Hour
+	SMSChallengeDuration     = 5 * time.Minute
+	ElevatedTokenDuration    = 5 * time.Minute
 )
 
 type Token struct {
-	PlainText string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int       `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int64         `json:"-"`
+	PlainText  string        `json:"token"`
+	Hash       []byte        `json:"-"`
+	UserID     int           `json:"-"`
+	Expiry     time.Time     `json:"expiry"`
+	Scope      string        `json:"-"`
+	Resource   string        `json:"resource,omitempty"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+	ExtendedBy time.Duration `json:"-"`
+	CreatedAt  time.Time     `json:"-"`
+	UserAgent  string        `json:"-"`
+	DeviceID   string        `json:"device_id,omitempty"`
+	Permission string        `json:"permission,omitempty"`
+	// BoundIP, when set, is the only client IP the token validates from
+	// through ValidateTokenBound.
+	BoundIP *string `json:"-"`
+}
+
+// Deploy token permissions. A write token may also be used for reads. Tokens
+// stored before permissions existed have none and are treated as write.
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+)
+
+func validPermission(permission string) bool {
+	return permission == PermissionRead || permission == PermissionWrite
+}
+
+// Allows reports whether the token's permission covers permission.
+func (t *Token) Allows(permission string) bool {
+	return t.Permission != PermissionRead || permission == PermissionRead
+}
+
+// SessionInfo describes an auth token for a "your sessions" listing. It
+// identifies the session by ID and never carries the plaintext or hash.
+type SessionInfo struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+}
+
+func (t *Token) Session() SessionInfo {
+	return SessionInfo{
+		ID:         t.ID,
+		CreatedAt:  t.CreatedAt,
+		Expiry:     t.Expiry,
+		LastUsedAt: t.LastUsedAt,
+		UserAgent:  t.UserAgent,
+	}
+}
+
+// AllowsResource reports whether the token may act on resource. Tokens
+// without a resource restriction are valid for every site the user owns.
+func (t *Token) AllowsResource(resource string) bool {
+	return t.Resource == "" || t.Resource == resource
+}
+
+// Sanitize returns a copy of the token with the hash, owner and scope
+// cleared, keeping the plaintext and expiry. Service methods that hand a
+// token back to a client return it sanitized.
+func (t *Token) Sanitize() *Token {
+	c := *t
+	c.Hash = nil
+	c.UserID = 0
+	c.Scope = ""
+	return &c
+}
+
+// PublicToken is the only token representation safe to return to clients.
+type PublicToken struct {
+	Token      string    `json:"token,omitempty"`
+	Expiry     time.Time `json:"expiry"`
+	Resource   string    `json:"resource,omitempty"`
+	Permission string    `json:"permission,omitempty"`
+}
+
+func (t *Token) Public() PublicToken {
+	return PublicToken{
+		Token:      t.PlainText,
+		Expiry:     t.Expiry,
+		Resource:   t.Resource,
+		Permission: t.Permission,
+	}
+}
+
+// CachedToken is the internal representation used to cache tokens. It
+// carries the hash and owner, never the plaintext, and must not be returned
+// to clients.
+type CachedToken struct {
+	Hash       []byte    `json:"hash"`
+	UserID     int       `json:"user_id"`
+	Expiry     time.Time `json:"expiry"`
+	Scope      string    `json:"scope"`
+	Resource   string    `json:"resource,omitempty"`
+	Permission string    `json:"permission,omitempty"`
+	DeviceID   string    `json:"device_id,omitempty"`
+	BoundIP    *string   `json:"bound_ip,omitempty"`
+}
+
+func (t *Token) Cached() CachedToken {
+	return CachedToken{
+		Hash:       t.Hash,
+		UserID:     t.UserID,
+		Expiry:     t.Expiry,
+		Scope:      t.Scope,
+		Resource:   t.Resource,
+		Permission: t.Permission,
+		DeviceID:   t.DeviceID,
+		BoundIP:    t.BoundIP,
+	}
+}
+
+// Matches reports whether plaintext hashes to the cached token.
+func (c CachedToken) Matches(plaintext string) bool {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hashesEqual(c.Hash, hash[:])
+}
+
+// hashesEqual compares token hashes in constant time. Use it instead of
+// bytes.Equal wherever hashes are compared in Go rather than in SQL.
+func hashesEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+func (c CachedToken) Token() *Token {
+	return &Token{
+		Hash:       c.Hash,
+		UserID:     c.UserID,
+		Expiry:     c.Expiry,
+		Scope:      c.Scope,
+		Resource:   c.Resource,
+		Permission: c.Permission,
+		DeviceID:   c.DeviceID,
+		BoundIP:    c.BoundIP,
+	}
+}
+
+// Encoding selects how the random token bytes are rendered as plaintext.
+type Encoding int
+
+const (
+	EncodingBase32 Encoding = iota // base32 without padding
+	EncodingBase64URL
+	EncodingHex
+)
+
+// DefaultEncoding is used by GenerateToken.
+var DefaultEncoding = EncodingBase32
+
+func (e Encoding) encode(b []byte) string {
+	switch e {
+	case EncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(b)
+	case EncodingHex:
+		return hex.EncodeToString(b)
+	default:
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	}
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
+	return GenerateTokenWithEncoding(userID, ttl, scope, DefaultEncoding)
+}
+
+// GenerateTokenWithEncoding is GenerateToken with an explicit plaintext
+// encoding. Unknown scopes are rejected with ErrInvalidScope. The hash is
+// always computed over the encoded plaintext, so lookups work the same
+// regardless of encoding.
+func GenerateTokenWithEncoding(userID int, ttl time.Duration, scope string, encoding Encoding) (*Token, error) {
+	if !IsKnownScope(scope) {
+		return nil, ErrInvalidScope
+	}
+
 	token := &Token{
 		UserID: userID,
 		Expiry: time.Now().Add(ttl),
@@ -40,7 +250,7 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	if err != nil {
 		return nil, err
 	}
-	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyByte)
+	token.PlainText = encoding.encode(emptyByte)
 	hash := sha256.Sum256([]byte(token.PlainText))
 	token.Hash = hash[:]
 	return token, nil
@@ -3,25 +3,196 @@ package token
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/samokw/zdeploy/server/internal/dbretry"
 )
 
+// ErrNotFound is returned by TokenRepository lookups, updates and deletes
+// when no matching token exists.
+var ErrNotFound = errors.New("token: not found")
+
 type TokenRepository interface {
 	Insert(ctx context.Context, token *Token) error
+	InsertBatch(ctx context.Context, tokens []*Token) error
 	GetByHash(ctx context.Context, hash []byte) (*Token, error)
+	GetByHashAndScope(ctx context.Context, hash []byte, scope string) (*Token, error)
 	CreateNewToken(ctx context.Context, userId int, ttl time.Duration, scope string) (*Token, error)
 	DeleteAllTokensForUser(ctx context.Context, userID int, scope string) error
+	DeleteExpiredTokensForUser(ctx context.Context, userID int, scope string, now time.Time) error
+	DeleteAllTokensForUserAllScopes(ctx context.Context, userID int) (int, error)
 	DeleteTokenByHash(ctx context.Context, hash []byte) error
+	DeleteTokenByID(ctx context.Context, id int64, userID int) error
+	DeleteTokenByIDAndScope(ctx context.Context, id int64, userID int, scope string) error
+	DeleteTokensForDevice(ctx context.Context, userID int, deviceID string) (int, error)
+	ListTokensForUser(ctx context.Context, userID int, scope string) ([]*Token, error)
+	ReplaceToken(ctx context.Context, oldHash []byte, token *Token) error
+	TouchToken(ctx context.Context, hash []byte, usedAt time.Time) error
+	RecordAttempt(ctx context.Context, hash []byte) (int, error)
+	UpdateTokenExpiry(ctx context.Context, hash []byte, expiry time.Time, extendedBy time.Duration) error
+	ListStaleTokens(ctx context.Context, olderThan time.Time) ([]*Token, error)
+	ListExpiringBefore(ctx context.Context, cutoff time.Time, scope string) ([]*Token, error)
+	CountByScope(ctx context.Context) (map[string]int, error)
+	CountTokensForUser(ctx context.Context, userID int, scope string) (int, error)
+	HasLiveToken(ctx context.Context, userID int, scope string) (bool, error)
+	SummarizeTokensForUser(ctx context.Context, userID int) (*UserTokenSummary, error)
+}
+
+// tokenColumns is the column list every token query selects, in the order
+// scanToken expects.
+const tokenColumns = `id, hash, user_id, expiry, scope, resource, last_used_at, extended_seconds, created_at,
+	user_agent, device_id, permission, bound_ip`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanToken(row rowScanner) (*Token, error) {
+	token := &Token{}
+	var resource, userAgent, deviceID, permission, boundIP sql.NullString
+	var extendedSeconds int64
+	err := row.Scan(
+		&token.ID,
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&resource,
+		&token.LastUsedAt,
+		&extendedSeconds,
+		&token.CreatedAt,
+		&userAgent,
+		&deviceID,
+		&permission,
+		&boundIP,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.Resource = resource.String
+	token.UserAgent = userAgent.String
+	token.DeviceID = deviceID.String
+	token.Permission = permission.String
+	if boundIP.Valid {
+		token.BoundIP = &boundIP.String
+	}
+	token.ExtendedBy = time.Duration(extendedSeconds) * time.Second
+	return token, nil
+}
+
+// nullIfEmpty stores an empty string as NULL.
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
 
 type TokenRepo struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration
+	retryPolicy  dbretry.Policy
+}
+
+type RepoOption func(*TokenRepo)
+
+// WithQueryTimeout bounds each query by timeout when the caller's context
+// has no deadline of its own.
+func WithQueryTimeout(timeout time.Duration) RepoOption {
+	return func(t *TokenRepo) {
+		t.queryTimeout = timeout
+	}
+}
+
+// WithRetry retries reads and idempotent updates that fail with a transient
+// error, such as a dropped connection. Retries are off by default.
+func WithRetry(policy dbretry.Policy) RepoOption {
+	return func(t *TokenRepo) {
+		t.retryPolicy = policy
+	}
 }
 
-func NewTokenRepo(db *sql.DB) *TokenRepo {
-	return &TokenRepo{
+func NewTokenRepo(db *sql.DB, opts ...RepoOption) *TokenRepo {
+	t := &TokenRepo{
 		db: db,
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+func (t *TokenRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, t.queryTimeout)
+}
+
+// queryToken runs a single-row token query, retrying transient failures. A
+// missing row is returned as ErrNotFound.
+func (t *TokenRepo) queryToken(ctx context.Context, query string, args ...any) (*Token, error) {
+	var token *Token
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		var err error
+		token, err = scanToken(t.db.QueryRowContext(ctx, query, args...))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (t *TokenRepo) queryTokens(ctx context.Context, query string, args ...any) ([]*Token, error) {
+	var tokens []*Token
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		rows, err := t.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		tokens, err = scanTokens(rows)
+		return err
+	})
+	return tokens, err
+}
+
+// exec runs a statement that is safe to repeat, retrying transient failures.
+func (t *TokenRepo) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		var err error
+		result, err = t.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Ping reports whether the database is reachable and able to answer queries.
+func (t *TokenRepo) Ping(ctx context.Context) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	if err := t.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("token repo: ping failed: %w", err)
+	}
+
+	var one int
+	if err := t.db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("token repo: select 1 failed: %w", err)
+	}
+	return nil
 }
 
 func (t *TokenRepo) CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -34,18 +205,129 @@ func (t *TokenRepo) CreateNewToken(ctx context.Context, userID int, ttl time.Dur
 }
 
 func (t *TokenRepo) Insert(ctx context.Context, token *Token) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	return insertToken(ctx, t.db, token)
+}
+
+// insertBatchSize keeps each multi-row INSERT well under Postgres's limit of
+// 65535 bind parameters.
+const insertBatchSize = 1000
+
+// InsertBatch inserts tokens in a single transaction, e.g. when migrating
+// from another system. Nothing is inserted if any token has an unknown scope
+// or any row fails. IDs and creation times are not read back.
+func (t *TokenRepo) InsertBatch(ctx context.Context, tokens []*Token) error {
+	for _, token := range tokens {
+		if !IsKnownScope(token.Scope) {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, token.Scope)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(tokens); start += insertBatchSize {
+		end := min(start+insertBatchSize, len(tokens))
+		batch := tokens[start:end]
+
+		var query strings.Builder
+		query.WriteString("INSERT INTO tokens (hash, user_id, expiry, scope, resource, user_agent, device_id, permission, bound_ip, extended_seconds) VALUES ")
+		args := make([]any, 0, len(batch)*10)
+		for i, token := range batch {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			n := len(args)
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10)
+			args = append(args,
+				token.Hash,
+				token.UserID,
+				token.Expiry,
+				token.Scope,
+				nullIfEmpty(token.Resource),
+				nullIfEmpty(token.UserAgent),
+				nullIfEmpty(token.DeviceID),
+				nullIfEmpty(token.Permission),
+				token.BoundIP,
+				int64(token.ExtendedBy/time.Second),
+			)
+		}
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertToken(ctx context.Context, q querier, token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO tokens (hash, user_id, expiry, scope, resource, user_agent, device_id, permission, bound_ip, extended_seconds)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id, created_at
 	`
-	_, err := t.db.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	return q.QueryRowContext(ctx, query,
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		nullIfEmpty(token.Resource),
+		nullIfEmpty(token.UserAgent),
+		nullIfEmpty(token.DeviceID),
+		nullIfEmpty(token.Permission),
+		token.BoundIP,
+		int64(token.ExtendedBy/time.Second),
+	).Scan(&token.ID, &token.CreatedAt)
+}
+
+// ReplaceToken inserts token and deletes the token with oldHash in one
+// transaction, so exactly one of them is valid at any moment. It returns
+// ErrNotFound if the old token no longer exists.
+func (t *TokenRepo) ReplaceToken(ctx context.Context, oldHash []byte, token *Token) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := t.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	if err := insertToken(ctx, tx, token); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1`, oldHash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return tx.Commit()
 }
 
 func (t *TokenRepo) DeleteAllTokensForUser(ctx context.Context, userID int, scope string) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 	DELETE FROM tokens
 	WHERE scope = $1 AND user_id = $2
@@ -54,7 +336,64 @@ func (t *TokenRepo) DeleteAllTokensForUser(ctx context.Context, userID int, scop
 	return err
 }
 
+// DeleteExpiredTokensForUser removes the user's tokens of scope that expired
+// before now.
+func (t *TokenRepo) DeleteExpiredTokensForUser(ctx context.Context, userID int, scope string, now time.Time) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE scope = $1 AND user_id = $2 AND expiry <= $3
+	`
+	_, err := t.db.ExecContext(ctx, query, scope, userID, now)
+	return err
+}
+
+func (t *TokenRepo) DeleteAllTokensForUserAllScopes(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1
+	`
+	result, err := t.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
+
+// DeleteTokensForDevice deletes the user's tokens of every scope that were
+// issued to deviceID and returns how many were removed.
+func (t *TokenRepo) DeleteTokensForDevice(ctx context.Context, userID int, deviceID string) (int, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND device_id = $2
+	`
+	result, err := t.db.ExecContext(ctx, query, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
+
 func (t *TokenRepo) DeleteTokenByHash(ctx context.Context, hash []byte) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
 	query := `
 	DELETE FROM tokens
 	WHERE hash = $1
@@ -63,27 +402,312 @@ func (t *TokenRepo) DeleteTokenByHash(ctx context.Context, hash []byte) error {
 	return err
 }
 
+// DeleteTokenByID deletes the token with id only if it belongs to userID,
+// returning ErrNotFound otherwise.
+func (t *TokenRepo) DeleteTokenByID(ctx context.Context, id int64, userID int) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE id = $1 AND user_id = $2
+	`
+	result, err := t.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteTokenByIDAndScope is DeleteTokenByID that only matches a token of
+// scope.
+func (t *TokenRepo) DeleteTokenByIDAndScope(ctx context.Context, id int64, userID int, scope string) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE id = $1 AND user_id = $2 AND scope = $3
+	`
+	result, err := t.db.ExecContext(ctx, query, id, userID, scope)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListTokensForUser returns the user's live tokens of scope, newest first.
+func (t *TokenRepo) ListTokensForUser(ctx context.Context, userID int, scope string) ([]*Token, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + tokenColumns + `
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND expiry > $3
+	ORDER BY created_at DESC
+	`
+	return t.queryTokens(ctx, query, userID, scope, time.Now())
+}
+
 func (t *TokenRepo) GetByHash(ctx context.Context, hash []byte) (*Token, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	SELECT hash, user_id, expiry, scope
+	SELECT ` + tokenColumns + `
 	FROM tokens
 	WHERE hash = $1
 	`
 
-	token := &Token{}
-	err := t.db.QueryRowContext(ctx, query, hash).Scan(
-		&token.Hash,
-		&token.UserID,
-		&token.Expiry,
-		&token.Scope,
+	return t.queryToken(ctx, query, hash)
+}
+
+func (t *TokenRepo) GetByHashAndScope(ctx context.Context, hash []byte, scope string) (*Token, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + tokenColumns + `
+	FROM tokens
+	WHERE hash = $1 AND scope = $2
+	`
+
+	return t.queryToken(ctx, query, hash, scope)
+}
+
+func (t *TokenRepo) TouchToken(ctx context.Context, hash []byte, usedAt time.Time) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE tokens
+	SET last_used_at = $1
+	WHERE hash = $2
+	`
+	_, err := t.exec(ctx, query, usedAt, hash)
+	return err
+}
+
+// RecordAttempt counts one more verification attempt against the token and
+// returns the new total. Counting before the check, rather than after a
+// miss, bounds the guesses concurrent requests get. It is not retried, as a
+// repeat would count twice.
+func (t *TokenRepo) RecordAttempt(ctx context.Context, hash []byte) (int, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE tokens
+	SET attempts = attempts + 1
+	WHERE hash = $1
+	RETURNING attempts
+	`
+	var attempts int
+	err := t.db.QueryRowContext(ctx, query, hash).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return attempts, nil
+}
+
+// ListStaleTokens returns tokens last used before olderThan. Tokens that
+// have never been used are not included; they are left to expire.
+func (t *TokenRepo) ListStaleTokens(ctx context.Context, olderThan time.Time) ([]*Token, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + tokenColumns + `
+	FROM tokens
+	WHERE last_used_at < $1
+	ORDER BY last_used_at ASC
+	`
+	return t.queryTokens(ctx, query, olderThan)
+}
+
+// ListExpiringBefore returns live tokens of scope that expire before cutoff.
+func (t *TokenRepo) ListExpiringBefore(ctx context.Context, cutoff time.Time, scope string) ([]*Token, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + tokenColumns + `
+	FROM tokens
+	WHERE scope = $1 AND expiry < $2 AND expiry > $3
+	ORDER BY expiry ASC
+	`
+	return t.queryTokens(ctx, query, scope, cutoff, time.Now())
+}
+
+// CountByScope returns the number of unexpired tokens in each scope. Scopes
+// with no live tokens are absent from the map.
+func (t *TokenRepo) CountByScope(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT scope, COUNT(*)
+	FROM tokens
+	WHERE expiry > $1
+	GROUP BY scope
+	`
+	var counts map[string]int
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		rows, err := t.db.QueryContext(ctx, query, time.Now())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		counts = make(map[string]int)
+		for rows.Next() {
+			var scope string
+			var count int
+			if err := rows.Scan(&scope, &count); err != nil {
+				return err
+			}
+			counts[scope] = count
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// CountTokensForUser counts the user's unexpired tokens of scope, or of
+// every scope if scope is empty.
+func (t *TokenRepo) CountTokensForUser(ctx context.Context, userID int, scope string) (int, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT COUNT(*)
+	FROM tokens
+	WHERE user_id = $1 AND expiry > $2 AND ($3::text = '' OR scope = $3)
+	`
+	var count int
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		return t.db.QueryRowContext(ctx, query, userID, time.Now(), scope).Scan(&count)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// HasLiveToken reports whether the user holds at least one unexpired token
+// of scope. Unlike CountTokensForUser it stops at the first match.
+func (t *TokenRepo) HasLiveToken(ctx context.Context, userID int, scope string) (bool, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
 	)
+	`
+	var exists bool
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		return t.db.QueryRowContext(ctx, query, userID, scope, time.Now()).Scan(&exists)
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// UserTokenSummary is how many live deploy tokens a user holds and whether
+// they have a live refresh token.
+type UserTokenSummary struct {
+	DeployTokens int
+	HasRefresh   bool
+}
+
+// SummarizeTokensForUser reads the user's live deploy token count and
+// refresh token presence in a single round trip.
+func (t *TokenRepo) SummarizeTokensForUser(ctx context.Context, userID int) (*UserTokenSummary, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
 
+	query := `
+	SELECT
+		(SELECT COUNT(*) FROM tokens
+		 WHERE user_id = $1 AND scope = $2 AND expiry > $4),
+		EXISTS (SELECT 1 FROM tokens
+		 WHERE user_id = $1 AND scope = $3 AND expiry > $4)
+	`
+	summary := &UserTokenSummary{}
+	err := dbretry.Do(ctx, t.retryPolicy, func() error {
+		return t.db.QueryRowContext(ctx, query, userID, ScopeDeploy, ScopeRefresh, time.Now()).
+			Scan(&summary.DeployTokens, &summary.HasRefresh)
+	})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, sql.ErrNoRows
+		return nil, err
+	}
+	return summary, nil
+}
+
+func scanTokens(rows *sql.Rows) ([]*Token, error) {
+	defer rows.Close()
+
+	var tokens []*Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
 		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return token, nil
+	return tokens, nil
+}
+
+// UpdateTokenExpiry moves a token's expiry and records the total extension
+// granted so far.
+func (t *TokenRepo) UpdateTokenExpiry(ctx context.Context, hash []byte, expiry time.Time, extendedBy time.Duration) error {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE tokens
+	SET expiry = $1, extended_seconds = $2
+	WHERE hash = $3
+	`
+	result, err := t.exec(ctx, query, expiry, int64(extendedBy/time.Second), hash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
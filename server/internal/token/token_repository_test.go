@@ -0,0 +1,162 @@
+package token
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTokenRepoNotFound checks that lookups and deletes of a missing token
+// report ErrNotFound rather than sql.ErrNoRows or a nil token.
+func TestTokenRepoNotFound(t *testing.T) {
+	ctx := context.Background()
+	hash := []byte("missing")
+
+	tests := []struct {
+		name string
+		call func(repo *TokenRepo) error
+	}{
+		{"GetByHash", func(repo *TokenRepo) error {
+			tok, err := repo.GetByHash(ctx, hash)
+			if tok != nil {
+				return errors.New("non-nil token")
+			}
+			return err
+		}},
+		{"GetByHashAndScope", func(repo *TokenRepo) error {
+			tok, err := repo.GetByHashAndScope(ctx, hash, ScopeAuth)
+			if tok != nil {
+				return errors.New("non-nil token")
+			}
+			return err
+		}},
+		{"DeleteTokenByID", func(repo *TokenRepo) error { return repo.DeleteTokenByID(ctx, 1, 1) }},
+		{"DeleteTokenByIDAndScope", func(repo *TokenRepo) error {
+			return repo.DeleteTokenByIDAndScope(ctx, 1, 1, ScopeDeploy)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := sql.OpenDB(&fakeDriver{})
+			defer db.Close()
+
+			err := tt.call(NewTokenRepo(db))
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v, want ErrNotFound", err)
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("%v leaks sql.ErrNoRows", err)
+			}
+		})
+	}
+}
+
+var errExec = errors.New("exec failed")
+
+func batchOf(t *testing.T, n int, scope string) []*Token {
+	t.Helper()
+	tokens := make([]*Token, n)
+	for i := 0; i < n; i++ {
+		tok, err := GenerateToken(i+1, time.Hour, ScopeDeploy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok.Scope = scope
+		tokens[i] = tok
+	}
+	return tokens
+}
+
+func TestInsertBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        int
+		scope         string
+		failAfter     int
+		wantErr       error
+		wantExecs     int
+		wantCommitted bool
+	}{
+		{name: "empty", tokens: 0, scope: ScopeDeploy},
+		{name: "one statement", tokens: 3, scope: ScopeDeploy, wantExecs: 1, wantCommitted: true},
+		{name: "split into chunks", tokens: 2*insertBatchSize + 1, scope: ScopeDeploy, wantExecs: 3, wantCommitted: true},
+		{name: "unknown scope", tokens: 3, scope: "bogus", wantErr: ErrInvalidScope},
+		{name: "failed chunk rolls back", tokens: 2*insertBatchSize + 1, scope: ScopeDeploy, failAfter: 1, wantErr: errExec, wantExecs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Statements fail once failAfter of them have run, if failAfter
+			// is positive.
+			d := &fakeDriver{}
+			d.exec = func(string, []driver.NamedValue) (driver.Result, error) {
+				if tt.failAfter > 0 && len(d.execs) > tt.failAfter {
+					return nil, errExec
+				}
+				return driver.RowsAffected(0), nil
+			}
+			db := sql.OpenDB(d)
+			defer db.Close()
+
+			err := NewTokenRepo(db).InsertBatch(context.Background(), batchOf(t, tt.tokens, tt.scope))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if len(d.execs) != tt.wantExecs {
+				t.Fatalf("ran %d statements, want %d", len(d.execs), tt.wantExecs)
+			}
+			if d.committed != tt.wantCommitted {
+				t.Errorf("committed = %v, want %v", d.committed, tt.wantCommitted)
+			}
+			if err != nil && len(d.execs) > 0 && !d.rolledBack {
+				t.Error("failed batch was not rolled back")
+			}
+
+			rows := 0
+			for _, e := range d.execs {
+				if !strings.HasPrefix(e.query, "INSERT INTO tokens") {
+					t.Errorf("unexpected statement %q", e.query)
+				}
+				rows += len(e.args) / 10
+			}
+			if tt.wantCommitted && rows != tt.tokens {
+				t.Errorf("inserted %d rows, want %d", rows, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestCountByScope(t *testing.T) {
+	d := &fakeDriver{query: func(string, []driver.NamedValue) (driver.Rows, error) {
+		return rowsOf([]string{"scope", "count"},
+			[]driver.Value{ScopeAuth, int64(4)},
+			[]driver.Value{ScopeDeploy, int64(2)},
+		), nil
+	}}
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	before := time.Now()
+	got, err := NewTokenRepo(db).CountByScope(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{ScopeAuth: 4, ScopeDeploy: 2}; !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if len(d.queries) != 1 {
+		t.Fatalf("ran %d queries, want 1", len(d.queries))
+	}
+	if q := d.queries[0].query; !strings.Contains(q, "GROUP BY scope") || !strings.Contains(q, "expiry > $1") {
+		t.Errorf("query %q does not group live tokens by scope", q)
+	}
+	if cutoff, ok := d.queries[0].args[0].Value.(time.Time); !ok || cutoff.Before(before) {
+		t.Errorf("expiry cutoff = %v, want the current time", d.queries[0].args[0].Value)
+	}
+}
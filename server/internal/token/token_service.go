@@ -2,29 +2,215 @@ package token
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/netip"
+	"strings"
 	"time"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+	"github.com/samokw/zdeploy/server/internal/securityevents"
 )
 
 var (
 	ErrTokenNotFound = errors.New("token not found")
 	ErrTokenExpired  = errors.New("token expired")
 	ErrInvalidScope  = errors.New("invalid token scope")
+
+	ErrResourceNotAllowed     = errors.New("token not valid for this resource")
+	ErrExtensionLimitExceeded = errors.New("token extension limit exceeded")
+	ErrTTLTooLong             = errors.New("token lifetime exceeds the maximum for its scope")
+	ErrDeviceIDRequired       = errors.New("device id is required")
+	ErrInvalidPermission      = errors.New("invalid token permission")
+	ErrInsufficientPermission = errors.New("token lacks the required permission")
+	ErrInvalidClientIP        = errors.New("invalid client ip")
+	ErrTokenBindingMismatch   = errors.New("token is bound to a different client ip")
+	ErrScopeNotExtendable     = errors.New("tokens of this scope cannot be extended")
+	ErrTooManyAttempts        = errors.New("too many attempts; request a new code")
+	ErrLookupNotAuthorized    = errors.New("token owner lookups are not authorized")
 )
 
+// DefaultMaxTokenExtension caps how far ExtendTokenExpiry may push a token
+// past its original expiry.
+const DefaultMaxTokenExtension = 4 * time.Hour
+
+// defaultTTLs are used when a caller does not ask for a specific lifetime,
+// unless WithTTLs overrides them.
+var defaultTTLs = map[string]time.Duration{
+	ScopeAuth:               AuthTokenDuration,
+	ScopeDeploy:             DeployTokenDuration,
+	ScopeRefresh:            RefreshTokenDuration,
+	ScopeEmailVerify:        EmailVerifyTokenDuration,
+	ScopeEmailAddressVerify: EmailVerifyTokenDuration,
+	ScopeSMSChallenge:       SMSChallengeDuration,
+	ScopeElevated:           ElevatedTokenDuration,
+}
+
+// DefaultMaxTTLs caps caller-chosen token lifetimes per scope. Scopes not
+// listed are not capped.
+var DefaultMaxTTLs = map[string]time.Duration{
+	ScopeAuth:    24 * time.Hour,
+	ScopeDeploy:  24 * time.Hour,
+	ScopeRefresh: 30 * 24 * time.Hour,
+}
+
 type TokenService struct {
-	repo TokenRepository
+	repo         TokenRepository
+	touchScopes  map[string]bool
+	maxExtension time.Duration
+	maxTTLs      map[string]time.Duration
+	ttls         map[string]time.Duration
+	jwt          jwtSigner
+	events       securityevents.EventRecorder
+	authorize    AdminAuthorizer
+	logger       *slog.Logger
+}
+
+type Option func(*TokenService)
+
+// AdminAuthorizer returns nil if adminID may look up who owns a token, and
+// the reason otherwise.
+type AdminAuthorizer func(ctx context.Context, adminID int64) error
+
+// WithTouchScopes records a last-used timestamp whenever a token of one of
+// the given scopes is validated. Touching is off for every scope by default
+// to avoid a write on each request.
+func WithTouchScopes(scopes ...string) Option {
+	return func(s *TokenService) {
+		for _, scope := range scopes {
+			s.touchScopes[scope] = true
+		}
+	}
+}
+
+// WithTTLs overrides the default lifetime of tokens per scope. Scopes not in
+// overrides keep their default, and non-positive durations are ignored.
+func WithTTLs(overrides map[string]time.Duration) Option {
+	return func(s *TokenService) {
+		for scope, ttl := range overrides {
+			if ttl > 0 {
+				s.ttls[scope] = ttl
+			}
+		}
+	}
+}
+
+// WithMaxTTL caps the lifetime callers may request for tokens of scope.
+func WithMaxTTL(scope string, max time.Duration) Option {
+	return func(s *TokenService) {
+		s.maxTTLs[scope] = max
+	}
+}
+
+func WithMaxTokenExtension(max time.Duration) Option {
+	return func(s *TokenService) {
+		s.maxExtension = max
+	}
+}
+
+// WithLogger sets the logger operations are reported to. The default is
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *TokenService) {
+		s.logger = logger
+	}
 }
 
-func NewTokenService(repo TokenRepository) *TokenService {
-	return &TokenService{
-		repo: repo,
+// WithSecurityEvents records token issuance and revocation to recorder.
+// Recording failures are logged and never fail the operation.
+func WithSecurityEvents(recorder securityevents.EventRecorder) Option {
+	return func(s *TokenService) {
+		s.events = recorder
+	}
+}
+
+// WithAdminAuthorizer sets the check FindUserIDByTokenPlaintext runs on its
+// caller, usually UserService.AuthorizeTokenLookup. Without one every lookup
+// is refused.
+func WithAdminAuthorizer(authorize AdminAuthorizer) Option {
+	return func(s *TokenService) {
+		s.authorize = authorize
+	}
+}
+
+func NewTokenService(repo TokenRepository, opts ...Option) *TokenService {
+	s := &TokenService{
+		repo:         repo,
+		touchScopes:  make(map[string]bool),
+		maxExtension: DefaultMaxTokenExtension,
+		maxTTLs:      make(map[string]time.Duration, len(DefaultMaxTTLs)),
+		ttls:         make(map[string]time.Duration, len(defaultTTLs)),
+		logger:       slog.Default(),
+	}
+	for scope, max := range DefaultMaxTTLs {
+		s.maxTTLs[scope] = max
+	}
+	for scope, ttl := range defaultTTLs {
+		s.ttls[scope] = ttl
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// resolveTTL returns the scope's default lifetime for a non-positive ttl and
+// rejects a ttl above the scope's maximum.
+func (s *TokenService) resolveTTL(scope string, ttl time.Duration) (time.Duration, error) {
+	if ttl <= 0 {
+		return s.ttls[scope], nil
+	}
+	if max, ok := s.maxTTLs[scope]; ok && ttl > max {
+		return 0, ErrTTLTooLong
+	}
+	return ttl, nil
+}
+
+// logOp records the outcome of op, tagged with the request's correlation ID.
+// attrs must never include passwords or token plaintext.
+func (s *TokenService) logOp(ctx context.Context, op string, err error, attrs ...any) {
+	logger := requestid.Logger(ctx, s.logger).With("op", op)
+	if err != nil {
+		logger.WarnContext(ctx, "operation failed", append(attrs, "error", err)...)
+		return
+	}
+	logger.InfoContext(ctx, "operation succeeded", attrs...)
+}
+
+// recordEvent appends a security event for userID if a recorder is
+// configured.
+func (s *TokenService) recordEvent(ctx context.Context, userID int, typ securityevents.Type, metadata map[string]any) {
+	if s.events == nil {
+		return
+	}
+	event, err := securityevents.NewEvent(int64(userID), typ, time.Now(), metadata)
+	if err == nil {
+		err = s.events.Record(ctx, event)
+	}
+	if err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "security events: record failed",
+			"user_id", userID, "type", typ, "error", err)
 	}
 }
 
-func (s *TokenService) CreateAuthToken(ctx context.Context, userID int, ttl time.Duration) (*Token, error) {
-	err := s.repo.DeleteAllTokensForUser(ctx, userID, ScopeAuth)
+func (s *TokenService) recordIssued(ctx context.Context, token *Token) {
+	s.recordEvent(ctx, token.UserID, securityevents.TokenIssued, map[string]any{"scope": token.Scope, "token_id": token.ID})
+}
+
+func (s *TokenService) CreateAuthToken(ctx context.Context, userID int, ttl time.Duration) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateAuthToken", err, "user_id", userID) }()
+
+	ttl, err = s.resolveTTL(ScopeAuth, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.repo.DeleteAllTokensForUser(ctx, userID, ScopeAuth)
 	if err != nil {
 		return nil, err
 	}
@@ -34,14 +220,111 @@ func (s *TokenService) CreateAuthToken(ctx context.Context, userID int, ttl time
 		return nil, err
 	}
 
-	return token, nil
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// CreateAuthSession is CreateAuthToken for a login that should show up in
+// ListAuthSessions with the client's user agent. Unlike CreateAuthToken it
+// leaves the user's other sessions in place.
+func (s *TokenService) CreateAuthSession(ctx context.Context, userID int, ttl time.Duration, userAgent string) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateAuthSession", err, "user_id", userID) }()
+
+	ttl, err = s.resolveTTL(ScopeAuth, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := GenerateToken(userID, ttl, ScopeAuth)
+	if err != nil {
+		return nil, err
+	}
+	token.UserAgent = userAgent
+
+	if err := s.repo.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
 }
 
+// ListAuthSessions returns the user's live auth tokens, newest first.
+func (s *TokenService) ListAuthSessions(ctx context.Context, userID int) ([]SessionInfo, error) {
+	tokens, err := s.repo.ListTokensForUser(ctx, userID, ScopeAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]SessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, token.Session())
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs out one of the user's sessions. A session belonging to
+// another user, or a token that is not an auth session, is reported as
+// ErrTokenNotFound.
+func (s *TokenService) RevokeSession(ctx context.Context, userID int, sessionID int64) (err error) {
+	defer func() { s.logOp(ctx, "RevokeSession", err, "user_id", userID, "session_id", sessionID) }()
+
+	err = s.repo.DeleteTokenByIDAndScope(ctx, sessionID, userID, ScopeAuth)
+	if errors.Is(err, ErrNotFound) {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+	s.recordEvent(ctx, userID, securityevents.TokenRevoked, map[string]any{"scope": ScopeAuth, "token_id": sessionID})
+	return nil
+}
+
+// RevokeSessionByID is RevokeSession for callers holding the session ID
+// first, as shown in a sessions list. It refuses another user's session with
+// ErrTokenNotFound.
+func (s *TokenService) RevokeSessionByID(ctx context.Context, id int64, userID int) error {
+	return s.RevokeSession(ctx, userID, id)
+}
+
+// ValidateToken checks that plaintext is a live token of scope and records
+// its use. Tokens bound to an IP are refused with ErrTokenBindingMismatch;
+// validate those with ValidateTokenBound, which knows the client address.
 func (s *TokenService) ValidateToken(ctx context.Context, plaintext string, scope string) (*Token, error) {
+	token, err := s.lookupToken(ctx, plaintext, scope)
+	if err != nil {
+		return nil, err
+	}
+	if token.BoundIP != nil {
+		return nil, ErrTokenBindingMismatch
+	}
+
+	s.touch(ctx, token)
+	return token, nil
+}
+
+// lookupToken is ValidateToken without the IP binding check and without
+// recording use.
+func (s *TokenService) lookupToken(ctx context.Context, plaintext string, scope string) (*Token, error) {
+	token, err := s.lookupAnyScope(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Scope != scope {
+		return nil, ErrInvalidScope
+	}
+
+	return token, nil
+}
+
+// lookupAnyScope is lookupToken for callers that accept several scopes and
+// check the token's scope themselves.
+func (s *TokenService) lookupAnyScope(ctx context.Context, plaintext string) (*Token, error) {
 	hash := sha256.Sum256([]byte(plaintext))
 
 	token, err := s.repo.GetByHash(ctx, hash[:])
-	if err != nil {
+	if err != nil || !hashesEqual(token.Hash, hash[:]) {
 		return nil, ErrTokenNotFound
 	}
 
@@ -49,65 +332,714 @@ func (s *TokenService) ValidateToken(ctx context.Context, plaintext string, scop
 		return nil, ErrTokenExpired
 	}
 
-	if token.Scope != scope {
-		return nil, ErrInvalidScope
+	return token, nil
+}
+
+// FindUserIDByTokenPlaintext resolves the owner of a token of any scope,
+// expired or not, so support can trace a token a user hands them. adminID
+// must pass the WithAdminAuthorizer check; the authorizer's error is
+// returned as is, or ErrLookupNotAuthorized if none is configured. Every
+// lookup is logged.
+func (s *TokenService) FindUserIDByTokenPlaintext(ctx context.Context, plaintext string, adminID int64) (userID int, err error) {
+	defer func() { s.logOp(ctx, "FindUserIDByTokenPlaintext", err, "admin_id", adminID, "user_id", userID) }()
+
+	if s.authorize == nil {
+		return 0, ErrLookupNotAuthorized
+	}
+	if err := s.authorize(ctx, adminID); err != nil {
+		return 0, err
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token, err := s.repo.GetByHash(ctx, hash[:])
+	if err != nil || !hashesEqual(token.Hash, hash[:]) {
+		return 0, ErrTokenNotFound
+	}
+	return token.UserID, nil
+}
+
+// Peek reports whether plaintext is a live token of any scope. Unlike
+// ValidateToken it never records use, so it is cheap enough to run before
+// heavier checks. The returned token has its scope set so callers can branch
+// on it.
+func (s *TokenService) Peek(ctx context.Context, plaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token, err := s.repo.GetByHash(ctx, hash[:])
+	if err != nil || !hashesEqual(token.Hash, hash[:]) {
+		return nil, ErrTokenNotFound
+	}
+
+	if time.Now().After(token.Expiry) {
+		return nil, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// ValidateTokenScoped filters on scope in the query, so a token presented
+// for the wrong scope is indistinguishable from one that does not exist.
+func (s *TokenService) ValidateTokenScoped(ctx context.Context, plaintext string, scope string) (*Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	token, err := s.repo.GetByHashAndScope(ctx, hash[:], scope)
+	if err != nil || !hashesEqual(token.Hash, hash[:]) {
+		return nil, ErrTokenNotFound
+	}
+
+	if time.Now().After(token.Expiry) {
+		return nil, ErrTokenExpired
+	}
+
+	if token.BoundIP != nil {
+		return nil, ErrTokenBindingMismatch
 	}
 
+	s.touch(ctx, token)
 	return token, nil
 }
 
-func (s *TokenService) RevokeToken(ctx context.Context, hash []byte) error {
-	return s.repo.DeleteTokenByHash(ctx, hash)
+// touch records token use for scopes that opted in. Failures are logged and
+// never fail validation.
+func (s *TokenService) touch(ctx context.Context, token *Token) {
+	if !s.touchScopes[token.Scope] {
+		return
+	}
+
+	now := time.Now()
+	if err := s.repo.TouchToken(ctx, token.Hash, now); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "failed to record token use", "scope", token.Scope, "error", err)
+		return
+	}
+	token.LastUsedAt = &now
+}
+
+// FindExpiringTokens returns live tokens of scope that expire within the
+// given window, e.g. to send renewal reminders.
+func (s *TokenService) FindExpiringTokens(ctx context.Context, within time.Duration, scope string) ([]*Token, error) {
+	return s.repo.ListExpiringBefore(ctx, time.Now().Add(within), scope)
+}
+
+// TokenCounts returns how many live tokens exist per scope, for monitoring.
+func (s *TokenService) TokenCounts(ctx context.Context) (map[string]int, error) {
+	return s.repo.CountByScope(ctx)
+}
+
+// CountActiveTokens returns how many live tokens of scope the user holds.
+// An empty scope counts tokens of every scope.
+func (s *TokenService) CountActiveTokens(ctx context.Context, userID int, scope string) (int, error) {
+	return s.repo.CountTokensForUser(ctx, userID, scope)
+}
+
+// HasActiveSession reports whether the user has a live auth token, i.e. is
+// signed in somewhere.
+func (s *TokenService) HasActiveSession(ctx context.Context, userID int) (bool, error) {
+	return s.repo.HasLiveToken(ctx, userID, ScopeAuth)
+}
+
+// SummarizeTokens returns the user's live deploy token count and whether
+// they hold a live refresh token.
+func (s *TokenService) SummarizeTokens(ctx context.Context, userID int) (*UserTokenSummary, error) {
+	return s.repo.SummarizeTokensForUser(ctx, userID)
+}
+
+// ListStaleTokens returns tokens that have not been used since olderThan.
+func (s *TokenService) ListStaleTokens(ctx context.Context, olderThan time.Time) ([]*Token, error) {
+	return s.repo.ListStaleTokens(ctx, olderThan)
 }
 
-func (s *TokenService) RevokeAllUserTokens(ctx context.Context, userID int, scope string) error {
-	return s.repo.DeleteAllTokensForUser(ctx, userID, scope)
+// extendableScopes are the scopes ExtendTokenExpiry accepts. Short-lived
+// proofs such as elevation, verification and challenge tokens keep the
+// lifetime they were issued with.
+var extendableScopes = map[string]bool{
+	ScopeAuth:   true,
+	ScopeDeploy: true,
+}
+
+// ExtendTokenExpiry pushes a live auth or deploy token's expiry back by
+// additional. The total extension over a token's life is capped so it cannot
+// be kept alive forever. Other scopes are refused with
+// ErrScopeNotExtendable and IP-bound tokens, like in ValidateToken, with
+// ErrTokenBindingMismatch.
+func (s *TokenService) ExtendTokenExpiry(ctx context.Context, plaintext string, additional time.Duration) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "ExtendTokenExpiry", err) }()
+
+	token, err := s.lookupAnyScope(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if !extendableScopes[token.Scope] {
+		return nil, ErrScopeNotExtendable
+	}
+	if token.BoundIP != nil {
+		return nil, ErrTokenBindingMismatch
+	}
+
+	if additional <= 0 || token.ExtendedBy+additional > s.maxExtension {
+		return nil, ErrExtensionLimitExceeded
+	}
+
+	expiry := token.Expiry.Add(additional)
+	extendedBy := token.ExtendedBy + additional
+	if err := s.repo.UpdateTokenExpiry(ctx, token.Hash, expiry, extendedBy); err != nil {
+		return nil, err
+	}
+
+	token.Expiry = expiry
+	token.ExtendedBy = extendedBy
+	return token.Sanitize(), nil
+}
+
+func (s *TokenService) RevokeToken(ctx context.Context, hash []byte) (err error) {
+	defer func() { s.logOp(ctx, "RevokeToken", err) }()
+
+	// The hash alone does not say whose token this is, so look it up for
+	// the security event before it is gone.
+	var revoked *Token
+	if s.events != nil {
+		revoked, _ = s.repo.GetByHash(ctx, hash)
+	}
+
+	if err := s.repo.DeleteTokenByHash(ctx, hash); err != nil {
+		return err
+	}
+	if revoked != nil {
+		s.recordEvent(ctx, revoked.UserID, securityevents.TokenRevoked, map[string]any{"scope": revoked.Scope, "token_id": revoked.ID})
+	}
+	return nil
+}
+
+func (s *TokenService) RevokeAllUserTokens(ctx context.Context, userID int, scope string) (err error) {
+	defer func() { s.logOp(ctx, "RevokeAllUserTokens", err, "user_id", userID, "scope", scope) }()
+
+	if err := s.repo.DeleteAllTokensForUser(ctx, userID, scope); err != nil {
+		return err
+	}
+	s.recordEvent(ctx, userID, securityevents.TokenRevoked, map[string]any{"scope": scope})
+	return nil
+}
+
+// RevokeAllUserTokensAllScopes deletes every token the user holds, regardless
+// of scope, and returns how many were removed.
+func (s *TokenService) RevokeAllUserTokensAllScopes(ctx context.Context, userID int) (_ int, err error) {
+	defer func() { s.logOp(ctx, "RevokeAllUserTokensAllScopes", err, "user_id", userID) }()
+
+	deleted, err := s.repo.DeleteAllTokensForUserAllScopes(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	s.recordEvent(ctx, userID, securityevents.TokenRevoked, map[string]any{"count": deleted})
+	return deleted, nil
 }
 
 func (s *TokenService) CreateAuthTokenWithRefresh(ctx context.Context, userID int64) (*Token, *Token, error) {
+	return s.CreateAuthTokenWithRefreshTTL(ctx, userID, 0, 0)
+}
+
+// CreateAuthTokenWithRefreshTTL is CreateAuthTokenWithRefresh with explicit
+// lifetimes. A zero ttl uses the scope's default duration.
+func (s *TokenService) CreateAuthTokenWithRefreshTTL(ctx context.Context, userID int64, authTTL, refreshTTL time.Duration) (_, _ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateAuthTokenWithRefresh", err, "user_id", userID) }()
+
+	return s.createTokenPair(ctx, userID, "", authTTL, refreshTTL)
+}
+
+// CreateAuthTokenWithRefreshForDevice is CreateAuthTokenWithRefresh for one
+// of the user's devices. The device's earlier tokens are replaced; tokens on
+// the user's other devices are left alone.
+func (s *TokenService) CreateAuthTokenWithRefreshForDevice(ctx context.Context, userID int64, deviceID string) (_, _ *Token, err error) {
+	defer func() {
+		s.logOp(ctx, "CreateAuthTokenWithRefreshForDevice", err, "user_id", userID, "device_id", deviceID)
+	}()
+
+	if deviceID == "" {
+		return nil, nil, ErrDeviceIDRequired
+	}
+	if _, err := s.repo.DeleteTokensForDevice(ctx, int(userID), deviceID); err != nil {
+		return nil, nil, err
+	}
+
+	return s.createTokenPair(ctx, userID, deviceID, 0, 0)
+}
+
+// createTokenPair issues an auth token and a refresh token, both bound to
+// deviceID if it is set.
+func (s *TokenService) createTokenPair(ctx context.Context, userID int64, deviceID string, authTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	authTTL, err := s.resolveTTL(ScopeAuth, authTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	refreshTTL, err = s.resolveTTL(ScopeRefresh, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Create short-lived auth token
-	authToken, err := s.repo.CreateNewToken(ctx, int(userID), AuthTokenDuration, ScopeAuth)
+	authToken, err := s.createDeviceToken(ctx, int(userID), deviceID, authTTL, ScopeAuth)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Create long-lived refresh token
-	refreshToken, err := s.repo.CreateNewToken(ctx, int(userID), RefreshTokenDuration, ScopeRefresh)
+	refreshToken, err := s.createDeviceToken(ctx, int(userID), deviceID, refreshTTL, ScopeRefresh)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return authToken, refreshToken, nil
+	s.recordIssued(ctx, authToken)
+	s.recordIssued(ctx, refreshToken)
+	return authToken.Sanitize(), refreshToken.Sanitize(), nil
 }
 
-func (s *TokenService) RefreshAuthToken(ctx context.Context, refreshTokenPlaintext string) (*Token, error) {
+func (s *TokenService) createDeviceToken(ctx context.Context, userID int, deviceID string, ttl time.Duration, scope string) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	token.DeviceID = deviceID
+
+	if err := s.repo.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// RevokeDevice logs one of the user's devices out by deleting every token
+// issued to it.
+func (s *TokenService) RevokeDevice(ctx context.Context, userID int, deviceID string) (_ int, err error) {
+	defer func() { s.logOp(ctx, "RevokeDevice", err, "user_id", userID, "device_id", deviceID) }()
+
+	if deviceID == "" {
+		return 0, ErrDeviceIDRequired
+	}
+	deleted, err := s.repo.DeleteTokensForDevice(ctx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	s.recordEvent(ctx, userID, securityevents.TokenRevoked, map[string]any{"device_id": deviceID, "count": deleted})
+	return deleted, nil
+}
+
+// RefreshAuthToken issues a new auth token for the refresh token's user and
+// device. A session created with CreateAuthTokenWithRefreshTTL should pass
+// the same authTTL here to keep its auth tokens' lifetime; a non-positive
+// authTTL uses the default and one above the auth scope's maximum is
+// rejected with ErrTTLTooLong.
+func (s *TokenService) RefreshAuthToken(ctx context.Context, refreshTokenPlaintext string, authTTL time.Duration) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "RefreshAuthToken", err) }()
+
+	authTTL, err = s.resolveTTL(ScopeAuth, authTTL)
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate refresh token
 	refreshToken, err := s.ValidateToken(ctx, refreshTokenPlaintext, ScopeRefresh)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create new auth token
-	authToken, err := s.repo.CreateNewToken(ctx, refreshToken.UserID, AuthTokenDuration, ScopeAuth)
+	// Create new auth token on the refresh token's device, if any
+	authToken, err := s.createDeviceToken(ctx, refreshToken.UserID, refreshToken.DeviceID, authTTL, ScopeAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordIssued(ctx, authToken)
+	return authToken.Sanitize(), nil
+}
+
+// CreateEmailVerificationToken issues a token proving control of the user's
+// email address. Any earlier verification token for the user is revoked.
+func (s *TokenService) CreateEmailVerificationToken(ctx context.Context, userID int64) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateEmailVerificationToken", err, "user_id", userID) }()
+
+	if err := s.repo.DeleteAllTokensForUser(ctx, int(userID), ScopeEmailVerify); err != nil {
+		return nil, err
+	}
+
+	token, err := s.repo.CreateNewToken(ctx, int(userID), s.ttls[ScopeEmailVerify], ScopeEmailVerify)
+	if err != nil {
+		return nil, err
+	}
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// CreateElevatedToken issues a short-lived token proving the user recently
+// re-entered their password, replacing any the user already holds. It does
+// no authentication itself; see UserService.ElevatePrivileges.
+func (s *TokenService) CreateElevatedToken(ctx context.Context, userID int64) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateElevatedToken", err, "user_id", userID) }()
+
+	if err := s.repo.DeleteAllTokensForUser(ctx, int(userID), ScopeElevated); err != nil {
+		return nil, err
+	}
+
+	token, err := s.repo.CreateNewToken(ctx, int(userID), s.ttls[ScopeElevated], ScopeElevated)
+	if err != nil {
+		return nil, err
+	}
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// CreateEmailAddressVerificationToken issues a token proving control of
+// one of the user's email addresses, recorded as the token's resource. Any
+// earlier token for the same address is revoked; tokens for the user's
+// other addresses stay valid.
+func (s *TokenService) CreateEmailAddressVerificationToken(ctx context.Context, userID int64, address string) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "CreateEmailAddressVerificationToken", err, "user_id", userID) }()
+
+	existing, err := s.repo.ListTokensForUser(ctx, int(userID), ScopeEmailAddressVerify)
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range existing {
+		if old.Resource != address {
+			continue
+		}
+		if err := s.repo.DeleteTokenByID(ctx, old.ID, int(userID)); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	token, err := GenerateToken(int(userID), s.ttls[ScopeEmailAddressVerify], ScopeEmailAddressVerify)
 	if err != nil {
 		return nil, err
 	}
+	token.Resource = address
+
+	if err := s.repo.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// smsChallengeDigits is the length of SMS challenge codes.
+const smsChallengeDigits = 6
+
+// smsChallengeKey binds a code to its user. Codes are short enough to
+// repeat across users, so the code alone cannot be the token's identity.
+func smsChallengeKey(userID int64, code string) string {
+	return fmt.Sprintf("%d:%s", userID, code)
+}
+
+// maxSMSChallengeAttempts is how many codes may be tried against one
+// challenge before it is burned.
+const maxSMSChallengeAttempts = 5
+
+// CreateSMSChallenge issues a short numeric code for the user, replacing any
+// outstanding one, and returns it for delivery. Only its hash is stored.
+// Each challenge accepts maxSMSChallengeAttempts guesses.
+func (s *TokenService) CreateSMSChallenge(ctx context.Context, userID int64) (_ string, err error) {
+	defer func() { s.logOp(ctx, "CreateSMSChallenge", err, "user_id", userID) }()
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(math.Pow10(smsChallengeDigits))))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%0*d", smsChallengeDigits, n.Int64())
+
+	if err := s.repo.DeleteAllTokensForUser(ctx, int(userID), ScopeSMSChallenge); err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(smsChallengeKey(userID, code)))
+	token := &Token{
+		Hash:   hash[:],
+		UserID: int(userID),
+		Expiry: time.Now().Add(s.ttls[ScopeSMSChallenge]),
+		Scope:  ScopeSMSChallenge,
+	}
+	if err := s.repo.Insert(ctx, token); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// VerifySMSChallenge checks code against the user's outstanding challenge
+// and consumes it on success. Once maxSMSChallengeAttempts codes have been
+// tried the challenge is deleted and ErrTooManyAttempts returned, so a new
+// code must be requested.
+func (s *TokenService) VerifySMSChallenge(ctx context.Context, userID int64, code string) (err error) {
+	defer func() { s.logOp(ctx, "VerifySMSChallenge", err, "user_id", userID) }()
+
+	// The stored hash covers the code, so the outstanding challenge is found
+	// by user rather than by the code being tried.
+	challenges, err := s.repo.ListTokensForUser(ctx, int(userID), ScopeSMSChallenge)
+	if err != nil {
+		return err
+	}
+	for _, challenge := range challenges {
+		attempts, err := s.repo.RecordAttempt(ctx, challenge.Hash)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if attempts > maxSMSChallengeAttempts {
+			if err := s.repo.DeleteTokenByHash(ctx, challenge.Hash); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			return ErrTooManyAttempts
+		}
+	}
+
+	token, err := s.ValidateToken(ctx, smsChallengeKey(userID, code), ScopeSMSChallenge)
+	if err != nil {
+		if errors.Is(err, ErrInvalidScope) {
+			return ErrTokenNotFound
+		}
+		return err
+	}
 
-	return authToken, nil
+	return s.repo.DeleteTokenByHash(ctx, token.Hash)
 }
 
 func (s *TokenService) CreateDeployToken(ctx context.Context, userID int64) (*Token, error) {
-	// Delete existing deploy tokens for this user
-	err := s.repo.DeleteAllTokensForUser(ctx, int(userID), ScopeDeploy)
+	return s.CreateDeployTokenForResource(ctx, userID, "")
+}
+
+// CreateDeployTokenForResource issues a deploy token restricted to a single
+// site. An empty resource grants access to every site.
+func (s *TokenService) CreateDeployTokenForResource(ctx context.Context, userID int64, resource string) (*Token, error) {
+	return s.CreateDeployTokenWithTTL(ctx, userID, resource, 0)
+}
+
+// CreateDeployTokenWithTTL is CreateDeployTokenForResource with an explicit
+// lifetime. A zero ttl uses the deploy scope's configured lifetime.
+func (s *TokenService) CreateDeployTokenWithTTL(ctx context.Context, userID int64, resource string, ttl time.Duration) (*Token, error) {
+	return s.CreateDeployTokenWithPermission(ctx, userID, resource, PermissionWrite, ttl)
+}
+
+// CreateDeployTokenWithPermission issues a deploy token limited to
+// permission, e.g. PermissionRead for CI steps that only check deployment
+// status. It replaces the user's earlier deploy token with the same
+// permission, so a user can hold one read and one write token at a time.
+func (s *TokenService) CreateDeployTokenWithPermission(ctx context.Context, userID int64, resource, permission string, ttl time.Duration) (_ *Token, err error) {
+	defer func() {
+		s.logOp(ctx, "CreateDeployToken", err, "user_id", userID, "resource", resource, "permission", permission)
+	}()
+
+	return s.createDeployToken(ctx, userID, resource, permission, ttl, nil)
+}
+
+// CreateDeployTokenBoundToIP is CreateDeployTokenForResource for a token
+// that only validates from clientIP, through ValidateTokenBound or
+// ValidateBoundDeployToken. Behind a
+// proxy or load balancer the caller must pass the client's real IP as
+// resolved from trusted forwarding headers, not the proxy's address.
+func (s *TokenService) CreateDeployTokenBoundToIP(ctx context.Context, userID int64, resource, clientIP string) (_ *Token, err error) {
+	defer func() {
+		s.logOp(ctx, "CreateDeployTokenBoundToIP", err, "user_id", userID, "resource", resource, "client_ip", clientIP)
+	}()
+
+	ip, err := canonicalIP(clientIP)
+	if err != nil {
+		return nil, err
+	}
+	return s.createDeployToken(ctx, userID, resource, PermissionWrite, 0, &ip)
+}
+
+func (s *TokenService) createDeployToken(ctx context.Context, userID int64, resource, permission string, ttl time.Duration, boundIP *string) (*Token, error) {
+	if !validPermission(permission) {
+		return nil, ErrInvalidPermission
+	}
+
+	ttl, err := s.resolveTTL(ScopeDeploy, ttl)
 	if err != nil {
 		return nil, err
 	}
 
+	// Expired deploy tokens are no longer listed below, so purge them
+	// separately or they would pile up.
+	if err := s.repo.DeleteExpiredTokensForUser(ctx, int(userID), ScopeDeploy, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Delete existing deploy tokens with the same permission for this user
+	existing, err := s.repo.ListTokensForUser(ctx, int(userID), ScopeDeploy)
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range existing {
+		if old.Allows(PermissionWrite) != (permission == PermissionWrite) {
+			continue
+		}
+		if err := s.repo.DeleteTokenByID(ctx, old.ID, int(userID)); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
 	// Create new deploy token
-	token, err := s.repo.CreateNewToken(ctx, int(userID), DeployTokenDuration, ScopeDeploy)
+	token, err := GenerateToken(int(userID), ttl, ScopeDeploy)
+	if err != nil {
+		return nil, err
+	}
+	token.Resource = resource
+	token.Permission = permission
+	token.BoundIP = boundIP
+
+	if err := s.repo.Insert(ctx, token); err != nil {
+		return nil, err
+	}
+
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// rotatableScopes are the scopes RotateToken accepts. Single-use proofs
+// such as challenge, elevation and verification tokens cannot be renewed.
+var rotatableScopes = map[string]bool{
+	ScopeAuth:    true,
+	ScopeDeploy:  true,
+	ScopeRefresh: true,
+}
+
+// RotateToken swaps a live auth, deploy or refresh token for a fresh
+// plaintext with the same user, scope, resource, device, user agent,
+// permission, expiry and extension budget. The old token stops validating
+// the moment the new one is stored. Other scopes are refused with
+// ErrInvalidScope and IP-bound tokens, like in ValidateToken, with
+// ErrTokenBindingMismatch.
+func (s *TokenService) RotateToken(ctx context.Context, oldPlaintext string) (_ *Token, err error) {
+	defer func() { s.logOp(ctx, "RotateToken", err) }()
+
+	old, err := s.lookupAnyScope(ctx, oldPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	if !rotatableScopes[old.Scope] {
+		return nil, ErrInvalidScope
+	}
+	if old.BoundIP != nil {
+		return nil, ErrTokenBindingMismatch
+	}
+
+	token, err := GenerateToken(old.UserID, time.Until(old.Expiry), old.Scope)
+	if err != nil {
+		return nil, err
+	}
+	token.Expiry = old.Expiry
+	token.Resource = old.Resource
+	token.DeviceID = old.DeviceID
+	token.Permission = old.Permission
+	token.UserAgent = old.UserAgent
+	token.ExtendedBy = old.ExtendedBy
+
+	if err := s.repo.ReplaceToken(ctx, old.Hash, token); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	s.recordIssued(ctx, token)
+	return token.Sanitize(), nil
+}
+
+// DeployTokenEnvVar is the environment variable the CLI reads its deploy
+// token from.
+const DeployTokenEnvVar = "ZDEPLOY_TOKEN"
+
+// CreateDeployTokenWithHint issues a deploy token along with a shell snippet
+// that configures the CLI with it. The snippet is built while the plaintext
+// is still available, since it is never stored.
+func (s *TokenService) CreateDeployTokenWithHint(ctx context.Context, userID int64) (*Token, string, error) {
+	token, err := s.CreateDeployToken(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hint := fmt.Sprintf("export %s=%s", DeployTokenEnvVar, token.PlainText)
+	return token, hint, nil
+}
+
+// ValidateDeployToken validates a deploy token and checks that it may be
+// used against resource. Like ValidateToken it refuses IP-bound tokens; use
+// ValidateBoundDeployToken for those.
+func (s *TokenService) ValidateDeployToken(ctx context.Context, plaintext, resource string) (*Token, error) {
+	token, err := s.ValidateToken(ctx, plaintext, ScopeDeploy)
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.AllowsResource(resource) {
+		return nil, ErrResourceNotAllowed
+	}
+
+	return token, nil
+}
+
+// ValidateBoundDeployToken is ValidateDeployTokenFor for requests whose
+// client address is known, so tokens from CreateDeployTokenBoundToIP can be
+// used. Unbound tokens validate from any address.
+func (s *TokenService) ValidateBoundDeployToken(ctx context.Context, plaintext, resource, permission, clientIP string) (*Token, error) {
+	token, err := s.ValidateTokenBound(ctx, plaintext, ScopeDeploy, clientIP)
 	if err != nil {
 		return nil, err
 	}
 
+	if !token.AllowsResource(resource) {
+		return nil, ErrResourceNotAllowed
+	}
+	if !token.Allows(permission) {
+		return nil, ErrInsufficientPermission
+	}
+
+	return token, nil
+}
+
+// ValidateDeployTokenFor is ValidateDeployToken for an endpoint that needs
+// permission. Handlers for mutating endpoints pass PermissionWrite so read
+// tokens are refused with ErrInsufficientPermission.
+func (s *TokenService) ValidateDeployTokenFor(ctx context.Context, plaintext, resource, permission string) (*Token, error) {
+	token, err := s.ValidateDeployToken(ctx, plaintext, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Allows(permission) {
+		return nil, ErrInsufficientPermission
+	}
+
+	return token, nil
+}
+
+// canonicalIP parses ip so equal addresses compare equal as strings,
+// whatever their notation. IPv4-mapped IPv6 addresses become IPv4.
+func canonicalIP(ip string) (string, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return "", ErrInvalidClientIP
+	}
+	return addr.Unmap().String(), nil
+}
+
+// ValidateTokenBound is ValidateToken that also enforces the token's IP
+// binding: a token with BoundIP set is refused with ErrTokenBindingMismatch
+// unless clientIP is that address. Tokens without a binding validate from
+// anywhere. As with CreateDeployTokenBoundToIP, clientIP must be the real
+// client address, not a proxy's.
+func (s *TokenService) ValidateTokenBound(ctx context.Context, plaintext, scope, clientIP string) (*Token, error) {
+	token, err := s.lookupToken(ctx, plaintext, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.BoundIP != nil {
+		ip, err := canonicalIP(clientIP)
+		if err != nil || ip != *token.BoundIP {
+			return nil, ErrTokenBindingMismatch
+		}
+	}
+
+	s.touch(ctx, token)
 	return token, nil
 }
@@ -0,0 +1,794 @@
+package token_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/securityevents"
+	"github.com/samokw/zdeploy/server/internal/securityevents/securityeventstest"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/token/tokentest"
+)
+
+func newService(t *testing.T, opts ...token.Option) (*token.TokenService, *tokentest.MemoryTokenRepo) {
+	t.Helper()
+	repo := tokentest.NewMemoryTokenRepo()
+	opts = append([]token.Option{token.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	return token.NewTokenService(repo, opts...), repo
+}
+
+func hashOf(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// insertToken stores a token of scope for userID straight into repo.
+func insertToken(t *testing.T, repo *tokentest.MemoryTokenRepo, userID int, scope string) *token.Token {
+	t.Helper()
+	tok, err := token.GenerateToken(userID, time.Hour, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Insert(context.Background(), tok); err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestRevokeAllUserTokensAllScopes(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		scopes      []string
+		wantDeleted int
+	}{
+		{"no tokens", nil, 0},
+		{"one scope", []string{token.ScopeAuth}, 1},
+		{"every scope", []string{token.ScopeAuth, token.ScopeRefresh, token.ScopeDeploy, token.ScopeEmailVerify}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			for _, scope := range tt.scopes {
+				insertToken(t, repo, 1, scope)
+			}
+			other := insertToken(t, repo, 2, token.ScopeAuth)
+
+			deleted, err := svc.RevokeAllUserTokensAllScopes(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %d, want %d", deleted, tt.wantDeleted)
+			}
+			if n, _ := svc.CountActiveTokens(ctx, 1, ""); n != 0 {
+				t.Errorf("%d tokens left for the user", n)
+			}
+			if _, err := repo.GetByHash(ctx, other.Hash); err != nil {
+				t.Errorf("another user's token was revoked: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenScoped(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		stored    string
+		presented string
+		expired   bool
+		unknown   bool
+		wantErr   error
+	}{
+		{name: "matching scope", stored: token.ScopeAuth, presented: token.ScopeAuth},
+		{name: "wrong scope looks missing", stored: token.ScopeDeploy, presented: token.ScopeAuth, wantErr: token.ErrTokenNotFound},
+		{name: "expired", stored: token.ScopeAuth, presented: token.ScopeAuth, expired: true, wantErr: token.ErrTokenExpired},
+		{name: "unknown token", stored: token.ScopeAuth, presented: token.ScopeAuth, unknown: true, wantErr: token.ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			tok, err := token.GenerateToken(1, time.Hour, tt.stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expired {
+				tok.Expiry = time.Now().Add(-time.Minute)
+			}
+			if !tt.unknown {
+				if err := repo.Insert(ctx, tok); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.ValidateTokenScoped(ctx, tok.PlainText, tt.presented)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got.UserID != 1 {
+				t.Errorf("UserID = %d, want 1", got.UserID)
+			}
+		})
+	}
+}
+
+func TestValidateDeployTokenResource(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		scopedTo  string
+		requested string
+		wantErr   error
+	}{
+		{"unrestricted token", "", "blog", nil},
+		{"matching site", "blog", "blog", nil},
+		{"other site", "blog", "shop", token.ErrResourceNotAllowed},
+		{"restricted token, no site", "blog", "", token.ErrResourceNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+			created, err := svc.CreateDeployTokenForResource(ctx, 1, tt.scopedTo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = svc.ValidateDeployToken(ctx, created.PlainText, tt.requested)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDeployTokenRejectsOtherScopes(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+	auth, err := svc.CreateAuthToken(ctx, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.ValidateDeployToken(ctx, auth.PlainText, "blog"); !errors.Is(err, token.ErrInvalidScope) {
+		t.Fatalf("got %v, want ErrInvalidScope", err)
+	}
+}
+
+func TestTouchScopes(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		touch     []string
+		scope     string
+		wantTouch bool
+	}{
+		{"off by default", nil, token.ScopeDeploy, false},
+		{"opted-in scope", []string{token.ScopeDeploy}, token.ScopeDeploy, true},
+		{"other scope", []string{token.ScopeDeploy}, token.ScopeAuth, false},
+		{"several scopes", []string{token.ScopeDeploy, token.ScopeAuth}, token.ScopeAuth, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t, token.WithTouchScopes(tt.touch...))
+			tok := insertToken(t, repo, 1, tt.scope)
+
+			before := time.Now()
+			validated, err := svc.ValidateToken(ctx, tok.PlainText, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := repo.GetByHash(ctx, tok.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if touched := stored.LastUsedAt != nil; touched != tt.wantTouch {
+				t.Fatalf("stored LastUsedAt = %v, want touched %v", stored.LastUsedAt, tt.wantTouch)
+			}
+			if (validated.LastUsedAt != nil) != tt.wantTouch {
+				t.Errorf("returned LastUsedAt = %v, want touched %v", validated.LastUsedAt, tt.wantTouch)
+			}
+			if tt.wantTouch && stored.LastUsedAt.Before(before) {
+				t.Errorf("LastUsedAt %v is before validation started at %v", stored.LastUsedAt, before)
+			}
+		})
+	}
+}
+
+func TestCreateDeployTokenWithHint(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		userID int64
+	}{
+		{"first user", 1},
+		{"another user", 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+
+			tok, hint, err := svc.CreateDeployTokenWithHint(ctx, tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix := "export " + token.DeployTokenEnvVar + "="
+			if !strings.HasPrefix(hint, prefix) {
+				t.Fatalf("hint %q does not start with %q", hint, prefix)
+			}
+
+			// The snippet must carry a usable token.
+			plaintext := strings.TrimPrefix(hint, prefix)
+			if plaintext != tok.PlainText {
+				t.Errorf("hint carries %q, token is %q", plaintext, tok.PlainText)
+			}
+			validated, err := svc.ValidateDeployToken(ctx, plaintext, "")
+			if err != nil {
+				t.Fatalf("ValidateDeployToken: %v", err)
+			}
+			if int64(validated.UserID) != tt.userID {
+				t.Errorf("UserID = %d, want %d", validated.UserID, tt.userID)
+			}
+		})
+	}
+}
+
+func TestFindExpiringTokens(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newService(t)
+	for _, ttl := range []time.Duration{-time.Minute, 30 * time.Minute, 2 * time.Hour, 48 * time.Hour} {
+		tok, err := token.GenerateToken(1, ttl, token.ScopeDeploy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Insert(ctx, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertToken(t, repo, 1, token.ScopeAuth)
+
+	tests := []struct {
+		name   string
+		within time.Duration
+		scope  string
+		want   int
+	}{
+		{"none soon", time.Minute, token.ScopeDeploy, 0},
+		{"within an hour", time.Hour, token.ScopeDeploy, 1},
+		{"within a day", 24 * time.Hour, token.ScopeDeploy, 2},
+		{"expired are excluded", 72 * time.Hour, token.ScopeDeploy, 3},
+		{"other scope", 2 * time.Hour, token.ScopeAuth, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := svc.FindExpiringTokens(ctx, tt.within, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != tt.want {
+				t.Fatalf("got %d tokens, want %d", len(tokens), tt.want)
+			}
+			for i := 1; i < len(tokens); i++ {
+				if tokens[i].Expiry.Before(tokens[i-1].Expiry) {
+					t.Errorf("tokens not ordered by expiry")
+				}
+			}
+		})
+	}
+}
+
+func TestCreatedTokensAreSanitized(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		create func(svc *token.TokenService) (*token.Token, error)
+	}{
+		{"auth", func(svc *token.TokenService) (*token.Token, error) { return svc.CreateAuthToken(ctx, 1, time.Hour) }},
+		{"session", func(svc *token.TokenService) (*token.Token, error) {
+			return svc.CreateAuthSession(ctx, 1, time.Hour, "test")
+		}},
+		{"refresh pair", func(svc *token.TokenService) (*token.Token, error) {
+			_, refresh, err := svc.CreateAuthTokenWithRefresh(ctx, 1)
+			return refresh, err
+		}},
+		{"email verification", func(svc *token.TokenService) (*token.Token, error) { return svc.CreateEmailVerificationToken(ctx, 1) }},
+		{"elevated", func(svc *token.TokenService) (*token.Token, error) { return svc.CreateElevatedToken(ctx, 1) }},
+		{"deploy", func(svc *token.TokenService) (*token.Token, error) { return svc.CreateDeployToken(ctx, 1) }},
+		{"deploy with permission", func(svc *token.TokenService) (*token.Token, error) {
+			return svc.CreateDeployTokenWithPermission(ctx, 1, "blog", token.PermissionRead, time.Hour)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+
+			tok, err := tt.create(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.PlainText == "" {
+				t.Error("plaintext missing")
+			}
+			if tok.Hash != nil || tok.UserID != 0 || tok.Scope != "" {
+				t.Errorf("token not sanitized: hash %x, user %d, scope %q", tok.Hash, tok.UserID, tok.Scope)
+			}
+		})
+	}
+}
+
+func TestTokenTTLOverrides(t *testing.T) {
+	ctx := context.Background()
+	auth := func(svc *token.TokenService, ttl time.Duration) (*token.Token, error) {
+		return svc.CreateAuthToken(ctx, 1, ttl)
+	}
+	deploy := func(svc *token.TokenService, ttl time.Duration) (*token.Token, error) {
+		return svc.CreateDeployTokenWithTTL(ctx, 1, "", ttl)
+	}
+	refresh := func(svc *token.TokenService, ttl time.Duration) (*token.Token, error) {
+		_, tok, err := svc.CreateAuthTokenWithRefreshTTL(ctx, 1, 0, ttl)
+		return tok, err
+	}
+	refreshed := func(svc *token.TokenService, ttl time.Duration) (*token.Token, error) {
+		_, refresh, err := svc.CreateAuthTokenWithRefresh(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		return svc.RefreshAuthToken(ctx, refresh.PlainText, ttl)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []token.Option
+		create  func(*token.TokenService, time.Duration) (*token.Token, error)
+		ttl     time.Duration
+		wantTTL time.Duration
+		wantErr error
+	}{
+		{name: "auth default", create: auth, wantTTL: token.AuthTokenDuration},
+		{name: "auth override", create: auth, ttl: time.Hour, wantTTL: time.Hour},
+		{name: "auth at max", create: auth, ttl: 24 * time.Hour, wantTTL: 24 * time.Hour},
+		{name: "auth beyond max", create: auth, ttl: 25 * time.Hour, wantErr: token.ErrTTLTooLong},
+		{name: "deploy default", create: deploy, wantTTL: token.DeployTokenDuration},
+		{name: "deploy override", create: deploy, ttl: 6 * time.Hour, wantTTL: 6 * time.Hour},
+		{name: "deploy beyond max", create: deploy, ttl: 365 * 24 * time.Hour, wantErr: token.ErrTTLTooLong},
+		{name: "refresh override", create: refresh, ttl: 30 * 24 * time.Hour, wantTTL: 30 * 24 * time.Hour},
+		{name: "refresh beyond max", create: refresh, ttl: 31 * 24 * time.Hour, wantErr: token.ErrTTLTooLong},
+		{name: "refreshed auth default", create: refreshed, wantTTL: token.AuthTokenDuration},
+		{name: "refreshed auth override", create: refreshed, ttl: time.Hour, wantTTL: time.Hour},
+		{name: "refreshed auth beyond max", create: refreshed, ttl: 25 * time.Hour, wantErr: token.ErrTTLTooLong},
+		{name: "custom max", opts: []token.Option{token.WithMaxTTL(token.ScopeAuth, time.Hour)}, create: auth, ttl: 2 * time.Hour, wantErr: token.ErrTTLTooLong},
+		{name: "custom default", opts: []token.Option{token.WithTTLs(map[string]time.Duration{token.ScopeAuth: 10 * time.Minute})}, create: auth, wantTTL: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, tt.opts...)
+
+			before := time.Now()
+			tok, err := tt.create(svc, tt.ttl)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := tok.Expiry.Sub(before); got < tt.wantTTL || got > tt.wantTTL+time.Minute {
+				t.Errorf("lifetime = %v, want %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestPeek(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		scope   string
+		ttl     time.Duration
+		unknown bool
+		wantErr error
+	}{
+		{name: "auth", scope: token.ScopeAuth, ttl: time.Hour},
+		{name: "deploy", scope: token.ScopeDeploy, ttl: time.Hour},
+		{name: "refresh", scope: token.ScopeRefresh, ttl: time.Hour},
+		{name: "email verification", scope: token.ScopeEmailVerify, ttl: time.Hour},
+		{name: "elevated", scope: token.ScopeElevated, ttl: time.Hour},
+		{name: "expired", scope: token.ScopeAuth, ttl: -time.Minute, wantErr: token.ErrTokenExpired},
+		{name: "unknown", scope: token.ScopeAuth, ttl: time.Hour, unknown: true, wantErr: token.ErrTokenNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Touching is on for the token's scope so that Peek recording
+			// use would show up in the repository.
+			svc, repo := newService(t, token.WithTouchScopes(tt.scope))
+			tok, err := token.GenerateToken(1, tt.ttl, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.unknown {
+				if err := repo.Insert(ctx, tok); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.Peek(ctx, tok.PlainText)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Scope != tt.scope || got.UserID != 1 {
+				t.Errorf("got scope %q, user %d; want %q, 1", got.Scope, got.UserID, tt.scope)
+			}
+			if stored, _ := repo.GetByHash(ctx, tok.Hash); stored.LastUsedAt != nil {
+				t.Error("Peek recorded token use")
+			}
+		})
+	}
+}
+
+func TestFindUserIDByTokenPlaintext(t *testing.T) {
+	ctx := context.Background()
+	errDenied := errors.New("denied")
+	const adminID = 7
+
+	// allowAdmin lets only adminID trace tokens.
+	allowAdmin := func(ctx context.Context, id int64) error {
+		if id != adminID {
+			return errDenied
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		scope      string
+		ttl        time.Duration
+		unknown    bool
+		authorize  token.AdminAuthorizer
+		caller     int64
+		wantUserID int
+		wantErr    error
+	}{
+		{name: "deploy token", scope: token.ScopeDeploy, ttl: time.Hour, authorize: allowAdmin, caller: adminID, wantUserID: 42},
+		{name: "auth token", scope: token.ScopeAuth, ttl: time.Hour, authorize: allowAdmin, caller: adminID, wantUserID: 42},
+		{name: "refresh token", scope: token.ScopeRefresh, ttl: time.Hour, authorize: allowAdmin, caller: adminID, wantUserID: 42},
+		{name: "expired token", scope: token.ScopeDeploy, ttl: -time.Hour, authorize: allowAdmin, caller: adminID, wantUserID: 42},
+		{name: "unknown token", scope: token.ScopeDeploy, ttl: time.Hour, unknown: true, authorize: allowAdmin, caller: adminID, wantErr: token.ErrTokenNotFound},
+		{name: "refused caller", scope: token.ScopeDeploy, ttl: time.Hour, authorize: allowAdmin, caller: 42, wantErr: errDenied},
+		{name: "no authorizer", scope: token.ScopeDeploy, ttl: time.Hour, caller: adminID, wantErr: token.ErrLookupNotAuthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			opts := []token.Option{token.WithLogger(slog.New(slog.NewTextHandler(&logs, nil)))}
+			if tt.authorize != nil {
+				opts = append(opts, token.WithAdminAuthorizer(tt.authorize))
+			}
+			svc, repo := newService(t, opts...)
+			tok, err := token.GenerateToken(42, tt.ttl, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.unknown {
+				if err := repo.Insert(ctx, tok); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			userID, err := svc.FindUserIDByTokenPlaintext(ctx, tok.PlainText, tt.caller)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if userID != tt.wantUserID {
+				t.Errorf("user ID = %d, want %d", userID, tt.wantUserID)
+			}
+			if !strings.Contains(logs.String(), "op=FindUserIDByTokenPlaintext") {
+				t.Errorf("lookup not logged: %q", logs.String())
+			}
+			if strings.Contains(logs.String(), tok.PlainText) {
+				t.Error("log leaks the plaintext")
+			}
+		})
+	}
+}
+
+func TestWithTTLs(t *testing.T) {
+	ctx := context.Background()
+	overrides := map[string]time.Duration{
+		token.ScopeDeploy:      6 * time.Hour,
+		token.ScopeEmailVerify: time.Hour,
+		token.ScopeAuth:        0,
+		token.ScopeRefresh:     -time.Hour,
+	}
+
+	tests := []struct {
+		name    string
+		create  func(*token.TokenService) (*token.Token, error)
+		wantTTL time.Duration
+	}{
+		{
+			name:    "overridden deploy",
+			create:  func(svc *token.TokenService) (*token.Token, error) { return svc.CreateDeployToken(ctx, 1) },
+			wantTTL: 6 * time.Hour,
+		},
+		{
+			name:    "overridden email verification",
+			create:  func(svc *token.TokenService) (*token.Token, error) { return svc.CreateEmailVerificationToken(ctx, 1) },
+			wantTTL: time.Hour,
+		},
+		{
+			name:    "zero override ignored",
+			create:  func(svc *token.TokenService) (*token.Token, error) { return svc.CreateAuthToken(ctx, 1, 0) },
+			wantTTL: token.AuthTokenDuration,
+		},
+		{
+			name: "negative override ignored",
+			create: func(svc *token.TokenService) (*token.Token, error) {
+				_, refresh, err := svc.CreateAuthTokenWithRefresh(ctx, 1)
+				return refresh, err
+			},
+			wantTTL: token.RefreshTokenDuration,
+		},
+		{
+			name:    "unset scope",
+			create:  func(svc *token.TokenService) (*token.Token, error) { return svc.CreateElevatedToken(ctx, 1) },
+			wantTTL: token.ElevatedTokenDuration,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, token.WithTTLs(overrides))
+
+			before := time.Now()
+			tok, err := tt.create(svc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tok.Expiry.Sub(before); got < tt.wantTTL || got > tt.wantTTL+time.Minute {
+				t.Errorf("lifetime = %v, want %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestWithTTLsAppliesToRefresh(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t, token.WithTTLs(map[string]time.Duration{token.ScopeAuth: 5 * time.Minute}))
+
+	_, refresh, err := svc.CreateAuthTokenWithRefresh(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	auth, err := svc.RefreshAuthToken(ctx, refresh.PlainText, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := auth.Expiry.Sub(before); got < 5*time.Minute || got > 6*time.Minute {
+		t.Errorf("refreshed auth token lifetime = %v, want 5m", got)
+	}
+}
+
+func TestTokenCounts(t *testing.T) {
+	type seed struct {
+		userID int
+		scope  string
+		ttl    time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		seeds []seed
+		want  map[string]int
+	}{
+		{name: "no tokens", want: map[string]int{}},
+		{
+			name: "several scopes",
+			seeds: []seed{
+				{1, token.ScopeAuth, time.Hour},
+				{2, token.ScopeAuth, time.Hour},
+				{1, token.ScopeDeploy, time.Hour},
+				{1, token.ScopeRefresh, time.Hour},
+				{2, token.ScopeRefresh, time.Hour},
+				{3, token.ScopeRefresh, time.Hour},
+			},
+			want: map[string]int{token.ScopeAuth: 2, token.ScopeDeploy: 1, token.ScopeRefresh: 3},
+		},
+		{
+			name: "expired tokens excluded",
+			seeds: []seed{
+				{1, token.ScopeAuth, time.Hour},
+				{2, token.ScopeAuth, -time.Hour},
+				{1, token.ScopeDeploy, -time.Minute},
+			},
+			want: map[string]int{token.ScopeAuth: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			svc, repo := newService(t)
+			for _, s := range tt.seeds {
+				tok, err := token.GenerateToken(s.userID, s.ttl, s.scope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := repo.Insert(ctx, tok); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.TokenCounts(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenSecurityEvents(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		action func(svc *token.TokenService) error
+		want   []securityevents.Type
+	}{
+		{
+			name: "issue",
+			action: func(svc *token.TokenService) error {
+				_, err := svc.CreateDeployToken(ctx, 1)
+				return err
+			},
+			want: []securityevents.Type{securityevents.TokenIssued},
+		},
+		{
+			name: "issue and revoke",
+			action: func(svc *token.TokenService) error {
+				if _, err := svc.CreateAuthToken(ctx, 1, 0); err != nil {
+					return err
+				}
+				return svc.RevokeAllUserTokens(ctx, 1, token.ScopeAuth)
+			},
+			want: []securityevents.Type{securityevents.TokenRevoked, securityevents.TokenIssued},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := securityeventstest.NewMemoryRecorder()
+			svc, _ := newService(t, token.WithSecurityEvents(recorder))
+
+			if err := tt.action(svc); err != nil {
+				t.Fatal(err)
+			}
+
+			events, err := recorder.ListSecurityEvents(ctx, 1, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []securityevents.Type
+			for _, e := range events {
+				got = append(got, e.Type)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded %v (newest first), want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountActiveTokens(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newService(t)
+
+	seeds := []struct {
+		userID int
+		scope  string
+		ttl    time.Duration
+	}{
+		{1, token.ScopeDeploy, time.Hour},
+		{1, token.ScopeDeploy, time.Hour},
+		{1, token.ScopeDeploy, -time.Hour},
+		{1, token.ScopeAuth, time.Hour},
+		{1, token.ScopeRefresh, -time.Minute},
+		{2, token.ScopeDeploy, time.Hour},
+	}
+	for _, s := range seeds {
+		tok, err := token.GenerateToken(s.userID, s.ttl, s.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Insert(ctx, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		scope  string
+		want   int
+	}{
+		{"live deploy tokens", 1, token.ScopeDeploy, 2},
+		{"auth tokens", 1, token.ScopeAuth, 1},
+		{"only expired", 1, token.ScopeRefresh, 0},
+		{"all scopes", 1, "", 3},
+		{"other user", 2, "", 1},
+		{"no tokens", 3, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := svc.CountActiveTokens(ctx, tt.userID, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasActiveSession(t *testing.T) {
+	ctx := context.Background()
+
+	type seed struct {
+		userID int
+		scope  string
+		ttl    time.Duration
+	}
+	tests := []struct {
+		name  string
+		seeds []seed
+		want  bool
+	}{
+		{"no tokens", nil, false},
+		{"live auth token", []seed{{1, token.ScopeAuth, time.Hour}}, true},
+		{"only expired auth token", []seed{{1, token.ScopeAuth, -time.Minute}}, false},
+		{"expired and live", []seed{{1, token.ScopeAuth, -time.Minute}, {1, token.ScopeAuth, time.Hour}}, true},
+		{"other scopes", []seed{{1, token.ScopeDeploy, time.Hour}, {1, token.ScopeRefresh, time.Hour}}, false},
+		{"other user", []seed{{2, token.ScopeAuth, time.Hour}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, repo := newService(t)
+			for _, s := range tt.seeds {
+				tok, err := token.GenerateToken(s.userID, s.ttl, s.scope)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := repo.Insert(ctx, tok); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.HasActiveSession(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package token_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+func TestTokenJSONOmitsSecrets(t *testing.T) {
+	tok, err := token.GenerateToken(7, time.Hour, token.ScopeDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok.ID = 42
+	tok.Resource = "blog"
+	tok.UserAgent = "curl/8.0"
+	boundIP := "203.0.113.7"
+	tok.BoundIP = &boundIP
+
+	tests := []struct {
+		name     string
+		value    any
+		wantKeys []string
+		// forbidKeys are checked on top of the hash, owner, scope and
+		// binding, which no representation may carry.
+		forbidKeys []string
+	}{
+		{"Token", tok, []string{"token", "expiry", "resource"}, nil},
+		{"PublicToken", tok.Public(), []string{"token", "expiry", "resource"}, nil},
+		{"SessionInfo", tok.Session(), []string{"id", "created_at", "expiry", "user_agent"}, []string{"token"}},
+	}
+	forbidden := []string{"hash", "Hash", "user_id", "UserID", "scope", "Scope", "bound_ip", "BoundIP"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range tt.wantKeys {
+				if _, ok := fields[key]; !ok {
+					t.Errorf("missing %q in %s", key, data)
+				}
+			}
+			for _, key := range append(forbidden, tt.forbidKeys...) {
+				if _, ok := fields[key]; ok {
+					t.Errorf("%s exposes %q: %s", tt.name, key, data)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateTokenWithEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding token.Encoding
+		length   int
+		alphabet string
+	}{
+		{"base32", token.EncodingBase32, 52, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"},
+		{"base64url", token.EncodingBase64URL, 43, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"},
+		{"hex", token.EncodingHex, 64, "0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := token.GenerateTokenWithEncoding(1, time.Hour, token.ScopeAuth, tt.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tok.PlainText) != tt.length {
+				t.Errorf("plaintext %q has length %d, want %d", tok.PlainText, len(tok.PlainText), tt.length)
+			}
+			if i := strings.IndexFunc(tok.PlainText, func(r rune) bool { return !strings.ContainsRune(tt.alphabet, r) }); i >= 0 {
+				t.Errorf("plaintext %q has %q outside the %s alphabet", tok.PlainText, tok.PlainText[i], tt.name)
+			}
+			if hash := sha256.Sum256([]byte(tok.PlainText)); !bytes.Equal(tok.Hash, hash[:]) {
+				t.Error("hash is not the SHA-256 of the encoded plaintext")
+			}
+		})
+	}
+}
+
+func TestGenerateTokenScopes(t *testing.T) {
+	// Registered once up front: the scope registry is process-wide.
+	token.RegisterScope("test_plugin")
+
+	tests := []struct {
+		scope   string
+		wantErr error
+	}{
+		{token.ScopeAuth, nil},
+		{token.ScopeDeploy, nil},
+		{token.ScopeRefresh, nil},
+		{token.ScopeEmailVerify, nil},
+		{token.ScopeElevated, nil},
+		{"test_plugin", nil},
+		{"", token.ErrInvalidScope},
+		{"Deployment", token.ErrInvalidScope},
+		{"made_up", token.ErrInvalidScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			tok, err := token.GenerateToken(1, time.Hour, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && tok.Scope != tt.scope {
+				t.Errorf("Scope = %q, want %q", tok.Scope, tt.scope)
+			}
+			if known := token.IsKnownScope(tt.scope); known != (tt.wantErr == nil) {
+				t.Errorf("IsKnownScope = %v", known)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tok, err := token.GenerateToken(7, time.Hour, token.ScopeDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := append([]byte(nil), tok.Hash...)
+
+	clean := tok.Sanitize()
+	if clean.Hash != nil || clean.UserID != 0 || clean.Scope != "" {
+		t.Errorf("sanitized token keeps hash %x, user %d, scope %q", clean.Hash, clean.UserID, clean.Scope)
+	}
+	if clean.PlainText != tok.PlainText || !clean.Expiry.Equal(tok.Expiry) {
+		t.Errorf("sanitized token lost its plaintext or expiry")
+	}
+	if !bytes.Equal(tok.Hash, hash) || tok.UserID != 7 || tok.Scope != token.ScopeDeploy {
+		t.Errorf("Sanitize modified the original token")
+	}
+}
+
+func TestCachedTokenMatches(t *testing.T) {
+	tok, err := token.GenerateToken(7, time.Hour, token.ScopeDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := token.GenerateToken(7, time.Hour, token.ScopeDeploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := tok.Cached()
+
+	tests := []struct {
+		name      string
+		plaintext string
+		want      bool
+	}{
+		{"own plaintext", tok.PlainText, true},
+		{"other token", other.PlainText, false},
+		{"truncated", tok.PlainText[:len(tok.PlainText)-1], false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cached.Matches(tt.plaintext); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
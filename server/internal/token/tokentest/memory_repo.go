@@ -0,0 +1,355 @@
+// Package tokentest provides an in-memory token.TokenRepository for tests
+// that should not need a database.
+package tokentest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+var _ token.TokenRepository = (*MemoryTokenRepo)(nil)
+
+// MemoryTokenRepo is a concurrency-safe, map-backed token.TokenRepository
+// keyed by token hash. Like TokenRepo, lookups return token.ErrNotFound on
+// a miss. Plaintexts are never stored.
+type MemoryTokenRepo struct {
+	mu       sync.Mutex
+	nextID   int64
+	tokens   map[string]*token.Token
+	attempts map[string]int
+}
+
+func NewMemoryTokenRepo() *MemoryTokenRepo {
+	return &MemoryTokenRepo{
+		tokens:   make(map[string]*token.Token),
+		attempts: make(map[string]int),
+	}
+}
+
+// clone copies t without its plaintext, matching what a database row holds.
+func clone(t *token.Token) *token.Token {
+	c := *t
+	c.PlainText = ""
+	c.Hash = append([]byte(nil), t.Hash...)
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		c.LastUsedAt = &lastUsedAt
+	}
+	if t.BoundIP != nil {
+		boundIP := *t.BoundIP
+		c.BoundIP = &boundIP
+	}
+	return &c
+}
+
+func (m *MemoryTokenRepo) Insert(ctx context.Context, t *token.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.insert(t)
+	return nil
+}
+
+// insert assigns t an ID and creation time, as the database would, and
+// stores a copy.
+func (m *MemoryTokenRepo) insert(t *token.Token) {
+	m.nextID++
+	t.ID = m.nextID
+	t.CreatedAt = time.Now()
+	m.tokens[string(t.Hash)] = clone(t)
+	delete(m.attempts, string(t.Hash))
+}
+
+func (m *MemoryTokenRepo) InsertBatch(ctx context.Context, tokens []*token.Token) error {
+	for _, t := range tokens {
+		if !token.IsKnownScope(t.Scope) {
+			return token.ErrInvalidScope
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range tokens {
+		m.insert(t)
+	}
+	return nil
+}
+
+func (m *MemoryTokenRepo) GetByHash(ctx context.Context, hash []byte) (*token.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[string(hash)]
+	if !ok {
+		return nil, token.ErrNotFound
+	}
+	return clone(t), nil
+}
+
+func (m *MemoryTokenRepo) GetByHashAndScope(ctx context.Context, hash []byte, scope string) (*token.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[string(hash)]
+	if !ok || t.Scope != scope {
+		return nil, token.ErrNotFound
+	}
+	return clone(t), nil
+}
+
+func (m *MemoryTokenRepo) CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*token.Token, error) {
+	t, err := token.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, t)
+	return t, err
+}
+
+func (m *MemoryTokenRepo) DeleteAllTokensForUser(ctx context.Context, userID int, scope string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope {
+			delete(m.tokens, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryTokenRepo) DeleteExpiredTokensForUser(ctx context.Context, userID int, scope string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope && !t.Expiry.After(now) {
+			delete(m.tokens, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryTokenRepo) DeleteAllTokensForUserAllScopes(ctx context.Context, userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for key, t := range m.tokens {
+		if t.UserID == userID {
+			delete(m.tokens, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryTokenRepo) DeleteTokensForDevice(ctx context.Context, userID int, deviceID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for key, t := range m.tokens {
+		if t.UserID == userID && t.DeviceID == deviceID {
+			delete(m.tokens, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryTokenRepo) DeleteTokenByHash(ctx context.Context, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tokens, string(hash))
+	return nil
+}
+
+func (m *MemoryTokenRepo) DeleteTokenByID(ctx context.Context, id int64, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.ID == id && t.UserID == userID {
+			delete(m.tokens, key)
+			return nil
+		}
+	}
+	return token.ErrNotFound
+}
+
+func (m *MemoryTokenRepo) DeleteTokenByIDAndScope(ctx context.Context, id int64, userID int, scope string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, t := range m.tokens {
+		if t.ID == id && t.UserID == userID && t.Scope == scope {
+			delete(m.tokens, key)
+			return nil
+		}
+	}
+	return token.ErrNotFound
+}
+
+func (m *MemoryTokenRepo) ListTokensForUser(ctx context.Context, userID int, scope string) ([]*token.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var tokens []*token.Token
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope && t.Expiry.After(now) {
+			tokens = append(tokens, clone(t))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (m *MemoryTokenRepo) ReplaceToken(ctx context.Context, oldHash []byte, t *token.Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[string(oldHash)]; !ok {
+		return token.ErrNotFound
+	}
+	delete(m.tokens, string(oldHash))
+	m.insert(t)
+	return nil
+}
+
+func (m *MemoryTokenRepo) TouchToken(ctx context.Context, hash []byte, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.tokens[string(hash)]; ok {
+		t.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+func (m *MemoryTokenRepo) RecordAttempt(ctx context.Context, hash []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[string(hash)]; !ok {
+		return 0, token.ErrNotFound
+	}
+	m.attempts[string(hash)]++
+	return m.attempts[string(hash)], nil
+}
+
+func (m *MemoryTokenRepo) UpdateTokenExpiry(ctx context.Context, hash []byte, expiry time.Time, extendedBy time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[string(hash)]
+	if !ok {
+		return token.ErrNotFound
+	}
+	t.Expiry = expiry
+	t.ExtendedBy = extendedBy
+	return nil
+}
+
+func (m *MemoryTokenRepo) ListStaleTokens(ctx context.Context, olderThan time.Time) ([]*token.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stale []*token.Token
+	for _, t := range m.tokens {
+		if t.LastUsedAt != nil && t.LastUsedAt.Before(olderThan) {
+			stale = append(stale, clone(t))
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].LastUsedAt.Before(*stale[j].LastUsedAt)
+	})
+	return stale, nil
+}
+
+func (m *MemoryTokenRepo) CountByScope(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	counts := make(map[string]int)
+	for _, t := range m.tokens {
+		if t.Expiry.After(now) {
+			counts[t.Scope]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *MemoryTokenRepo) CountTokensForUser(ctx context.Context, userID int, scope string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, t := range m.tokens {
+		if t.UserID == userID && (scope == "" || t.Scope == scope) && t.Expiry.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryTokenRepo) HasLiveToken(ctx context.Context, userID int, scope string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope && t.Expiry.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryTokenRepo) SummarizeTokensForUser(ctx context.Context, userID int) (*token.UserTokenSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	summary := &token.UserTokenSummary{}
+	for _, t := range m.tokens {
+		if t.UserID != userID || !t.Expiry.After(now) {
+			continue
+		}
+		switch t.Scope {
+		case token.ScopeDeploy:
+			summary.DeployTokens++
+		case token.ScopeRefresh:
+			summary.HasRefresh = true
+		}
+	}
+	return summary, nil
+}
+
+func (m *MemoryTokenRepo) ListExpiringBefore(ctx context.Context, cutoff time.Time, scope string) ([]*token.Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var expiring []*token.Token
+	for _, t := range m.tokens {
+		if t.Scope == scope && t.Expiry.Before(cutoff) && t.Expiry.After(now) {
+			expiring = append(expiring, clone(t))
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].Expiry.Before(expiring[j].Expiry)
+	})
+	return expiring, nil
+}
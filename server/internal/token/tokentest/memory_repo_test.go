@@ -0,0 +1,204 @@
+package tokentest_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/token/tokentest"
+)
+
+func TestMemoryTokenRepo(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		run     func(repo *tokentest.MemoryTokenRepo, live *token.Token) error
+		wantErr error
+	}{
+		{
+			name: "get by hash",
+			run: func(repo *tokentest.MemoryTokenRepo, live *token.Token) error {
+				got, err := repo.GetByHash(ctx, live.Hash)
+				if err == nil && got.PlainText != "" {
+					return errors.New("plaintext was stored")
+				}
+				return err
+			},
+		},
+		{
+			name: "get missing",
+			run: func(repo *tokentest.MemoryTokenRepo, _ *token.Token) error {
+				_, err := repo.GetByHash(ctx, []byte("missing"))
+				return err
+			},
+			wantErr: token.ErrNotFound,
+		},
+		{
+			name: "get with other scope",
+			run: func(repo *tokentest.MemoryTokenRepo, live *token.Token) error {
+				_, err := repo.GetByHashAndScope(ctx, live.Hash, token.ScopeAuth)
+				return err
+			},
+			wantErr: token.ErrNotFound,
+		},
+		{
+			name: "delete another user's token",
+			run: func(repo *tokentest.MemoryTokenRepo, live *token.Token) error {
+				return repo.DeleteTokenByID(ctx, live.ID, live.UserID+1)
+			},
+			wantErr: token.ErrNotFound,
+		},
+		{
+			name: "replace missing",
+			run: func(repo *tokentest.MemoryTokenRepo, live *token.Token) error {
+				return repo.ReplaceToken(ctx, []byte("missing"), live)
+			},
+			wantErr: token.ErrNotFound,
+		},
+		{
+			name: "batch with unknown scope",
+			run: func(repo *tokentest.MemoryTokenRepo, live *token.Token) error {
+				bad := *live
+				bad.Scope = "bogus"
+				return repo.InsertBatch(ctx, []*token.Token{&bad})
+			},
+			wantErr: token.ErrInvalidScope,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tokentest.NewMemoryTokenRepo()
+			live, err := token.GenerateToken(1, time.Hour, token.ScopeDeploy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.Insert(ctx, live); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.run(repo, live); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryTokenRepoListSkipsExpired(t *testing.T) {
+	ctx := context.Background()
+	repo := tokentest.NewMemoryTokenRepo()
+
+	for _, ttl := range []time.Duration{time.Hour, -time.Hour, 2 * time.Hour} {
+		tok, err := token.GenerateToken(1, ttl, token.ScopeAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Insert(ctx, tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := repo.ListTokensForUser(ctx, 1, token.ScopeAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Errorf("listed %d tokens, want 2 live ones", len(tokens))
+	}
+}
+
+func TestMemoryTokenRepoConcurrentInserts(t *testing.T) {
+	ctx := context.Background()
+	repo := tokentest.NewMemoryTokenRepo()
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok, err := token.GenerateToken(1, time.Hour, token.ScopeAuth)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := repo.Insert(ctx, tok); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := repo.CountTokensForUser(ctx, 1, token.ScopeAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != workers {
+		t.Errorf("counted %d tokens, want %d", n, workers)
+	}
+
+	tokens, err := repo.ListTokensForUser(ctx, 1, token.ScopeAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for _, tok := range tokens {
+		if seen[tok.ID] {
+			t.Fatalf("ID %d assigned twice", tok.ID)
+		}
+		seen[tok.ID] = true
+	}
+}
+
+func TestMemoryTokenRepoInsertBatch(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		wantErr error
+	}{
+		{name: "empty"},
+		{name: "mixed scopes", scopes: []string{token.ScopeDeploy, token.ScopeAuth, token.ScopeDeploy}},
+		{name: "one unknown scope", scopes: []string{token.ScopeDeploy, "bogus", token.ScopeAuth}, wantErr: token.ErrInvalidScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tokentest.NewMemoryTokenRepo()
+			var batch []*token.Token
+			for i, scope := range tt.scopes {
+				tok, err := token.GenerateToken(i+1, time.Hour, token.ScopeDeploy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tok.Scope = scope
+				batch = append(batch, tok)
+			}
+
+			if err := repo.InsertBatch(ctx, batch); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			// Either every token is retrievable by hash or, after a failure,
+			// none is.
+			for _, tok := range batch {
+				got, err := repo.GetByHash(ctx, tok.Hash)
+				if tt.wantErr != nil {
+					if !errors.Is(err, token.ErrNotFound) {
+						t.Errorf("token of failed batch: got %v, want ErrNotFound", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.UserID != tok.UserID || got.Scope != tok.Scope {
+					t.Errorf("got user %d scope %q, want user %d scope %q", got.UserID, got.Scope, tok.UserID, tok.Scope)
+				}
+			}
+		})
+	}
+}
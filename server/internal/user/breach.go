@@ -0,0 +1,77 @@
+package user
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BreachChecker reports whether a password appears in a known breach corpus.
+type BreachChecker interface {
+	IsBreached(ctx context.Context, password string) (bool, error)
+}
+
+const DefaultHIBPRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// HIBPChecker queries the Have I Been Pwned range API. Only the first five
+// hex characters of the password's SHA-1 leave the process; the suffix is
+// matched locally against the returned list (k-anonymity).
+type HIBPChecker struct {
+	client   *http.Client
+	rangeURL string
+}
+
+func NewHIBPChecker(client *http.Client) *HIBPChecker {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &HIBPChecker{
+		client:   client,
+		rangeURL: DefaultHIBPRangeURL,
+	}
+}
+
+func (c *HIBPChecker) IsBreached(ctx context.Context, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.rangeURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding makes every response a similar size so the prefix can't be
+	// inferred from traffic.
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("hibp: unexpected status %d", resp.StatusCode)
+	}
+
+	// Each line is "SUFFIX:COUNT"; padding entries have a count of zero.
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		hashSuffix, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || count == "0" {
+			continue
+		}
+		if strings.EqualFold(hashSuffix, suffix) {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, nil
+}
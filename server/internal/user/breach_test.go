@@ -0,0 +1,117 @@
+package user_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+// rangeAPI answers HIBP range requests from body and records the request.
+type rangeAPI struct {
+	status int
+	body   string
+	req    *http.Request
+}
+
+func (a *rangeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.req = req
+	return &http.Response{
+		StatusCode: a.status,
+		Body:       io.NopCloser(strings.NewReader(a.body)),
+		Header:     make(http.Header),
+		Request:    req,
+	}, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestHIBPChecker(t *testing.T) {
+	const password = "hunter2"
+	digest := sha1Hex(password)
+	prefix, suffix := digest[:5], digest[5:]
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    bool
+		wantErr bool
+	}{
+		{"listed", http.StatusOK, "0000000000000000000000000000000000A:3\r\n" + suffix + ":42\r\n", true, false},
+		{"listed in lower case", http.StatusOK, strings.ToLower(suffix) + ":1\n", true, false},
+		{"not listed", http.StatusOK, "0000000000000000000000000000000000A:3\n", false, false},
+		{"padding entry", http.StatusOK, suffix + ":0\n", false, false},
+		{"empty response", http.StatusOK, "", false, false},
+		{"server error", http.StatusServiceUnavailable, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &rangeAPI{status: tt.status, body: tt.body}
+			checker := user.NewHIBPChecker(&http.Client{Transport: api})
+
+			got, err := checker.IsBreached(context.Background(), password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IsBreached = %v, want %v", got, tt.want)
+			}
+
+			// Only the five-character prefix may leave the process.
+			if path := api.req.URL.String(); !strings.HasSuffix(path, "/range/"+prefix) || strings.Contains(path, suffix) {
+				t.Errorf("requested %q, want only the prefix %s", path, prefix)
+			}
+			if api.req.Header.Get("Add-Padding") != "true" {
+				t.Error("request does not ask for padding")
+			}
+		})
+	}
+}
+
+type stubBreachChecker struct {
+	breached bool
+	err      error
+}
+
+func (c stubBreachChecker) IsBreached(context.Context, string) (bool, error) {
+	return c.breached, c.err
+}
+
+func TestCreateUserBreachCheck(t *testing.T) {
+	errDown := errors.New("hibp down")
+
+	tests := []struct {
+		name       string
+		checker    stubBreachChecker
+		failClosed bool
+		wantErr    error
+	}{
+		{name: "clean", checker: stubBreachChecker{}},
+		{name: "breached", checker: stubBreachChecker{breached: true}, wantErr: user.ErrPasswordBreached},
+		{name: "checker down fails open", checker: stubBreachChecker{err: errDown}},
+		{name: "checker down fails closed", checker: stubBreachChecker{err: errDown}, failClosed: true, wantErr: errDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t,
+				user.WithBreachChecker(tt.checker),
+				user.WithBreachCheckFailClosed(tt.failClosed))
+
+			_, err := svc.CreateUser(context.Background(), "newcomer", testutil.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package user
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// UserCache holds users by ID so hot paths can skip the database.
+// Implementations must be safe for concurrent use.
+type UserCache interface {
+	Get(id int64) (*User, bool)
+	Set(user *User)
+	Invalidate(id int64)
+}
+
+type lruEntry struct {
+	user      *User
+	expiresAt time.Time
+}
+
+// LRUUserCache is an in-memory UserCache that evicts the least recently used
+// entry once full and treats entries older than its TTL as misses.
+type LRUUserCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[int64]*list.Element
+}
+
+func NewLRUUserCache(capacity int, ttl time.Duration) *LRUUserCache {
+	return &LRUUserCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[int64]*list.Element),
+	}
+}
+
+func (c *LRUUserCache) Get(id int64) (*User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.user.clone(), true
+}
+
+func (c *LRUUserCache) Set(user *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry{
+		user:      user.clone(),
+		expiresAt: time.Now().Add(c.ttl),
+	}
+	if elem, ok := c.entries[user.ID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[user.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).user.ID)
+	}
+}
+
+func (c *LRUUserCache) Invalidate(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// clone copies u so a cached user never shares state with a caller.
+func (u *User) clone() *User {
+	c := *u
+	c.PasswordHash.plainText = nil
+	c.PasswordHash.hash = append([]byte(nil), u.PasswordHash.hash...)
+	c.ApprovedAt = cloneTime(u.ApprovedAt)
+	c.DeleteAfter = cloneTime(u.DeleteAfter)
+	c.EmailVerifiedAt = cloneTime(u.EmailVerifiedAt)
+	c.SuspendedUntil = cloneTime(u.SuspendedUntil)
+	c.LockedUntil = cloneTime(u.LockedUntil)
+	if u.ApprovedBy != nil {
+		approvedBy := *u.ApprovedBy
+		c.ApprovedBy = &approvedBy
+	}
+	if u.Phone != nil {
+		phone := *u.Phone
+		c.Phone = &phone
+	}
+	if u.Emails != nil {
+		c.Emails = make([]Email, len(u.Emails))
+		for i, email := range u.Emails {
+			c.Emails[i] = email
+			c.Emails[i].VerifiedAt = cloneTime(email.VerifiedAt)
+		}
+	}
+	return &c
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// cachingStore reads users by ID through a UserCache and invalidates the
+// cached entry on every write to that user, including the bulk deletions
+// made by MergeUsers, PurgeScheduledDeletions and PurgeStalePending.
+//
+// A read that misses the cache only stores its result if no invalidation
+// happened while it was at the database; otherwise a write landing between
+// the read and the Set could leave the stale row cached until the TTL.
+type cachingStore struct {
+	UserStore
+	cache UserCache
+
+	mu         sync.Mutex
+	generation uint64
+}
+
+func (cs *cachingStore) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	if user, ok := cs.cache.Get(id); ok {
+		return user, nil
+	}
+
+	cs.mu.Lock()
+	generation := cs.generation
+	cs.mu.Unlock()
+
+	user, err := cs.UserStore.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	if cs.generation == generation {
+		cs.cache.Set(user)
+	}
+	cs.mu.Unlock()
+	return user, nil
+}
+
+// invalidate drops the cached entries for ids and bumps the generation so
+// that in-flight misses do not repopulate them with what they read before
+// the write.
+func (cs *cachingStore) invalidate(ids ...int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.generation++
+	for _, id := range ids {
+		cs.cache.Invalidate(id)
+	}
+}
+
+func (cs *cachingStore) UpdateUser(ctx context.Context, user *User) error {
+	defer cs.invalidate(user.ID)
+	return cs.UserStore.UpdateUser(ctx, user)
+}
+
+func (cs *cachingStore) ApproveUser(ctx context.Context, userID, approvedBy int64) error {
+	defer cs.invalidate(userID)
+	return cs.UserStore.ApproveUser(ctx, userID, approvedBy)
+}
+
+func (cs *cachingStore) UnapproveUser(ctx context.Context, userID int64) error {
+	defer cs.invalidate(userID)
+	return cs.UserStore.UnapproveUser(ctx, userID)
+}
+
+func (cs *cachingStore) ChangeUsername(ctx context.Context, userID int64, username, normalizedUsername string) error {
+	defer cs.invalidate(userID)
+	return cs.UserStore.ChangeUsername(ctx, userID, username, normalizedUsername)
+}
+
+func (cs *cachingStore) MergeUsers(ctx context.Context, keepID, mergeID int64) (int, []int64, error) {
+	moved, reapproved, err := cs.UserStore.MergeUsers(ctx, keepID, mergeID)
+	cs.invalidate(append([]int64{keepID, mergeID}, reapproved...)...)
+	return moved, reapproved, err
+}
+
+func (cs *cachingStore) RecordFailedLogin(ctx context.Context, normalizedUsername string, maxFailures int, lockUntil time.Time) (int64, bool, error) {
+	userID, locked, err := cs.UserStore.RecordFailedLogin(ctx, normalizedUsername, maxFailures, lockUntil)
+	if err == nil {
+		cs.invalidate(userID)
+	}
+	return userID, locked, err
+}
+
+func (cs *cachingStore) ClearFailedLogins(ctx context.Context, userID int64) error {
+	defer cs.invalidate(userID)
+	return cs.UserStore.ClearFailedLogins(ctx, userID)
+}
+
+func (cs *cachingStore) DeleteUserByUsername(ctx context.Context, normalizedUsername string) error {
+	user, err := cs.UserStore.GetUserByUsername(ctx, normalizedUsername)
+	if err != nil {
+		return err
+	}
+	defer cs.invalidate(user.ID)
+	return cs.UserStore.DeleteUserByUsername(ctx, normalizedUsername)
+}
+
+func (cs *cachingStore) PurgeScheduledDeletions(ctx context.Context, now time.Time) ([]int64, error) {
+	purged, err := cs.UserStore.PurgeScheduledDeletions(ctx, now)
+	cs.invalidate(purged...)
+	return purged, err
+}
+
+func (cs *cachingStore) PurgeStalePending(ctx context.Context, pendingBefore time.Time) ([]int64, error) {
+	purged, err := cs.UserStore.PurgeStalePending(ctx, pendingBefore)
+	cs.invalidate(purged...)
+	return purged, err
+}
@@ -0,0 +1,117 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+func TestUserCacheInvalidatesPurgedUsers(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		seed  testutil.UserOptions
+		purge func(svc *user.UserService, u, admin *user.User, clock *fakeClock) error
+	}{
+		{
+			name: "scheduled deletion",
+			purge: func(svc *user.UserService, u, admin *user.User, clock *fakeClock) error {
+				if err := svc.ScheduleUserDeletion(ctx, u.ID, admin.ID, time.Hour); err != nil {
+					return err
+				}
+				// Re-cache the user with DeleteAfter set before the purge.
+				if _, err := svc.GetUserByID(ctx, u.ID); err != nil {
+					return err
+				}
+				clock.Advance(2 * time.Hour)
+				_, err := svc.PurgeScheduledDeletions(ctx)
+				return err
+			},
+		},
+		{
+			name: "stale pending",
+			seed: testutil.UserOptions{Pending: true},
+			purge: func(svc *user.UserService, u, admin *user.User, clock *fakeClock) error {
+				clock.Advance(48 * time.Hour)
+				_, err := svc.PurgeStalePending(ctx, 24*time.Hour)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Now()}
+			svc, store := newService(t,
+				user.WithClock(clock.Now),
+				user.WithUserCache(user.NewLRUUserCache(16, time.Hour)))
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+			u := seedUser(t, store, tt.seed)
+
+			if _, err := svc.GetUserByID(ctx, u.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.purge(svc, u, admin, clock); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := svc.GetUserByID(ctx, u.ID); !errors.Is(err, user.ErrUserNotFound) {
+				t.Fatalf("GetUserByID after purge: got %v, want ErrUserNotFound", err)
+			}
+		})
+	}
+}
+
+// racingStore runs onRead once, after a GetUserByID has read from the store
+// but before the result reaches the cache.
+type racingStore struct {
+	*usertest.MemoryUserStore
+	onRead func()
+}
+
+func (r *racingStore) GetUserByID(ctx context.Context, id int64) (*user.User, error) {
+	u, err := r.MemoryUserStore.GetUserByID(ctx, id)
+	if hook := r.onRead; hook != nil {
+		r.onRead = nil
+		hook()
+	}
+	return u, err
+}
+
+func TestUserCacheDropsReadRacingWrite(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{MemoryUserStore: usertest.NewMemoryUserStore()}
+	svc := user.NewUserService(store,
+		user.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		user.WithUserCache(user.NewLRUUserCache(16, time.Hour)))
+	admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	store.onRead = func() {
+		if err := svc.DisableUser(ctx, u.ID, admin.ID); err != nil {
+			t.Error(err)
+		}
+	}
+	stale, err := svc.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Disabled {
+		t.Fatal("racing read already saw the write")
+	}
+
+	got, err := svc.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled {
+		t.Error("cache kept the user read before DisableUser")
+	}
+}
@@ -0,0 +1,164 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+)
+
+var (
+	ErrNoCommandToUndo = errors.New("no command to undo")
+	ErrCommandConflict = errors.New("user changed since the command; refusing to undo")
+)
+
+// CommandAction names an admin mutation kept in the command log.
+type CommandAction string
+
+const (
+	CommandApproveUser      CommandAction = "approve_user"
+	CommandMakeAdmin        CommandAction = "make_admin"
+	CommandRevokeAdmin      CommandAction = "revoke_admin"
+	CommandUpdateUserStatus CommandAction = "update_user_status"
+	CommandSetUserRole      CommandAction = "set_user_role"
+)
+
+// permission is what an admin needs to perform, and so to undo, the action.
+func (a CommandAction) permission() Permission {
+	switch a {
+	case CommandApproveUser:
+		return PermissionApproveUsers
+	case CommandMakeAdmin, CommandRevokeAdmin, CommandSetUserRole:
+		return PermissionManageAdmins
+	default:
+		return PermissionManageUsers
+	}
+}
+
+// CommandSnapshot holds the user fields admin mutations change.
+type CommandSnapshot struct {
+	Role       Role       `json:"role"`
+	Status     string     `json:"status"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	ApprovedBy *int64     `json:"approved_by,omitempty"`
+}
+
+func snapshotOf(u *User) CommandSnapshot {
+	return CommandSnapshot{
+		Role:       u.Role,
+		Status:     u.Status,
+		ApprovedAt: cloneTime(u.ApprovedAt),
+		ApprovedBy: u.ApprovedBy,
+	}
+}
+
+func (cs CommandSnapshot) equal(other CommandSnapshot) bool {
+	timesEqual := func(a, b *time.Time) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return a.Equal(*b)
+	}
+	idsEqual := func(a, b *int64) bool {
+		if a == nil || b == nil {
+			return a == b
+		}
+		return *a == *b
+	}
+	return cs.Role == other.Role &&
+		cs.Status == other.Status &&
+		timesEqual(cs.ApprovedAt, other.ApprovedAt) &&
+		idsEqual(cs.ApprovedBy, other.ApprovedBy)
+}
+
+func (cs CommandSnapshot) applyTo(u *User) {
+	u.Role = cs.Role
+	u.Status = cs.Status
+	u.ApprovedAt = cloneTime(cs.ApprovedAt)
+	u.ApprovedBy = cs.ApprovedBy
+}
+
+// Command is one entry in the command log: an admin mutation with the
+// target's state before and after it.
+type Command struct {
+	ID        int64           `json:"id"`
+	AdminID   int64           `json:"admin_id"`
+	TargetID  int64           `json:"target_id"`
+	Action    CommandAction   `json:"action"`
+	Before    CommandSnapshot `json:"before"`
+	After     CommandSnapshot `json:"after"`
+	CreatedAt time.Time       `json:"created_at"`
+	UndoneAt  *time.Time      `json:"undone_at,omitempty"`
+}
+
+// recordCommand appends an admin mutation to the command log. The mutation
+// has already happened, so a failure is logged rather than returned.
+func (s *UserService) recordCommand(ctx context.Context, adminID int64, action CommandAction, targetID int64, before, after CommandSnapshot) {
+	cmd := &Command{
+		AdminID:  adminID,
+		TargetID: targetID,
+		Action:   action,
+		Before:   before,
+		After:    after,
+	}
+	if err := s.repo.RecordCommand(ctx, cmd); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "command log: record failed",
+			"action", action, "user_id", targetID, "admin_id", adminID, "error", err)
+	}
+}
+
+// UndoLastCommand reverses the admin's most recent command that has not
+// already been undone, restoring the target's prior snapshot. Calling it
+// again steps further back. If the target has changed since the command,
+// it returns ErrCommandConflict and leaves the user alone.
+//
+// Only the snapshot fields are restored: tokens revoked by a demotion stay
+// revoked, and undoing an approval clears the user's sign-offs as
+// UnapproveUser does.
+func (s *UserService) UndoLastCommand(ctx context.Context, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "UndoLastCommand", err, "admin_id", adminID) }()
+
+	cmd, err := s.repo.LastCommand(ctx, adminID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrNoCommandToUndo
+		}
+		return err
+	}
+
+	if err := s.authorize(ctx, adminID, cmd.Action.permission()); err != nil {
+		return err
+	}
+	// Undoing a role change is itself a role change, and needs the same
+	// elevation as MakeAdmin or SetUserRole.
+	if cmd.Before.Role != cmd.After.Role {
+		if err := s.checkElevation(ctx, adminID); err != nil {
+			return err
+		}
+	}
+
+	user, err := s.getUser(ctx, cmd.TargetID)
+	if err != nil {
+		return err
+	}
+	if !snapshotOf(user).equal(cmd.After) {
+		return ErrCommandConflict
+	}
+
+	if cmd.Action == CommandApproveUser && cmd.Before.ApprovedAt == nil {
+		err = s.repo.UnapproveUser(ctx, user.ID)
+	} else {
+		cmd.Before.applyTo(user)
+		// UpdateUser's version check catches changes made since getUser.
+		err = s.repo.UpdateUser(ctx, user)
+	}
+	if err != nil {
+		if errors.Is(err, ErrConcurrentUpdate) {
+			return ErrCommandConflict
+		}
+		return err
+	}
+
+	return s.repo.MarkCommandUndone(ctx, cmd.ID, s.now())
+}
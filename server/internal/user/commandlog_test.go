@@ -0,0 +1,158 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestUndoLastCommand(t *testing.T) {
+	ctx := context.Background()
+
+	type env struct {
+		svc          *user.UserService
+		admin, other *user.User
+		target       *user.User
+	}
+
+	tests := []struct {
+		name    string
+		pending bool
+		act     func(e env) error
+		wantErr error
+		check   func(t *testing.T, got *user.User)
+	}{
+		{
+			name: "make admin",
+			act:  func(e env) error { return e.svc.MakeAdmin(ctx, e.target.ID, e.admin.ID) },
+			check: func(t *testing.T, got *user.User) {
+				if got.IsAdmin() {
+					t.Errorf("role = %q, want the admin grant reversed", got.Role)
+				}
+			},
+		},
+		{
+			name: "revoke admin",
+			act: func(e env) error {
+				if err := e.svc.MakeAdmin(ctx, e.target.ID, e.other.ID); err != nil {
+					return err
+				}
+				return e.svc.RevokeAdmin(ctx, e.target.ID, e.admin.ID)
+			},
+			check: func(t *testing.T, got *user.User) {
+				if !got.IsAdmin() {
+					t.Errorf("role = %q, want admin restored", got.Role)
+				}
+			},
+		},
+		{
+			name:    "approve user",
+			pending: true,
+			act:     func(e env) error { return e.svc.ApproveUser(ctx, e.target.ID, e.admin.ID) },
+			check: func(t *testing.T, got *user.User) {
+				if got.IsApproved() || got.ApprovedBy != nil {
+					t.Errorf("approved_at %v approved_by %v, want the user pending again", got.ApprovedAt, got.ApprovedBy)
+				}
+			},
+		},
+		{
+			name: "update status",
+			act:  func(e env) error { return e.svc.UpdateUserStatus(ctx, e.target.ID, "inactive", e.admin.ID) },
+			check: func(t *testing.T, got *user.User) {
+				if got.Status != "active" {
+					t.Errorf("status = %q, want active", got.Status)
+				}
+			},
+		},
+		{
+			name:    "nothing to undo",
+			act:     func(e env) error { return nil },
+			wantErr: user.ErrNoCommandToUndo,
+		},
+		{
+			name:    "another admin's command",
+			act:     func(e env) error { return e.svc.MakeAdmin(ctx, e.target.ID, e.other.ID) },
+			wantErr: user.ErrNoCommandToUndo,
+		},
+		{
+			name: "changed since",
+			act: func(e env) error {
+				if err := e.svc.MakeAdmin(ctx, e.target.ID, e.admin.ID); err != nil {
+					return err
+				}
+				return e.svc.UpdateUserStatus(ctx, e.target.ID, "inactive", e.other.ID)
+			},
+			wantErr: user.ErrCommandConflict,
+			check: func(t *testing.T, got *user.User) {
+				if !got.IsAdmin() || got.Status != "inactive" {
+					t.Errorf("role %q status %q, want the intervening change kept", got.Role, got.Status)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			e := env{
+				svc:    svc,
+				admin:  seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin}),
+				other:  seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin}),
+				target: seedUser(t, store, testutil.UserOptions{Pending: tt.pending}),
+			}
+			if err := tt.act(e); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.UndoLastCommand(ctx, e.admin.ID); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.check == nil {
+				return
+			}
+			got, err := store.GetUserByID(ctx, e.target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestUndoLastCommandStepsBack(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+	target := seedUser(t, store, testutil.UserOptions{})
+
+	if err := svc.MakeAdmin(ctx, target.ID, admin.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.UpdateUserStatus(ctx, target.ID, "inactive", admin.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		wantErr    error
+		wantAdmin  bool
+		wantStatus string
+	}{
+		{nil, true, "active"},
+		{nil, false, "active"},
+		{user.ErrNoCommandToUndo, false, "active"},
+	}
+	for i, step := range steps {
+		if err := svc.UndoLastCommand(ctx, admin.ID); !errors.Is(err, step.wantErr) {
+			t.Fatalf("undo %d: got %v, want %v", i+1, err, step.wantErr)
+		}
+		got, err := store.GetUserByID(ctx, target.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.IsAdmin() != step.wantAdmin || got.Status != step.wantStatus {
+			t.Errorf("after undo %d: admin %v status %q, want %v %q", i+1, got.IsAdmin(), got.Status, step.wantAdmin, step.wantStatus)
+		}
+	}
+}
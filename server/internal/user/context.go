@@ -0,0 +1,34 @@
+package user
+
+import "context"
+
+type contextKey struct{}
+
+// NewContextWithUser returns a copy of ctx carrying user as the
+// authenticated principal. The password hash is cleared on a copy so it
+// never travels with the request.
+func NewContextWithUser(ctx context.Context, user *User) context.Context {
+	if user != nil {
+		c := *user
+		c.PasswordHash = password{}
+		user = &c
+	}
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// UserFromContext returns the authenticated user stored in ctx, if any.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(contextKey{}).(*User)
+	return user, ok && user != nil
+}
+
+// ContextWithTokenUser resolves the owner of plaintext for scope and returns
+// a copy of ctx carrying them, so handlers can read the principal with
+// UserFromContext instead of validating the token again.
+func (s *UserService) ContextWithTokenUser(ctx context.Context, plaintext, scope string) (context.Context, error) {
+	user, err := s.ResolveUserFromToken(ctx, plaintext, scope)
+	if err != nil {
+		return ctx, err
+	}
+	return NewContextWithUser(ctx, user), nil
+}
@@ -0,0 +1,101 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestUserContext(t *testing.T) {
+	_, store := newService(t)
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		wantOK bool
+	}{
+		{"empty context", context.Background(), false},
+		{"nil user", user.NewContextWithUser(context.Background(), nil), false},
+		{"with user", user.NewContextWithUser(context.Background(), u), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := user.UserFromContext(tt.ctx)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				if got != nil {
+					t.Errorf("got %+v without ok", got)
+				}
+				return
+			}
+			if got.ID != u.ID || got.Username != u.Username {
+				t.Errorf("got user %d %q, want %d %q", got.ID, got.Username, u.ID, u.Username)
+			}
+			if got.PasswordHash.IsSet() {
+				t.Error("password hash travels with the context")
+			}
+			if !u.PasswordHash.IsSet() {
+				t.Error("caller's user lost its password hash")
+			}
+		})
+	}
+}
+
+func TestContextWithTokenUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		noTokens  bool
+		pending   bool
+		scope     string
+		plaintext func(valid string) string
+		wantErr   error
+	}{
+		{name: "valid token", scope: token.ScopeAuth},
+		{name: "wrong scope", scope: token.ScopeDeploy, wantErr: token.ErrTokenNotFound},
+		{name: "unknown scope", scope: "bogus", wantErr: token.ErrTokenNotFound},
+		{name: "unknown token", scope: token.ScopeAuth, plaintext: func(string) string { return "not-a-token" }, wantErr: token.ErrTokenNotFound},
+		{name: "unapproved owner", scope: token.ScopeAuth, pending: true, wantErr: user.ErrUserNotApproved},
+		{name: "no token manager", scope: token.ScopeAuth, noTokens: true, wantErr: user.ErrTokensNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			var opts []user.Option
+			if !tt.noTokens {
+				opts = append(opts, user.WithTokenManager(tokens))
+			}
+			svc, store := newService(t, opts...)
+			u := seedUser(t, store, testutil.UserOptions{Pending: tt.pending})
+
+			auth, err := tokens.CreateAuthToken(ctx, int(u.ID), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext := auth.PlainText
+			if tt.plaintext != nil {
+				plaintext = tt.plaintext(plaintext)
+			}
+
+			got, err := svc.ContextWithTokenUser(ctx, plaintext, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			principal, ok := user.UserFromContext(got)
+			if ok != (err == nil) {
+				t.Fatalf("user attached = %v with error %v", ok, err)
+			}
+			if ok && (principal.ID != u.ID || principal.PasswordHash.IsSet()) {
+				t.Errorf("attached user %d with hash set %v, want %d without hash", principal.ID, principal.PasswordHash.IsSet(), u.ID)
+			}
+		})
+	}
+}
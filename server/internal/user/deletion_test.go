@@ -0,0 +1,193 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+func TestCancelUserDeletion(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		actor   func(self, admin, other *user.User) int64
+		wantErr error
+	}{
+		{"self", func(self, admin, other *user.User) int64 { return self.ID }, nil},
+		{"admin", func(self, admin, other *user.User) int64 { return admin.ID }, nil},
+		{"other user", func(self, admin, other *user.User) int64 { return other.ID }, user.ErrUnauthorized},
+		{"unknown actor", func(self, admin, other *user.User) int64 { return 9999 }, user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+			self := seedUser(t, store, testutil.UserOptions{})
+			other := seedUser(t, store, testutil.UserOptions{})
+
+			if err := svc.ScheduleUserDeletion(ctx, self.ID, admin.ID, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+
+			err := svc.CancelUserDeletion(ctx, self.ID, tt.actor(self, admin, other))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			stored, err := store.GetUserByID(ctx, self.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pending := stored.DeleteAfter != nil; pending != (tt.wantErr != nil) {
+				t.Errorf("DeleteAfter = %v after cancel with error %v", stored.DeleteAfter, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeleteOwnAccount(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		wantErr     error
+		wantDeleted bool
+	}{
+		{name: "right password", password: testutil.DefaultPassword, wantDeleted: true},
+		{name: "username in other case", username: "ALICE", password: testutil.DefaultPassword, wantDeleted: true},
+		{name: "wrong password", password: "Wrong-password1", wantErr: user.ErrUnauthorized},
+		{name: "empty password", password: "", wantErr: user.ErrUnauthorized},
+		{name: "unknown user", username: "nobody", password: testutil.DefaultPassword, wantErr: user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			alice := seedUser(t, store, testutil.UserOptions{Username: "alice"})
+			deploy, err := tokens.CreateDeployToken(ctx, alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			username := tt.username
+			if username == "" {
+				username = alice.Username
+			}
+			if err := svc.DeleteOwnAccount(ctx, username, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			_, err = store.GetUserByID(ctx, alice.ID)
+			if deleted := errors.Is(err, user.ErrNotFound); deleted != tt.wantDeleted {
+				t.Fatalf("deleted = %v, want %v (lookup error %v)", deleted, tt.wantDeleted, err)
+			}
+			_, err = tokens.ValidateToken(ctx, deploy.PlainText, token.ScopeDeploy)
+			if revoked := errors.Is(err, token.ErrTokenNotFound); revoked != tt.wantDeleted {
+				t.Errorf("deploy token revoked = %v, want %v", revoked, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestScheduleUserDeletionRevokesTokens(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		scope  string
+		create func(tokens *token.TokenService, userID int64) (*token.Token, error)
+	}{
+		{token.ScopeAuth, func(tokens *token.TokenService, userID int64) (*token.Token, error) {
+			return tokens.CreateAuthToken(ctx, int(userID), 0)
+		}},
+		{token.ScopeRefresh, func(tokens *token.TokenService, userID int64) (*token.Token, error) {
+			_, refresh, err := tokens.CreateAuthTokenWithRefresh(ctx, userID)
+			return refresh, err
+		}},
+		{token.ScopeDeploy, func(tokens *token.TokenService, userID int64) (*token.Token, error) {
+			return tokens.CreateDeployToken(ctx, userID)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+			doomed := seedUser(t, store, testutil.UserOptions{})
+			tok, err := tt.create(tokens, doomed.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.ScheduleUserDeletion(ctx, doomed.ID, admin.ID, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tokens.ValidateToken(ctx, tok.PlainText, tt.scope); !errors.Is(err, token.ErrTokenNotFound) {
+				t.Errorf("%s token after scheduling deletion: got %v, want ErrTokenNotFound", tt.scope, err)
+			}
+		})
+	}
+}
+
+func TestPurgesRemoveTokens(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// doom prepares u so that purge removes it.
+		doom  func(t *testing.T, store *usertest.MemoryUserStore, u *user.User)
+		purge func(svc *user.UserService) (int, error)
+	}{
+		{
+			name: "scheduled deletion",
+			doom: func(t *testing.T, store *usertest.MemoryUserStore, u *user.User) {
+				past := time.Now().Add(-time.Minute)
+				u.DeleteAfter = &past
+				if err := store.UpdateUser(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+			},
+			purge: func(svc *user.UserService) (int, error) { return svc.PurgeScheduledDeletions(ctx) },
+		},
+		{
+			name: "stale pending",
+			doom: func(t *testing.T, store *usertest.MemoryUserStore, u *user.User) {
+				if err := store.UnapproveUser(ctx, u.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			purge: func(svc *user.UserService) (int, error) { return svc.PurgeStalePending(ctx, time.Hour) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var now time.Time
+			svc, store := newService(t, user.WithClock(func() time.Time { return now }))
+			doomed := seedUser(t, store, testutil.UserOptions{})
+			survivor := seedUser(t, store, testutil.UserOptions{})
+			tt.doom(t, store, doomed)
+			for _, u := range []*user.User{doomed, survivor} {
+				store.AddToken("token-of-"+u.Username, token.ScopeDeploy, u.ID, time.Now().Add(time.Hour))
+			}
+			now = time.Now().Add(2 * time.Hour)
+
+			if purged, err := tt.purge(svc); err != nil || purged != 1 {
+				t.Fatalf("purged %d, %v; want 1, nil", purged, err)
+			}
+			if n := store.TokenCount(doomed.ID); n != 0 {
+				t.Errorf("purged user kept %d tokens", n)
+			}
+			if n := store.TokenCount(survivor.ID); n != 1 {
+				t.Errorf("surviving user has %d tokens, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var ErrNotDuplicates = errors.New("users do not share a normalized username")
+
+// FindDuplicateUsernames groups users whose usernames normalize to the same
+// value, such as "Bob" and "bob" created before usernames were
+// case-insensitive. Groups are ordered by normalized username and users
+// within a group by ID, oldest first. It scans every user, so run it as an
+// occasional admin task.
+func (s *UserService) FindDuplicateUsernames(ctx context.Context) ([][]*User, error) {
+	byName := make(map[string][]*User)
+	// Walk by ID rather than ListUsers, which skips users scheduled for
+	// deletion; they can still collide with a live username.
+	var afterID int64
+	for {
+		users, err := s.repo.ListUsersAfterID(ctx, afterID, HardMaxListLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			// Normalize again rather than trusting the stored column, which
+			// older rows may have filled in differently.
+			name := s.normalizeUsername(u.Username)
+			byName[name] = append(byName[name], u)
+		}
+		if len(users) < HardMaxListLimit {
+			break
+		}
+		afterID = users[len(users)-1].ID
+	}
+
+	names := make([]string, 0)
+	for name, users := range byName {
+		if len(users) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	groups := make([][]*User, 0, len(names))
+	for _, name := range names {
+		users := byName[name]
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		groups = append(groups, users)
+	}
+	return groups, nil
+}
+
+// MergeUsers folds the duplicate account mergeID into keepID: mergeID's
+// tokens, email addresses, identities, granted approvals and command history
+// are reassigned to keepID and mergeID is deleted, in one transaction. The
+// two must share a normalized username.
+func (s *UserService) MergeUsers(ctx context.Context, keepID, mergeID int64) (err error) {
+	var moved int
+	defer func() {
+		s.logOp(ctx, "MergeUsers", err, "keep_id", keepID, "merge_id", mergeID, "tokens_moved", moved)
+	}()
+
+	if keepID == mergeID {
+		return ErrNotDuplicates
+	}
+
+	keep, err := s.getUser(ctx, keepID)
+	if err != nil {
+		return err
+	}
+	merge, err := s.getUser(ctx, mergeID)
+	if err != nil {
+		return err
+	}
+	if s.normalizeUsername(keep.Username) != s.normalizeUsername(merge.Username) {
+		return ErrNotDuplicates
+	}
+
+	moved, _, err = s.repo.MergeUsers(ctx, keepID, mergeID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	return nil
+}
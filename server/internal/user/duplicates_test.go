@@ -0,0 +1,146 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+// keepCase stores usernames as given, so a pre-normalization duplicate such
+// as "Bob" can be seeded next to "bob".
+func keepCase(s string) string { return s }
+
+func TestMergeUsers(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name             string
+		keepHasPrimary   bool
+		wantMovedPrimary bool
+	}{
+		{"keep has no email", false, true},
+		{"keep has a primary email", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithUserCache(user.NewLRUUserCache(100, time.Hour)))
+			keep := seedUser(t, store, testutil.UserOptions{Username: "bob", Role: user.RoleSuperAdmin})
+			merge := seedUser(t, store, testutil.UserOptions{Username: "Bob", Role: user.RoleSuperAdmin, Normalizer: keepCase})
+			approved := seedUser(t, store, testutil.UserOptions{Pending: true})
+
+			if err := svc.ApproveUser(ctx, approved.ID, merge.ID); err != nil {
+				t.Fatal(err)
+			}
+			if tt.keepHasPrimary {
+				if err := store.AddEmail(ctx, keep.ID, "bob@example.com"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.AddEmail(ctx, merge.ID, "bob@example.org"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.AddPasswordHistory(ctx, merge.ID, []byte("old-hash")); err != nil {
+				t.Fatal(err)
+			}
+			store.AddToken("merge-session", "auth", merge.ID, time.Now().Add(time.Hour))
+			if err := store.ChangeUsername(ctx, merge.ID, "BOB", "BOB"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Prime the cache so a missed invalidation would show.
+			if _, err := svc.GetUserByID(ctx, approved.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.MergeUsers(ctx, keep.ID, merge.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := svc.GetUserByID(ctx, merge.ID); !errors.Is(err, user.ErrUserNotFound) {
+				t.Errorf("merged user lookup: got %v, want ErrUserNotFound", err)
+			}
+
+			got, err := svc.GetUserByID(ctx, approved.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ApprovedBy == nil || *got.ApprovedBy != keep.ID {
+				t.Errorf("ApprovedBy = %v, want %d", got.ApprovedBy, keep.ID)
+			}
+
+			owner, err := store.GetUserToken(ctx, "auth", "merge-session")
+			if err != nil || owner.ID != keep.ID {
+				t.Errorf("token owner = %v, %v; want user %d", owner, err, keep.ID)
+			}
+
+			emails, err := store.ListEmails(ctx, keep.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var moved *user.Email
+			for i := range emails {
+				if emails[i].Address == "bob@example.org" {
+					moved = &emails[i]
+				}
+			}
+			if moved == nil {
+				t.Fatalf("merged address not moved to keep: %+v", emails)
+			}
+			if moved.Primary != tt.wantMovedPrimary {
+				t.Errorf("moved address primary = %v, want %v", moved.Primary, tt.wantMovedPrimary)
+			}
+
+			history, err := store.ListPasswordHistory(ctx, merge.ID, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 0 {
+				t.Errorf("merged user still has %d password history entries", len(history))
+			}
+
+			if names := store.UsernameHistory(keep.ID); !slices.Contains(names, "Bob") {
+				t.Errorf("keep's username history = %v, want the merged user's entry", names)
+			}
+			if names := store.UsernameHistory(merge.ID); len(names) != 0 {
+				t.Errorf("merged user still has username history %v", names)
+			}
+
+			cmd, err := store.LastCommand(ctx, keep.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.TargetID != approved.ID || cmd.Action != user.CommandApproveUser {
+				t.Errorf("keep's last command = %+v, want the approval merge issued", cmd)
+			}
+		})
+	}
+}
+
+func TestMergeUsersRejectsNonDuplicates(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	a := seedUser(t, store, testutil.UserOptions{Username: "alice"})
+	b := seedUser(t, store, testutil.UserOptions{Username: "bob"})
+
+	tests := []struct {
+		name        string
+		keep, merge int64
+		wantErr     error
+	}{
+		{"different names", a.ID, b.ID, user.ErrNotDuplicates},
+		{"same user", a.ID, a.ID, user.ErrNotDuplicates},
+		{"missing user", a.ID, 9999, user.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := svc.MergeUsers(ctx, tt.keep, tt.merge); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package user
+
+import (
+	"context"
+	"errors"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+var ErrElevationRequired = errors.New("elevated privileges required; re-enter your password")
+
+type elevationKey struct{}
+
+// NewContextWithElevation returns a copy of ctx carrying an elevated token's
+// plaintext for the sensitive admin operations guarded by
+// WithRequireElevation.
+func NewContextWithElevation(ctx context.Context, plaintext string) context.Context {
+	return context.WithValue(ctx, elevationKey{}, plaintext)
+}
+
+func elevationFromContext(ctx context.Context) string {
+	plaintext, _ := ctx.Value(elevationKey{}).(string)
+	return plaintext
+}
+
+// ElevatePrivileges re-authenticates the user with their password and
+// returns a short-lived elevated token, opening a "sudo" window for
+// sensitive admin operations. The token's plaintext goes in the request
+// context with NewContextWithElevation. Wrong passwords count towards the
+// same lockout as failed logins.
+func (s *UserService) ElevatePrivileges(ctx context.Context, userID int64, password string) (_ *token.Token, err error) {
+	defer func() { s.logOp(ctx, "ElevatePrivileges", err, "user_id", userID) }()
+
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+
+	// As in verifyCredentials, locked and suspended accounts are refused
+	// before the password is compared.
+	now := s.now()
+	if user.IsLocked(now) {
+		s.compareDummyHash(password)
+		return nil, ErrAccountLocked
+	}
+	if user.IsSuspended(now) {
+		s.compareDummyHash(password)
+		return nil, ErrUserSuspended
+	}
+
+	ok, err := user.PasswordHash.Matches(password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		s.registerFailedLogin(ctx, user.Username)
+		return nil, ErrInvalidCredentials
+	}
+	s.clearFailedLogins(ctx, user)
+
+	return s.tokens.CreateElevatedToken(ctx, userID)
+}
+
+// checkElevation requires, when WithRequireElevation is on, that ctx carry
+// a live elevated token belonging to actorID. It complements authorize,
+// which must still be called.
+func (s *UserService) checkElevation(ctx context.Context, actorID int64) error {
+	if !s.elevationRequired {
+		return nil
+	}
+	if s.tokens == nil {
+		return ErrTokensNotConfigured
+	}
+
+	plaintext := elevationFromContext(ctx)
+	if plaintext == "" {
+		return ErrElevationRequired
+	}
+
+	tok, err := s.tokens.ValidateToken(ctx, plaintext, token.ScopeElevated)
+	switch {
+	case errors.Is(err, token.ErrTokenNotFound), errors.Is(err, token.ErrTokenExpired), errors.Is(err, token.ErrInvalidScope):
+		return ErrElevationRequired
+	case err != nil:
+		return err
+	}
+	if int64(tok.UserID) != actorID {
+		return ErrElevationRequired
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestUndoLastCommandElevation(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		act      func(ctx context.Context, svc *user.UserService, targetID, adminID int64) error
+		elevated bool
+		wantErr  error
+	}{
+		{"role change without elevation", func(ctx context.Context, svc *user.UserService, targetID, adminID int64) error {
+			return svc.MakeAdmin(ctx, targetID, adminID)
+		}, false, user.ErrElevationRequired},
+		{"role change with elevation", func(ctx context.Context, svc *user.UserService, targetID, adminID int64) error {
+			return svc.MakeAdmin(ctx, targetID, adminID)
+		}, true, nil},
+		{"status change without elevation", func(ctx context.Context, svc *user.UserService, targetID, adminID int64) error {
+			return svc.UpdateUserStatus(ctx, targetID, "inactive", adminID)
+		}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithTokenManager(newTokenService(t)), user.WithRequireElevation(true))
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+			target := seedUser(t, store, testutil.UserOptions{})
+
+			tok, err := svc.ElevatePrivileges(ctx, admin.ID, testutil.DefaultPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			elevatedCtx := user.NewContextWithElevation(ctx, tok.PlainText)
+			if err := tt.act(elevatedCtx, svc, target.ID, admin.ID); err != nil {
+				t.Fatal(err)
+			}
+			changed, err := store.GetUserByID(ctx, target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			undoCtx := ctx
+			if tt.elevated {
+				undoCtx = elevatedCtx
+			}
+			if err := svc.UndoLastCommand(undoCtx, admin.ID); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := store.GetUserByID(ctx, target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := target
+			if tt.wantErr != nil {
+				want = changed
+			}
+			if got.Role != want.Role || got.Status != want.Status {
+				t.Errorf("after undo role %q status %q, want %q %q", got.Role, got.Status, want.Role, want.Status)
+			}
+		})
+	}
+}
+
+func TestElevatePrivilegesLockout(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t,
+		user.WithTokenManager(newTokenService(t)),
+		user.WithLockout(2, time.Hour),
+	)
+	admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+
+	tests := []struct {
+		password string
+		wantErr  error
+	}{
+		{"wrong-password", user.ErrInvalidCredentials},
+		{"wrong-password", user.ErrInvalidCredentials},
+		{testutil.DefaultPassword, user.ErrAccountLocked},
+	}
+	for i, tt := range tests {
+		if _, err := svc.ElevatePrivileges(ctx, admin.ID, tt.password); !errors.Is(err, tt.wantErr) {
+			t.Fatalf("attempt %d: got %v, want %v", i+1, err, tt.wantErr)
+		}
+	}
+
+	if _, err := svc.AuthenticateUser(ctx, admin.Username, testutil.DefaultPassword); !errors.Is(err, user.ErrAccountLocked) {
+		t.Fatalf("login after elevation lockout: got %v, want ErrAccountLocked", err)
+	}
+}
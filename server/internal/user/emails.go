@@ -0,0 +1,221 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+var (
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrEmailTaken         = errors.New("email address already in use")
+	ErrEmailNotFound      = errors.New("email address not found")
+	ErrLastEmail          = errors.New("cannot remove the only email address")
+	ErrRemovePrimaryEmail = errors.New("cannot remove the primary email address; make another one primary first")
+)
+
+// Email is one of a user's addresses. Exactly one of a user's addresses is
+// primary.
+type Email struct {
+	Address    string     `json:"address"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	Primary    bool       `json:"primary"`
+}
+
+// PrimaryEmail returns the user's primary address, or "" if the user has
+// none or their emails were not loaded (see GetUserWithEmails).
+func (u *User) PrimaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Address
+		}
+	}
+	return ""
+}
+
+func normalizeEmail(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(address), nil
+}
+
+// GetUserWithEmails is GetUserByID with the user's email addresses loaded.
+func (s *UserService) GetUserWithEmails(ctx context.Context, userID int64) (*User, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user.Emails, err = s.repo.ListEmails(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = password{}
+	return user, nil
+}
+
+// AddEmail adds an unverified address to the user. The user's first
+// address becomes their primary one.
+func (s *UserService) AddEmail(ctx context.Context, userID int64, address string) (err error) {
+	defer func() { s.logOp(ctx, "AddEmail", err, "user_id", userID) }()
+
+	address, err = normalizeEmail(address)
+	if err != nil {
+		return err
+	}
+	if _, err := s.getUser(ctx, userID); err != nil {
+		return err
+	}
+
+	err = s.repo.AddEmail(ctx, userID, address)
+	if errors.Is(err, ErrNotFound) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// IssueEmailAddressVerificationToken creates a token proving control of one
+// of the user's addresses. Delivering it to that address is up to the
+// caller; VerifyEmailAddress consumes it.
+func (s *UserService) IssueEmailAddressVerificationToken(ctx context.Context, userID int64, address string) (*token.Token, error) {
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	email, err := s.findEmail(ctx, userID, address)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokens.CreateEmailAddressVerificationToken(ctx, userID, email.Address)
+}
+
+// VerifyEmailAddress marks the address a token from
+// IssueEmailAddressVerificationToken was issued for as verified. The token
+// is single-use. Verifying the primary address also marks the user's email
+// verified.
+func (s *UserService) VerifyEmailAddress(ctx context.Context, plaintext string) (err error) {
+	var userID int64
+	defer func() { s.logOp(ctx, "VerifyEmailAddress", err, "user_id", userID) }()
+
+	if s.tokens == nil {
+		return ErrTokensNotConfigured
+	}
+
+	tok, err := s.tokens.ValidateToken(ctx, plaintext, token.ScopeEmailAddressVerify)
+	if err != nil {
+		if errors.Is(err, token.ErrInvalidScope) {
+			return token.ErrTokenNotFound
+		}
+		return err
+	}
+	userID = int64(tok.UserID)
+
+	// The address may have been removed, or moved to another user and back,
+	// since the token was issued; it must still belong to the token's owner.
+	email, err := s.findEmail(ctx, userID, tok.Resource)
+	if err != nil {
+		return err
+	}
+
+	if email.VerifiedAt == nil {
+		now := s.now()
+		if err := s.repo.MarkEmailVerified(ctx, userID, email.Address, now); err != nil {
+			return err
+		}
+		if email.Primary {
+			if err := s.syncEmailVerified(ctx, userID, &now); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.tokens.RevokeToken(ctx, tok.Hash); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "failed to revoke email address verification token", "user_id", userID, "error", err)
+	}
+	return nil
+}
+
+// SetPrimaryEmail makes a verified address the user's primary one.
+func (s *UserService) SetPrimaryEmail(ctx context.Context, userID int64, address string) (err error) {
+	defer func() { s.logOp(ctx, "SetPrimaryEmail", err, "user_id", userID) }()
+
+	email, err := s.findEmail(ctx, userID, address)
+	if err != nil {
+		return err
+	}
+	if email.Primary {
+		return nil
+	}
+	if email.VerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+
+	if err := s.repo.SetPrimaryEmail(ctx, userID, email.Address); err != nil {
+		return err
+	}
+	return s.syncEmailVerified(ctx, userID, email.VerifiedAt)
+}
+
+// RemoveEmail removes one of the user's addresses. The primary address and
+// a user's only address cannot be removed.
+func (s *UserService) RemoveEmail(ctx context.Context, userID int64, address string) (err error) {
+	defer func() { s.logOp(ctx, "RemoveEmail", err, "user_id", userID) }()
+
+	address, err = normalizeEmail(address)
+	if err != nil {
+		return err
+	}
+	emails, err := s.repo.ListEmails(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		if email.Address != address {
+			continue
+		}
+		if len(emails) == 1 {
+			return ErrLastEmail
+		}
+		if email.Primary {
+			return ErrRemovePrimaryEmail
+		}
+		return s.repo.RemoveEmail(ctx, userID, address)
+	}
+	return ErrEmailNotFound
+}
+
+func (s *UserService) findEmail(ctx context.Context, userID int64, address string) (*Email, error) {
+	address, err := normalizeEmail(address)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := s.repo.ListEmails(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range emails {
+		if emails[i].Address == address {
+			return &emails[i], nil
+		}
+	}
+	return nil, ErrEmailNotFound
+}
+
+// syncEmailVerified keeps User.EmailVerifiedAt, which approval checks, in
+// step with the verification of the primary address.
+func (s *UserService) syncEmailVerified(ctx context.Context, userID int64, verifiedAt *time.Time) error {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = verifiedAt
+	return s.repo.UpdateUser(ctx, user)
+}
@@ -0,0 +1,160 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestVerifyEmailAddress(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// run issues and consumes tokens for u and returns VerifyEmailAddress's
+		// error for the token under test.
+		run          func(t *testing.T, svc *user.UserService, u *user.User) error
+		wantErr      error
+		wantVerified map[string]bool
+	}{
+		{
+			name: "valid token verifies its address",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				tok := issueAddressToken(t, svc, u.ID, "second@example.com")
+				return svc.VerifyEmailAddress(ctx, tok.PlainText)
+			},
+			wantVerified: map[string]bool{"first@example.com": false, "second@example.com": true},
+		},
+		{
+			name: "token is single-use",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				tok := issueAddressToken(t, svc, u.ID, "second@example.com")
+				if err := svc.VerifyEmailAddress(ctx, tok.PlainText); err != nil {
+					t.Fatal(err)
+				}
+				return svc.VerifyEmailAddress(ctx, tok.PlainText)
+			},
+			wantErr:      token.ErrTokenNotFound,
+			wantVerified: map[string]bool{"first@example.com": false, "second@example.com": true},
+		},
+		{
+			name: "account verification token is refused",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				tok, err := svc.IssueEmailVerificationToken(ctx, u.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return svc.VerifyEmailAddress(ctx, tok.PlainText)
+			},
+			wantErr:      token.ErrTokenNotFound,
+			wantVerified: map[string]bool{"first@example.com": false, "second@example.com": false},
+		},
+		{
+			name: "removed address",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				tok := issueAddressToken(t, svc, u.ID, "second@example.com")
+				if err := svc.RemoveEmail(ctx, u.ID, "second@example.com"); err != nil {
+					t.Fatal(err)
+				}
+				return svc.VerifyEmailAddress(ctx, tok.PlainText)
+			},
+			wantErr:      user.ErrEmailNotFound,
+			wantVerified: map[string]bool{"first@example.com": false},
+		},
+		{
+			name: "unknown token",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				return svc.VerifyEmailAddress(ctx, "not-a-token")
+			},
+			wantErr:      token.ErrTokenNotFound,
+			wantVerified: map[string]bool{"first@example.com": false, "second@example.com": false},
+		},
+		{
+			name: "primary address verifies the account",
+			run: func(t *testing.T, svc *user.UserService, u *user.User) error {
+				tok := issueAddressToken(t, svc, u.ID, "first@example.com")
+				return svc.VerifyEmailAddress(ctx, tok.PlainText)
+			},
+			wantVerified: map[string]bool{"first@example.com": true, "second@example.com": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithTokenManager(newTokenService(t)))
+			u := seedUser(t, store, testutil.UserOptions{})
+			for _, address := range []string{"first@example.com", "second@example.com"} {
+				if err := svc.AddEmail(ctx, u.ID, address); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := tt.run(t, svc, u); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := svc.GetUserWithEmails(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Emails) != len(tt.wantVerified) {
+				t.Fatalf("got %d addresses, want %d", len(got.Emails), len(tt.wantVerified))
+			}
+			for _, email := range got.Emails {
+				if verified := email.VerifiedAt != nil; verified != tt.wantVerified[email.Address] {
+					t.Errorf("%s verified = %v, want %v", email.Address, verified, tt.wantVerified[email.Address])
+				}
+				if email.Primary && (got.EmailVerifiedAt != nil) != (email.VerifiedAt != nil) {
+					t.Errorf("EmailVerifiedAt = %v out of step with primary address", got.EmailVerifiedAt)
+				}
+			}
+		})
+	}
+}
+
+func issueAddressToken(t *testing.T, svc *user.UserService, userID int64, address string) *token.Token {
+	t.Helper()
+	tok, err := svc.IssueEmailAddressVerificationToken(context.Background(), userID, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestAddEmailSinglePrimary(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := svc.AddEmail(ctx, u.ID, fmt.Sprintf("user%d@example.com", i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := svc.GetUserWithEmails(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaries := 0
+	for _, email := range got.Emails {
+		if email.Primary {
+			primaries++
+		}
+	}
+	if len(got.Emails) != n || primaries != 1 {
+		t.Fatalf("got %d addresses with %d primary, want %d with 1", len(got.Emails), primaries, n)
+	}
+}
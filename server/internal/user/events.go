@@ -0,0 +1,20 @@
+package user
+
+import "context"
+
+// UserEvents receives notifications about user lifecycle changes. Errors
+// returned by a subscriber are logged and never fail the operation.
+type UserEvents interface {
+	OnUserCreated(ctx context.Context, user *User) error
+	OnUserApproved(ctx context.Context, user *User) error
+}
+
+type NoopUserEvents struct{}
+
+func (NoopUserEvents) OnUserCreated(ctx context.Context, user *User) error {
+	return nil
+}
+
+func (NoopUserEvents) OnUserApproved(ctx context.Context, user *User) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/securityevents"
+	"github.com/samokw/zdeploy/server/internal/securityevents/securityeventstest"
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+// recordingEvents records the usernames it is notified about, failing every
+// notification with err.
+type recordingEvents struct {
+	err      error
+	created  []string
+	approved []string
+}
+
+func (e *recordingEvents) OnUserCreated(ctx context.Context, u *user.User) error {
+	e.created = append(e.created, u.Username)
+	return e.err
+}
+
+func (e *recordingEvents) OnUserApproved(ctx context.Context, u *user.User) error {
+	e.approved = append(e.approved, u.Username)
+	return e.err
+}
+
+func TestUserEvents(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		username     string
+		subscriber   error
+		wantErr      error
+		wantCreated  []string
+		wantApproved []string
+	}{
+		{"registered and approved", "newcomer", nil, nil, []string{"newcomer"}, []string{"newcomer"}},
+		{"failing subscriber", "newcomer", errors.New("queue down"), nil, []string{"newcomer"}, []string{"newcomer"}},
+		{"rejected registration", "x", nil, user.ErrInvalidUsername, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &recordingEvents{err: tt.subscriber}
+			svc, store := newService(t, user.WithUserEvents(events))
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+
+			u, err := svc.CreateUser(ctx, tt.username, testutil.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateUser: got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := svc.ApproveUser(ctx, u.ID, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !slices.Equal(events.created, tt.wantCreated) {
+				t.Errorf("created = %v, want %v", events.created, tt.wantCreated)
+			}
+			if !slices.Equal(events.approved, tt.wantApproved) {
+				t.Errorf("approved = %v, want %v", events.approved, tt.wantApproved)
+			}
+		})
+	}
+}
+
+// failingRecorder rejects every security event.
+type failingRecorder struct{}
+
+func (failingRecorder) Record(context.Context, securityevents.Event) error {
+	return errors.New("events table unavailable")
+}
+
+func TestSecurityEvents(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		action func(svc *user.UserService, u *user.User) error
+		want   []securityevents.Type
+	}{
+		{
+			name: "login success",
+			action: func(svc *user.UserService, u *user.User) error {
+				_, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword)
+				return err
+			},
+			want: []securityevents.Type{securityevents.LoginSucceeded},
+		},
+		{
+			name: "login failure",
+			action: func(svc *user.UserService, u *user.User) error {
+				if _, err := svc.AuthenticateUser(ctx, u.Username, "Wrong-password1"); !errors.Is(err, user.ErrInvalidCredentials) {
+					return fmt.Errorf("got %v, want ErrInvalidCredentials", err)
+				}
+				return nil
+			},
+			want: []securityevents.Type{securityevents.LoginFailed},
+		},
+		{
+			name: "password change",
+			action: func(svc *user.UserService, u *user.User) error {
+				return svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, "Brand-new-pass9")
+			},
+			want: []securityevents.Type{securityevents.PasswordChanged},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := securityeventstest.NewMemoryRecorder()
+			svc, store := newService(t, user.WithSecurityEvents(recorder))
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			if err := tt.action(svc, u); err != nil {
+				t.Fatal(err)
+			}
+
+			events, err := recorder.ListSecurityEvents(ctx, u.ID, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []securityevents.Type
+			for _, e := range events {
+				got = append(got, e.Type)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("recorded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityEventsNeverBlock(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t, user.WithSecurityEvents(failingRecorder{}))
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	if _, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword); err != nil {
+		t.Errorf("login: %v", err)
+	}
+	if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, "Brand-new-pass9"); err != nil {
+		t.Errorf("password change: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package user
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+)
+
+// exportedUser is one line of an ExportUsers stream. PasswordHash is
+// base64-encoded by encoding/json. Approver IDs are instance-specific and
+// are not exported.
+type exportedUser struct {
+	Username           string     `json:"username"`
+	PasswordHash       []byte     `json:"password_hash"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ApprovedAt         *time.Time `json:"approved_at,omitempty"`
+	Role               Role       `json:"role"`
+	Status             string     `json:"status"`
+	MustChangePassword bool       `json:"must_change_password"`
+	PasswordChangedAt  time.Time  `json:"password_changed_at"`
+	Disabled           bool       `json:"disabled"`
+	EmailVerifiedAt    *time.Time `json:"email_verified_at,omitempty"`
+	Phone              *string    `json:"phone,omitempty"`
+	Identities         []Identity `json:"identities,omitempty"`
+}
+
+const exportPageSize = 100
+
+// ExportUsers writes every user as newline-delimited JSON, including the
+// password hash and linked identities so the accounts keep working after
+// ImportUsers. Users are paged by ID, so users created or deleted during the
+// export cannot shift a page and cause others to be skipped or repeated.
+func (s *UserService) ExportUsers(ctx context.Context, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	var afterID int64
+	for {
+		users, err := s.repo.ListUsersAfterID(ctx, afterID, exportPageSize)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]int64, len(users))
+		for i, user := range users {
+			ids[i] = user.ID
+		}
+		identities, err := s.repo.ListIdentities(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			record := exportedUser{
+				Username:           user.Username,
+				PasswordHash:       user.PasswordHash.hash,
+				CreatedAt:          user.CreatedAt,
+				ApprovedAt:         user.ApprovedAt,
+				Role:               user.Role,
+				Status:             user.Status,
+				MustChangePassword: user.MustChangePassword,
+				PasswordChangedAt:  user.PasswordChangedAt,
+				Disabled:           user.Disabled,
+				EmailVerifiedAt:    user.EmailVerifiedAt,
+				Phone:              user.Phone,
+				Identities:         identities[user.ID],
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+
+		if len(users) < exportPageSize {
+			return nil
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
+
+// ImportUsers reads a stream produced by ExportUsers. Users whose username
+// already exists, or one of whose identities is already linked, are skipped
+// and logged rather than aborting the import. A user without a password
+// hash is only accepted with at least one identity to sign in through.
+func (s *UserService) ImportUsers(ctx context.Context, r io.Reader) (int, error) {
+	imported := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record exportedUser
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(record.PasswordHash) == 0 && len(record.Identities) == 0 {
+			return imported, fmt.Errorf("line %d: missing password hash", line)
+		}
+		for _, identity := range record.Identities {
+			if identity.Provider == "" || identity.Subject == "" {
+				return imported, fmt.Errorf("line %d: %w", line, ErrInvalidIdentity)
+			}
+		}
+
+		normalized := s.normalizeUsername(record.Username)
+		taken, err := s.usernameTaken(ctx, normalized)
+		if err != nil {
+			return imported, err
+		}
+		if taken {
+			requestid.Logger(ctx, s.logger).InfoContext(ctx, "user import: skipping existing user",
+				"username", record.Username, "line", line)
+			continue
+		}
+
+		user := &User{
+			Username:           record.Username,
+			NormalizedUsername: normalized,
+			PasswordHash:       password{hash: record.PasswordHash},
+			ApprovedAt:         record.ApprovedAt,
+			Role:               record.Role,
+			Status:             record.Status,
+			MustChangePassword: record.MustChangePassword,
+			PasswordChangedAt:  record.PasswordChangedAt,
+			Disabled:           record.Disabled,
+			EmailVerifiedAt:    record.EmailVerifiedAt,
+			Phone:              record.Phone,
+		}
+		if user.PasswordHash.hash == nil {
+			// An empty, non-nil hash is stored as "no password" rather
+			// than NULL, as for GetOrCreateFederatedUser.
+			user.PasswordHash.hash = []byte{}
+		}
+
+		err = s.repo.CreateUserWithIdentities(ctx, user, record.Identities)
+		if errors.Is(err, ErrIdentityExists) {
+			requestid.Logger(ctx, s.logger).InfoContext(ctx, "user import: skipping user with an already linked identity",
+				"username", record.Username, "line", line)
+			continue
+		}
+		if err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+		imported++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+
+	return imported, nil
+}
@@ -0,0 +1,112 @@
+package user_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	src, srcStore := newService(t)
+	// More than one export page, so paging is exercised.
+	const passwordUsers = 130
+	for i := 0; i < passwordUsers; i++ {
+		seedUser(t, srcStore, testutil.UserOptions{Username: fmt.Sprintf("export%03d", i)})
+	}
+	federated, err := src.GetOrCreateFederatedUser(ctx, "github", "12345", "octocat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportUsers(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != passwordUsers+1 {
+		t.Fatalf("exported %d users, want %d", lines, passwordUsers+1)
+	}
+
+	dst, dstStore := newService(t)
+	imported, err := dst.ImportUsers(ctx, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != passwordUsers+1 {
+		t.Fatalf("imported %d users, want %d", imported, passwordUsers+1)
+	}
+
+	tests := []struct {
+		name  string
+		check func(t *testing.T)
+	}{
+		{"password users can log in", func(t *testing.T) {
+			for _, name := range []string{"export000", "export064", "export129"} {
+				if _, err := dst.AuthenticateUser(ctx, name, testutil.DefaultPassword); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		}},
+		{"federated user keeps its identity", func(t *testing.T) {
+			got, err := dstStore.GetUserByIdentity(ctx, "github", "12345")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Username != federated.Username {
+				t.Errorf("identity resolves to %q, want %q", got.Username, federated.Username)
+			}
+			if got.PasswordHash.IsSet() {
+				t.Error("federated user gained a password")
+			}
+		}},
+		{"federated user cannot log in with a password", func(t *testing.T) {
+			if _, err := dst.AuthenticateUser(ctx, "octocat", ""); err == nil {
+				t.Error("empty password authenticated a federated user")
+			}
+		}},
+		{"reimport skips existing users", func(t *testing.T) {
+			again, err := dst.ImportUsers(ctx, bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != 0 {
+				t.Errorf("reimport created %d users, want 0", again)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.check)
+	}
+}
+
+func TestImportUsersRejectsMissingHash(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr error
+	}{
+		{"no hash and no identity", `{"username":"nohash","role":"user","status":"active"}`, nil},
+		{"identity without subject", `{"username":"badid","role":"user","status":"active","identities":[{"provider":"github"}]}`, user.ErrInvalidIdentity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t)
+			n, err := svc.ImportUsers(ctx, strings.NewReader(tt.line+"\n"))
+			if err == nil || n != 0 {
+				t.Fatalf("ImportUsers = %d, %v; want an error", n, err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package user
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// fakeDriver is the database/sql driver the repository tests run against.
+// It records every query and statement it is sent. Queries are answered by
+// query and statements by exec; left unset, the database looks empty:
+// queries return no rows, EXISTS checks are false and statements affect no
+// rows. Pings fail with pingErr.
+type fakeDriver struct {
+	query   func(c *fakeConn, query string, args []driver.NamedValue) (driver.Rows, error)
+	exec    func(c *fakeConn, query string, args []driver.NamedValue) (driver.Result, error)
+	pingErr error
+
+	mu      sync.Mutex
+	queries []string
+	execs   []string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error)             { return &fakeConn{d: d}, nil }
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) { return &fakeConn{d: d}, nil }
+func (d *fakeDriver) Driver() driver.Driver                        { return d }
+
+func (d *fakeDriver) record(list *[]string, query string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*list = append(*list, query)
+}
+
+// fakeConn is one connection of a fakeDriver. onEnd, if set, runs when the
+// connection's transaction commits or rolls back, so a query hook can hold a
+// lock for the rest of the transaction.
+type fakeConn struct {
+	d     *fakeDriver
+	inTx  bool
+	onEnd func()
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Ping(context.Context) error          { return c.d.pingErr }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.inTx = true
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error   { c.end(); return nil }
+func (c *fakeConn) Rollback() error { c.end(); return nil }
+
+func (c *fakeConn) end() {
+	if c.onEnd != nil {
+		c.onEnd()
+		c.onEnd = nil
+	}
+	c.inTx = false
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.record(&c.d.queries, query)
+	if c.d.query != nil {
+		return c.d.query(c, query, args)
+	}
+	if strings.Contains(query, "EXISTS") {
+		return rowsOf([]string{"exists"}, []driver.Value{false}), nil
+	}
+	return rowsOf(nil), nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.record(&c.d.execs, query)
+	if c.d.exec != nil {
+		return c.d.exec(c, query, args)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// fakeRows hands out rows one at a time under cols.
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func rowsOf(cols []string, rows ...[]driver.Value) *fakeRows {
+	return &fakeRows{cols: cols, rows: rows}
+}
+
+// columns names n columns col0, col1 and so on, for rows that are scanned
+// by position.
+func columns(n int) []string {
+	cols := make([]string, n)
+	for i := range cols {
+		cols[i] = fmt.Sprintf("col%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,91 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+)
+
+var (
+	ErrInvalidIdentity = errors.New("identity provider and subject are required")
+	ErrIdentityExists  = errors.New("identity already linked to a user")
+)
+
+// Identity links a user to an external identity provider's subject.
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+}
+
+// GetOrCreateFederatedUser returns the local user linked to an external
+// identity provider's subject (the OIDC "sub" claim), provisioning one on
+// first login. Provisioned users are approved and have no password, so they
+// can only sign in through the provider; AuthenticateUser refuses them
+// until a password is set, e.g. with ResetUserPassword.
+//
+// username is only used when provisioning. A username already held by a
+// local account returns ErrUserAlreadyExists rather than linking to it. A
+// linked user that is unapproved, disabled, pending deletion or suspended is
+// refused with the same errors AuthenticateUser returns.
+func (s *UserService) GetOrCreateFederatedUser(ctx context.Context, provider, subject, username string) (_ *User, err error) {
+	defer func() {
+		s.logOp(ctx, "GetOrCreateFederatedUser", err, "provider", provider, "username", username)
+	}()
+
+	provider = strings.TrimSpace(provider)
+	if provider == "" || subject == "" {
+		return nil, ErrInvalidIdentity
+	}
+
+	user, err := s.repo.GetUserByIdentity(ctx, provider, subject)
+	if err == nil {
+		if err := s.checkAccountUsable(user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if err := s.validateUsername(username); err != nil {
+		return nil, err
+	}
+	if err := s.checkReservedUsername(username); err != nil {
+		return nil, err
+	}
+	taken, err := s.usernameTaken(ctx, s.normalizeUsername(username))
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrUserAlreadyExists
+	}
+
+	now := s.now()
+	user = &User{
+		Username:           strings.TrimSpace(username),
+		NormalizedUsername: s.normalizeUsername(username),
+		Status:             "active",
+		Role:               RoleUser,
+		ApprovedAt:         &now,
+		PasswordChangedAt:  now,
+	}
+	// An empty, non-nil hash is stored as "no password" rather than NULL.
+	user.PasswordHash.hash = []byte{}
+
+	if err := s.repo.CreateFederatedUser(ctx, user, provider, subject); err != nil {
+		if errors.Is(err, ErrIdentityExists) {
+			// A concurrent first login won the race; use its user.
+			return s.repo.GetUserByIdentity(ctx, provider, subject)
+		}
+		return nil, err
+	}
+
+	if err := s.events.OnUserCreated(ctx, user); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "user events: OnUserCreated failed", "user_id", user.ID, "error", err)
+	}
+	return user, nil
+}
@@ -0,0 +1,119 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestGetOrCreateFederatedUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare runs after the identity's user was provisioned.
+		prepare  func(t *testing.T, svc *user.UserService, provisioned, admin *user.User)
+		provider string
+		subject  string
+		username string
+		wantErr  error
+		wantSame bool
+	}{
+		{
+			name:     "returning user",
+			prepare:  func(*testing.T, *user.UserService, *user.User, *user.User) {},
+			provider: "github", subject: "1", username: "ignored",
+			wantSame: true,
+		},
+		{
+			name:     "new identity provisions a new user",
+			prepare:  func(*testing.T, *user.UserService, *user.User, *user.User) {},
+			provider: "github", subject: "2", username: "newcomer",
+		},
+		{
+			name: "disabled user",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User) {
+				if err := svc.DisableUser(ctx, u.ID, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			provider: "github", subject: "1",
+			wantErr: user.ErrUserDisabled,
+		},
+		{
+			name: "suspended user",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User) {
+				if err := svc.SuspendUser(ctx, u.ID, admin.ID, time.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			provider: "github", subject: "1",
+			wantErr: user.ErrUserSuspended,
+		},
+		{
+			name: "user pending deletion",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User) {
+				if err := svc.ScheduleUserDeletion(ctx, u.ID, admin.ID, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			},
+			provider: "github", subject: "1",
+			wantErr: user.ErrUserDisabled,
+		},
+		{
+			name:     "username held by a local account",
+			prepare:  func(*testing.T, *user.UserService, *user.User, *user.User) {},
+			provider: "github", subject: "3", username: "boss",
+			wantErr: user.ErrUserAlreadyExists,
+		},
+		{
+			name:     "missing subject",
+			prepare:  func(*testing.T, *user.UserService, *user.User, *user.User) {},
+			provider: "github", subject: "", username: "nobody",
+			wantErr: user.ErrInvalidIdentity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			provisioned, err := svc.GetOrCreateFederatedUser(ctx, "github", "1", "octocat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.prepare(t, svc, provisioned, admin)
+
+			got, err := svc.GetOrCreateFederatedUser(ctx, tt.provider, tt.subject, tt.username)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if same := got.ID == provisioned.ID; same != tt.wantSame {
+				t.Errorf("returned user %d, provisioned %d; same = %v, want %v", got.ID, provisioned.ID, same, tt.wantSame)
+			}
+			if !got.IsApproved() {
+				t.Error("federated user is not approved")
+			}
+		})
+	}
+}
+
+func TestFederatedUserCannotUsePasswordLogin(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newService(t)
+	if _, err := svc.GetOrCreateFederatedUser(ctx, "github", "1", "octocat"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"", "anything"} {
+		if _, err := svc.AuthenticateUser(ctx, "octocat", password); !errors.Is(err, user.ErrInvalidCredentials) {
+			t.Errorf("AuthenticateUser(%q) = %v, want ErrInvalidCredentials", password, err)
+		}
+	}
+}
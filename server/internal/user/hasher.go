@@ -0,0 +1,263 @@
+package user
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Hasher hashes and verifies passwords for a single algorithm.
+type Hasher interface {
+	Hash(password string) ([]byte, error)
+	Compare(hash []byte, password string) (bool, error)
+}
+
+// Rehasher is implemented by hashers that can tell when a stored hash was
+// produced by another algorithm or with outdated settings.
+type Rehasher interface {
+	NeedsRehash(hash []byte) bool
+}
+
+var DefaultHasher Hasher = NewBcryptHasher(12)
+
+const argon2idPrefix = "$argon2id$"
+
+// hasherFor picks the verifier matching the algorithm prefix of a stored
+// hash. Hashes without a recognised prefix are treated as bcrypt.
+func hasherFor(hash []byte) Hasher {
+	if bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return NewArgon2idHasher(DefaultArgon2Params)
+	}
+	return NewBcryptHasher(bcrypt.DefaultCost)
+}
+
+func compareHash(hash []byte, password string) (bool, error) {
+	return hasherFor(hash).Compare(hash, password)
+}
+
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{
+		cost: cost,
+	}
+}
+
+func (h *BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost)
+}
+
+func (h *BcryptHasher) Compare(hash []byte, password string) (bool, error) {
+	// Longer passwords are refused by validatePassword but are still
+	// compared here: accounts created before the limit have hashes of their
+	// first 72 bytes, and refusing them would lock those users out.
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// NeedsRehash reports true for non-bcrypt hashes and for bcrypt hashes whose
+// cost is below the hasher's configured cost.
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	if bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return false
+	}
+	return cost < h.cost
+}
+
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  1,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Bounds for CalibrateHasher. The memory floor follows OWASP's minimum for
+// argon2id; the iteration cap keeps calibration itself quick.
+const (
+	minArgon2Memory     = 19 * 1024
+	maxArgon2Iterations = 10
+)
+
+// CalibrateHasher benchmarks argon2id on this machine and returns parameters
+// whose hash time is as close to target as possible without exceeding it.
+// Starting from DefaultArgon2Params it halves memory (down to a floor) when a
+// single pass is already too slow, then adds iterations while they still fit.
+// It takes a few multiples of target to run, so call it once at startup.
+func CalibrateHasher(target time.Duration) Argon2Params {
+	salt := make([]byte, DefaultArgon2Params.SaltLength)
+	measure := func(p Argon2Params) time.Duration {
+		start := time.Now()
+		argon2.IDKey([]byte("calibration password"), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		return time.Since(start)
+	}
+
+	params := DefaultArgon2Params
+	for params.Memory/2 >= minArgon2Memory && measure(params) > target {
+		params.Memory /= 2
+	}
+
+	for params.Iterations < maxArgon2Iterations {
+		next := params
+		next.Iterations++
+		if measure(next) > target {
+			break
+		}
+		params = next
+	}
+
+	return params
+}
+
+// Limits applied when decoding a stored hash. Hashes can arrive from outside
+// (ImportUsers), so parameters that would panic argon2, accept any password
+// or exhaust the machine are rejected as ErrInvalidHash.
+const (
+	maxDecodedArgon2Memory     = 4 * 1024 * 1024 // KiB, i.e. 4 GiB
+	maxDecodedArgon2Iterations = 100
+	minDecodedSaltLength       = 8
+	minDecodedKeyLength        = 16
+	maxDecodedKeyLength        = 1024
+)
+
+// Argon2idHasher produces PHC-formatted hashes
+// ($argon2id$v=19$m=...,t=...,p=...$salt$key) so the parameters travel
+// with the hash.
+type Argon2idHasher struct {
+	params Argon2Params
+}
+
+func NewArgon2idHasher(params Argon2Params) *Argon2idHasher {
+	return &Argon2idHasher{
+		params: params,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.params.Memory,
+		h.params.Iterations,
+		h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(encoded), nil
+}
+
+func (h *Argon2idHasher) Compare(hash []byte, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, candidate) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := decodeArgon2idHash(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.params.Memory ||
+		params.Iterations != h.params.Iterations ||
+		params.Parallelism != h.params.Parallelism ||
+		params.KeyLength != h.params.KeyLength
+}
+
+func decodeArgon2idHash(hash []byte) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	if !validDecodedArgon2Params(params) {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	return params, salt, key, nil
+}
+
+func validDecodedArgon2Params(p Argon2Params) bool {
+	switch {
+	case p.Iterations == 0 || p.Iterations > maxDecodedArgon2Iterations:
+		return false
+	case p.Parallelism == 0:
+		return false
+	// argon2 needs at least 8 KiB of memory per lane.
+	case p.Memory < 8*uint32(p.Parallelism) || p.Memory > maxDecodedArgon2Memory:
+		return false
+	case p.SaltLength < minDecodedSaltLength:
+		return false
+	case p.KeyLength < minDecodedKeyLength || p.KeyLength > maxDecodedKeyLength:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestArgon2idCompareRejectsMalformedHash(t *testing.T) {
+	h := user.NewArgon2idHasher(user.DefaultArgon2Params)
+
+	const (
+		salt = "c29tZXNhbHRzb21lc2FsdA"                      // 16 bytes
+		key  = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U" // 32 bytes
+	)
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"wrong algorithm", "$argon2i$v=19$m=65536,t=1,p=4$" + salt + "$" + key},
+		{"wrong version", "$argon2id$v=16$m=65536,t=1,p=4$" + salt + "$" + key},
+		{"empty salt", "$argon2id$v=19$m=65536,t=1,p=4$$" + key},
+		{"empty key", "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$"},
+		{"short key", "$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$a2V5"},
+		{"zero iterations", "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key},
+		{"zero parallelism", "$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + key},
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=4$" + salt + "$" + key},
+		{"memory below lanes", "$argon2id$v=19$m=16,t=1,p=4$" + salt + "$" + key},
+		{"huge memory", "$argon2id$v=19$m=4294967295,t=1,p=4$" + salt + "$" + key},
+		{"huge iterations", "$argon2id$v=19$m=65536,t=4294967295,p=4$" + salt + "$" + key},
+		{"parallelism overflow", "$argon2id$v=19$m=65536,t=1,p=256$" + salt + "$" + key},
+		{"bad base64", "$argon2id$v=19$m=65536,t=1,p=4$!!!$" + key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := h.Compare([]byte(tt.hash), "anything")
+			if ok || !errors.Is(err, user.ErrInvalidHash) {
+				t.Fatalf("Compare = %v, %v; want false, ErrInvalidHash", ok, err)
+			}
+			if !h.NeedsRehash([]byte(tt.hash)) {
+				t.Fatal("NeedsRehash = false for a malformed hash")
+			}
+		})
+	}
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	h := user.NewArgon2idHasher(user.DefaultArgon2Params)
+	hash, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"correct horse", true},
+		{"wrong horse", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		ok, err := h.Compare(hash, tt.password)
+		if err != nil {
+			t.Fatalf("Compare(%q): %v", tt.password, err)
+		}
+		if ok != tt.want {
+			t.Errorf("Compare(%q) = %v, want %v", tt.password, ok, tt.want)
+		}
+	}
+	if h.NeedsRehash(hash) {
+		t.Error("NeedsRehash = true for a hash made with the same params")
+	}
+}
+
+// countingHasher counts the hashes made through it, i.e. rehashes on login,
+// and the comparisons.
+type countingHasher struct {
+	inner interface {
+		user.Hasher
+		user.Rehasher
+	}
+	hashes   int
+	compares int
+}
+
+func (h *countingHasher) Hash(password string) ([]byte, error) {
+	h.hashes++
+	return h.inner.Hash(password)
+}
+
+func (h *countingHasher) Compare(hash []byte, password string) (bool, error) {
+	h.compares++
+	return h.inner.Compare(hash, password)
+}
+
+func (h *countingHasher) NeedsRehash(hash []byte) bool { return h.inner.NeedsRehash(hash) }
+
+func TestRehashOnLogin(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		hasher     *countingHasher
+		password   string
+		wantRehash bool
+	}{
+		{"current bcrypt cost", &countingHasher{inner: user.NewBcryptHasher(4)}, testutil.DefaultPassword, false},
+		{"outdated bcrypt cost", &countingHasher{inner: user.NewBcryptHasher(5)}, testutil.DefaultPassword, true},
+		{"bcrypt to argon2id", &countingHasher{inner: user.NewArgon2idHasher(user.DefaultArgon2Params)}, testutil.DefaultPassword, true},
+		{"wrong password", &countingHasher{inner: user.NewArgon2idHasher(user.DefaultArgon2Params)}, "wrong-password", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithHasher(tt.hasher))
+			// Seeded users are hashed with bcrypt at cost 4.
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			_, _ = svc.AuthenticateUser(ctx, u.Username, tt.password)
+			if rehashed := tt.hasher.hashes > 0; rehashed != tt.wantRehash {
+				t.Fatalf("rehashed = %v, want %v", rehashed, tt.wantRehash)
+			}
+			if !tt.wantRehash {
+				return
+			}
+
+			// The upgraded hash still verifies and is not rehashed again.
+			if _, err := svc.AuthenticateUser(ctx, u.Username, tt.password); err != nil {
+				t.Fatalf("login after rehash: %v", err)
+			}
+			if tt.hasher.hashes != 1 {
+				t.Errorf("hashed %d times over two logins, want 1", tt.hasher.hashes)
+			}
+		})
+	}
+}
+
+func TestCalibrateHasher(t *testing.T) {
+	// Nothing hashes in a nanosecond, so calibration backs off as far as
+	// its bounds allow.
+	params := user.CalibrateHasher(time.Nanosecond)
+
+	if params.Memory < 19*1024 || params.Memory > user.DefaultArgon2Params.Memory {
+		t.Errorf("Memory = %d KiB, want between the 19 MiB floor and the default", params.Memory)
+	}
+	if params.Iterations != 1 {
+		t.Errorf("Iterations = %d, want 1", params.Iterations)
+	}
+	if params.Parallelism != user.DefaultArgon2Params.Parallelism ||
+		params.SaltLength != user.DefaultArgon2Params.SaltLength ||
+		params.KeyLength != user.DefaultArgon2Params.KeyLength {
+		t.Errorf("calibration changed fixed parameters: %+v", params)
+	}
+
+	tuned := user.NewArgon2idHasher(params)
+	hash, err := tuned.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hash carries its parameters, so any argon2id hasher can verify it.
+	if want := fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism); !strings.Contains(string(hash), want) {
+		t.Errorf("hash %q does not record %s", hash, want)
+	}
+	tests := []struct {
+		name     string
+		verifier *user.Argon2idHasher
+		password string
+		want     bool
+	}{
+		{"tuned hasher", tuned, "correct horse", true},
+		{"default hasher", user.NewArgon2idHasher(user.DefaultArgon2Params), "correct horse", true},
+		{"wrong password", tuned, "wrong horse", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := tt.verifier.Compare(hash, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("Compare = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+
+	if tuned.NeedsRehash(hash) {
+		t.Error("NeedsRehash = true under the tuned params")
+	}
+	if params != user.DefaultArgon2Params && !user.NewArgon2idHasher(user.DefaultArgon2Params).NeedsRehash(hash) {
+		t.Error("NeedsRehash = false under different params")
+	}
+}
@@ -0,0 +1,58 @@
+package user_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/token/tokentest"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+// fakeClock is a settable clock for WithClock.
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newService(t *testing.T, opts ...user.Option) (*user.UserService, *usertest.MemoryUserStore) {
+	t.Helper()
+	store := usertest.NewMemoryUserStore()
+	opts = append([]user.Option{user.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	return user.NewUserService(store, opts...), store
+}
+
+func seedUser(t *testing.T, store user.UserStore, opts testutil.UserOptions) *user.User {
+	t.Helper()
+	return testutil.SeedUser(context.Background(), store, opts)
+}
+
+// scheduleDeletion marks u for deletion an hour from now directly in the
+// store, as ScheduleUserDeletion would.
+func scheduleDeletion(t *testing.T, store user.UserStore, u *user.User) {
+	t.Helper()
+	deleteAfter := time.Now().Add(time.Hour)
+	u.DeleteAfter = &deleteAfter
+	if err := store.UpdateUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTokenService returns a token service over an in-memory repository, for
+// WithTokenManager.
+func newTokenService(t *testing.T, opts ...token.Option) *token.TokenService {
+	t.Helper()
+	opts = append([]token.Option{token.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	return token.NewTokenService(tokentest.NewMemoryTokenRepo(), opts...)
+}
@@ -0,0 +1,64 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+)
+
+var ErrAccountLocked = errors.New("account temporarily locked after repeated failed logins")
+
+// LockoutNotifier is told when repeated failed logins lock an account, e.g.
+// to email the user and the security team.
+type LockoutNotifier interface {
+	OnLockout(ctx context.Context, userID int64, until time.Time)
+}
+
+type NoopLockoutNotifier struct{}
+
+func (NoopLockoutNotifier) OnLockout(ctx context.Context, userID int64, until time.Time) {}
+
+// IsLocked reports whether a failed-login lockout is in effect at now.
+// Lockouts are separate from admin suspensions and lapse on their own.
+func (u *User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// registerFailedLogin counts a wrong password against the account and,
+// once the limit is reached, locks it for the lockout duration. The count
+// is kept on the user row under a row lock, so every instance shares it.
+// The notifier runs in the background so it never delays the login
+// response.
+func (s *UserService) registerFailedLogin(ctx context.Context, username string) {
+	if s.lockoutThreshold <= 0 {
+		return
+	}
+
+	until := s.now().Add(s.lockoutDuration)
+	userID, locked, err := s.repo.RecordFailedLogin(ctx, s.normalizeUsername(username), s.lockoutThreshold, until)
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "lockout: recording failed login failed", "username", username, "error", err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	go s.lockoutNotifier.OnLockout(context.WithoutCancel(ctx), userID, until)
+}
+
+// clearFailedLogins forgets the user's failed logins and any lockout. It is
+// best-effort: a stale count only brings the next lockout forward.
+func (s *UserService) clearFailedLogins(ctx context.Context, user *User) {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return
+	}
+	if err := s.repo.ClearFailedLogins(ctx, user.ID); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "lockout: clearing failed logins failed", "user_id", user.ID, "error", err)
+	}
+}
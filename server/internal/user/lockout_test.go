@@ -0,0 +1,129 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+type recordingNotifier struct {
+	mu    sync.Mutex
+	calls []int64
+	fired chan struct{}
+}
+
+func newRecordingNotifier() *recordingNotifier {
+	return &recordingNotifier{fired: make(chan struct{}, 10)}
+}
+
+func (n *recordingNotifier) OnLockout(ctx context.Context, userID int64, until time.Time) {
+	n.mu.Lock()
+	n.calls = append(n.calls, userID)
+	n.mu.Unlock()
+	n.fired <- struct{}{}
+}
+
+func (n *recordingNotifier) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.calls)
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	notifier := newRecordingNotifier()
+	svc, store := newService(t,
+		user.WithClock(clock.Now),
+		user.WithLockout(3, 10*time.Minute),
+		user.WithLockoutNotifier(notifier),
+	)
+	u := seedUser(t, store, testutil.UserOptions{Username: "alice"})
+
+	for i := 0; i < 3; i++ {
+		if _, err := svc.AuthenticateUser(ctx, "alice", "wrong-password"); !errors.Is(err, user.ErrInvalidCredentials) {
+			t.Fatalf("attempt %d: got %v, want ErrInvalidCredentials", i+1, err)
+		}
+	}
+
+	select {
+	case <-notifier.fired:
+	case <-time.After(time.Second):
+		t.Fatal("notifier did not fire on lockout")
+	}
+
+	tests := []struct {
+		name     string
+		password string
+	}{
+		{"wrong password", "wrong-password"},
+		{"correct password is not confirmed", testutil.DefaultPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.AuthenticateUser(ctx, "alice", tt.password); !errors.Is(err, user.ErrAccountLocked) {
+				t.Fatalf("got %v, want ErrAccountLocked", err)
+			}
+		})
+	}
+
+	if got := notifier.count(); got != 1 {
+		t.Fatalf("notifier fired %d times, want 1", got)
+	}
+
+	stored, err := store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SuspendedUntil != nil {
+		t.Fatalf("lockout set SuspendedUntil = %v", stored.SuspendedUntil)
+	}
+
+	clock.Advance(11 * time.Minute)
+	if _, err := svc.AuthenticateUser(ctx, "alice", testutil.DefaultPassword); err != nil {
+		t.Fatalf("login after lockout lapsed: %v", err)
+	}
+	stored, err = store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailedLogins != 0 || stored.LockedUntil != nil {
+		t.Fatalf("successful login left failed logins %d, locked until %v", stored.FailedLogins, stored.LockedUntil)
+	}
+}
+
+func TestLockoutKeepsLongerSuspension(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	svc, store := newService(t, user.WithClock(clock.Now), user.WithLockout(1, time.Minute))
+	admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+	u := seedUser(t, store, testutil.UserOptions{Username: "bob"})
+
+	suspendUntil := clock.Now().Add(24 * time.Hour)
+	if err := svc.SuspendUser(ctx, u.ID, admin.ID, suspendUntil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The suspension is checked before the password, so this failure is
+	// not counted and cannot shorten the suspension.
+	if _, err := svc.AuthenticateUser(ctx, "bob", "wrong-password"); !errors.Is(err, user.ErrUserSuspended) {
+		t.Fatalf("got %v, want ErrUserSuspended", err)
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := svc.AuthenticateUser(ctx, "bob", testutil.DefaultPassword); !errors.Is(err, user.ErrUserSuspended) {
+		t.Fatalf("got %v, want ErrUserSuspended", err)
+	}
+
+	stored, err := store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SuspendedUntil == nil || !stored.SuspendedUntil.Equal(suspendUntil) {
+		t.Fatalf("SuspendedUntil = %v, want %v", stored.SuspendedUntil, suspendUntil)
+	}
+}
@@ -0,0 +1,25 @@
+package user
+
+// Login failure reasons reported to Metrics.IncLoginFailure.
+const (
+	LoginFailureInvalidCredentials     = "invalid_credentials"
+	LoginFailureNotApproved            = "not_approved"
+	LoginFailureDisabled               = "disabled"
+	LoginFailureSuspended              = "suspended"
+	LoginFailureLocked                 = "locked"
+	LoginFailurePasswordChangeRequired = "password_change_required"
+	LoginFailurePasswordExpired        = "password_expired"
+	LoginFailureError                  = "error"
+)
+
+// Metrics collects authentication outcomes, e.g. as Prometheus counters.
+type Metrics interface {
+	IncLoginSuccess()
+	IncLoginFailure(reason string)
+}
+
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncLoginSuccess() {}
+
+func (NoopMetrics) IncLoginFailure(reason string) {}
@@ -0,0 +1,71 @@
+package user_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+// recordingMetrics records every login outcome, "success" for successes.
+type recordingMetrics struct {
+	outcomes []string
+}
+
+func (m *recordingMetrics) IncLoginSuccess()              { m.outcomes = append(m.outcomes, "success") }
+func (m *recordingMetrics) IncLoginFailure(reason string) { m.outcomes = append(m.outcomes, reason) }
+
+func TestLoginMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		opts     testutil.UserOptions
+		username string
+		password string
+		want     string
+	}{
+		{name: "success", password: testutil.DefaultPassword, want: "success"},
+		{name: "wrong password", password: "wrong-password", want: user.LoginFailureInvalidCredentials},
+		{name: "unknown user", username: "nobody", password: testutil.DefaultPassword, want: user.LoginFailureInvalidCredentials},
+		{name: "pending", opts: testutil.UserOptions{Pending: true}, password: testutil.DefaultPassword, want: user.LoginFailureNotApproved},
+		{name: "disabled", opts: testutil.UserOptions{Disabled: true}, password: testutil.DefaultPassword, want: user.LoginFailureDisabled},
+		{name: "must change password", opts: testutil.UserOptions{MustChangePassword: true}, password: testutil.DefaultPassword, want: user.LoginFailurePasswordChangeRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &recordingMetrics{}
+			svc, store := newService(t, user.WithMetrics(metrics))
+			u := seedUser(t, store, tt.opts)
+
+			username := tt.username
+			if username == "" {
+				username = u.Username
+			}
+			_, _ = svc.AuthenticateUser(ctx, username, tt.password)
+
+			if want := []string{tt.want}; !slices.Equal(metrics.outcomes, want) {
+				t.Errorf("outcomes = %v, want %v", metrics.outcomes, want)
+			}
+		})
+	}
+}
+
+func TestLoginMetricsSuspended(t *testing.T) {
+	ctx := context.Background()
+	metrics := &recordingMetrics{}
+	svc, store := newService(t, user.WithMetrics(metrics))
+	admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+	u := seedUser(t, store, testutil.UserOptions{})
+	if err := svc.SuspendUser(ctx, u.ID, admin.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword)
+	if want := []string{user.LoginFailureSuspended}; !slices.Equal(metrics.outcomes, want) {
+		t.Errorf("outcomes = %v, want %v", metrics.outcomes, want)
+	}
+}
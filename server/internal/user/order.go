@@ -0,0 +1,74 @@
+package user
+
+import "errors"
+
+var ErrInvalidOrder = errors.New("invalid sort column or direction")
+
+// SortColumn is a user field ListUsersOrdered can sort by.
+type SortColumn string
+
+const (
+	SortByCreatedAt  SortColumn = "created_at"
+	SortByUsername   SortColumn = "username"
+	SortByStatus     SortColumn = "status"
+	SortByApprovedAt SortColumn = "approved_at"
+)
+
+type SortDirection string
+
+const (
+	SortAsc  SortDirection = "asc"
+	SortDesc SortDirection = "desc"
+)
+
+// UserOrder is a sort column and direction. The zero value is
+// DefaultUserOrder.
+type UserOrder struct {
+	Column    SortColumn
+	Direction SortDirection
+}
+
+// DefaultUserOrder lists the newest users first, as ListUsers does.
+var DefaultUserOrder = UserOrder{Column: SortByCreatedAt, Direction: SortDesc}
+
+// sortColumns is the allowlist of sortable columns. Only these fixed
+// strings ever reach the ORDER BY clause, never caller input. Usernames
+// sort by their normalized form so case does not split the order.
+var sortColumns = map[SortColumn]string{
+	SortByCreatedAt:  "created_at",
+	SortByUsername:   "username_normalized",
+	SortByStatus:     "status",
+	SortByApprovedAt: "approved_at",
+}
+
+// Normalize fills in defaults and returns ErrInvalidOrder for a column or
+// direction outside the allowlist.
+func (o UserOrder) Normalize() (UserOrder, error) {
+	if o.Column == "" {
+		o.Column = DefaultUserOrder.Column
+	}
+	if o.Direction == "" {
+		o.Direction = DefaultUserOrder.Direction
+	}
+	if _, ok := sortColumns[o.Column]; !ok {
+		return o, ErrInvalidOrder
+	}
+	if o.Direction != SortAsc && o.Direction != SortDesc {
+		return o, ErrInvalidOrder
+	}
+	return o, nil
+}
+
+// orderBy renders o as an ORDER BY clause. Users not yet approved sort
+// last either way, and ties break on id so pages are stable.
+func (o UserOrder) orderBy() (string, error) {
+	o, err := o.Normalize()
+	if err != nil {
+		return "", err
+	}
+	direction := "ASC"
+	if o.Direction == SortDesc {
+		direction = "DESC"
+	}
+	return "ORDER BY " + sortColumns[o.Column] + " " + direction + " NULLS LAST, id " + direction, nil
+}
@@ -0,0 +1,84 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestUserOrderNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   user.UserOrder
+		want    user.UserOrder
+		wantErr error
+	}{
+		{"zero value", user.UserOrder{}, user.DefaultUserOrder, nil},
+		{"column only", user.UserOrder{Column: user.SortByUsername}, user.UserOrder{Column: user.SortByUsername, Direction: user.SortDesc}, nil},
+		{"direction only", user.UserOrder{Direction: user.SortAsc}, user.UserOrder{Column: user.SortByCreatedAt, Direction: user.SortAsc}, nil},
+		{"explicit", user.UserOrder{Column: user.SortByApprovedAt, Direction: user.SortAsc}, user.UserOrder{Column: user.SortByApprovedAt, Direction: user.SortAsc}, nil},
+		{"unknown column", user.UserOrder{Column: "password_hash"}, user.UserOrder{}, user.ErrInvalidOrder},
+		{"injected column", user.UserOrder{Column: "id; DROP TABLE users"}, user.UserOrder{}, user.ErrInvalidOrder},
+		{"uppercase direction", user.UserOrder{Direction: "DESC"}, user.UserOrder{}, user.ErrInvalidOrder},
+		{"unknown direction", user.UserOrder{Direction: "sideways"}, user.UserOrder{}, user.ErrInvalidOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.order.Normalize()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsersOrdered(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	// Seeded in this order, so created_at and approved_at follow it. bob is
+	// pending and has no approved_at.
+	seedUser(t, store, testutil.UserOptions{Username: "carol", Status: "inactive"})
+	seedUser(t, store, testutil.UserOptions{Username: "Alice", Status: "active"})
+	seedUser(t, store, testutil.UserOptions{Username: "bob", Pending: true})
+
+	tests := []struct {
+		name    string
+		order   user.UserOrder
+		want    []string
+		wantErr error
+	}{
+		{"default", user.UserOrder{}, []string{"bob", "Alice", "carol"}, nil},
+		{"created_at asc", user.UserOrder{Column: user.SortByCreatedAt, Direction: user.SortAsc}, []string{"carol", "Alice", "bob"}, nil},
+		{"username asc", user.UserOrder{Column: user.SortByUsername, Direction: user.SortAsc}, []string{"Alice", "bob", "carol"}, nil},
+		{"username desc", user.UserOrder{Column: user.SortByUsername, Direction: user.SortDesc}, []string{"carol", "bob", "Alice"}, nil},
+		{"status asc", user.UserOrder{Column: user.SortByStatus, Direction: user.SortAsc}, []string{"Alice", "carol", "bob"}, nil},
+		{"status desc", user.UserOrder{Column: user.SortByStatus, Direction: user.SortDesc}, []string{"bob", "carol", "Alice"}, nil},
+		{"approved_at asc", user.UserOrder{Column: user.SortByApprovedAt, Direction: user.SortAsc}, []string{"carol", "Alice", "bob"}, nil},
+		{"approved_at desc keeps pending last", user.UserOrder{Column: user.SortByApprovedAt, Direction: user.SortDesc}, []string{"Alice", "carol", "bob"}, nil},
+		{"invalid column", user.UserOrder{Column: "email"}, nil, user.ErrInvalidOrder},
+		{"invalid direction", user.UserOrder{Column: user.SortByUsername, Direction: "up"}, nil, user.ErrInvalidOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := svc.ListUsersOrdered(ctx, tt.order, 10, 0)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, u := range users {
+				got = append(got, u.Username)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
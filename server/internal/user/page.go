@@ -0,0 +1,24 @@
+package user
+
+// Page is one page of a list result along with the totals needed to render
+// pagination controls.
+type Page[T any] struct {
+	Items   []T  `json:"items"`
+	Limit   int  `json:"limit"`
+	Offset  int  `json:"offset"`
+	Total   int  `json:"total"`
+	HasMore bool `json:"has_more"`
+}
+
+func newPage[T any](items []T, limit, offset, total int) *Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return &Page[T]{
+		Items:   items,
+		Limit:   limit,
+		Offset:  offset,
+		Total:   total,
+		HasMore: offset+len(items) < total,
+	}
+}
@@ -0,0 +1,35 @@
+package user
+
+import "context"
+
+// UserProfile is a user together with a summary of the tokens they hold.
+type UserProfile struct {
+	User              *User `json:"user"`
+	DeployTokens      int   `json:"deploy_tokens"`
+	HasRefreshSession bool  `json:"has_refresh_session"`
+}
+
+// GetUserProfile returns the user, with the password hash cleared, and
+// counts of their live deploy and refresh tokens.
+func (s *UserService) GetUserProfile(ctx context.Context, userID int64) (*UserProfile, error) {
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = password{}
+
+	summary, err := s.tokens.SummarizeTokens(ctx, int(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserProfile{
+		User:              user,
+		DeployTokens:      summary.DeployTokens,
+		HasRefreshSession: summary.HasRefresh,
+	}, nil
+}
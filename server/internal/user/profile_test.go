@@ -0,0 +1,72 @@
+package user_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestGetUserProfile(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		issue       func(t *testing.T, tokens *token.TokenService, userID int64)
+		wantDeploy  int
+		wantRefresh bool
+	}{
+		{
+			name:  "no tokens",
+			issue: func(t *testing.T, tokens *token.TokenService, userID int64) {},
+		},
+		{
+			name: "deploy tokens and a refresh session",
+			issue: func(t *testing.T, tokens *token.TokenService, userID int64) {
+				for _, permission := range []string{token.PermissionRead, token.PermissionWrite} {
+					if _, err := tokens.CreateDeployTokenWithPermission(ctx, userID, "", permission, 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, _, err := tokens.CreateAuthTokenWithRefresh(ctx, userID); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantDeploy:  2,
+			wantRefresh: true,
+		},
+		{
+			name: "auth session only",
+			issue: func(t *testing.T, tokens *token.TokenService, userID int64) {
+				if _, err := tokens.CreateAuthToken(ctx, int(userID), time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			u := seedUser(t, store, testutil.UserOptions{})
+			tt.issue(t, tokens, u.ID)
+
+			profile, err := svc.GetUserProfile(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.DeployTokens != tt.wantDeploy {
+				t.Errorf("DeployTokens = %d, want %d", profile.DeployTokens, tt.wantDeploy)
+			}
+			if profile.HasRefreshSession != tt.wantRefresh {
+				t.Errorf("HasRefreshSession = %v, want %v", profile.HasRefreshSession, tt.wantRefresh)
+			}
+			if ok, _ := profile.User.PasswordHash.Matches(testutil.DefaultPassword); ok {
+				t.Error("profile exposes the password hash")
+			}
+		})
+	}
+}
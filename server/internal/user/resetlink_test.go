@@ -0,0 +1,140 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+const newResetPassword = "N3w-Reset-Passw0rd"
+
+// flipChar replaces the base64 character at i with a different one.
+func flipChar(link string, i int) string {
+	c := byte('A')
+	if link[i] == c {
+		c = 'B'
+	}
+	return link[:i] + string(c) + link[i+1:]
+}
+
+func TestConsumeResetLink(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// prepare may alter the link or the account before it is consumed.
+		prepare func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string
+		wantErr error
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "tampered payload",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				return flipChar(link, 0)
+			},
+			wantErr: user.ErrInvalidResetLink,
+		},
+		{
+			name: "tampered signature",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				return flipChar(link, len(link)-5)
+			},
+			wantErr: user.ErrInvalidResetLink,
+		},
+		{
+			name: "missing signature",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				return link[:len(link)/2]
+			},
+			wantErr: user.ErrInvalidResetLink,
+		},
+		{
+			name: "reused",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				if err := svc.ConsumeResetLink(ctx, link, "F1rst-Reset-Passw0rd"); err != nil {
+					t.Fatal(err)
+				}
+				clock.Advance(time.Minute)
+				return link
+			},
+			wantErr: user.ErrInvalidResetLink,
+		},
+		{
+			name: "expired",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				clock.Advance(2 * time.Hour)
+				return link
+			},
+			wantErr: user.ErrResetLinkExpired,
+		},
+		{
+			name: "disabled user",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				if err := svc.DisableUser(ctx, u.ID, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+				return link
+			},
+			wantErr: user.ErrUserDisabled,
+		},
+		{
+			name: "suspended user",
+			prepare: func(t *testing.T, svc *user.UserService, u, admin *user.User, clock *fakeClock, link string) string {
+				if err := svc.SuspendUser(ctx, u.ID, admin.ID, clock.Now().Add(time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+				return link
+			},
+			wantErr: user.ErrUserSuspended,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			svc, store := newService(t,
+				user.WithClock(clock.Now),
+				user.WithResetLinkSecret([]byte("reset-link-secret"), time.Hour))
+			admin := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			link, err := svc.GenerateResetLink(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				link = tt.prepare(t, svc, u, admin, clock, link)
+			}
+
+			err = svc.ConsumeResetLink(ctx, link, newResetPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			changed, err := svc.VerifyPassword(ctx, u.ID, newResetPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != (tt.wantErr == nil) {
+				t.Errorf("password changed = %v with error %v", changed, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConsumeResetLinkNotConfigured(t *testing.T) {
+	svc, store := newService(t)
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	if _, err := svc.GenerateResetLink(context.Background(), u.ID); !errors.Is(err, user.ErrResetLinksNotConfigured) {
+		t.Fatalf("GenerateResetLink: got %v, want ErrResetLinksNotConfigured", err)
+	}
+	if err := svc.ConsumeResetLink(context.Background(), "a.b", newResetPassword); !errors.Is(err, user.ErrResetLinksNotConfigured) {
+		t.Fatalf("ConsumeResetLink: got %v, want ErrResetLinksNotConfigured", err)
+	}
+}
@@ -0,0 +1,68 @@
+package user
+
+type Role string
+
+const (
+	RoleUser       Role = "user"
+	RoleViewer     Role = "viewer"
+	RoleApprover   Role = "approver"
+	RoleSuperAdmin Role = "super_admin"
+)
+
+type Permission string
+
+const (
+	PermissionListUsers    Permission = "users:list"
+	PermissionApproveUsers Permission = "users:approve"
+	PermissionManageUsers  Permission = "users:manage"
+	PermissionManageAdmins Permission = "admins:manage"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {
+		PermissionListUsers,
+	},
+	RoleApprover: {
+		PermissionListUsers,
+		PermissionApproveUsers,
+	},
+	RoleSuperAdmin: {
+		PermissionListUsers,
+		PermissionApproveUsers,
+		PermissionManageUsers,
+		PermissionManageAdmins,
+	},
+}
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleViewer, RoleApprover, RoleSuperAdmin:
+		return true
+	}
+	return false
+}
+
+func (r Role) Has(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// losesPermissions reports whether moving from r to to drops any
+// permission r grants.
+func (r Role) losesPermissions(to Role) bool {
+	for _, p := range rolePermissions[r] {
+		if !to.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// can reports whether user holds permission. A nil user has none.
+func can(user *User, permission Permission) bool {
+	return user != nil && user.Role.Has(permission)
+}
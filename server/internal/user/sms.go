@@ -0,0 +1,65 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/samokw/zdeploy/server/internal/token"
+)
+
+var (
+	ErrSMSNotConfigured = errors.New("sms sender not configured")
+	ErrNoPhoneNumber    = errors.New("user has no phone number")
+	ErrInvalidSMSCode   = errors.New("invalid sms code")
+)
+
+// SMSSender delivers text messages, e.g. through an SMS gateway.
+type SMSSender interface {
+	Send(ctx context.Context, phone, message string) error
+}
+
+// StartSMSChallenge texts a one-time code to the user's phone for use as a
+// second factor. Any earlier code stops working.
+func (s *UserService) StartSMSChallenge(ctx context.Context, userID int64) (err error) {
+	defer func() { s.logOp(ctx, "StartSMSChallenge", err, "user_id", userID) }()
+
+	if s.sms == nil {
+		return ErrSMSNotConfigured
+	}
+	if s.tokens == nil {
+		return ErrTokensNotConfigured
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Phone == nil || *user.Phone == "" {
+		return ErrNoPhoneNumber
+	}
+
+	code, err := s.tokens.CreateSMSChallenge(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.sms.Send(ctx, *user.Phone, fmt.Sprintf("Your zdeploy verification code is %s", code))
+}
+
+// VerifySMSChallenge checks a code sent by StartSMSChallenge. A wrong code
+// returns ErrInvalidSMSCode, an expired one token.ErrTokenExpired, and any
+// code once the challenge has had too many tries token.ErrTooManyAttempts.
+func (s *UserService) VerifySMSChallenge(ctx context.Context, userID int64, code string) (err error) {
+	defer func() { s.logOp(ctx, "VerifySMSChallenge", err, "user_id", userID) }()
+
+	if s.tokens == nil {
+		return ErrTokensNotConfigured
+	}
+
+	err = s.tokens.VerifySMSChallenge(ctx, userID, code)
+	if errors.Is(err, token.ErrTokenNotFound) {
+		return ErrInvalidSMSCode
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/token/tokentest"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+// recordingSMS keeps the last message sent through it.
+type recordingSMS struct {
+	phone, message string
+	err            error
+}
+
+func (s *recordingSMS) Send(ctx context.Context, phone, message string) error {
+	s.phone, s.message = phone, message
+	return s.err
+}
+
+var smsCode = regexp.MustCompile(`\d{6}`)
+
+func (s *recordingSMS) code(t *testing.T) string {
+	t.Helper()
+	code := smsCode.FindString(s.message)
+	if code == "" {
+		t.Fatalf("no code in message %q", s.message)
+	}
+	return code
+}
+
+func seedUserWithPhone(t *testing.T, store *usertest.MemoryUserStore, phone string) *user.User {
+	t.Helper()
+	u := seedUser(t, store, testutil.UserOptions{})
+	u.Phone = &phone
+	if err := store.UpdateUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSMSChallenge(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// code picks the code to verify given the one that was texted.
+		code    func(sent string) string
+		twice   bool
+		wantErr error
+	}{
+		{name: "right code", code: func(sent string) string { return sent }},
+		{name: "wrong code", code: func(sent string) string { return sent + "0" }, wantErr: user.ErrInvalidSMSCode},
+		{name: "code is single-use", code: func(sent string) string { return sent }, twice: true, wantErr: user.ErrInvalidSMSCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sms := &recordingSMS{}
+			svc, store := newService(t, user.WithSMSSender(sms), user.WithTokenManager(newTokenService(t)))
+			u := seedUserWithPhone(t, store, "+15550100")
+
+			if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+				t.Fatal(err)
+			}
+			if sms.phone != "+15550100" {
+				t.Errorf("texted %q, want the user's phone", sms.phone)
+			}
+
+			code := tt.code(sms.code(t))
+			if tt.twice {
+				if err := svc.VerifySMSChallenge(ctx, u.ID, code); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := svc.VerifySMSChallenge(ctx, u.ID, code); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSMSChallengeAttemptLimit(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		misses  int
+		restart bool
+		wantErr error
+	}{
+		{name: "no misses", misses: 0},
+		{name: "four misses", misses: 4},
+		{name: "five misses burn the challenge", misses: 5, wantErr: token.ErrTooManyAttempts},
+		{name: "new challenge starts afresh", misses: 5, restart: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sms := &recordingSMS{}
+			svc, store := newService(t, user.WithSMSSender(sms), user.WithTokenManager(newTokenService(t)))
+			u := seedUserWithPhone(t, store, "+15550100")
+
+			if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+				t.Fatal(err)
+			}
+			code := sms.code(t)
+			for i := 0; i < tt.misses; i++ {
+				if err := svc.VerifySMSChallenge(ctx, u.ID, code+"0"); !errors.Is(err, user.ErrInvalidSMSCode) {
+					t.Fatalf("miss %d: got %v, want ErrInvalidSMSCode", i+1, err)
+				}
+			}
+			if tt.restart {
+				if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+					t.Fatal(err)
+				}
+				code = sms.code(t)
+			}
+
+			if err := svc.VerifySMSChallenge(ctx, u.ID, code); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("right code: got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				// The challenge is gone, not merely locked for one call.
+				if err := svc.VerifySMSChallenge(ctx, u.ID, code); !errors.Is(err, user.ErrInvalidSMSCode) {
+					t.Errorf("after burning: got %v, want ErrInvalidSMSCode", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSMSChallengeReplacesEarlierCode(t *testing.T) {
+	ctx := context.Background()
+	sms := &recordingSMS{}
+	svc, store := newService(t, user.WithSMSSender(sms), user.WithTokenManager(newTokenService(t)))
+	u := seedUserWithPhone(t, store, "+15550100")
+
+	if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	first := sms.code(t)
+	if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	second := sms.code(t)
+
+	if first != second {
+		if err := svc.VerifySMSChallenge(ctx, u.ID, first); !errors.Is(err, user.ErrInvalidSMSCode) {
+			t.Errorf("earlier code: got %v, want ErrInvalidSMSCode", err)
+		}
+	}
+	if err := svc.VerifySMSChallenge(ctx, u.ID, second); err != nil {
+		t.Errorf("latest code: %v", err)
+	}
+}
+
+func TestSMSChallengeOtherUsersCode(t *testing.T) {
+	ctx := context.Background()
+	sms := &recordingSMS{}
+	svc, store := newService(t, user.WithSMSSender(sms), user.WithTokenManager(newTokenService(t)))
+	alice := seedUserWithPhone(t, store, "+15550100")
+	bob := seedUserWithPhone(t, store, "+15550101")
+
+	if err := svc.StartSMSChallenge(ctx, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.VerifySMSChallenge(ctx, bob.ID, sms.code(t)); !errors.Is(err, user.ErrInvalidSMSCode) {
+		t.Fatalf("got %v, want ErrInvalidSMSCode", err)
+	}
+}
+
+func TestStartSMSChallengeErrors(t *testing.T) {
+	ctx := context.Background()
+	errGateway := errors.New("gateway down")
+
+	tests := []struct {
+		name    string
+		opts    func(t *testing.T) []user.Option
+		phone   string
+		wantErr error
+	}{
+		{
+			name:    "no sender",
+			opts:    func(t *testing.T) []user.Option { return []user.Option{user.WithTokenManager(newTokenService(t))} },
+			phone:   "+15550100",
+			wantErr: user.ErrSMSNotConfigured,
+		},
+		{
+			name:    "no token manager",
+			opts:    func(t *testing.T) []user.Option { return []user.Option{user.WithSMSSender(&recordingSMS{})} },
+			phone:   "+15550100",
+			wantErr: user.ErrTokensNotConfigured,
+		},
+		{
+			name: "no phone",
+			opts: func(t *testing.T) []user.Option {
+				return []user.Option{user.WithSMSSender(&recordingSMS{}), user.WithTokenManager(newTokenService(t))}
+			},
+			wantErr: user.ErrNoPhoneNumber,
+		},
+		{
+			name: "gateway error",
+			opts: func(t *testing.T) []user.Option {
+				return []user.Option{user.WithSMSSender(&recordingSMS{err: errGateway}), user.WithTokenManager(newTokenService(t))}
+			},
+			phone:   "+15550100",
+			wantErr: errGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, tt.opts(t)...)
+			u := seedUserWithPhone(t, store, tt.phone)
+
+			if err := svc.StartSMSChallenge(ctx, u.ID); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySMSChallengeExpired(t *testing.T) {
+	ctx := context.Background()
+	sms := &recordingSMS{}
+	// Codes expire a nanosecond after they are issued.
+	tokens := token.NewTokenService(tokentest.NewMemoryTokenRepo(),
+		token.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		token.WithTTLs(map[string]time.Duration{token.ScopeSMSChallenge: time.Nanosecond}))
+	svc, store := newService(t, user.WithSMSSender(sms), user.WithTokenManager(tokens))
+	u := seedUserWithPhone(t, store, "+15550100")
+
+	if err := svc.StartSMSChallenge(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := svc.VerifySMSChallenge(ctx, u.ID, sms.code(t)); !errors.Is(err, token.ErrTokenExpired) {
+		t.Fatalf("got %v, want ErrTokenExpired", err)
+	}
+}
@@ -0,0 +1,134 @@
+package user
+
+import (
+	"context"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// StrengthEstimator scores a password from 0 (trivially guessable) to 4
+// (very strong), in the spirit of zxcvbn.
+type StrengthEstimator interface {
+	Score(password string) int
+}
+
+// commonPasswordBases are words that on their own, or decorated with digits
+// and symbols, top every leaked password list.
+var commonPasswordBases = map[string]bool{
+	"password": true,
+	"passw0rd": true,
+	"qwerty":   true,
+	"qwertyui": true,
+	"letmein":  true,
+	"welcome":  true,
+	"admin":    true,
+	"iloveyou": true,
+	"monkey":   true,
+	"dragon":   true,
+	"abc123":   true,
+	"123456":   true,
+	"12345678": true,
+	"football": true,
+	"baseball": true,
+	"sunshine": true,
+	"princess": true,
+	"trustno1": true,
+	"zdeploy":  true,
+}
+
+// EntropyEstimator scores passwords by the brute-force entropy of their
+// length and character classes. Common passwords with digits or symbols
+// tacked on score zero regardless of length. It favors long passphrases
+// over short, symbol-laden passwords.
+type EntropyEstimator struct{}
+
+func (EntropyEstimator) Score(password string) int {
+	base := strings.TrimRightFunc(strings.ToLower(password), func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	if commonPasswordBases[base] || commonPasswordBases[strings.ToLower(password)] {
+		return 0
+	}
+
+	var lower, upper, digit, other bool
+	distinct := make(map[rune]bool)
+	for _, r := range password {
+		distinct[r] = true
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	charset := 0
+	if lower {
+		charset += 26
+	}
+	if upper {
+		charset += 26
+	}
+	if digit {
+		charset += 10
+	}
+	if other {
+		charset += 33
+	}
+	if charset == 0 {
+		return 0
+	}
+
+	// Repeated characters add little, so count at most twice the number
+	// of distinct characters.
+	length := min(len([]rune(password)), 2*len(distinct))
+	bits := float64(length) * math.Log2(float64(charset))
+
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// PasswordCheck is CheckPasswordStrength's verdict in a form suited to live
+// form feedback.
+type PasswordCheck struct {
+	// Err is why CreateUser would reject the password, or nil.
+	Err error `json:"-"`
+	// Score is the configured StrengthEstimator's score, or -1 without one.
+	Score    int `json:"score"`
+	MinScore int `json:"min_score"`
+}
+
+// Acceptable reports whether CreateUser would accept the password.
+func (c PasswordCheck) Acceptable() bool {
+	return c.Err == nil
+}
+
+// CheckPasswordStrength runs the same password policy as CreateUser,
+// including strength and breach checks, without a username or any database
+// access. Use it to give feedback before an account exists.
+func (s *UserService) CheckPasswordStrength(ctx context.Context, password string) PasswordCheck {
+	check := PasswordCheck{
+		Err:      s.validatePassword(ctx, password),
+		Score:    -1,
+		MinScore: s.minStrength,
+	}
+	if s.strength != nil {
+		check.Score = s.strength.Score(password)
+	}
+	return check
+}
@@ -0,0 +1,121 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestEntropyEstimator(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"abcde", 0},
+		{"abcdef", 1},
+		{"abcdefgh", 2},
+		{"aaaaaaaaaaaaaaaaaaaa", 0},
+		{"password", 0},
+		{"Password1", 0},
+		{"QWERTY123!", 0},
+		{"zdeploy2024", 0},
+		{"Tr0ub4dor&3", 3},
+		{"correct horse battery staple", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := (user.EntropyEstimator{}).Score(tt.password); got != tt.want {
+				t.Errorf("Score(%q) = %d, want %d", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateUserStrength(t *testing.T) {
+	const passphrase = "correct horse battery staple"
+
+	tests := []struct {
+		name        string
+		password    string
+		composition bool
+		estimator   bool
+		wantErr     error
+	}{
+		{name: "composition rejects passphrase", password: passphrase, composition: true, wantErr: user.ErrInvalidPassword},
+		{name: "composition accepts weak password", password: "Password1", composition: true},
+		{name: "estimator accepts passphrase", password: passphrase, estimator: true},
+		{name: "estimator rejects weak password", password: "Password1", estimator: true, wantErr: user.ErrPasswordTooWeak},
+		{name: "both rules apply", password: "Password1", composition: true, estimator: true, wantErr: user.ErrPasswordTooWeak},
+		{name: "length still applies", password: "Xk9$", estimator: true, wantErr: user.ErrInvalidPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []user.Option{user.WithPasswordCompositionRules(tt.composition)}
+			if tt.estimator {
+				opts = append(opts, user.WithStrengthEstimator(user.EntropyEstimator{}, 3))
+			}
+			svc, _ := newService(t, opts...)
+
+			_, err := svc.CreateUser(context.Background(), "newcomer", tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordStrengthMatchesCreateUser(t *testing.T) {
+	ctx := context.Background()
+
+	policies := []struct {
+		name      string
+		opts      []user.Option
+		wantScore bool
+	}{
+		{name: "default"},
+		{
+			name:      "estimator without composition",
+			opts:      []user.Option{user.WithPasswordCompositionRules(false), user.WithStrengthEstimator(user.EntropyEstimator{}, 3)},
+			wantScore: true,
+		},
+		{
+			name: "breach checker",
+			opts: []user.Option{user.WithBreachChecker(stubBreachChecker{breached: true})},
+		},
+	}
+	passwords := []string{
+		"short1A",
+		"alllowercase1",
+		"Password1",
+		"correct horse battery staple",
+		testutil.DefaultPassword,
+		strings.Repeat("Aa1", 25),
+	}
+
+	for _, p := range policies {
+		for _, password := range passwords {
+			t.Run(p.name+"/"+password, func(t *testing.T) {
+				svc, _ := newService(t, p.opts...)
+				_, createErr := svc.CreateUser(ctx, "newcomer", password)
+
+				// The checker needs no store: a nil one would panic if used.
+				check := user.NewUserService(nil, p.opts...).CheckPasswordStrength(ctx, password)
+
+				if (check.Err == nil) != (createErr == nil) || (createErr != nil && !errors.Is(createErr, check.Err)) {
+					t.Errorf("CheckPasswordStrength = %v, CreateUser = %v", check.Err, createErr)
+				}
+				if check.Acceptable() != (createErr == nil) {
+					t.Errorf("Acceptable = %v with CreateUser error %v", check.Acceptable(), createErr)
+				}
+				if got := check.Score >= 0; got != p.wantScore {
+					t.Errorf("Score = %d, want a score: %v", check.Score, p.wantScore)
+				}
+			})
+		}
+	}
+}
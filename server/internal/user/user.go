@@ -1,10 +1,8 @@
 package user
 
 import (
-	"errors"
+	"encoding/json"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type password struct {
@@ -13,7 +11,11 @@ type password struct {
 }
 
 func (p *password) Set(plainTextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plainTextPassword), 12)
+	return p.SetWithHasher(DefaultHasher, plainTextPassword)
+}
+
+func (p *password) SetWithHasher(hasher Hasher, plainTextPassword string) error {
+	hash, err := hasher.Hash(plainTextPassword)
 	if err != nil {
 		return err
 	}
@@ -22,17 +24,14 @@ func (p *password) Set(plainTextPassword string) error {
 	return nil
 }
 
+// Matches verifies against whichever algorithm produced the stored hash, so
+// hashes from a previous default keep working after the default changes.
+// A user without a password, such as a federated one, matches nothing.
 func (p *password) Matches(plainTextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plainTextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+	if len(p.hash) == 0 {
+		return false, nil
 	}
-	return true, nil
+	return compareHash(p.hash, plainTextPassword)
 }
 
 func (p *password) ClearPlainText() {
@@ -44,12 +43,109 @@ func (p *password) IsSet() bool {
 }
 
 type User struct {
-	ID           int64      `json:"id"`
-	Username     string     `json:"username"`
-	PasswordHash password   `json:"-"`
-	CreatedAt    time.Time  `json:"created_at"`
-	ApprovedAt   *time.Time `json:"approved_at,omitempty"`
-	ApprovedBy   *int64     `json:"-"`
-	IsAdmin      bool       `json:"is_admin"`
-	Status       string     `json:"status"`
+	ID                 int64      `json:"id"`
+	Username           string     `json:"username"`
+	PasswordHash       password   `json:"-"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ApprovedAt         *time.Time `json:"approved_at,omitempty"`
+	ApprovedBy         *int64     `json:"-"`
+	Role               Role       `json:"role"`
+	Status             string     `json:"status"`
+	MustChangePassword bool       `json:"-"`
+	PasswordChangedAt  time.Time  `json:"-"`
+	NormalizedUsername string     `json:"-"`
+	Disabled           bool       `json:"-"`
+	DeleteAfter        *time.Time `json:"-"`
+	EmailVerifiedAt    *time.Time `json:"email_verified_at,omitempty"`
+	SuspendedUntil     *time.Time `json:"-"`
+	Phone              *string    `json:"-"`
+	Version            int        `json:"-"`
+	FailedLogins       int        `json:"-"`
+	LockedUntil        *time.Time `json:"-"`
+	Emails             []Email    `json:"-"`
+}
+
+// MarshalJSON encodes the user's public fields. It keeps the is_admin flag
+// clients read before roles existed. Account state and contact details are
+// only in AdminUser.
+func (u User) MarshalJSON() ([]byte, error) {
+	type plain User
+	return json.Marshal(struct {
+		plain
+		IsAdmin bool `json:"is_admin"`
+	}{plain(u), u.IsAdmin()})
+}
+
+// UserStats summarizes the user table for the admin dashboard. Suspended
+// counts users whose suspension has not yet lapsed; ByStatus breaks the
+// total down by the status column. Users scheduled for deletion can no
+// longer log in and are counted only in PendingDeletion.
+type UserStats struct {
+	Total           int            `json:"total"`
+	Pending         int            `json:"pending"`
+	Approved        int            `json:"approved"`
+	Suspended       int            `json:"suspended"`
+	Admins          int            `json:"admins"`
+	PendingDeletion int            `json:"pending_deletion"`
+	ByStatus        map[string]int `json:"by_status"`
+}
+
+// IsApproved reports whether an admin has approved the user. A zero
+// ApprovedAt is treated the same as no approval.
+func (u *User) IsApproved() bool {
+	return u.ApprovedAt != nil && !u.ApprovedAt.IsZero()
+}
+
+// IsSuspended reports whether a suspension is in effect at now. Suspensions
+// lapse on their own once SuspendedUntil has passed.
+func (u *User) IsSuspended(now time.Time) bool {
+	return u.SuspendedUntil != nil && now.Before(*u.SuspendedUntil)
+}
+
+// IsAdmin reports whether the user holds the super-admin role.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleSuperAdmin
+}
+
+// AdminUser is the representation of a user for admin views. Unlike the
+// default JSON form of User it includes who approved the account, the
+// account's state and the user's contact details.
+type AdminUser struct {
+	ID                 int64      `json:"id"`
+	Username           string     `json:"username"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ApprovedAt         *time.Time `json:"approved_at,omitempty"`
+	ApprovedBy         *int64     `json:"approved_by,omitempty"`
+	Role               Role       `json:"role"`
+	Status             string     `json:"status"`
+	MustChangePassword bool       `json:"must_change_password"`
+	PasswordChangedAt  time.Time  `json:"password_changed_at"`
+	Disabled           bool       `json:"disabled"`
+	DeleteAfter        *time.Time `json:"delete_after,omitempty"`
+	EmailVerifiedAt    *time.Time `json:"email_verified_at,omitempty"`
+	SuspendedUntil     *time.Time `json:"suspended_until,omitempty"`
+	Phone              *string    `json:"phone,omitempty"`
+	Emails             []Email    `json:"emails,omitempty"`
+	IsAdmin            bool       `json:"is_admin"`
+}
+
+func (u *User) Admin() AdminUser {
+	return AdminUser{
+		ID:                 u.ID,
+		Username:           u.Username,
+		CreatedAt:          u.CreatedAt,
+		ApprovedAt:         u.ApprovedAt,
+		ApprovedBy:         u.ApprovedBy,
+		Role:               u.Role,
+		Status:             u.Status,
+		MustChangePassword: u.MustChangePassword,
+		PasswordChangedAt:  u.PasswordChangedAt,
+		Disabled:           u.Disabled,
+		DeleteAfter:        u.DeleteAfter,
+		EmailVerifiedAt:    u.EmailVerifiedAt,
+		SuspendedUntil:     u.SuspendedUntil,
+		Phone:              u.Phone,
+		Emails:             u.Emails,
+		IsAdmin:            u.IsAdmin(),
+	}
 }
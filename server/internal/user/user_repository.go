@@ -4,93 +4,1196 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/samokw/zdeploy/server/internal/dbretry"
 )
 
+// ErrNotFound is returned by UserStore lookups, updates and deletes when no
+// matching user exists.
+var ErrNotFound = errors.New("user: not found")
+
+// ErrConcurrentUpdate is returned by UpdateUser when the row changed after
+// the user was read. Re-read the user and apply the change again.
+var ErrConcurrentUpdate = errors.New("user: modified concurrently")
+
 type UserStore interface {
 	CreateUser(ctx context.Context, user *User) error
+	CreateUserBootstrapAdmin(ctx context.Context, user *User) error
+	CountUsers(ctx context.Context) (int, error)
+	CountPendingUsers(ctx context.Context) (int, error)
+	CountAdmins(ctx context.Context) (int, error)
+	GetUserStats(ctx context.Context, now time.Time) (*UserStats, error)
 	GetUserByID(ctx context.Context, id int64) (*User, error)
+	GetUsersByIDs(ctx context.Context, ids []int64) (map[int64]*User, error)
+	GetUsersByUsernames(ctx context.Context, normalizedUsernames []string) (map[string]*User, error)
+	ListEmails(ctx context.Context, userID int64) ([]Email, error)
+	AddEmail(ctx context.Context, userID int64, address string) error
+	MarkEmailVerified(ctx context.Context, userID int64, address string, verifiedAt time.Time) error
+	SetPrimaryEmail(ctx context.Context, userID int64, address string) error
+	RemoveEmail(ctx context.Context, userID int64, address string) error
 	GetUserByUsername(ctx context.Context, username string) (*User, error)
 	UpdateUser(ctx context.Context, user *User) error
+	ChangeUsername(ctx context.Context, userID int64, username, normalizedUsername string) error
 	DeleteUserByUsername(ctx context.Context, username string) error
+	PurgeScheduledDeletions(ctx context.Context, now time.Time) ([]int64, error)
+	PurgeStalePending(ctx context.Context, pendingBefore time.Time) ([]int64, error)
 	GetUserToken(ctx context.Context, scope, tokenPlainText string) (*User, error)
+	AddPasswordHistory(ctx context.Context, userID int64, hash []byte) error
+	ListPasswordHistory(ctx context.Context, userID int64, limit int) ([][]byte, error)
 
 	// Admin methods
 	ApproveUser(ctx context.Context, userID, approvedBy int64) error
+	UnapproveUser(ctx context.Context, userID int64) error
+	RecordApproval(ctx context.Context, userID, approverID int64) (bool, error)
+	CountApprovals(ctx context.Context, userID int64) (int, error)
 	ListUsers(ctx context.Context, limit, offset int) ([]*User, error)
+	ListUsersOrdered(ctx context.Context, order UserOrder, limit, offset int) ([]*User, error)
 	ListPendingUsers(ctx context.Context, limit, offset int) ([]*User, error)
+	ListAdmins(ctx context.Context, limit, offset int) ([]*User, error)
+	ListUsersApprovedBetween(ctx context.Context, start, end time.Time, limit, offset int) ([]*User, error)
+	ListUsersApprovedBy(ctx context.Context, approverID int64, limit, offset int) ([]*User, error)
+	SearchUsersByUsername(ctx context.Context, fragment string, limit, offset int) ([]*User, error)
+	RecordCommand(ctx context.Context, cmd *Command) error
+	LastCommand(ctx context.Context, adminID int64) (*Command, error)
+	MarkCommandUndone(ctx context.Context, commandID int64, undoneAt time.Time) error
+	MergeUsers(ctx context.Context, keepID, mergeID int64) (int, []int64, error)
+	CreateUserWithIdentities(ctx context.Context, user *User, identities []Identity) error
+	ListIdentities(ctx context.Context, userIDs []int64) (map[int64][]Identity, error)
+	ListUsersAfterID(ctx context.Context, afterID int64, limit int) ([]*User, error)
+	RecordFailedLogin(ctx context.Context, normalizedUsername string, maxFailures int, lockUntil time.Time) (int64, bool, error)
+	ClearFailedLogins(ctx context.Context, userID int64) error
+	GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	CreateFederatedUser(ctx context.Context, user *User, provider, subject string) error
+}
+
+// userColumns is the column list every user query selects, in the order
+// scanUser expects.
+//
+// Rows written before roles existed have no role; their is_admin flag is
+// mapped to the super-admin role.
+const userColumns = `id, username, password_hash, created_at, approved_at, approved_by,
+	COALESCE(role, CASE WHEN is_admin THEN 'super_admin' ELSE 'user' END), status, must_change_password,
+	password_changed_at, username_normalized, disabled, delete_after, email_verified_at,
+	suspended_until, phone, version, failed_logins, locked_until`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.PasswordHash.hash,
+		&user.CreatedAt,
+		&user.ApprovedAt,
+		&user.ApprovedBy,
+		&user.Role,
+		&user.Status,
+		&user.MustChangePassword,
+		&user.PasswordChangedAt,
+		&user.NormalizedUsername,
+		&user.Disabled,
+		&user.DeleteAfter,
+		&user.EmailVerifiedAt,
+		&user.SuspendedUntil,
+		&user.Phone,
+		&user.Version,
+		&user.FailedLogins,
+		&user.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func scanUsers(rows *sql.Rows) ([]*User, error) {
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func scanIDs(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+type UserRepo struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+	retryPolicy  dbretry.Policy
+}
+
+type RepoOption func(*UserRepo)
+
+// WithQueryTimeout bounds each query by timeout when the caller's context
+// has no deadline of its own.
+func WithQueryTimeout(timeout time.Duration) RepoOption {
+	return func(ur *UserRepo) {
+		ur.queryTimeout = timeout
+	}
+}
+
+// WithRetry retries reads and idempotent updates that fail with a transient
+// error, such as a dropped connection. Retries are off by default.
+func WithRetry(policy dbretry.Policy) RepoOption {
+	return func(ur *UserRepo) {
+		ur.retryPolicy = policy
+	}
+}
+
+func NewUserRepo(db *sql.DB, opts ...RepoOption) *UserRepo {
+	ur := &UserRepo{
+		db: db,
+	}
+	for _, opt := range opts {
+		opt(ur)
+	}
+	return ur
+}
+
+func (ur *UserRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ur.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, ur.queryTimeout)
+}
+
+// queryUser runs a single-row user query, retrying transient failures. A
+// missing row is returned as ErrNotFound.
+func (ur *UserRepo) queryUser(ctx context.Context, query string, args ...any) (*User, error) {
+	var user *User
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		var err error
+		user, err = scanUser(ur.db.QueryRowContext(ctx, query, args...))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (ur *UserRepo) queryUsers(ctx context.Context, query string, args ...any) ([]*User, error) {
+	var users []*User
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		rows, err := ur.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		users, err = scanUsers(rows)
+		return err
+	})
+	return users, err
+}
+
+// exec runs a statement that is safe to repeat, retrying transient failures.
+func (ur *UserRepo) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		var err error
+		result, err = ur.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Ping reports whether the database is reachable and able to answer queries.
+func (ur *UserRepo) Ping(ctx context.Context) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	if err := ur.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("user repo: ping failed: %w", err)
+	}
+
+	var one int
+	if err := ur.db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("user repo: select 1 failed: %w", err)
+	}
+	return nil
+}
+
+func (ur *UserRepo) CreateUser(ctx context.Context, user *User) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	return insertUser(ctx, ur.db, user)
+}
+
+// GetUserByIdentity returns the user linked to an external identity
+// provider's subject, or ErrNotFound.
+func (ur *UserRepo) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)
+	`
+	return ur.queryUser(ctx, query, provider, subject)
+}
+
+// CreateFederatedUser inserts user and links it to provider's subject in one
+// transaction. If the identity is already linked, nothing is inserted and
+// ErrIdentityExists is returned.
+func (ur *UserRepo) CreateFederatedUser(ctx context.Context, user *User, provider, subject string) error {
+	return ur.CreateUserWithIdentities(ctx, user, []Identity{{Provider: provider, Subject: subject}})
+}
+
+// CreateUserWithIdentities inserts user and links it to every identity in
+// one transaction. If any identity is already linked, nothing is inserted
+// and ErrIdentityExists is returned.
+func (ur *UserRepo) CreateUserWithIdentities(ctx context.Context, user *User, identities []Identity) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO user_identities (provider, subject, user_id)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (provider, subject) DO NOTHING
+	`
+	for _, identity := range identities {
+		result, err := tx.ExecContext(ctx, query, identity.Provider, identity.Subject, user.ID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrIdentityExists
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListIdentities returns the identities linked to each of userIDs, ordered
+// by provider and subject. Users with none are omitted from the map.
+func (ur *UserRepo) ListIdentities(ctx context.Context, userIDs []int64) (map[int64][]Identity, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	identities := make(map[int64][]Identity)
+	if len(userIDs) == 0 {
+		return identities, nil
+	}
+
+	query := `
+	SELECT user_id, provider, subject
+	FROM user_identities
+	WHERE user_id = ANY($1::bigint[])
+	ORDER BY user_id, provider, subject
+	`
+	rows, err := ur.db.QueryContext(ctx, query, int64ArrayLiteral(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		var identity Identity
+		if err := rows.Scan(&userID, &identity.Provider, &identity.Subject); err != nil {
+			return nil, err
+		}
+		identities[userID] = append(identities[userID], identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// CreateUserBootstrapAdmin inserts user, promoting it to an approved admin
+// when the users table is empty. The table lock makes concurrent first
+// signups wait, so only one of them can see the empty table.
+func (ur *UserRepo) CreateUserBootstrapAdmin(ctx context.Context, user *User) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	count, err := countUsers(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		now := time.Now()
+		user.Role = RoleSuperAdmin
+		user.Status = "active"
+		user.ApprovedAt = &now
+	}
+
+	if err := insertUser(ctx, tx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertUser(ctx context.Context, q querier, user *User) error {
+	query := `
+	INSERT INTO users (username, password_hash, status, role, is_admin, approved_at, must_change_password,
+		password_changed_at, username_normalized, disabled, email_verified_at, phone)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	RETURNING id, created_at
+	`
+	err := q.QueryRowContext(ctx, query,
+		user.Username,
+		user.PasswordHash.hash,
+		user.Status,
+		user.Role,
+		user.IsAdmin(),
+		user.ApprovedAt,
+		user.MustChangePassword,
+		user.PasswordChangedAt,
+		user.NormalizedUsername,
+		user.Disabled,
+		user.EmailVerifiedAt,
+		user.Phone,
+	).Scan(&user.ID, &user.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// CountUsers counts users, leaving out those scheduled for deletion.
+func (ur *UserRepo) CountUsers(ctx context.Context) (int, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT COUNT(*)
+	FROM users
+	WHERE delete_after IS NULL
+	`
+	var count int
+	err := ur.db.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// countUsers counts every row, including users scheduled for deletion, who
+// still hold their usernames until they are purged.
+func countUsers(ctx context.Context, q querier) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountPendingUsers counts unapproved users, leaving out those scheduled
+// for deletion.
+func (ur *UserRepo) CountPendingUsers(ctx context.Context) (int, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT COUNT(*)
+	FROM users
+	WHERE approved_at IS NULL AND delete_after IS NULL
+	`
+	var count int
+	err := ur.db.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (ur *UserRepo) CountAdmins(ctx context.Context) (int, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT COUNT(*)
+	FROM users
+	WHERE is_admin = true
+	`
+	var count int
+	err := ur.db.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetUserStats computes every dashboard count in one pass over the table,
+// grouping by status and totalling the groups. Users scheduled for deletion
+// are counted only in PendingDeletion.
+func (ur *UserRepo) GetUserStats(ctx context.Context, now time.Time) (*UserStats, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT status,
+		COUNT(*) FILTER (WHERE delete_after IS NULL),
+		COUNT(*) FILTER (WHERE delete_after IS NULL AND approved_at IS NULL),
+		COUNT(*) FILTER (WHERE delete_after IS NULL AND approved_at IS NOT NULL),
+		COUNT(*) FILTER (WHERE delete_after IS NULL AND suspended_until > $1),
+		COUNT(*) FILTER (WHERE delete_after IS NULL AND is_admin = true),
+		COUNT(*) FILTER (WHERE delete_after IS NOT NULL)
+	FROM users
+	GROUP BY status
+	`
+	var stats *UserStats
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		rows, err := ur.db.QueryContext(ctx, query, now)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		stats = &UserStats{ByStatus: make(map[string]int)}
+		for rows.Next() {
+			var status string
+			var total, pending, approved, suspended, admins, pendingDeletion int
+			if err := rows.Scan(&status, &total, &pending, &approved, &suspended, &admins, &pendingDeletion); err != nil {
+				return err
+			}
+			if total > 0 {
+				stats.ByStatus[status] = total
+			}
+			stats.Total += total
+			stats.Pending += pending
+			stats.Approved += approved
+			stats.Suspended += suspended
+			stats.Admins += admins
+			stats.PendingDeletion += pendingDeletion
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetUserByUsername looks a user up by the normalized form of their
+// username, as produced by the service.
+func (ur *UserRepo) GetUserByUsername(ctx context.Context, normalizedUsername string) (*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE username_normalized = $1
+	`
+	return ur.queryUser(ctx, query, normalizedUsername)
+}
+
+// WithTx runs fn in a transaction, committing if it returns nil and rolling
+// back otherwise. It is the unit of work for read-modify-write sequences
+// such as GetUserByUsernameForUpdate followed by an update.
+func (ur *UserRepo) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUserByUsernameForUpdate is GetUserByUsername inside tx, locking the
+// row until tx ends so concurrent read-modify-write sequences on the same
+// user are serialized. Use it from a WithTx callback.
+func (ur *UserRepo) GetUserByUsernameForUpdate(ctx context.Context, tx *sql.Tx, normalizedUsername string) (*User, error) {
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE username_normalized = $1
+	FOR UPDATE
+	`
+	user, err := scanUser(tx.QueryRowContext(ctx, query, normalizedUsername))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RecordFailedLogin counts a failed login for the user, holding the row
+// lock so concurrent failures on any instance are all counted. When the
+// count reaches maxFailures it is reset and the account is locked until
+// lockUntil, or longer if an earlier lockout already runs past it. It
+// returns the user's ID and whether this failure locked the account.
+func (ur *UserRepo) RecordFailedLogin(ctx context.Context, normalizedUsername string, maxFailures int, lockUntil time.Time) (int64, bool, error) {
+	var userID int64
+	var locked bool
+	err := ur.WithTx(ctx, func(tx *sql.Tx) error {
+		user, err := ur.GetUserByUsernameForUpdate(ctx, tx, normalizedUsername)
+		if err != nil {
+			return err
+		}
+		userID = user.ID
+
+		failures := user.FailedLogins + 1
+		lockedUntil := user.LockedUntil
+		if failures >= maxFailures {
+			failures = 0
+			locked = true
+			if lockedUntil == nil || lockedUntil.Before(lockUntil) {
+				lockedUntil = &lockUntil
+			}
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE users SET failed_logins = $1, locked_until = $2 WHERE id = $3`,
+			failures, lockedUntil, userID,
+		)
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return userID, locked, nil
+}
+
+// ClearFailedLogins resets the user's failed-login count and lifts any
+// lockout.
+func (ur *UserRepo) ClearFailedLogins(ctx context.Context, userID int64) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	_, err := ur.exec(ctx, `UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1`, userID)
+	return err
+}
+
+func (ur *UserRepo) UpdateUser(ctx context.Context, user *User) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE users
+	SET username = $1, password_hash = $2, status = $3, role = $4, is_admin = $5, approved_at = $6, approved_by = $7,
+		must_change_password = $8, password_changed_at = $9, username_normalized = $10, disabled = $11,
+		delete_after = $12, email_verified_at = $13, suspended_until = $14, phone = $15,
+		version = version + 1
+	WHERE id = $16 AND version = $17
+	`
+	// Not retried: if a dropped connection hid a successful update, the
+	// retry would find the version already bumped and report a spurious
+	// ErrConcurrentUpdate.
+	result, err := ur.db.ExecContext(ctx, query,
+		user.Username,
+		user.PasswordHash.hash,
+		user.Status,
+		user.Role,
+		user.IsAdmin(),
+		user.ApprovedAt,
+		user.ApprovedBy,
+		user.MustChangePassword,
+		user.PasswordChangedAt,
+		user.NormalizedUsername,
+		user.Disabled,
+		user.DeleteAfter,
+		user.EmailVerifiedAt,
+		user.SuspendedUntil,
+		user.Phone,
+		user.ID,
+		user.Version,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		err := ur.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, user.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrConcurrentUpdate
+		}
+		return ErrNotFound
+	}
+	user.Version++
+	return nil
+}
+
+// ChangeUsername renames a user and records the old name in
+// username_history. It returns ErrUserAlreadyExists if another user holds
+// normalizedUsername and ErrNotFound if the user does not exist.
+func (ur *UserRepo) ChangeUsername(ctx context.Context, userID int64, username, normalizedUsername string) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldUsername string
+	err = tx.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&oldUsername)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var taken bool
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM users
+		WHERE username_normalized = $1 AND id <> $2
+	)
+	`
+	if err := tx.QueryRowContext(ctx, query, normalizedUsername, userID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return ErrUserAlreadyExists
+	}
+
+	query = `
+	UPDATE users
+	SET username = $1, username_normalized = $2, version = version + 1
+	WHERE id = $3
+	`
+	if _, err := tx.ExecContext(ctx, query, username, normalizedUsername, userID); err != nil {
+		return err
+	}
+
+	query = `
+	INSERT INTO username_history (user_id, old_username, new_username)
+	VALUES ($1, $2, $3)
+	`
+	if _, err := tx.ExecContext(ctx, query, userID, oldUsername, username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ur *UserRepo) DeleteUserByUsername(ctx context.Context, normalizedUsername string) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM users
+	WHERE username_normalized = $1
+	`
+	result, err := ur.db.ExecContext(ctx, query, normalizedUsername)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MergeUsers folds mergeID into keepID in one transaction: tokens, email
+// addresses, federated identities, username history, approvals mergeID
+// granted and commands it issued move to keepID; its password history and
+// the approvals and commands that targeted it are deleted; then mergeID
+// itself is deleted. It returns how many tokens moved and the IDs of users
+// whose approved_by changed.
+func (ur *UserRepo) MergeUsers(ctx context.Context, keepID, mergeID int64) (int, []int64, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE tokens SET user_id = $1 WHERE user_id = $2`, keepID, mergeID)
+	if err != nil {
+		return 0, nil, err
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+	UPDATE users
+	SET approved_by = $1, version = version + 1
+	WHERE approved_by = $2
+	RETURNING id
+	`, keepID, mergeID)
+	if err != nil {
+		return 0, nil, err
+	}
+	reapproved, err := scanIDs(rows)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Approvals mergeID gave move to keepID unless keepID already gave the
+	// same one; approvals of mergeID itself go with it.
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO user_approvals (user_id, approver_id)
+		SELECT user_id, $1 FROM user_approvals WHERE approver_id = $2 AND user_id <> $1
+		ON CONFLICT (user_id, approver_id) DO NOTHING`, []any{keepID, mergeID}},
+		{`DELETE FROM user_approvals WHERE approver_id = $1 OR user_id = $1`, []any{mergeID}},
+		{`DELETE FROM password_history WHERE user_id = $1`, []any{mergeID}},
+		{`UPDATE user_emails
+		SET user_id = $1,
+			is_primary = is_primary AND NOT EXISTS (SELECT 1 FROM user_emails WHERE user_id = $1 AND is_primary)
+		WHERE user_id = $2`, []any{keepID, mergeID}},
+		{`UPDATE user_identities SET user_id = $1 WHERE user_id = $2`, []any{keepID, mergeID}},
+		{`UPDATE username_history SET user_id = $1 WHERE user_id = $2`, []any{keepID, mergeID}},
+		{`UPDATE command_log SET admin_id = $1 WHERE admin_id = $2`, []any{keepID, mergeID}},
+		{`DELETE FROM command_log WHERE target_id = $1`, []any{mergeID}},
+	}
+	for _, st := range statements {
+		if _, err := tx.ExecContext(ctx, st.query, st.args...); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	result, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, mergeID)
+	if err != nil {
+		return 0, nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+	if rowsAffected == 0 {
+		return 0, nil, ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return int(moved), reapproved, nil
+}
+
+// PurgeScheduledDeletions deletes users whose scheduled deletion time has
+// passed, together with their tokens, and returns the IDs of the removed
+// users.
+func (ur *UserRepo) PurgeScheduledDeletions(ctx context.Context, now time.Time) ([]int64, error) {
+	return ur.purgeUsers(ctx, `delete_after IS NOT NULL AND delete_after <= $1`, now)
+}
+
+// PurgeStalePending deletes unapproved users who have been pending since
+// before pendingBefore, together with their tokens, and returns the IDs of
+// the removed users. A user
+// returned to pending by UnapproveUser counts from that moment rather than
+// from signup, and users holding some of their required sign-offs are kept.
+func (ur *UserRepo) PurgeStalePending(ctx context.Context, pendingBefore time.Time) ([]int64, error) {
+	return ur.purgeUsers(ctx, `approved_at IS NULL
+		AND COALESCE(pending_since, created_at) < $1
+		AND NOT EXISTS (SELECT 1 FROM user_approvals WHERE user_approvals.user_id = users.id)`, pendingBefore)
+}
+
+// purgeUsers deletes the users matching where, and their tokens, in one
+// transaction so no token outlives its user. where may refer to $1, which
+// is bound to arg.
+func (ur *UserRepo) purgeUsers(ctx context.Context, where string, arg any) ([]int64, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id IN (SELECT id FROM users WHERE ` + where + `)
+	`
+	if _, err := tx.ExecContext(ctx, query, arg); err != nil {
+		return nil, err
+	}
+
+	query = `
+	DELETE FROM users
+	WHERE ` + where + `
+	RETURNING id
+	`
+	rows, err := tx.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (ur *UserRepo) GetUserToken(ctx context.Context, scope, tokenPlainText string) (*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE id = (
+		SELECT user_id
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+	)
+	`
+	return ur.queryUser(ctx, query, tokenHash[:], scope, time.Now())
+}
+
+func (ur *UserRepo) AddPasswordHistory(ctx context.Context, userID int64, hash []byte) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	INSERT INTO password_history (user_id, password_hash)
+	VALUES ($1, $2)
+	`
+	_, err := ur.db.ExecContext(ctx, query, userID, hash)
+	return err
+}
+
+func (ur *UserRepo) ListPasswordHistory(ctx context.Context, userID int64, limit int) ([][]byte, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT password_hash
+	FROM password_history
+	WHERE user_id = $1
+	ORDER BY created_at DESC
+	LIMIT $2
+	`
+	rows, err := ur.db.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes [][]byte
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// Admin-specific methods
+func (ur *UserRepo) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE id = $1
+	`
+	return ur.queryUser(ctx, query, id)
+}
+
+// GetUsersByIDs fetches several users in one query. IDs with no matching
+// user are absent from the result.
+func (ur *UserRepo) GetUsersByIDs(ctx context.Context, ids []int64) (map[int64]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	users := make(map[int64]*User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE id = ANY($1::bigint[])
+	`
+	found, err := ur.queryUsers(ctx, query, int64ArrayLiteral(ids))
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range found {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
+// GetUsersByUsernames looks up several users by normalized username in one
+// query. The map is keyed by normalized username; missing names are omitted.
+func (ur *UserRepo) GetUsersByUsernames(ctx context.Context, normalizedUsernames []string) (map[string]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	users := make(map[string]*User, len(normalizedUsernames))
+	if len(normalizedUsernames) == 0 {
+		return users, nil
+	}
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE username_normalized = ANY($1::text[])
+	`
+	found, err := ur.queryUsers(ctx, query, textArrayLiteral(normalizedUsernames))
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range found {
+		users[user.NormalizedUsername] = user
+	}
+	return users, nil
 }
 
-type UserRepo struct {
-	db *sql.DB
+// textArrayQuoter escapes an element for a double-quoted array literal.
+var textArrayQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// textArrayLiteral formats values as a Postgres array literal, quoting each
+// element so commas and braces are taken literally.
+func textArrayLiteral(values []string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = `"` + textArrayQuoter.Replace(v) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
 }
 
-func NewUserRepo(db *sql.DB) *UserRepo {
-	return &UserRepo{
-		db: db,
+// int64ArrayLiteral formats ids as a Postgres array literal, which any
+// driver can pass as a plain string parameter.
+func int64ArrayLiteral(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
 	}
+	return "{" + strings.Join(parts, ",") + "}"
 }
 
-func (ur *UserRepo) CreateUser(ctx context.Context, user *User) error {
+func (ur *UserRepo) ApproveUser(ctx context.Context, userID, approvedBy int64) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	INSERT INTO users (username, password_hash, status, is_admin)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at
+	UPDATE users
+	SET approved_at = CURRENT_TIMESTAMP, approved_by = $1, version = version + 1
+	WHERE id = $2
 	`
-	err := ur.db.QueryRowContext(ctx, query,
-		user.Username,
-		user.PasswordHash.hash,
-		user.Status,
-		user.IsAdmin,
-	).Scan(&user.ID, &user.CreatedAt)
+	result, err := ur.db.ExecContext(ctx, query, approvedBy, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-func (ur *UserRepo) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	user := &User{
-		PasswordHash: password{},
+// UnapproveUser returns a user to pending and forgets the sign-offs that
+// approved them, so re-approval needs a fresh quorum.
+func (ur *UserRepo) UnapproveUser(ctx context.Context, userID int64) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
 	query := `
-	SELECT id, username, password_hash, created_at, approved_at, approved_by, is_admin, status
-	FROM users
-	WHERE username = $1
+	UPDATE users
+	SET approved_at = NULL, approved_by = NULL, pending_since = CURRENT_TIMESTAMP, version = version + 1
+	WHERE id = $1
 	`
-	err := ur.db.QueryRowContext(ctx, query, username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.PasswordHash.hash,
-		&user.CreatedAt,
-		&user.ApprovedAt,
-		&user.ApprovedBy,
-		&user.IsAdmin,
-		&user.Status,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	result, err := tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_approvals WHERE user_id = $1`, userID); err != nil {
+		return err
 	}
+
+	return tx.Commit()
+}
+
+// ListEmails returns the user's email addresses, primary first.
+func (ur *UserRepo) ListEmails(ctx context.Context, userID int64) ([]Email, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT email, verified_at, is_primary
+	FROM user_emails
+	WHERE user_id = $1
+	ORDER BY is_primary DESC, email
+	`
+	var emails []Email
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		rows, err := ur.db.QueryContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		emails = nil
+		for rows.Next() {
+			var email Email
+			if err := rows.Scan(&email.Address, &email.VerifiedAt, &email.Primary); err != nil {
+				return err
+			}
+			emails = append(emails, email)
+		}
+		return rows.Err()
+	})
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+	return emails, nil
 }
 
-func (ur *UserRepo) UpdateUser(ctx context.Context, user *User) error {
+// AddEmail stores an unverified address for the user. Addresses are unique
+// across users; a duplicate returns ErrEmailTaken. The address becomes the
+// primary one if the user has none; the user's row is locked while that is
+// decided, so concurrent adds cannot both become primary.
+func (ur *UserRepo) AddEmail(ctx context.Context, userID int64, address string) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockUser(ctx, tx, userID); err != nil {
+		return err
+	}
+
 	query := `
-	UPDATE users
-	SET username = $1, status = $2, is_admin = $3, approved_at = $4, approved_by = $5
-	WHERE id = $6
+	INSERT INTO user_emails (user_id, email, is_primary)
+	VALUES ($1, $2, NOT EXISTS (SELECT 1 FROM user_emails WHERE user_id = $1 AND is_primary))
+	ON CONFLICT (email) DO NOTHING
 	`
-	result, err := ur.db.ExecContext(ctx, query,
-		user.Username,
-		user.Status,
-		user.IsAdmin,
-		user.ApprovedAt,
-		user.ApprovedBy,
-		user.ID,
-	)
+	result, err := tx.ExecContext(ctx, query, userID, address)
 	if err != nil {
 		return err
 	}
@@ -99,17 +1202,34 @@ func (ur *UserRepo) UpdateUser(ctx context.Context, user *User) error {
 		return err
 	}
 	if rowsAffected == 0 {
-		return sql.ErrNoRows
+		return ErrEmailTaken
 	}
-	return nil
+
+	return tx.Commit()
+}
+
+// lockUser takes a row lock on the user for the rest of tx, serializing
+// changes to rows that hang off the user. It returns ErrNotFound if the user
+// does not exist.
+func lockUser(ctx context.Context, tx *sql.Tx, userID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
 }
 
-func (ur *UserRepo) DeleteUserByUsername(ctx context.Context, username string) error {
+func (ur *UserRepo) MarkEmailVerified(ctx context.Context, userID int64, address string, verifiedAt time.Time) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	DELETE FROM users
-	WHERE username = $1
+	UPDATE user_emails
+	SET verified_at = $3
+	WHERE user_id = $1 AND email = $2
 	`
-	result, err := ur.db.ExecContext(ctx, query, username)
+	result, err := ur.exec(ctx, query, userID, address, verifiedAt)
 	if err != nil {
 		return err
 	}
@@ -118,79 +1238,137 @@ func (ur *UserRepo) DeleteUserByUsername(ctx context.Context, username string) e
 		return err
 	}
 	if rowsAffected == 0 {
-		return sql.ErrNoRows
+		return ErrNotFound
 	}
 	return nil
 }
 
-func (ur *UserRepo) GetUserToken(ctx context.Context, scope, tokenPlainText string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+// SetPrimaryEmail makes address the user's only primary address.
+func (ur *UserRepo) SetPrimaryEmail(ctx context.Context, userID int64, address string) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
 
-	query := `
-	SELECT u.id, u.username, u.password_hash, u.created_at, u.approved_at, u.approved_by, u.is_admin, u.status
-	FROM users u
-	INNER JOIN tokens t ON t.user_id = u.id
-	WHERE t.hash = $1 AND t.scope = $2 AND t.expiry > $3
-	`
-	user := &User{
-		PasswordHash: password{},
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	err := ur.db.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
-		&user.ID,
-		&user.Username,
-		&user.PasswordHash.hash,
-		&user.CreatedAt,
-		&user.ApprovedAt,
-		&user.ApprovedBy,
-		&user.IsAdmin,
-		&user.Status,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	if err := lockUser(ctx, tx, userID); err != nil {
+		return err
 	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM user_emails WHERE user_id = $1 AND email = $2)`,
+		userID, address,
+	).Scan(&exists)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return user, nil
+	if !exists {
+		return ErrNotFound
+	}
+
+	// Clear the old primary first so a unique index on primary addresses
+	// is never violated mid-statement.
+	if _, err := tx.ExecContext(ctx, `UPDATE user_emails SET is_primary = false WHERE user_id = $1 AND is_primary`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_emails SET is_primary = true WHERE user_id = $1 AND email = $2`, userID, address); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// Admin-specific methods
-func (ur *UserRepo) GetUserByID(ctx context.Context, id int64) (*User, error) {
-	user := &User{
-		PasswordHash: password{},
+func (ur *UserRepo) RemoveEmail(ctx context.Context, userID int64, address string) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	result, err := ur.db.ExecContext(ctx, `DELETE FROM user_emails WHERE user_id = $1 AND email = $2`, userID, address)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordCommand appends cmd to the command log, setting its ID and
+// CreatedAt.
+func (ur *UserRepo) RecordCommand(ctx context.Context, cmd *Command) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	before, err := json.Marshal(cmd.Before)
+	if err != nil {
+		return err
 	}
+	after, err := json.Marshal(cmd.After)
+	if err != nil {
+		return err
+	}
+
 	query := `
-	SELECT id, username, password_hash, created_at, approved_at, approved_by, is_admin, status
-	FROM users
-	WHERE id = $1
+	INSERT INTO command_log (admin_id, target_id, action, before, after)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at
 	`
-	err := ur.db.QueryRowContext(ctx, query, id).Scan(
-		&user.ID,
-		&user.Username,
-		&user.PasswordHash.hash,
-		&user.CreatedAt,
-		&user.ApprovedAt,
-		&user.ApprovedBy,
-		&user.IsAdmin,
-		&user.Status,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+	return ur.db.QueryRowContext(ctx, query, cmd.AdminID, cmd.TargetID, cmd.Action, before, after).
+		Scan(&cmd.ID, &cmd.CreatedAt)
+}
+
+// LastCommand returns the admin's most recent command that has not been
+// undone, or ErrNotFound.
+func (ur *UserRepo) LastCommand(ctx context.Context, adminID int64) (*Command, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT id, admin_id, target_id, action, before, after, created_at, undone_at
+	FROM command_log
+	WHERE admin_id = $1 AND undone_at IS NULL
+	ORDER BY id DESC
+	LIMIT 1
+	`
+	var cmd Command
+	var before, after []byte
+	err := dbretry.Do(ctx, ur.retryPolicy, func() error {
+		return ur.db.QueryRowContext(ctx, query, adminID).Scan(
+			&cmd.ID, &cmd.AdminID, &cmd.TargetID, &cmd.Action, &before, &after, &cmd.CreatedAt, &cmd.UndoneAt,
+		)
+	})
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
-	return user, nil
+	if err := json.Unmarshal(before, &cmd.Before); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(after, &cmd.After); err != nil {
+		return nil, err
+	}
+	return &cmd, nil
 }
 
-func (ur *UserRepo) ApproveUser(ctx context.Context, userID, approvedBy int64) error {
+func (ur *UserRepo) MarkCommandUndone(ctx context.Context, commandID int64, undoneAt time.Time) error {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	UPDATE users
-	SET approved_at = CURRENT_TIMESTAMP, approved_by = $1
-	WHERE id = $2
+	UPDATE command_log
+	SET undone_at = $2
+	WHERE id = $1 AND undone_at IS NULL
 	`
-	result, err := ur.db.ExecContext(ctx, query, approvedBy, userID)
+	result, err := ur.exec(ctx, query, commandID, undoneAt)
 	if err != nil {
 		return err
 	}
@@ -199,90 +1377,189 @@ func (ur *UserRepo) ApproveUser(ctx context.Context, userID, approvedBy int64) e
 		return err
 	}
 	if rowsAffected == 0 {
-		return sql.ErrNoRows
+		return ErrNotFound
 	}
 	return nil
 }
 
+// RecordApproval stores an approver's sign-off for a user. It reports false
+// when that approver had already signed off.
+func (ur *UserRepo) RecordApproval(ctx context.Context, userID, approverID int64) (bool, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	INSERT INTO user_approvals (user_id, approver_id)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id, approver_id) DO NOTHING
+	`
+	result, err := ur.db.ExecContext(ctx, query, userID, approverID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func (ur *UserRepo) CountApprovals(ctx context.Context, userID int64) (int, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT COUNT(DISTINCT approver_id)
+	FROM user_approvals
+	WHERE user_id = $1
+	`
+	var count int
+	err := ur.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ListUsers pages through users, newest first. Like CountUsers, it leaves
+// out users scheduled for deletion.
 func (ur *UserRepo) ListUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	SELECT id, username, password_hash, created_at, approved_at, approved_by, is_admin, status
+	SELECT ` + userColumns + `
 	FROM users
+	WHERE delete_after IS NULL
 	ORDER BY created_at DESC
 	LIMIT $1 OFFSET $2
 	`
-	rows, err := ur.db.QueryContext(ctx, query, limit, offset)
+	return ur.queryUsers(ctx, query, limit, offset)
+}
+
+// ListUsersOrdered is ListUsers sorted by order, which is checked against
+// the allowlist of sortable columns before it reaches the query.
+func (ur *UserRepo) ListUsersOrdered(ctx context.Context, order UserOrder, limit, offset int) ([]*User, error) {
+	orderBy, err := order.orderBy()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var users []*User
-	for rows.Next() {
-		user := &User{
-			PasswordHash: password{},
-		}
-		err := rows.Scan(
-			&user.ID,
-			&user.Username,
-			&user.PasswordHash.hash,
-			&user.CreatedAt,
-			&user.ApprovedAt,
-			&user.ApprovedBy,
-			&user.IsAdmin,
-			&user.Status,
-		)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
-	}
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
 
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE delete_after IS NULL
+	` + orderBy + `
+	LIMIT $1 OFFSET $2
+	`
+	return ur.queryUsers(ctx, query, limit, offset)
+}
 
-	return users, nil
+// ListUsersAfterID returns up to limit users with an ID above afterID, in
+// ID order. Passing the last ID of one page as afterID of the next walks
+// every user exactly once, even while users are created or deleted.
+func (ur *UserRepo) ListUsersAfterID(ctx context.Context, afterID int64, limit int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE id > $1
+	ORDER BY id
+	LIMIT $2
+	`
+	return ur.queryUsers(ctx, query, afterID, limit)
 }
 
+// ListPendingUsers pages through unapproved users, newest first. Like
+// CountPendingUsers, it leaves out users scheduled for deletion.
 func (ur *UserRepo) ListPendingUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
 	query := `
-	SELECT id, username, password_hash, created_at, approved_at, approved_by, is_admin, status
+	SELECT ` + userColumns + `
 	FROM users
-	WHERE approved_at IS NULL
+	WHERE approved_at IS NULL AND delete_after IS NULL
 	ORDER BY created_at DESC
 	LIMIT $1 OFFSET $2
 	`
-	rows, err := ur.db.QueryContext(ctx, query, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return ur.queryUsers(ctx, query, limit, offset)
+}
 
-	var users []*User
-	for rows.Next() {
-		user := &User{
-			PasswordHash: password{},
-		}
-		err := rows.Scan(
-			&user.ID,
-			&user.Username,
-			&user.PasswordHash.hash,
-			&user.CreatedAt,
-			&user.ApprovedAt,
-			&user.ApprovedBy,
-			&user.IsAdmin,
-			&user.Status,
-		)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+func (ur *UserRepo) ListAdmins(ctx context.Context, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE is_admin = true
+	ORDER BY created_at DESC
+	LIMIT $1 OFFSET $2
+	`
+	return ur.queryUsers(ctx, query, limit, offset)
+}
+
+func (ur *UserRepo) ListUsersApprovedBetween(ctx context.Context, start, end time.Time, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	if start.After(end) {
+		return []*User{}, nil
 	}
 
-	if err = rows.Err(); err != nil {
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE approved_at IS NOT NULL AND approved_at BETWEEN $1 AND $2
+	ORDER BY approved_at DESC
+	LIMIT $3 OFFSET $4
+	`
+	return ur.queryUsers(ctx, query, start, end, limit, offset)
+}
+
+// ListUsersApprovedBy returns the users whose final approval came from
+// approverID, most recent first. An approver that approved no one, or does
+// not exist, yields an empty list.
+func (ur *UserRepo) ListUsersApprovedBy(ctx context.Context, approverID int64, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE approved_by = $1
+	ORDER BY approved_at DESC
+	LIMIT $2 OFFSET $3
+	`
+	users, err := ur.queryUsers(ctx, query, approverID, limit, offset)
+	if err != nil {
 		return nil, err
 	}
-
+	if users == nil {
+		users = []*User{}
+	}
 	return users, nil
 }
+
+// likeEscaper escapes LIKE wildcards so user input only matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (ur *UserRepo) SearchUsersByUsername(ctx context.Context, fragment string, limit, offset int) ([]*User, error) {
+	ctx, cancel := ur.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users
+	WHERE username ILIKE '%' || $1 || '%' ESCAPE '\'
+	ORDER BY username ASC
+	LIMIT $2 OFFSET $3
+	`
+	return ur.queryUsers(ctx, query, likeEscaper.Replace(fragment), limit, offset)
+}
@@ -0,0 +1,453 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/dbretry"
+)
+
+func TestUpdateUserIsNotRetried(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"connection reset", syscall.ECONNRESET},
+		{"unexpected EOF", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDriver{exec: failExec(tt.err)}
+			db := sql.OpenDB(d)
+			defer db.Close()
+
+			repo := NewUserRepo(db, WithRetry(dbretry.Policy{MaxRetries: 3}))
+			err := repo.UpdateUser(context.Background(), &User{ID: 1, Version: 1})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if n := len(d.execs); n != 1 {
+				t.Fatalf("UPDATE ran %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestExecRetriesTransientErrors(t *testing.T) {
+	d := &fakeDriver{exec: failExec(syscall.ECONNRESET)}
+	db := sql.OpenDB(d)
+	defer db.Close()
+
+	repo := NewUserRepo(db, WithRetry(dbretry.Policy{MaxRetries: 3}))
+	if _, err := repo.exec(context.Background(), "UPDATE users SET status = $1", "active"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got %v, want ECONNRESET", err)
+	}
+	if n := len(d.execs); n != 4 {
+		t.Fatalf("exec ran %d times, want 4", n)
+	}
+}
+
+func TestOrderByUsesAllowlistedColumns(t *testing.T) {
+	tests := []struct {
+		order   UserOrder
+		want    string
+		wantErr error
+	}{
+		{UserOrder{}, "ORDER BY created_at DESC NULLS LAST, id DESC", nil},
+		{UserOrder{Column: SortByUsername, Direction: SortAsc}, "ORDER BY username_normalized ASC NULLS LAST, id ASC", nil},
+		{UserOrder{Column: SortByApprovedAt}, "ORDER BY approved_at DESC NULLS LAST, id DESC", nil},
+		{UserOrder{Column: "created_at; DROP TABLE users"}, "", ErrInvalidOrder},
+		{UserOrder{Direction: "asc, password_hash"}, "", ErrInvalidOrder},
+	}
+	for _, tt := range tests {
+		got, err := tt.order.orderBy()
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%+v: got %v, want %v", tt.order, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		pingErr  error
+		queryErr error
+		wantErr  error
+		wantText string
+	}{
+		{name: "healthy"},
+		{name: "unreachable", pingErr: errDown, wantErr: errDown, wantText: "ping failed"},
+		{name: "cannot query", queryErr: errDown, wantErr: errDown, wantText: "select 1 failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := sql.OpenDB(&fakeDriver{
+				pingErr: tt.pingErr,
+				query: func(*fakeConn, string, []driver.NamedValue) (driver.Rows, error) {
+					if tt.queryErr != nil {
+						return nil, tt.queryErr
+					}
+					return rowsOf([]string{"?column?"}, []driver.Value{int64(1)}), nil
+				},
+			})
+			defer db.Close()
+
+			err := NewUserRepo(db).Ping(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("error %q does not mention %q", err, tt.wantText)
+			}
+		})
+	}
+}
+
+// failExec answers every statement with err.
+func failExec(err error) func(*fakeConn, string, []driver.NamedValue) (driver.Result, error) {
+	return func(*fakeConn, string, []driver.NamedValue) (driver.Result, error) {
+		return nil, err
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	callerDeadline := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		ctxDeadline  *time.Time
+		wantDeadline bool
+		wantCaller   bool
+	}{
+		{name: "no timeout configured"},
+		{name: "timeout applied", timeout: time.Second, wantDeadline: true},
+		{name: "caller deadline kept", timeout: time.Second, ctxDeadline: &callerDeadline, wantDeadline: true, wantCaller: true},
+		{name: "caller deadline without timeout", ctxDeadline: &callerDeadline, wantDeadline: true, wantCaller: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.ctxDeadline != nil {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, *tt.ctxDeadline)
+				defer cancel()
+			}
+
+			repo := NewUserRepo(nil, WithQueryTimeout(tt.timeout))
+			ctx, cancel := repo.withTimeout(ctx)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if ok != tt.wantDeadline {
+				t.Fatalf("has deadline = %v, want %v", ok, tt.wantDeadline)
+			}
+			if !ok {
+				return
+			}
+			if tt.wantCaller && !deadline.Equal(callerDeadline) {
+				t.Errorf("deadline = %v, want the caller's %v", deadline, callerDeadline)
+			}
+			if !tt.wantCaller && time.Until(deadline) > tt.timeout {
+				t.Errorf("deadline %v is further out than the %v timeout", deadline, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestInt64ArrayLiteral(t *testing.T) {
+	tests := []struct {
+		ids  []int64
+		want string
+	}{
+		{nil, "{}"},
+		{[]int64{7}, "{7}"},
+		{[]int64{1, 2, 3}, "{1,2,3}"},
+		{[]int64{-1, 9223372036854775807}, "{-1,9223372036854775807}"},
+	}
+	for _, tt := range tests {
+		if got := int64ArrayLiteral(tt.ids); got != tt.want {
+			t.Errorf("int64ArrayLiteral(%v) = %q, want %q", tt.ids, got, tt.want)
+		}
+	}
+}
+
+func TestGetUsersByIDsSkipsEmptyQuery(t *testing.T) {
+	// A nil *sql.DB would panic if the repository tried to query it.
+	users, err := NewUserRepo(nil).GetUsersByIDs(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users == nil || len(users) != 0 {
+		t.Errorf("got %v, want an empty map", users)
+	}
+}
+
+// TestUserRepoNotFound checks that every lookup, update and delete of a
+// missing user reports ErrNotFound rather than sql.ErrNoRows or a nil user.
+func TestUserRepoNotFound(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func(repo *UserRepo) error
+	}{
+		{"GetUserByID", func(repo *UserRepo) error {
+			u, err := repo.GetUserByID(ctx, 1)
+			if u != nil {
+				return errors.New("non-nil user")
+			}
+			return err
+		}},
+		{"GetUserByUsername", func(repo *UserRepo) error {
+			u, err := repo.GetUserByUsername(ctx, "ghost")
+			if u != nil {
+				return errors.New("non-nil user")
+			}
+			return err
+		}},
+		{"UpdateUser", func(repo *UserRepo) error { return repo.UpdateUser(ctx, &User{ID: 1, Version: 1}) }},
+		{"DeleteUserByUsername", func(repo *UserRepo) error { return repo.DeleteUserByUsername(ctx, "ghost") }},
+		{"ApproveUser", func(repo *UserRepo) error { return repo.ApproveUser(ctx, 1, 2) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := sql.OpenDB(&fakeDriver{})
+			defer db.Close()
+
+			err := tt.call(NewUserRepo(db))
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("got %v, want ErrNotFound", err)
+			}
+			if errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("%v leaks sql.ErrNoRows", err)
+			}
+		})
+	}
+}
+
+func TestGetUserStatsSumsGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]driver.Value
+		want UserStats
+	}{
+		{
+			name: "no users",
+			want: UserStats{ByStatus: map[string]int{}},
+		},
+		{
+			name: "several statuses",
+			rows: [][]driver.Value{
+				{"active", int64(5), int64(0), int64(5), int64(1), int64(2), int64(0)},
+				{"pending", int64(3), int64(3), int64(0), int64(0), int64(0), int64(0)},
+				{"disabled", int64(1), int64(0), int64(1), int64(1), int64(0), int64(0)},
+			},
+			want: UserStats{
+				Total: 9, Pending: 3, Approved: 6, Suspended: 2, Admins: 2,
+				ByStatus: map[string]int{"active": 5, "pending": 3, "disabled": 1},
+			},
+		},
+		{
+			name: "scheduled for deletion",
+			rows: [][]driver.Value{
+				{"active", int64(2), int64(0), int64(2), int64(0), int64(1), int64(1)},
+				{"disabled", int64(0), int64(0), int64(0), int64(0), int64(0), int64(2)},
+			},
+			want: UserStats{
+				Total: 2, Approved: 2, Admins: 1, PendingDeletion: 3,
+				ByStatus: map[string]int{"active": 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &fakeDriver{query: func(*fakeConn, string, []driver.NamedValue) (driver.Rows, error) {
+				cols := []string{"status", "total", "pending", "approved", "suspended", "admins", "pending_deletion"}
+				return rowsOf(cols, tt.rows...), nil
+			}}
+			db := sql.OpenDB(d)
+			defer db.Close()
+
+			got, err := NewUserRepo(db).GetUserStats(context.Background(), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(d.queries) != 1 {
+				t.Errorf("ran %d queries, want 1", len(d.queries))
+			}
+			if got.Total != tt.want.Total || got.Pending != tt.want.Pending || got.Approved != tt.want.Approved ||
+				got.Suspended != tt.want.Suspended || got.Admins != tt.want.Admins ||
+				got.PendingDeletion != tt.want.PendingDeletion {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+			if !maps.Equal(got.ByStatus, tt.want.ByStatus) {
+				t.Errorf("ByStatus = %v, want %v", got.ByStatus, tt.want.ByStatus)
+			}
+		})
+	}
+}
+
+func TestTextArrayLiteral(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, "{}"},
+		{[]string{"alice"}, `{"alice"}`},
+		{[]string{"alice", "bob"}, `{"alice","bob"}`},
+		{[]string{"a,b", "{c}"}, `{"a,b","{c}"}`},
+		{[]string{`say "hi"`, `back\slash`}, `{"say \"hi\"","back\\slash"}`},
+		{[]string{""}, `{""}`},
+	}
+	for _, tt := range tests {
+		if got := textArrayLiteral(tt.values); got != tt.want {
+			t.Errorf("textArrayLiteral(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestGetUsersByUsernamesSkipsEmptyQuery(t *testing.T) {
+	// A nil *sql.DB would panic if the repository tried to query it.
+	users, err := NewUserRepo(nil).GetUsersByUsernames(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users == nil || len(users) != 0 {
+		t.Errorf("got %v, want an empty map", users)
+	}
+}
+
+func TestRecordFailedLoginSerializesIncrements(t *testing.T) {
+	const workers = 20
+
+	tests := []struct {
+		name        string
+		maxFailures int
+		wantFailed  int64
+		wantLocks   int
+	}{
+		{name: "below threshold", maxFailures: workers + 1, wantFailed: workers},
+		{name: "reaches threshold", maxFailures: workers, wantFailed: 0, wantLocks: 1},
+		{name: "reaches threshold twice", maxFailures: workers / 2, wantFailed: 0, wantLocks: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := &usersRow{}
+			db := sql.OpenDB(row.driver())
+			defer db.Close()
+			repo := NewUserRepo(db)
+			lockUntil := time.Now().Add(time.Hour)
+
+			var wg sync.WaitGroup
+			var locks atomic.Int32
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, locked, err := repo.RecordFailedLogin(context.Background(), "alice", tt.maxFailures, lockUntil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if locked {
+						locks.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if n := row.unlocked.Load(); n != 0 {
+				t.Errorf("%d row-locking reads ran outside a transaction", n)
+			}
+			if row.failed != tt.wantFailed {
+				t.Errorf("failed_logins = %d, want %d", row.failed, tt.wantFailed)
+			}
+			if int(locks.Load()) != tt.wantLocks {
+				t.Errorf("%d failures locked the account, want %d", locks.Load(), tt.wantLocks)
+			}
+			if (row.lockedUntil != nil) != (tt.wantLocks > 0) {
+				t.Errorf("locked_until = %v, want set: %v", row.lockedUntil, tt.wantLocks > 0)
+			}
+		})
+	}
+}
+
+func TestGetUserByUsernameForUpdateNotFound(t *testing.T) {
+	db := sql.OpenDB(&fakeDriver{})
+	defer db.Close()
+	repo := NewUserRepo(db)
+
+	err := repo.WithTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := repo.GetUserByUsernameForUpdate(context.Background(), tx, "ghost")
+		return err
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+// usersRow is a database/sql stand-in for a single users row. lock is taken
+// by SELECT ... FOR UPDATE for the rest of the transaction, as Postgres
+// does, and UPDATE writes failed_logins and locked_until.
+type usersRow struct {
+	lock        sync.Mutex
+	failed      int64
+	lockedUntil *time.Time
+	unlocked    atomic.Int32 // FOR UPDATE queries run outside a transaction
+}
+
+func (r *usersRow) driver() *fakeDriver {
+	return &fakeDriver{query: r.query, exec: r.exec}
+}
+
+func (r *usersRow) query(c *fakeConn, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "FOR UPDATE") {
+		return nil, errors.New("unexpected query")
+	}
+	if !c.inTx {
+		r.unlocked.Add(1)
+	} else if c.onEnd == nil {
+		r.lock.Lock()
+		c.onEnd = r.lock.Unlock
+	}
+	var lockedUntil driver.Value
+	if r.lockedUntil != nil {
+		lockedUntil = *r.lockedUntil
+	}
+	now := time.Now()
+	values := []driver.Value{
+		int64(1), "alice", []byte("hash"), now, now, nil, "user", "active", false,
+		now, "alice", false, nil, nil, nil, nil, int64(1), r.failed, lockedUntil,
+	}
+	// Widen the window between read and write so a missing lock would
+	// lose increments.
+	time.Sleep(time.Millisecond)
+	return rowsOf(columns(len(values)), values), nil
+}
+
+func (r *usersRow) exec(c *fakeConn, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(strings.TrimSpace(query), "UPDATE users") {
+		return nil, errors.New("unexpected statement")
+	}
+	r.failed = args[0].Value.(int64)
+	if until, ok := args[1].Value.(time.Time); ok {
+		r.lockedUntil = &until
+	}
+	return driver.RowsAffected(1), nil
+}
@@ -4,8 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samokw/zdeploy/server/internal/requestid"
+	"github.com/samokw/zdeploy/server/internal/securityevents"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultPasswordHistoryDepth is how many of a user's most recent passwords,
+// including the current one, cannot be reused.
+const DefaultPasswordHistoryDepth = 5
+
+// DefaultMaxListLimit is the largest page the list methods return unless
+// WithMaxListLimit changes it. HardMaxListLimit bounds that setting so a
+// misconfiguration cannot request unbounded rows.
+const (
+	DefaultMaxListLimit = 100
+	HardMaxListLimit    = 5000
 )
 
 var (
@@ -16,260 +38,1673 @@ var (
 	ErrUserNotApproved     = errors.New("user not approved")
 	ErrUnauthorized        = errors.New("unauthorized")
 	ErrUserAlreadyApproved = errors.New("user already approved")
+
+	ErrPasswordChangeRequired = errors.New("password change required")
+	ErrPasswordReused         = errors.New("password was used recently")
+	ErrPasswordExpired        = errors.New("password expired")
+	ErrSearchTermTooShort     = errors.New("search term too short")
+	ErrReservedUsername       = errors.New("username is reserved")
+	ErrUserDisabled           = errors.New("user disabled")
+	ErrAlreadyApprovedByYou   = errors.New("user already approved by this admin")
+	ErrInvalidCredentials     = errors.New("invalid username or password")
+	ErrInvalidRole            = errors.New("invalid role")
+	ErrPasswordBreached       = errors.New("password has appeared in a data breach")
+	ErrEmailNotVerified       = errors.New("email not verified")
+	ErrPasswordTooLong        = errors.New("password must be at most 72 bytes")
+	ErrPasswordTooWeak        = errors.New("password is too easy to guess")
+	ErrUserSuspended          = errors.New("user is suspended")
+	ErrTokensNotConfigured    = errors.New("token service not configured")
 )
 
-type UserService struct {
-	repo UserStore
-}
+// TokenManager is the subset of token.TokenService the user service relies
+// on.
+type TokenManager interface {
+	ValidateToken(ctx context.Context, plaintext string, scope string) (*token.Token, error)
+	CreateEmailVerificationToken(ctx context.Context, userID int64) (*token.Token, error)
+	CreateElevatedToken(ctx context.Context, userID int64) (*token.Token, error)
+	CreateEmailAddressVerificationToken(ctx context.Context, userID int64, address string) (*token.Token, error)
+	RevokeToken(ctx context.Context, hash []byte) error
+	RevokeAllUserTokens(ctx context.Context, userID int, scope string) error
+	RevokeAllUserTokensAllScopes(ctx context.Context, userID int) (int, error)
+	FindUserIDByTokenPlaintext(ctx context.Context, plaintext string, adminID int64) (int, error)
+	SummarizeTokens(ctx context.Context, userID int) (*token.UserTokenSummary, error)
+	CreateSMSChallenge(ctx context.Context, userID int64) (string, error)
+	VerifySMSChallenge(ctx context.Context, userID int64, code string) error
+}
+
+type UserService struct {
+	repo                 UserStore
+	hasher               Hasher
+	events               UserEvents
+	tokens               TokenManager
+	sms                  SMSSender
+	metrics              Metrics
+	logger               *slog.Logger
+	breachChecker        BreachChecker
+	breachFailClosed     bool
+	skipComposition      bool
+	strength             StrengthEstimator
+	minStrength          int
+	passwordHistoryDepth int
+	passwordMaxAge       time.Duration
+	bootstrapFirstAdmin  bool
+	autoApprove          bool
+	securityEvents       securityevents.EventRecorder
+	resetLinkSecret      []byte
+	resetLinkTTL         time.Duration
+	unicodeUsernames     bool
+	usernameNormalizer   UsernameNormalizer
+	usernameMinLength    int
+	usernameMaxLength    int
+	requiredApprovals    int
+	maxListLimit         int
+	requireVerifiedEmail bool
+	revokeDeployTokens   bool
+	revokeOnDemotion     bool
+	elevationRequired    bool
+	lockoutThreshold     int
+	lockoutDuration      time.Duration
+	lockoutNotifier      LockoutNotifier
+	now                  func() time.Time
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+}
+
+type Option func(*UserService)
+
+// WithPasswordHistoryDepth sets how many recent passwords are rejected on
+// change. A depth of zero or less disables the check.
+func WithPasswordHistoryDepth(depth int) Option {
+	return func(s *UserService) {
+		s.passwordHistoryDepth = depth
+	}
+}
+
+// WithHasher sets the algorithm used for new password hashes. Existing
+// hashes from other algorithms still verify and are upgraded on login.
+func WithHasher(hasher Hasher) Option {
+	return func(s *UserService) {
+		s.hasher = hasher
+	}
+}
+
+// WithPasswordMaxAge makes AuthenticateUser return ErrPasswordExpired once a
+// password is older than maxAge. Zero disables expiry.
+func WithPasswordMaxAge(maxAge time.Duration) Option {
+	return func(s *UserService) {
+		s.passwordMaxAge = maxAge
+	}
+}
+
+func WithClock(now func() time.Time) Option {
+	return func(s *UserService) {
+		s.now = now
+	}
+}
+
+func WithUserEvents(events UserEvents) Option {
+	return func(s *UserService) {
+		s.events = events
+	}
+}
+
+func WithMetrics(metrics Metrics) Option {
+	return func(s *UserService) {
+		s.metrics = metrics
+	}
+}
+
+// WithLogger sets the logger operations are reported to. The default is
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *UserService) {
+		s.logger = logger
+	}
+}
+
+// WithRevokeDeployTokensOnPasswordChange also revokes the user's deploy
+// tokens when their password changes. Auth and refresh tokens are always
+// revoked.
+func WithRevokeDeployTokensOnPasswordChange(enabled bool) Option {
+	return func(s *UserService) {
+		s.revokeDeployTokens = enabled
+	}
+}
+
+// WithRevokeSessionsOnDemotion controls whether RevokeAdmin and SetUserRole
+// revoke a demoted user's auth tokens, forcing them to log in again with
+// their reduced privileges. It is on by default.
+func WithRevokeSessionsOnDemotion(enabled bool) Option {
+	return func(s *UserService) {
+		s.revokeOnDemotion = enabled
+	}
+}
+
+// WithRequireElevation makes sensitive admin operations, such as MakeAdmin
+// and RevokeAdmin, demand an elevated token from ElevatePrivileges in the
+// request context (see NewContextWithElevation). It is off by default.
+func WithRequireElevation(enabled bool) Option {
+	return func(s *UserService) {
+		s.elevationRequired = enabled
+	}
+}
+
+// WithLockout locks an account for duration after maxFailures consecutive
+// wrong passwords. While locked, logins are refused without checking the
+// password. Lockout is off by default.
+func WithLockout(maxFailures int, duration time.Duration) Option {
+	return func(s *UserService) {
+		if maxFailures > 0 && duration > 0 {
+			s.lockoutThreshold = maxFailures
+			s.lockoutDuration = duration
+		}
+	}
+}
+
+// WithLockoutNotifier is called whenever WithLockout locks an account.
+func WithLockoutNotifier(notifier LockoutNotifier) Option {
+	return func(s *UserService) {
+		s.lockoutNotifier = notifier
+	}
+}
+
+func WithSMSSender(sender SMSSender) Option {
+	return func(s *UserService) {
+		s.sms = sender
+	}
+}
+
+func WithTokenManager(tokens TokenManager) Option {
+	return func(s *UserService) {
+		s.tokens = tokens
+	}
+}
+
+// WithPasswordCompositionRules toggles the requirement for an uppercase
+// letter, a lowercase letter and a digit. It is on by default; turn it off
+// when a StrengthEstimator is in use so passphrases are accepted.
+func WithPasswordCompositionRules(enabled bool) Option {
+	return func(s *UserService) {
+		s.skipComposition = !enabled
+	}
+}
+
+// WithStrengthEstimator rejects passwords that estimator scores below
+// minScore (0-4).
+func WithStrengthEstimator(estimator StrengthEstimator, minScore int) Option {
+	return func(s *UserService) {
+		s.strength = estimator
+		s.minStrength = minScore
+	}
+}
+
+// WithBreachChecker rejects new passwords that checker reports as
+// breached. If the checker errors the password is allowed unless
+// WithBreachCheckFailClosed is set.
+func WithBreachChecker(checker BreachChecker) Option {
+	return func(s *UserService) {
+		s.breachChecker = checker
+	}
+}
+
+// WithBreachCheckFailClosed makes a breach checker error reject the
+// password instead of allowing it.
+func WithBreachCheckFailClosed(failClosed bool) Option {
+	return func(s *UserService) {
+		s.breachFailClosed = failClosed
+	}
+}
+
+// WithBootstrapFirstAdmin makes the first account created on an empty
+// install an approved admin, so there is someone to approve everyone else.
+func WithBootstrapFirstAdmin(enabled bool) Option {
+	return func(s *UserService) {
+		s.bootstrapFirstAdmin = enabled
+	}
+}
+
+// WithAutoApprove approves every new account at creation, skipping the
+// admin approval step entirely. It also bypasses WithRequiredApprovals and
+// WithRequireVerifiedEmail. Off by default.
+func WithAutoApprove(enabled bool) Option {
+	return func(s *UserService) {
+		s.autoApprove = enabled
+	}
+}
+
+// WithResetLinkSecret enables GenerateResetLink and ConsumeResetLink,
+// signing links with secret. A non-positive ttl uses DefaultResetLinkTTL.
+// Rotating the secret invalidates every outstanding link.
+func WithResetLinkSecret(secret []byte, ttl time.Duration) Option {
+	return func(s *UserService) {
+		if ttl <= 0 {
+			ttl = DefaultResetLinkTTL
+		}
+		s.resetLinkSecret = secret
+		s.resetLinkTTL = ttl
+	}
+}
+
+// WithUnicodeUsernames allows letters and digits from any script in
+// usernames instead of only ASCII.
+func WithUnicodeUsernames(enabled bool) Option {
+	return func(s *UserService) {
+		s.unicodeUsernames = enabled
+	}
+}
+
+// UsernameNormalizer maps a username to the key that uniqueness checks and
+// lookups compare. Usernames that normalize alike are the same account.
+type UsernameNormalizer func(username string) string
+
+// WithUsernameNormalizer replaces NormalizeUsername, the default, e.g. with
+// one that also drops dots or strips diacritics, or with one that returns
+// usernames verbatim. Input is trimmed of surrounding space first. Changing
+// the normalizer on a populated database does not rewrite stored keys, so
+// existing users may need their usernames re-saved.
+func WithUsernameNormalizer(normalizer UsernameNormalizer) Option {
+	return func(s *UserService) {
+		if normalizer != nil {
+			s.usernameNormalizer = normalizer
+		}
+	}
+}
+
+// WithUsernameLength sets the allowed username length in characters. The
+// default is 3 to 50. Values that are not positive, or where min exceeds
+// max, are ignored.
+func WithUsernameLength(min, max int) Option {
+	return func(s *UserService) {
+		if min > 0 && max >= min {
+			s.usernameMinLength = min
+			s.usernameMaxLength = max
+		}
+	}
+}
+
+// WithMaxListLimit raises or lowers the largest page the list methods return.
+// Values above HardMaxListLimit are capped and values below 1 are ignored.
+func WithMaxListLimit(n int) Option {
+	return func(s *UserService) {
+		if n > 0 {
+			s.maxListLimit = min(n, HardMaxListLimit)
+		}
+	}
+}
+
+// WithUserCache serves user lookups by ID from cache, invalidating entries
+// whenever the service writes to a user. Caching is off by default; a nil
+// cache keeps it off.
+func WithUserCache(cache UserCache) Option {
+	return func(s *UserService) {
+		if cache != nil {
+			s.repo = &cachingStore{UserStore: s.repo, cache: cache}
+		}
+	}
+}
+
+// WithRequiredApprovals sets how many distinct admins must approve a user
+// before the account is approved. The default is one.
+func WithRequiredApprovals(n int) Option {
+	return func(s *UserService) {
+		if n > 0 {
+			s.requiredApprovals = n
+		}
+	}
+}
+
+// WithRequireVerifiedEmail makes ApproveUser refuse users who have not
+// verified their email address.
+func WithRequireVerifiedEmail(required bool) Option {
+	return func(s *UserService) {
+		s.requireVerifiedEmail = required
+	}
+}
+
+// WithSecurityEvents records logins and password changes to recorder.
+// Recording failures are logged and never fail the operation.
+func WithSecurityEvents(recorder securityevents.EventRecorder) Option {
+	return func(s *UserService) {
+		s.securityEvents = recorder
+	}
+}
+
+func NewUserService(repo UserStore, opts ...Option) *UserService {
+	s := &UserService{
+		repo:                 repo,
+		hasher:               DefaultHasher,
+		events:               NoopUserEvents{},
+		metrics:              NoopMetrics{},
+		logger:               slog.Default(),
+		passwordHistoryDepth: DefaultPasswordHistoryDepth,
+		requiredApprovals:    1,
+		usernameMinLength:    3,
+		usernameMaxLength:    50,
+		maxListLimit:         DefaultMaxListLimit,
+		revokeOnDemotion:     true,
+		usernameNormalizer:   NormalizeUsername,
+		lockoutNotifier:      NoopLockoutNotifier{},
+		now:                  time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// logOp records the outcome of op, tagged with the request's correlation ID.
+// attrs must never include passwords or token plaintext.
+func (s *UserService) logOp(ctx context.Context, op string, err error, attrs ...any) {
+	logger := requestid.Logger(ctx, s.logger).With("op", op)
+	if err != nil {
+		logger.WarnContext(ctx, "operation failed", append(attrs, "error", err)...)
+		return
+	}
+	logger.InfoContext(ctx, "operation succeeded", attrs...)
+}
+
+// recordEvent appends a security event for userID if a recorder is
+// configured.
+func (s *UserService) recordEvent(ctx context.Context, userID int64, typ securityevents.Type, metadata map[string]any) {
+	if s.securityEvents == nil {
+		return
+	}
+	event, err := securityevents.NewEvent(userID, typ, s.now(), metadata)
+	if err == nil {
+		err = s.securityEvents.Record(ctx, event)
+	}
+	if err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "security events: record failed",
+			"user_id", userID, "type", typ, "error", err)
+	}
+}
+
+// recordLoginFailure records a failed login against the account it targeted.
+// Attempts on usernames that do not exist are not recorded.
+func (s *UserService) recordLoginFailure(ctx context.Context, username string, reason error) {
+	if s.securityEvents == nil {
+		return
+	}
+	user, err := s.repo.GetUserByUsername(ctx, s.normalizeUsername(username))
+	if err != nil {
+		return
+	}
+	s.recordEvent(ctx, user.ID, securityevents.LoginFailed, map[string]any{"reason": reason.Error()})
+}
+
+func (s *UserService) CreateUser(ctx context.Context, username, password string) (_ *User, err error) {
+	defer func() { s.logOp(ctx, "CreateUser", err, "username", username) }()
+
+	return s.createUser(ctx, username, password, false)
+}
+
+// ValidateNewUser runs every check CreateUser would and returns the first
+// error, without creating anything.
+func (s *UserService) ValidateNewUser(ctx context.Context, username, password string) error {
+	if err := s.validateUsername(username); err != nil {
+		return err
+	}
+
+	if err := s.checkReservedUsername(username); err != nil {
+		return err
+	}
+
+	if err := s.validatePassword(ctx, password); err != nil {
+		return err
+	}
+
+	taken, err := s.usernameTaken(ctx, s.normalizeUsername(username))
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUserAlreadyExists
+	}
+
+	return nil
+}
+
+func (s *UserService) createUser(ctx context.Context, username, password string, mustChangePassword bool) (*User, error) {
+	if err := s.ValidateNewUser(ctx, username, password); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		Username:           strings.TrimSpace(username),
+		NormalizedUsername: s.normalizeUsername(username),
+		Status:             "pending",
+		Role:               RoleUser,
+		MustChangePassword: mustChangePassword,
+	}
+	if s.autoApprove {
+		now := s.now()
+		user.ApprovedAt = &now
+		user.Status = "active"
+	}
+
+	if err := user.PasswordHash.SetWithHasher(s.hasher, password); err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.PasswordChangedAt = s.now()
+
+	var err error
+	if s.bootstrapFirstAdmin {
+		err = s.repo.CreateUserBootstrapAdmin(ctx, user)
+	} else {
+		err = s.repo.CreateUser(ctx, user)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.PasswordHash.ClearPlainText()
+
+	if err := s.events.OnUserCreated(ctx, user); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "user events: OnUserCreated failed", "user_id", user.ID, "error", err)
+	}
+
+	return user, nil
+}
+
+func (s *UserService) AuthenticateUser(ctx context.Context, username, password string) (_ *User, err error) {
+	defer func() { s.logOp(ctx, "AuthenticateUser", err, "username", username) }()
+
+	user, err := s.verifyCredentials(ctx, username, password)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			s.metrics.IncLoginFailure(LoginFailureInvalidCredentials)
+			s.registerFailedLogin(ctx, username)
+		case errors.Is(err, ErrUserNotApproved):
+			s.metrics.IncLoginFailure(LoginFailureNotApproved)
+		case errors.Is(err, ErrUserDisabled):
+			s.metrics.IncLoginFailure(LoginFailureDisabled)
+		case errors.Is(err, ErrUserSuspended):
+			s.metrics.IncLoginFailure(LoginFailureSuspended)
+		case errors.Is(err, ErrAccountLocked):
+			s.metrics.IncLoginFailure(LoginFailureLocked)
+		default:
+			s.metrics.IncLoginFailure(LoginFailureError)
+		}
+		s.recordLoginFailure(ctx, username, err)
+		return nil, err
+	}
+
+	s.rehashIfNeeded(ctx, user, password)
+
+	if user.MustChangePassword {
+		s.metrics.IncLoginFailure(LoginFailurePasswordChangeRequired)
+		s.recordEvent(ctx, user.ID, securityevents.LoginFailed, map[string]any{"reason": ErrPasswordChangeRequired.Error()})
+		return nil, ErrPasswordChangeRequired
+	}
+
+	if s.passwordExpired(user) {
+		s.metrics.IncLoginFailure(LoginFailurePasswordExpired)
+		s.recordEvent(ctx, user.ID, securityevents.LoginFailed, map[string]any{"reason": ErrPasswordExpired.Error()})
+		return nil, ErrPasswordExpired
+	}
+
+	s.clearFailedLogins(ctx, user)
+	s.metrics.IncLoginSuccess()
+	s.recordEvent(ctx, user.ID, securityevents.LoginSucceeded, nil)
+	return user, nil
+}
+
+func (s *UserService) passwordExpired(user *User) bool {
+	if s.passwordMaxAge <= 0 || user.PasswordChangedAt.IsZero() {
+		return false
+	}
+	return s.now().Sub(user.PasswordChangedAt) > s.passwordMaxAge
+}
+
+// rehashIfNeeded upgrades a stored hash made with another algorithm or
+// outdated settings. It is best-effort and never fails the login.
+func (s *UserService) rehashIfNeeded(ctx context.Context, user *User, password string) {
+	rehasher, ok := s.hasher.(Rehasher)
+	if !ok || !rehasher.NeedsRehash(user.PasswordHash.hash) {
+		return
+	}
+
+	previousHash := user.PasswordHash.hash
+	if err := user.PasswordHash.SetWithHasher(s.hasher, password); err != nil {
+		return
+	}
+	user.PasswordHash.ClearPlainText()
+
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		user.PasswordHash.hash = previousHash
+	}
+}
+
+// verifyCredentials checks the password and approval gate without enforcing
+// a pending password change, so ChangePassword can still be used to clear it.
+func (s *UserService) verifyCredentials(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.repo.GetUserByUsername(ctx, s.normalizeUsername(username))
+	if errors.Is(err, ErrNotFound) {
+		// Spend the same time as a real comparison so response timing does
+		// not reveal which usernames exist.
+		s.compareDummyHash(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Locked and suspended accounts are refused before the password is
+	// compared, so guesses against them are neither counted nor confirmed.
+	// The dummy comparison keeps the response time the same.
+	now := s.now()
+	if user.IsLocked(now) {
+		s.compareDummyHash(password)
+		return nil, ErrAccountLocked
+	}
+	if user.IsSuspended(now) {
+		s.compareDummyHash(password)
+		return nil, ErrUserSuspended
+	}
+
+	// Federated users have no password until they set one.
+	if !user.PasswordHash.IsSet() {
+		s.compareDummyHash(password)
+		return nil, ErrInvalidCredentials
+	}
+
+	matches, err := user.PasswordHash.Matches(password)
+	if err != nil {
+		return nil, err
+	}
+	if !matches {
+		return nil, ErrInvalidCredentials
+	}
+
+	if !user.IsApproved() {
+		return nil, ErrUserNotApproved
+	}
+
+	// Accounts pending deletion are locked out until the deletion is
+	// cancelled or carried out.
+	if user.Disabled || user.DeleteAfter != nil {
+		return nil, ErrUserDisabled
+	}
+
+	return user, nil
+}
+
+func (s *UserService) compareDummyHash(password string) {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.hasher.Hash("zdeploy-dummy-password")
+	})
+	if len(s.dummyHash) > 0 {
+		_, _ = s.hasher.Compare(s.dummyHash, password)
+	}
+}
+
+// VerifyPassword re-checks a known user's password before a sensitive
+// operation. Unlike AuthenticateUser it skips the approval gate.
+func (s *UserService) VerifyPassword(ctx context.Context, userID int64, password string) (bool, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return user.PasswordHash.Matches(password)
+}
+
+func (s *UserService) GetUserByID(ctx context.Context, id int64) (*User, error) {
+	return s.getUser(ctx, id)
+}
+
+// getUser looks a user up by ID, reporting a miss as ErrUserNotFound.
+func (s *UserService) getUser(ctx context.Context, id int64) (*User, error) {
+	user, err := s.repo.GetUserByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// authorize checks that the acting user holds permission. An acting user
+// that does not exist is unauthorized rather than not found.
+func (s *UserService) authorize(ctx context.Context, actorID int64, permission Permission) error {
+	actor, err := s.repo.GetUserByID(ctx, actorID)
+	if errors.Is(err, ErrNotFound) {
+		return ErrUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+	if !can(actor, permission) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// usernameTaken reports whether any user holds normalizedUsername.
+func (s *UserService) usernameTaken(ctx context.Context, normalizedUsername string) (bool, error) {
+	_, err := s.repo.GetUserByUsername(ctx, normalizedUsername)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetUsersByIDs looks up several users at once, e.g. to resolve approver
+// names for a list. Missing IDs are omitted from the map.
+func (s *UserService) GetUsersByIDs(ctx context.Context, ids []int64) (map[int64]*User, error) {
+	return s.repo.GetUsersByIDs(ctx, ids)
+}
+
+func (s *UserService) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	user, err := s.repo.GetUserByUsername(ctx, s.normalizeUsername(username))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResolveUserFromToken returns the approved owner of a token with the
+// password hash cleared, ready to be returned to the client.
+func (s *UserService) ResolveUserFromToken(ctx context.Context, plaintext, scope string) (*User, error) {
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	tok, err := s.tokens.ValidateToken(ctx, plaintext, scope)
+	if err != nil {
+		if errors.Is(err, token.ErrInvalidScope) {
+			return nil, token.ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	user, err := s.getUser(ctx, int64(tok.UserID))
+	if err != nil {
+		return nil, err
+	}
+
+	if !user.IsApproved() {
+		return nil, ErrUserNotApproved
+	}
+
+	user.PasswordHash = password{}
+	return user, nil
+}
+
+// FindTokenOwner identifies the account behind a token for support staff,
+// whatever the token's scope and even if it has expired. adminID must be
+// allowed to manage users.
+func (s *UserService) FindTokenOwner(ctx context.Context, plaintext string, adminID int64) (_ *User, err error) {
+	defer func() { s.logOp(ctx, "FindTokenOwner", err, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
+		return nil, err
+	}
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	userID, err := s.tokens.FindUserIDByTokenPlaintext(ctx, plaintext, adminID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.getUser(ctx, int64(userID))
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = password{}
+	return user, nil
+}
+
+// CanDeploy reports whether the user may deploy right now, independent of
+// whether they hold a valid deploy token. Call it after validating the
+// token. When the answer is false the error says why: ErrUserNotApproved,
+// ErrUserDisabled or ErrUserSuspended. Other errors mean the check itself
+// failed.
+func (s *UserService) CanDeploy(ctx context.Context, userID int64) (bool, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := s.checkAccountUsable(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AuthorizeTokenLookup allows adminID to trace token owners if they may
+// manage users. Pass it to token.WithAdminAuthorizer.
+func (s *UserService) AuthorizeTokenLookup(ctx context.Context, adminID int64) error {
+	return s.authorize(ctx, adminID, PermissionManageUsers)
+}
+
+// checkAccountUsable returns ErrUserNotApproved, ErrUserDisabled or
+// ErrUserSuspended if the account may not be used right now, whatever the
+// credentials presented for it.
+func (s *UserService) checkAccountUsable(user *User) error {
+	switch {
+	case !user.IsApproved():
+		return ErrUserNotApproved
+	case user.Disabled || user.DeleteAfter != nil:
+		return ErrUserDisabled
+	case user.IsSuspended(s.now()):
+		return ErrUserSuspended
+	}
+	return nil
+}
+
+// IssueEmailVerificationToken creates a verification token for the user.
+// Delivering it to the user's address is up to the caller.
+func (s *UserService) IssueEmailVerificationToken(ctx context.Context, userID int64) (*token.Token, error) {
+	if s.tokens == nil {
+		return nil, ErrTokensNotConfigured
+	}
+
+	if _, err := s.getUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return s.tokens.CreateEmailVerificationToken(ctx, userID)
+}
+
+// VerifyEmail marks the token owner's email as verified. The token is
+// single-use.
+func (s *UserService) VerifyEmail(ctx context.Context, plaintext string) (err error) {
+	defer func() { s.logOp(ctx, "VerifyEmail", err) }()
+
+	if s.tokens == nil {
+		return ErrTokensNotConfigured
+	}
+
+	tok, err := s.tokens.ValidateToken(ctx, plaintext, token.ScopeEmailVerify)
+	if err != nil {
+		if errors.Is(err, token.ErrInvalidScope) {
+			return token.ErrTokenNotFound
+		}
+		return err
+	}
+
+	user, err := s.getUser(ctx, int64(tok.UserID))
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerifiedAt == nil {
+		now := s.now()
+		user.EmailVerifiedAt = &now
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+	}
+
+	if err := s.tokens.RevokeToken(ctx, tok.Hash); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "failed to revoke email verification token", "user_id", user.ID, "error", err)
+	}
+	return nil
+}
+
+// CheckUsernameAvailable runs the same username checks as CreateUser without
+// creating anything, so a signup form can give early feedback.
+func (s *UserService) CheckUsernameAvailable(ctx context.Context, username string) error {
+	if err := s.validateUsername(username); err != nil {
+		return err
+	}
+
+	if err := s.checkReservedUsername(username); err != nil {
+		return err
+	}
+
+	taken, err := s.usernameTaken(ctx, s.normalizeUsername(username))
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUserAlreadyExists
+	}
+
+	return nil
+}
+
+// CheckUsernamesBulk runs CheckUsernameAvailable over a batch of names, e.g.
+// before importing a directory, using a single query for availability. Every
+// name appears in the result with a nil error if it is available. A name that
+// normalizes to the same username as an earlier name in the batch is
+// reported as taken.
+func (s *UserService) CheckUsernamesBulk(ctx context.Context, usernames []string) (map[string]error, error) {
+	results := make(map[string]error, len(usernames))
+	normalized := make(map[string]string, len(usernames))
+	claimed := make(map[string]bool, len(usernames))
+
+	for _, username := range usernames {
+		if err := s.validateUsername(username); err != nil {
+			results[username] = err
+			continue
+		}
+		if err := s.checkReservedUsername(username); err != nil {
+			results[username] = err
+			continue
+		}
+
+		name := s.normalizeUsername(username)
+		if claimed[name] {
+			results[username] = ErrUserAlreadyExists
+			continue
+		}
+		claimed[name] = true
+		normalized[username] = name
+		results[username] = nil
+	}
+
+	names := make([]string, 0, len(normalized))
+	for _, name := range normalized {
+		names = append(names, name)
+	}
+	existing, err := s.repo.GetUsersByUsernames(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	for username, name := range normalized {
+		if _, taken := existing[name]; taken {
+			results[username] = ErrUserAlreadyExists
+		}
+	}
+
+	return results, nil
+}
+
+func (s *UserService) UpdateUser(ctx context.Context, user *User) error {
+	if err := s.validateUsername(user.Username); err != nil {
+		return err
+	}
+	user.NormalizedUsername = s.normalizeUsername(user.Username)
+
+	return s.repo.UpdateUser(ctx, user)
+}
+
+// ChangeUsername renames a user after running the same checks as signup.
+// Changing only the case of one's own username is allowed.
+func (s *UserService) ChangeUsername(ctx context.Context, userID int64, newUsername string) (err error) {
+	defer func() { s.logOp(ctx, "ChangeUsername", err, "user_id", userID, "username", newUsername) }()
+
+	if err := s.validateUsername(newUsername); err != nil {
+		return err
+	}
+
+	if err := s.checkReservedUsername(newUsername); err != nil {
+		return err
+	}
+
+	err = s.repo.ChangeUsername(ctx, userID, strings.TrimSpace(newUsername), s.normalizeUsername(newUsername))
+	if errors.Is(err, ErrNotFound) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+func (s *UserService) DeleteUser(ctx context.Context, username string) (err error) {
+	defer func() { s.logOp(ctx, "DeleteUser", err, "username", username) }()
+
+	return s.repo.DeleteUserByUsername(ctx, s.normalizeUsername(username))
+}
+
+// DeleteOwnAccount deletes the caller's account after re-checking their
+// password, so a hijacked session alone cannot delete it. Every token the
+// user holds is revoked first.
+func (s *UserService) DeleteOwnAccount(ctx context.Context, username, password string) (err error) {
+	defer func() { s.logOp(ctx, "DeleteOwnAccount", err, "username", username) }()
+
+	user, err := s.verifyCredentials(ctx, username, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return ErrUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.tokens != nil {
+		if _, err := s.tokens.RevokeAllUserTokensAllScopes(ctx, int(user.ID)); err != nil {
+			return err
+		}
+	}
+
+	return s.repo.DeleteUserByUsername(ctx, user.NormalizedUsername)
+}
+
+func (s *UserService) ChangePassword(ctx context.Context, username, currentPassword, newPassword string) (err error) {
+	defer func() { s.logOp(ctx, "ChangePassword", err, "username", username) }()
+
+	user, err := s.verifyCredentials(ctx, username, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := s.validatePassword(ctx, newPassword); err != nil {
+		return err
+	}
+
+	return s.setPassword(ctx, user, newPassword, false)
+}
+
+// setPassword rejects recently used passwords, stores the new hash and
+// records the replaced one in the user's password history.
+func (s *UserService) setPassword(ctx context.Context, user *User, newPassword string, mustChange bool) error {
+	if err := s.checkPasswordReuse(ctx, user, newPassword); err != nil {
+		return err
+	}
+
+	previousHash := user.PasswordHash.hash
+	if err := user.PasswordHash.SetWithHasher(s.hasher, newPassword); err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.MustChangePassword = mustChange
+	user.PasswordChangedAt = s.now()
+
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	user.PasswordHash.ClearPlainText()
+	s.recordEvent(ctx, user.ID, securityevents.PasswordChanged, map[string]any{"must_change": mustChange})
+
+	if err := s.revokeSessions(ctx, user.ID); err != nil {
+		return err
+	}
+
+	if s.passwordHistoryDepth > 0 && len(previousHash) > 0 {
+		return s.repo.AddPasswordHistory(ctx, user.ID, previousHash)
+	}
+	return nil
+}
+
+// revokeSessions ends the user's sessions after a password change so a
+// stolen token does not outlive the old password.
+func (s *UserService) revokeSessions(ctx context.Context, userID int64) error {
+	if s.tokens == nil {
+		return nil
+	}
+
+	scopes := []string{token.ScopeAuth, token.ScopeRefresh}
+	if s.revokeDeployTokens {
+		scopes = append(scopes, token.ScopeDeploy)
+	}
+	for _, scope := range scopes {
+		if err := s.tokens.RevokeAllUserTokens(ctx, int(userID), scope); err != nil {
+			return fmt.Errorf("password changed but revoking %s tokens failed: %w", scope, err)
+		}
+	}
+	return nil
+}
+
+func (s *UserService) checkPasswordReuse(ctx context.Context, user *User, newPassword string) error {
+	if s.passwordHistoryDepth <= 0 {
+		return nil
+	}
+
+	hashes := [][]byte{user.PasswordHash.hash}
+	if s.passwordHistoryDepth > 1 {
+		history, err := s.repo.ListPasswordHistory(ctx, user.ID, s.passwordHistoryDepth-1)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, history...)
+	}
+
+	for _, hash := range hashes {
+		if len(hash) == 0 {
+			continue
+		}
+		matches, err := compareHash(hash, newPassword)
+		if err != nil {
+			return err
+		}
+		if matches {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+// Admin methods
+func (s *UserService) ApproveUser(ctx context.Context, userID, approvedBy int64) (err error) {
+	defer func() { s.logOp(ctx, "ApproveUser", err, "user_id", userID, "admin_id", approvedBy) }()
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.IsApproved() {
+		return ErrUserAlreadyApproved
+	}
+
+	if s.requireVerifiedEmail && user.EmailVerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+
+	if err := s.authorize(ctx, approvedBy, PermissionApproveUsers); err != nil {
+		return err
+	}
+
+	recorded, err := s.repo.RecordApproval(ctx, userID, approvedBy)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return ErrAlreadyApprovedByYou
+	}
+
+	approvals, err := s.repo.CountApprovals(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if approvals < s.requiredApprovals {
+		return nil
+	}
+
+	before := snapshotOf(user)
+	if err := s.repo.ApproveUser(ctx, userID, approvedBy); err != nil {
+		return err
+	}
 
-func NewUserService(repo UserStore) *UserService {
-	return &UserService{
-		repo: repo,
+	// The database stamps approved_at, so read it back for the command log.
+	if approved, err := s.getUser(ctx, userID); err == nil {
+		user = approved
+	} else {
+		now := s.now()
+		user.ApprovedAt = &now
+		user.ApprovedBy = &approvedBy
 	}
+	s.recordCommand(ctx, approvedBy, CommandApproveUser, userID, before, snapshotOf(user))
+	s.notifyApproved(ctx, user)
+
+	return nil
 }
 
-func (s *UserService) CreateUser(ctx context.Context, username, password string) (*User, error) {
-	if err := s.validateUsername(username); err != nil {
+// ApproveUserIdempotent is ApproveUser for retrying clients: repeating an
+// approval is not an error, and the user is returned in its current state.
+// While more approvals are still required the returned user is not yet
+// approved.
+func (s *UserService) ApproveUserIdempotent(ctx context.Context, userID, approvedBy int64) (*User, error) {
+	err := s.ApproveUser(ctx, userID, approvedBy)
+	switch {
+	case err == nil, errors.Is(err, ErrAlreadyApprovedByYou):
+	case errors.Is(err, ErrUserAlreadyApproved):
+		// ApproveUser reports this before checking the approver.
+		if err := s.authorize(ctx, approvedBy, PermissionApproveUsers); err != nil {
+			return nil, err
+		}
+	default:
 		return nil, err
 	}
 
-	if err := s.validatePassword(password); err != nil {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
 		return nil, err
 	}
+	return user, nil
+}
+
+// UnapproveUser sends an approved user back to pending review. They can no
+// longer log in, their auth and refresh tokens are revoked, and approving
+// them again starts a fresh round of sign-offs.
+func (s *UserService) UnapproveUser(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "UnapproveUser", err, "user_id", userID, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionApproveUsers); err != nil {
+		return err
+	}
 
-	existingUser, err := s.repo.GetUserByUsername(ctx, username)
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if existingUser != nil {
-		return nil, ErrUserAlreadyExists
+	if !user.IsApproved() {
+		return ErrUserNotApproved
 	}
 
-	user := &User{
-		Username: username,
-		Status:   "pending",
-		IsAdmin:  false,
+	if err := s.repo.UnapproveUser(ctx, userID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrUserNotFound
+		}
+		return err
 	}
 
-	if err := user.PasswordHash.Set(password); err != nil {
-		return nil, fmt.Errorf("failed to hash password: %w", err)
+	if s.tokens == nil {
+		return nil
+	}
+	for _, scope := range []string{token.ScopeAuth, token.ScopeRefresh} {
+		if err := s.tokens.RevokeAllUserTokens(ctx, int(userID), scope); err != nil {
+			return fmt.Errorf("user unapproved but revoking %s tokens failed: %w", scope, err)
+		}
+	}
+	return nil
+}
+
+func (s *UserService) notifyApproved(ctx context.Context, user *User) {
+	if err := s.events.OnUserApproved(ctx, user); err != nil {
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "user events: OnUserApproved failed", "user_id", user.ID, "error", err)
 	}
+}
+
+// ProvisionUser creates an approved account on behalf of an admin. The
+// temporary password must be changed by the user on first login.
+func (s *UserService) ProvisionUser(ctx context.Context, username, password string, adminID int64) (_ *User, err error) {
+	defer func() { s.logOp(ctx, "ProvisionUser", err, "username", username, "admin_id", adminID) }()
 
-	if err := s.repo.CreateUser(ctx, user); err != nil {
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
 		return nil, err
 	}
 
-	user.PasswordHash.ClearPlainText()
+	user, err := s.createUser(ctx, username, password, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.ApproveUser(ctx, user.ID, adminID); err != nil {
+		return nil, err
+	}
+
+	user, err = s.getUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.notifyApproved(ctx, user)
+
 	return user, nil
 }
 
-func (s *UserService) AuthenticateUser(ctx context.Context, username, password string) (*User, error) {
-	user, err := s.repo.GetUserByUsername(ctx, username)
+// ResetUserPassword sets a temporary password chosen by an admin and forces
+// the user to change it on next login.
+func (s *UserService) ResetUserPassword(ctx context.Context, userID int64, newPassword string, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "ResetUserPassword", err, "user_id", userID, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
+		return err
+	}
+	if err := s.checkElevation(ctx, adminID); err != nil {
+		return err
+	}
+
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
+
+	if err := s.validatePassword(ctx, newPassword); err != nil {
+		return err
 	}
 
-	matches, err := user.PasswordHash.Matches(password)
+	return s.setPassword(ctx, user, newPassword, true)
+}
+
+// clampPage applies the default page size, the configured maximum and a
+// non-negative offset.
+func (s *UserService) clampPage(limit, offset int) (int, int) {
+	if limit <= 0 {
+		limit = 10
+	}
+	if limit > s.maxListLimit {
+		limit = s.maxListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func (s *UserService) ListUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListUsers(ctx, limit, offset)
+}
+
+// ListUsersOrdered is ListUsers sorted by order. An unknown column or
+// direction returns ErrInvalidOrder.
+func (s *UserService) ListUsersOrdered(ctx context.Context, order UserOrder, limit, offset int) ([]*User, error) {
+	order, err := order.Normalize()
 	if err != nil {
 		return nil, err
 	}
-	if !matches {
-		return nil, ErrUnauthorized
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListUsersOrdered(ctx, order, limit, offset)
+}
+
+func (s *UserService) ListPendingUsers(ctx context.Context, limit, offset int) ([]*User, error) {
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListPendingUsers(ctx, limit, offset)
+}
+
+func (s *UserService) ListAdmins(ctx context.Context, limit, offset int) ([]*User, error) {
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListAdmins(ctx, limit, offset)
+}
+
+func (s *UserService) ListUsersPaged(ctx context.Context, limit, offset int) (*Page[*User], error) {
+	limit, offset = s.clampPage(limit, offset)
+
+	users, err := s.repo.ListUsers(ctx, limit, offset)
+	if err != nil {
+		return nil, err
 	}
 
-	if user.ApprovedAt == nil {
-		return nil, ErrUserNotApproved
+	total, err := s.repo.CountUsers(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return user, nil
+	return newPage(users, limit, offset, total), nil
 }
 
-func (s *UserService) GetUserByID(ctx context.Context, id int64) (*User, error) {
-	user, err := s.repo.GetUserByID(ctx, id)
+func (s *UserService) ListPendingUsersPaged(ctx context.Context, limit, offset int) (*Page[*User], error) {
+	limit, offset = s.clampPage(limit, offset)
+
+	users, err := s.repo.ListPendingUsers(ctx, limit, offset)
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
+
+	total, err := s.repo.CountPendingUsers(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return user, nil
+
+	return newPage(users, limit, offset, total), nil
 }
 
-func (s *UserService) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	user, err := s.repo.GetUserByUsername(ctx, username)
-	if err != nil {
+func (s *UserService) CountUsers(ctx context.Context) (int, error) {
+	return s.repo.CountUsers(ctx)
+}
+
+func (s *UserService) CountPendingUsers(ctx context.Context) (int, error) {
+	return s.repo.CountPendingUsers(ctx)
+}
+
+func (s *UserService) CountAdmins(ctx context.Context) (int, error) {
+	return s.repo.CountAdmins(ctx)
+}
+
+// GetUserStats returns the admin dashboard counts. adminID must be allowed
+// to list users.
+func (s *UserService) GetUserStats(ctx context.Context, adminID int64) (*UserStats, error) {
+	if err := s.authorize(ctx, adminID, PermissionListUsers); err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
+	return s.repo.GetUserStats(ctx, s.now())
+}
+
+func (s *UserService) ListUsersApprovedBetween(ctx context.Context, start, end time.Time, limit, offset int, adminID int64) ([]*User, error) {
+	if err := s.authorize(ctx, adminID, PermissionListUsers); err != nil {
+		return nil, err
 	}
-	return user, nil
+
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListUsersApprovedBetween(ctx, start, end, limit, offset)
 }
 
-func (s *UserService) UpdateUser(ctx context.Context, user *User) error {
-	if err := s.validateUsername(user.Username); err != nil {
-		return err
+// ListUsersApprovedBy lists the users approverID approved, for
+// accountability reviews. adminID must be allowed to list users.
+func (s *UserService) ListUsersApprovedBy(ctx context.Context, approverID int64, limit, offset int, adminID int64) ([]*User, error) {
+	if err := s.authorize(ctx, adminID, PermissionListUsers); err != nil {
+		return nil, err
 	}
 
-	return s.repo.UpdateUser(ctx, user)
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.ListUsersApprovedBy(ctx, approverID, limit, offset)
 }
 
-func (s *UserService) DeleteUser(ctx context.Context, username string) error {
-	return s.repo.DeleteUserByUsername(ctx, username)
+// minSearchLength keeps username searches from degenerating into full scans.
+const minSearchLength = 2
+
+func (s *UserService) SearchUsersByUsername(ctx context.Context, fragment string, limit, offset int, adminID int64) ([]*User, error) {
+	if err := s.authorize(ctx, adminID, PermissionListUsers); err != nil {
+		return nil, err
+	}
+
+	fragment = strings.TrimSpace(fragment)
+	if len(fragment) < minSearchLength {
+		return nil, ErrSearchTermTooShort
+	}
+
+	limit, offset = s.clampPage(limit, offset)
+
+	return s.repo.SearchUsersByUsername(ctx, fragment, limit, offset)
 }
 
-func (s *UserService) ChangePassword(ctx context.Context, username, currentPassword, newPassword string) error {
-	user, err := s.AuthenticateUser(ctx, username, currentPassword)
-	if err != nil {
+func (s *UserService) MakeAdmin(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "MakeAdmin", err, "user_id", userID, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionManageAdmins); err != nil {
 		return err
 	}
-
-	if err := s.validatePassword(newPassword); err != nil {
+	if err := s.checkElevation(ctx, adminID); err != nil {
 		return err
 	}
 
-	if err := user.PasswordHash.Set(newPassword); err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
 	}
 
-	return s.repo.UpdateUser(ctx, user)
+	return s.setRole(ctx, user, RoleSuperAdmin, adminID, CommandMakeAdmin)
 }
 
-// Admin methods
-func (s *UserService) ApproveUser(ctx context.Context, userID, approvedBy int64) error {
-	user, err := s.repo.GetUserByID(ctx, userID)
-	if err != nil {
+func (s *UserService) RevokeAdmin(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "RevokeAdmin", err, "user_id", userID, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionManageAdmins); err != nil {
 		return err
 	}
-	if user == nil {
-		return ErrUserNotFound
+	if err := s.checkElevation(ctx, adminID); err != nil {
+		return err
 	}
 
-	if user.ApprovedAt != nil {
-		return ErrUserAlreadyApproved
+	if userID == adminID {
+		return errors.New("cannot revoke your own admin privileges")
 	}
 
-	approver, err := s.repo.GetUserByID(ctx, approvedBy)
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if approver == nil || !approver.IsAdmin {
-		return ErrUnauthorized
-	}
 
-	return s.repo.ApproveUser(ctx, userID, approvedBy)
+	return s.setRole(ctx, user, RoleUser, adminID, CommandRevokeAdmin)
 }
 
-func (s *UserService) ListUsers(ctx context.Context, limit, offset int) ([]*User, error) {
-	if limit <= 0 {
-		limit = 10
+// SetUserRole assigns role to the user. Like RevokeAdmin, it refuses to
+// change the caller's own role.
+func (s *UserService) SetUserRole(ctx context.Context, userID int64, role Role, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "SetUserRole", err, "user_id", userID, "role", role, "admin_id", adminID) }()
+
+	if !role.Valid() {
+		return ErrInvalidRole
+	}
+
+	if err := s.authorize(ctx, adminID, PermissionManageAdmins); err != nil {
+		return err
 	}
-	if limit > 100 {
-		limit = 100
+	if err := s.checkElevation(ctx, adminID); err != nil {
+		return err
 	}
-	if offset < 0 {
-		offset = 0
+
+	if userID == adminID {
+		return errors.New("cannot change your own role")
 	}
 
-	return s.repo.ListUsers(ctx, limit, offset)
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.setRole(ctx, user, role, adminID, CommandSetUserRole)
 }
 
-func (s *UserService) ListPendingUsers(ctx context.Context, limit, offset int) ([]*User, error) {
-	if limit <= 0 {
-		limit = 10
+// setRole changes the user's role and records the change in the command
+// log. When the new role lacks a permission the old one had, the user's
+// auth tokens are revoked so they log in again with reduced privileges.
+func (s *UserService) setRole(ctx context.Context, user *User, role Role, adminID int64, action CommandAction) error {
+	before := snapshotOf(user)
+	user.Role = role
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
 	}
-	if limit > 100 {
-		limit = 100
+	s.recordCommand(ctx, adminID, action, user.ID, before, snapshotOf(user))
+
+	if !before.Role.losesPermissions(role) || !s.revokeOnDemotion || s.tokens == nil {
+		return nil
 	}
-	if offset < 0 {
-		offset = 0
+	if err := s.tokens.RevokeAllUserTokens(ctx, int(user.ID), token.ScopeAuth); err != nil {
+		return fmt.Errorf("role changed but revoking auth tokens failed: %w", err)
 	}
+	return nil
+}
 
-	return s.repo.ListPendingUsers(ctx, limit, offset)
+// DisableUser blocks the user from logging in regardless of approval or
+// status.
+func (s *UserService) DisableUser(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "DisableUser", err, "user_id", userID, "admin_id", adminID) }()
+
+	return s.setDisabled(ctx, userID, adminID, true)
 }
 
-func (s *UserService) MakeAdmin(ctx context.Context, userID, adminID int64) error {
-	admin, err := s.repo.GetUserByID(ctx, adminID)
-	if err != nil {
+func (s *UserService) EnableUser(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "EnableUser", err, "user_id", userID, "admin_id", adminID) }()
+
+	return s.setDisabled(ctx, userID, adminID, false)
+}
+
+func (s *UserService) setDisabled(ctx context.Context, userID, adminID int64, disabled bool) error {
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
 		return err
 	}
-	if admin == nil || !admin.IsAdmin {
-		return ErrUnauthorized
+
+	if disabled && userID == adminID {
+		return errors.New("cannot disable your own account")
 	}
 
-	user, err := s.repo.GetUserByID(ctx, userID)
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if user == nil {
-		return ErrUserNotFound
-	}
 
-	user.IsAdmin = true
+	user.Disabled = disabled
 	return s.repo.UpdateUser(ctx, user)
 }
 
-func (s *UserService) RevokeAdmin(ctx context.Context, userID, adminID int64) error {
-	admin, err := s.repo.GetUserByID(ctx, adminID)
+// SuspendUser blocks the user from logging in until the given time, after
+// which they are treated as active again without further action.
+func (s *UserService) SuspendUser(ctx context.Context, userID, adminID int64, until time.Time) (err error) {
+	defer func() { s.logOp(ctx, "SuspendUser", err, "user_id", userID, "admin_id", adminID, "until", until) }()
+
+	return s.setSuspendedUntil(ctx, userID, adminID, &until)
+}
+
+// LiftSuspension ends a suspension early.
+func (s *UserService) LiftSuspension(ctx context.Context, userID, adminID int64) (err error) {
+	defer func() { s.logOp(ctx, "LiftSuspension", err, "user_id", userID, "admin_id", adminID) }()
+
+	return s.setSuspendedUntil(ctx, userID, adminID, nil)
+}
+
+func (s *UserService) setSuspendedUntil(ctx context.Context, userID, adminID int64, until *time.Time) error {
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
+		return err
+	}
+
+	if until != nil && userID == adminID {
+		return errors.New("cannot suspend your own account")
+	}
+
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if admin == nil || !admin.IsAdmin {
-		return ErrUnauthorized
+
+	user.SuspendedUntil = until
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	if until == nil {
+		// Lifting a suspension also lifts a failed-login lockout, as an
+		// admin unlocking an account expects.
+		return s.repo.ClearFailedLogins(ctx, userID)
+	}
+	return nil
+}
+
+// ScheduleUserDeletion marks a user for deletion once after has elapsed,
+// leaving a window in which CancelUserDeletion can undo it. The user cannot
+// log in while the deletion is pending, and its tokens are revoked.
+func (s *UserService) ScheduleUserDeletion(ctx context.Context, userID, adminID int64, after time.Duration) (err error) {
+	defer func() { s.logOp(ctx, "ScheduleUserDeletion", err, "user_id", userID, "admin_id", adminID) }()
+
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
+		return err
 	}
 
 	if userID == adminID {
-		return errors.New("cannot revoke your own admin privileges")
+		return errors.New("cannot schedule deletion of your own account")
 	}
 
-	user, err := s.repo.GetUserByID(ctx, userID)
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if user == nil {
-		return ErrUserNotFound
+
+	deleteAfter := s.now().Add(after)
+	user.DeleteAfter = &deleteAfter
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
 	}
 
-	user.IsAdmin = false
-	return s.repo.UpdateUser(ctx, user)
+	// The account can no longer log in, so its existing tokens must not keep
+	// working until the purge either.
+	if s.tokens != nil {
+		if _, err := s.tokens.RevokeAllUserTokensAllScopes(ctx, int(userID)); err != nil {
+			return fmt.Errorf("deletion scheduled but revoking tokens failed: %w", err)
+		}
+	}
+	return nil
 }
 
-func (s *UserService) UpdateUserStatus(ctx context.Context, userID int64, status string, adminID int64) error {
-	admin, err := s.repo.GetUserByID(ctx, adminID)
+// CancelUserDeletion clears a pending deletion. actorID may be the user
+// themselves or an admin who can manage users.
+func (s *UserService) CancelUserDeletion(ctx context.Context, userID, actorID int64) (err error) {
+	defer func() { s.logOp(ctx, "CancelUserDeletion", err, "user_id", userID, "actor_id", actorID) }()
+
+	if actorID != userID {
+		if err := s.authorize(ctx, actorID, PermissionManageUsers); err != nil {
+			return err
+		}
+	}
+
+	user, err := s.getUser(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if admin == nil || !admin.IsAdmin {
-		return ErrUnauthorized
+
+	user.DeleteAfter = nil
+	return s.repo.UpdateUser(ctx, user)
+}
+
+// PurgeScheduledDeletions deletes every user whose deletion window has
+// passed.
+func (s *UserService) PurgeScheduledDeletions(ctx context.Context) (int, error) {
+	purged, err := s.repo.PurgeScheduledDeletions(ctx, s.now())
+	return len(purged), err
+}
+
+// RunDeletionReaper purges expired scheduled deletions every interval until
+// ctx is cancelled. It is meant to run in its own goroutine.
+func (s *UserService) RunDeletionReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.PurgeScheduledDeletions(ctx)
+			if err != nil {
+				s.logger.ErrorContext(ctx, "deletion reaper failed", "error", err)
+				continue
+			}
+			if purged > 0 {
+				s.logger.InfoContext(ctx, "deletion reaper purged users", "count", purged)
+			}
+		}
 	}
+}
 
-	user, err := s.repo.GetUserByID(ctx, userID)
-	if err != nil {
+// PurgeStalePending deletes users who have been awaiting approval for
+// longer than olderThan, and returns how many were removed. Approved users,
+// users holding some of their required approvals and users recently put
+// back into pending by UnapproveUser are never touched, and a non-positive
+// olderThan purges nothing, so a misconfigured schedule cannot empty the
+// pending queue.
+func (s *UserService) PurgeStalePending(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+	var purged int
+	defer func() { s.logOp(ctx, "PurgeStalePending", err, "older_than", olderThan, "count", purged) }()
+
+	if olderThan <= 0 {
+		return 0, nil
+	}
+	ids, err := s.repo.PurgeStalePending(ctx, s.now().Add(-olderThan))
+	purged = len(ids)
+	return purged, err
+}
+
+// RunPendingReaper purges pending users older than olderThan every interval
+// until ctx is cancelled. It is meant to run in its own goroutine.
+func (s *UserService) RunPendingReaper(ctx context.Context, interval, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// PurgeStalePending logs its own outcome.
+			_, _ = s.PurgeStalePending(ctx, olderThan)
+		}
+	}
+}
+
+func (s *UserService) UpdateUserStatus(ctx context.Context, userID int64, status string, adminID int64) (err error) {
+	defer func() {
+		s.logOp(ctx, "UpdateUserStatus", err, "user_id", userID, "status", status, "admin_id", adminID)
+	}()
+
+	if err := s.authorize(ctx, adminID, PermissionManageUsers); err != nil {
 		return err
 	}
-	if user == nil {
-		return ErrUserNotFound
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
 	}
 
+	before := snapshotOf(user)
 	user.Status = status
-	return s.repo.UpdateUser(ctx, user)
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	s.recordCommand(ctx, adminID, CommandUpdateUserStatus, userID, before, snapshotOf(user))
+	return nil
 }
 
 // Validation methods
 func (s *UserService) validateUsername(username string) error {
 	username = strings.TrimSpace(username)
-	if len(username) < 3 {
+	length := utf8.RuneCountInString(username)
+	if length < s.usernameMinLength {
 		return ErrInvalidUsername
 	}
-	if len(username) > 50 {
+	if length > s.usernameMaxLength {
 		return ErrInvalidUsername
 	}
 
 	// Allow alphanumeric characters, underscores, and hyphens
 	validUsername := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	if s.unicodeUsernames {
+		validUsername = regexp.MustCompile(`^[\p{L}\p{M}\p{N}_-]+$`)
+	}
 	if !validUsername.MatchString(username) {
 		return ErrInvalidUsername
 	}
@@ -277,22 +1712,84 @@ func (s *UserService) validateUsername(username string) error {
 	return nil
 }
 
-func (s *UserService) validatePassword(password string) error {
+// normalizeUsername maps usernames that should be considered the same
+// account to one key with the configured UsernameNormalizer. Every create,
+// lookup and uniqueness check goes through it.
+func (s *UserService) normalizeUsername(username string) string {
+	return s.usernameNormalizer(strings.TrimSpace(username))
+}
+
+// NormalizeUsername is the default UsernameNormalizer: compatibility forms
+// are unified with NFKC and case is folded. NFKC is applied again after
+// folding because folding can produce unnormalized output.
+func NormalizeUsername(username string) string {
+	username = norm.NFKC.String(strings.TrimSpace(username))
+	return norm.NFKC.String(cases.Fold().String(username))
+}
+
+// reservedUsernames cannot be registered by regular signups.
+var reservedUsernames = map[string]struct{}{
+	"admin":         {},
+	"administrator": {},
+	"root":          {},
+	"system":        {},
+	"support":       {},
+	"zdeploy":       {},
+	"api":           {},
+}
+
+func (s *UserService) checkReservedUsername(username string) error {
+	if _, ok := reservedUsernames[s.normalizeUsername(username)]; ok {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+const maxPasswordBytes = 72
+
+func (s *UserService) validatePassword(ctx context.Context, password string) error {
 	if len(password) < 8 {
 		return ErrInvalidPassword
 	}
-	if len(password) > 100 {
-		return ErrInvalidPassword
+	// bcrypt ignores everything past 72 bytes, so longer passwords would
+	// silently collide with any password sharing their first 72 bytes.
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
 	}
 
-	// Check for at least one uppercase, one lowercase, and one digit
-	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
-	hasLower := regexp.MustCompile(`[a-z]`).MatchString(password)
-	hasDigit := regexp.MustCompile(`\d`).MatchString(password)
+	if !s.skipComposition {
+		// Check for at least one uppercase, one lowercase, and one digit
+		hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
+		hasLower := regexp.MustCompile(`[a-z]`).MatchString(password)
+		hasDigit := regexp.MustCompile(`\d`).MatchString(password)
 
-	if !hasUpper || !hasLower || !hasDigit {
-		return ErrInvalidPassword
+		if !hasUpper || !hasLower || !hasDigit {
+			return ErrInvalidPassword
+		}
+	}
+
+	if s.strength != nil && s.strength.Score(password) < s.minStrength {
+		return ErrPasswordTooWeak
+	}
+
+	return s.checkBreached(ctx, password)
+}
+
+func (s *UserService) checkBreached(ctx context.Context, password string) error {
+	if s.breachChecker == nil {
+		return nil
 	}
 
+	breached, err := s.breachChecker.IsBreached(ctx, password)
+	if err != nil {
+		if s.breachFailClosed {
+			return fmt.Errorf("breach check failed: %w", err)
+		}
+		requestid.Logger(ctx, s.logger).WarnContext(ctx, "breach check failed, allowing password", "error", err)
+		return nil
+	}
+	if breached {
+		return ErrPasswordBreached
+	}
 	return nil
 }
@@ -0,0 +1,2001 @@
+package user_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/testutil"
+	"github.com/samokw/zdeploy/server/internal/token"
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+func usernames(users []*user.User) []string {
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	return names
+}
+
+func TestListUsersApprovedBetween(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	viewer := seedUser(t, store, testutil.UserOptions{Username: "viewer", Role: user.RoleViewer})
+	plain := seedUser(t, store, testutil.UserOptions{Username: "plain"})
+	seedUser(t, store, testutil.UserOptions{Username: "waiting", Pending: true})
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		actor      int64
+		want       []string
+		wantErr    error
+	}{
+		{"window covers approvals", now.Add(-time.Hour), now.Add(time.Hour), viewer.ID, []string{"plain", "viewer"}, nil},
+		{"window in the past", now.Add(-2 * time.Hour), now.Add(-time.Hour), viewer.ID, []string{}, nil},
+		{"start after end", now.Add(time.Hour), now.Add(-time.Hour), viewer.ID, []string{}, nil},
+		{"actor without permission", now.Add(-time.Hour), now.Add(time.Hour), plain.ID, nil, user.ErrUnauthorized},
+		{"unknown actor", now.Add(-time.Hour), now.Add(time.Hour), 9999, nil, user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := svc.ListUsersApprovedBetween(ctx, tt.start, tt.end, 10, 0, tt.actor)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := usernames(users)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMustChangePassword(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, svc *user.UserService, admin *user.User) *user.User
+		wantErr error
+	}{
+		{
+			name: "provisioned account",
+			setup: func(t *testing.T, svc *user.UserService, admin *user.User) *user.User {
+				u, err := svc.ProvisionUser(ctx, "provisioned", testutil.DefaultPassword, admin.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return u
+			},
+			wantErr: user.ErrPasswordChangeRequired,
+		},
+		{
+			name: "admin reset",
+			setup: func(t *testing.T, svc *user.UserService, admin *user.User) *user.User {
+				u, err := svc.ProvisionUser(ctx, "reset", "Temp0rary-Pass", admin.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.ChangePassword(ctx, "reset", "Temp0rary-Pass", "Ch0sen-By-User"); err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.ResetUserPassword(ctx, u.ID, testutil.DefaultPassword, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+				return u
+			},
+			wantErr: user.ErrPasswordChangeRequired,
+		},
+		{
+			name: "self-registered account",
+			setup: func(t *testing.T, svc *user.UserService, admin *user.User) *user.User {
+				u, err := svc.CreateUser(ctx, "selfmade", testutil.DefaultPassword)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.ApproveUser(ctx, u.ID, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+				return u
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			u := tt.setup(t, svc, admin)
+
+			_, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			// Changing the password clears the flag.
+			if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, "Fresh-Passw0rd"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.AuthenticateUser(ctx, u.Username, "Fresh-Passw0rd"); err != nil {
+				t.Fatalf("login after change: %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisionUserRequiresManagePermission(t *testing.T) {
+	svc, store := newService(t)
+	approver := seedUser(t, store, testutil.UserOptions{Role: user.RoleApprover})
+
+	_, err := svc.ProvisionUser(context.Background(), "provisioned", testutil.DefaultPassword, approver.ID)
+	if !errors.Is(err, user.ErrUnauthorized) {
+		t.Fatalf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	ctx := context.Background()
+	const (
+		second = "Sec0nd-Passw0rd"
+		third  = "Th1rd-Passw0rd"
+	)
+
+	tests := []struct {
+		name    string
+		depth   int
+		changes []string // applied in order before the attempt
+		attempt string
+		wantErr error
+	}{
+		{"disabled allows current", 0, nil, testutil.DefaultPassword, nil},
+		{"depth 1 rejects current", 1, nil, testutil.DefaultPassword, user.ErrPasswordReused},
+		{"depth 1 allows previous", 1, []string{second}, testutil.DefaultPassword, nil},
+		{"depth 2 rejects previous", 2, []string{second}, testutil.DefaultPassword, user.ErrPasswordReused},
+		{"depth 2 forgets older", 2, []string{second, third}, testutil.DefaultPassword, nil},
+		{"depth 3 remembers older", 3, []string{second, third}, testutil.DefaultPassword, user.ErrPasswordReused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithPasswordHistoryDepth(tt.depth))
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			current := testutil.DefaultPassword
+			for _, next := range tt.changes {
+				if err := svc.ChangePassword(ctx, u.Username, current, next); err != nil {
+					t.Fatalf("change to %q: %v", next, err)
+				}
+				current = next
+			}
+
+			err := svc.ChangePassword(ctx, u.Username, current, tt.attempt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApprovalChecks(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		opts    testutil.UserOptions
+		wantErr error
+	}{
+		{"approved", testutil.UserOptions{}, nil},
+		{"pending", testutil.UserOptions{Pending: true}, user.ErrUserNotApproved},
+		{"active status but never approved", testutil.UserOptions{Pending: true, Status: "active"}, user.ErrUserNotApproved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			u := seedUser(t, store, tt.opts)
+
+			if _, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthenticateUser: got %v, want %v", err, tt.wantErr)
+			}
+			ok, err := svc.CanDeploy(ctx, u.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CanDeploy: got %v, want %v", err, tt.wantErr)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Errorf("CanDeploy = %v with error %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestSearchUsersByUsername(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	viewer := seedUser(t, store, testutil.UserOptions{Username: "viewer", Role: user.RoleViewer})
+	plain := seedUser(t, store, testutil.UserOptions{Username: "plain"})
+	for _, name := range []string{"DeployBot", "deploy-ci", "alice"} {
+		seedUser(t, store, testutil.UserOptions{Username: name})
+	}
+
+	tests := []struct {
+		name     string
+		fragment string
+		actor    int64
+		want     []string
+		wantErr  error
+	}{
+		{"case-insensitive partial", "DEPLOY", viewer.ID, []string{"DeployBot", "deploy-ci"}, nil},
+		{"infix", "lic", viewer.ID, []string{"alice"}, nil},
+		{"surrounding space trimmed", "  ali  ", viewer.ID, []string{"alice"}, nil},
+		{"no match", "zz", viewer.ID, []string{}, nil},
+		{"too short", "a", viewer.ID, nil, user.ErrSearchTermTooShort},
+		{"too short after trimming", " a ", viewer.ID, nil, user.ErrSearchTermTooShort},
+		{"actor without permission", "deploy", plain.ID, nil, user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := svc.SearchUsersByUsername(ctx, tt.fragment, 10, 0, tt.actor)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := usernames(users); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapFirstAdmin(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantRoles  []user.Role
+		wantActive []bool
+	}{
+		{"enabled", true, []user.Role{user.RoleSuperAdmin, user.RoleUser}, []bool{true, false}},
+		{"disabled", false, []user.Role{user.RoleUser, user.RoleUser}, []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, user.WithBootstrapFirstAdmin(tt.enabled))
+
+			for i, name := range []string{"founder", "second"} {
+				u, err := svc.CreateUser(ctx, name, testutil.DefaultPassword)
+				if err != nil {
+					t.Fatal(err)
+				}
+				stored, err := svc.GetUserByID(ctx, u.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Role != tt.wantRoles[i] {
+					t.Errorf("%s: Role = %q, want %q", name, stored.Role, tt.wantRoles[i])
+				}
+				if stored.IsApproved() != tt.wantActive[i] {
+					t.Errorf("%s: IsApproved() = %v, want %v", name, stored.IsApproved(), tt.wantActive[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		approved    int
+		pending     int
+		scheduled   int
+		wantTotal   int
+		wantPending int
+	}{
+		{"empty", 0, 0, 0, 0, 0},
+		{"approved only", 3, 0, 0, 3, 0},
+		{"mixed", 2, 3, 0, 5, 3},
+		{"scheduled for deletion", 2, 3, 2, 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			for i := 0; i < tt.approved; i++ {
+				seedUser(t, store, testutil.UserOptions{})
+			}
+			for i := 0; i < tt.pending; i++ {
+				seedUser(t, store, testutil.UserOptions{Pending: true})
+			}
+			for i := 0; i < tt.scheduled; i++ {
+				scheduleDeletion(t, store, seedUser(t, store, testutil.UserOptions{Pending: i%2 == 0}))
+			}
+
+			users, err := svc.ListUsers(ctx, 100, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != tt.wantTotal {
+				t.Errorf("listed %d users, want %d", len(users), tt.wantTotal)
+			}
+			total, err := svc.CountUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending, err := svc.CountPendingUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.wantTotal || pending != tt.wantPending {
+				t.Errorf("counts = %d total, %d pending; want %d, %d", total, pending, tt.wantTotal, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestResolveUserFromToken(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		opts    testutil.UserOptions
+		scope   string
+		deleted bool
+		wantErr error
+	}{
+		{name: "approved owner", scope: token.ScopeAuth},
+		{name: "wrong scope looks missing", scope: token.ScopeDeploy, wantErr: token.ErrTokenNotFound},
+		{name: "pending owner", opts: testutil.UserOptions{Pending: true}, scope: token.ScopeAuth, wantErr: user.ErrUserNotApproved},
+		{name: "deleted owner", scope: token.ScopeAuth, deleted: true, wantErr: user.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			u := seedUser(t, store, tt.opts)
+			auth, err := tokens.CreateAuthToken(ctx, int(u.ID), time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.deleted {
+				if err := store.DeleteUserByUsername(ctx, u.NormalizedUsername); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.ResolveUserFromToken(ctx, auth.PlainText, tt.scope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ID != u.ID {
+				t.Errorf("resolved user %d, want %d", got.ID, u.ID)
+			}
+			if got.PasswordHash.IsSet() {
+				t.Error("resolved user carries a password hash")
+			}
+		})
+	}
+}
+
+func TestResolveUserFromTokenNotConfigured(t *testing.T) {
+	svc, _ := newService(t)
+	if _, err := svc.ResolveUserFromToken(context.Background(), "anything", token.ScopeAuth); !errors.Is(err, user.ErrTokensNotConfigured) {
+		t.Fatalf("got %v, want ErrTokensNotConfigured", err)
+	}
+}
+
+func TestPasswordMaxAge(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		elapsed time.Duration
+		wantErr error
+	}{
+		{"no maximum", 0, 1000 * time.Hour, nil},
+		{"within maximum", 90 * 24 * time.Hour, 24 * time.Hour, nil},
+		{"past maximum", 90 * 24 * time.Hour, 91 * 24 * time.Hour, user.ErrPasswordExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Now()}
+			svc, store := newService(t, user.WithClock(clock.Now), user.WithPasswordMaxAge(tt.maxAge))
+			u := seedUser(t, store, testutil.UserOptions{})
+			clock.Advance(tt.elapsed)
+
+			_, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+
+			// An expired password can still be changed, which restarts the
+			// clock.
+			if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, "Fresh-Passw0rd"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.AuthenticateUser(ctx, u.Username, "Fresh-Passw0rd"); err != nil {
+				t.Fatalf("login after change: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckUsernameAvailable(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	seedUser(t, store, testutil.UserOptions{Username: "taken"})
+
+	tests := []struct {
+		name     string
+		username string
+		wantErr  error
+	}{
+		{"available", "fresh-name", nil},
+		{"taken", "taken", user.ErrUserAlreadyExists},
+		{"taken in other case", "TAKEN", user.ErrUserAlreadyExists},
+		{"taken with surrounding space", " taken ", user.ErrUserAlreadyExists},
+		{"reserved", "admin", user.ErrReservedUsername},
+		{"invalid characters", "bad name!", user.ErrInvalidUsername},
+		{"too short", "ab", user.ErrInvalidUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := svc.CheckUsernameAvailable(ctx, tt.username); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			// The pre-flight check must agree with CreateUser.
+			if err := svc.ValidateNewUser(ctx, tt.username, testutil.DefaultPassword); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateNewUser: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		opts     testutil.UserOptions
+		userID   func(u *user.User) int64
+		password string
+		want     bool
+		wantErr  error
+	}{
+		{"correct", testutil.UserOptions{}, func(u *user.User) int64 { return u.ID }, testutil.DefaultPassword, true, nil},
+		{"wrong", testutil.UserOptions{}, func(u *user.User) int64 { return u.ID }, "wrong-password", false, nil},
+		{"pending user skips approval gate", testutil.UserOptions{Pending: true}, func(u *user.User) int64 { return u.ID }, testutil.DefaultPassword, true, nil},
+		{"unknown user", testutil.UserOptions{}, func(u *user.User) int64 { return 9999 }, testutil.DefaultPassword, false, user.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			u := seedUser(t, store, tt.opts)
+
+			got, err := svc.VerifyPassword(ctx, tt.userID(u), tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("VerifyPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsersPaged(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	for i := 0; i < 3; i++ {
+		seedUser(t, store, testutil.UserOptions{})
+	}
+	for i := 0; i < 2; i++ {
+		seedUser(t, store, testutil.UserOptions{Pending: true})
+	}
+
+	tests := []struct {
+		name        string
+		pending     bool
+		limit       int
+		offset      int
+		wantItems   int
+		wantLimit   int
+		wantOffset  int
+		wantTotal   int
+		wantHasMore bool
+	}{
+		{"first page", false, 2, 0, 2, 2, 0, 5, true},
+		{"last page", false, 2, 4, 1, 2, 4, 5, false},
+		{"past the end", false, 2, 10, 0, 2, 10, 5, false},
+		{"clamped", false, 0, -3, 5, 10, 0, 5, false},
+		{"pending first page", true, 1, 0, 1, 1, 0, 2, true},
+		{"pending all", true, 5, 0, 2, 5, 0, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := svc.ListUsersPaged
+			if tt.pending {
+				list = svc.ListPendingUsersPaged
+			}
+
+			page, err := list(ctx, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Items == nil {
+				t.Fatal("Items is nil, want an empty slice")
+			}
+			if len(page.Items) != tt.wantItems {
+				t.Errorf("got %d items, want %d", len(page.Items), tt.wantItems)
+			}
+			if page.Limit != tt.wantLimit || page.Offset != tt.wantOffset {
+				t.Errorf("limit, offset = %d, %d; want %d, %d", page.Limit, page.Offset, tt.wantLimit, tt.wantOffset)
+			}
+			if page.Total != tt.wantTotal {
+				t.Errorf("Total = %d, want %d", page.Total, tt.wantTotal)
+			}
+			if page.HasMore != tt.wantHasMore {
+				t.Errorf("HasMore = %v, want %v", page.HasMore, tt.wantHasMore)
+			}
+		})
+	}
+}
+
+func TestCreateUserUniquenessIgnoresCase(t *testing.T) {
+	ctx := context.Background()
+	verbatim := user.WithUsernameNormalizer(func(username string) string { return username })
+
+	tests := []struct {
+		name    string
+		opts    []user.Option
+		first   string
+		second  string
+		wantErr error
+	}{
+		{"same name", nil, "bob", "bob", user.ErrUserAlreadyExists},
+		{"ascii case", nil, "Bob", "bOB", user.ErrUserAlreadyExists},
+		{"surrounding space", nil, "bob", "  bob ", user.ErrUserAlreadyExists},
+		{"unicode case", []user.Option{user.WithUnicodeUsernames(true)}, "Élodie", "éLODIE", user.ErrUserAlreadyExists},
+		{"greek case", []user.Option{user.WithUnicodeUsernames(true)}, "ΣΟΦΙΑ", "σοφια", user.ErrUserAlreadyExists},
+		{"different names", nil, "bob", "bobby", nil},
+		{"custom normalizer", []user.Option{verbatim}, "Bob", "bob", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, tt.opts...)
+
+			if _, err := svc.CreateUser(ctx, tt.first, testutil.DefaultPassword); err != nil {
+				t.Fatal(err)
+			}
+			_, err := svc.CreateUser(ctx, tt.second, testutil.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"bob", "bob"},
+		{"  Bob ", "bob"},
+		{"ÉLODIE", "élodie"},
+	}
+	for _, tt := range tests {
+		if got := user.NormalizeUsername(tt.in); got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDisableEnableUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		actorRole user.Role
+		unknown   bool
+		disable   bool
+		startOff  bool
+		wantErr   error
+		wantLogin error
+	}{
+		{name: "disable", actorRole: user.RoleSuperAdmin, disable: true, wantLogin: user.ErrUserDisabled},
+		{name: "enable", actorRole: user.RoleSuperAdmin, startOff: true},
+		{name: "disable is idempotent", actorRole: user.RoleSuperAdmin, startOff: true, disable: true, wantLogin: user.ErrUserDisabled},
+		{name: "approver cannot manage users", actorRole: user.RoleApprover, disable: true, wantErr: user.ErrUnauthorized},
+		{name: "unknown user", actorRole: user.RoleSuperAdmin, unknown: true, disable: true, wantErr: user.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			actor := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: tt.actorRole})
+			target := seedUser(t, store, testutil.UserOptions{Disabled: tt.startOff})
+
+			targetID := target.ID
+			if tt.unknown {
+				targetID = 9999
+			}
+
+			var err error
+			if tt.disable {
+				err = svc.DisableUser(ctx, targetID, actor.ID)
+			} else {
+				err = svc.EnableUser(ctx, targetID, actor.ID)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := svc.AuthenticateUser(ctx, target.Username, testutil.DefaultPassword); !errors.Is(err, tt.wantLogin) {
+				t.Errorf("AuthenticateUser: got %v, want %v", err, tt.wantLogin)
+			}
+			stored, err := svc.GetUserByID(ctx, target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != target.Status {
+				t.Errorf("Status changed from %q to %q", target.Status, stored.Status)
+			}
+		})
+	}
+}
+
+func TestDisableUserRejectsSelf(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+
+	if err := svc.DisableUser(ctx, admin.ID, admin.ID); err == nil {
+		t.Fatal("admin disabled their own account")
+	}
+	if _, err := svc.AuthenticateUser(ctx, "boss", testutil.DefaultPassword); err != nil {
+		t.Fatalf("AuthenticateUser: %v", err)
+	}
+}
+
+func TestRequiredApprovals(t *testing.T) {
+	ctx := context.Background()
+
+	type step struct {
+		approver string
+		wantErr  error
+	}
+	tests := []struct {
+		name         string
+		required     int
+		steps        []step
+		wantApproved bool
+	}{
+		{"default of one", 0, []step{{"ann", nil}}, true},
+		{"two of two", 2, []step{{"ann", nil}, {"ben", nil}}, true},
+		{"one of two", 2, []step{{"ann", nil}}, false},
+		{"same admin twice", 2, []step{{"ann", nil}, {"ann", user.ErrAlreadyApprovedByYou}}, false},
+		{"viewer does not count", 2, []step{{"ann", nil}, {"val", user.ErrUnauthorized}}, false},
+		{"approved already", 1, []step{{"ann", nil}, {"ben", user.ErrUserAlreadyApproved}}, true},
+		{"three of three", 3, []step{{"ann", nil}, {"ben", nil}, {"ann", user.ErrAlreadyApprovedByYou}, {"cat", nil}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithRequiredApprovals(tt.required))
+			admins := map[string]*user.User{
+				"ann": seedUser(t, store, testutil.UserOptions{Username: "ann", Role: user.RoleApprover}),
+				"ben": seedUser(t, store, testutil.UserOptions{Username: "ben", Role: user.RoleApprover}),
+				"cat": seedUser(t, store, testutil.UserOptions{Username: "cat", Role: user.RoleSuperAdmin}),
+				"val": seedUser(t, store, testutil.UserOptions{Username: "val", Role: user.RoleViewer}),
+			}
+			pending := seedUser(t, store, testutil.UserOptions{Pending: true})
+
+			for i, s := range tt.steps {
+				err := svc.ApproveUser(ctx, pending.ID, admins[s.approver].ID)
+				if !errors.Is(err, s.wantErr) {
+					t.Fatalf("step %d (%s): got %v, want %v", i, s.approver, err, s.wantErr)
+				}
+			}
+
+			got, err := svc.GetUserByID(ctx, pending.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.IsApproved() != tt.wantApproved {
+				t.Errorf("IsApproved = %v, want %v", got.IsApproved(), tt.wantApproved)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUserDoesNotRevealUsernames(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		username     string
+		password     string
+		wantErr      error
+		wantDummyRun bool
+	}{
+		{"unknown username", "nobody", testutil.DefaultPassword, user.ErrInvalidCredentials, true},
+		{"wrong password", "known", "wrong-password", user.ErrInvalidCredentials, false},
+		{"pending, wrong password", "waiting", "wrong-password", user.ErrInvalidCredentials, false},
+		{"pending, right password", "waiting", testutil.DefaultPassword, user.ErrUserNotApproved, false},
+		{"right password", "known", testutil.DefaultPassword, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hasher := &countingHasher{inner: user.NewBcryptHasher(4)}
+			svc, store := newService(t, user.WithHasher(hasher))
+			seedUser(t, store, testutil.UserOptions{Username: "known"})
+			seedUser(t, store, testutil.UserOptions{Username: "waiting", Pending: true})
+
+			_, err := svc.AuthenticateUser(ctx, tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(err, user.ErrUserNotFound) {
+				t.Error("error reveals that the user does not exist")
+			}
+			if tt.wantDummyRun && hasher.compares == 0 {
+				t.Error("no dummy hash comparison for an unknown username")
+			}
+		})
+	}
+}
+
+func TestValidateNewUserMatchesCreateUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{"valid", "newcomer", testutil.DefaultPassword, nil},
+		{"invalid username", "bad name", testutil.DefaultPassword, user.ErrInvalidUsername},
+		{"reserved username", "admin", testutil.DefaultPassword, user.ErrReservedUsername},
+		{"weak password", "newcomer", "short", user.ErrInvalidPassword},
+		{"taken username", "Taken", testutil.DefaultPassword, user.ErrUserAlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			seedUser(t, store, testutil.UserOptions{Username: "taken"})
+
+			if err := svc.ValidateNewUser(ctx, tt.username, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateNewUser: got %v, want %v", err, tt.wantErr)
+			}
+			if n, _ := svc.CountUsers(ctx); n != 1 {
+				t.Fatalf("ValidateNewUser left %d users, want 1", n)
+			}
+
+			if _, err := svc.CreateUser(ctx, tt.username, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateUser: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApproveUserRequiresVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		require      bool
+		verified     bool
+		viaToken     bool
+		wantErr      error
+		wantApproved bool
+	}{
+		{name: "not required", require: false, wantApproved: true},
+		{name: "required, unverified", require: true, wantErr: user.ErrEmailNotVerified},
+		{name: "required, verified", require: true, verified: true, wantApproved: true},
+		{name: "required, verified by token", require: true, viaToken: true, wantApproved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t,
+				user.WithRequireVerifiedEmail(tt.require),
+				user.WithTokenManager(newTokenService(t)))
+			admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			pending := seedUser(t, store, testutil.UserOptions{Pending: true, EmailVerified: tt.verified})
+
+			if tt.viaToken {
+				tok, err := svc.IssueEmailVerificationToken(ctx, pending.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.VerifyEmail(ctx, tok.PlainText); err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.VerifyEmail(ctx, tok.PlainText); !errors.Is(err, token.ErrTokenNotFound) {
+					t.Fatalf("reusing the token: got %v, want ErrTokenNotFound", err)
+				}
+			}
+
+			err := svc.ApproveUser(ctx, pending.ID, admin.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			got, err := svc.GetUserByID(ctx, pending.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.IsApproved() != tt.wantApproved {
+				t.Errorf("IsApproved = %v, want %v", got.IsApproved(), tt.wantApproved)
+			}
+		})
+	}
+}
+
+func TestListAdmins(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	seedUser(t, store, testutil.UserOptions{Username: "root1", Role: user.RoleSuperAdmin})
+	seedUser(t, store, testutil.UserOptions{Username: "approver", Role: user.RoleApprover})
+	seedUser(t, store, testutil.UserOptions{Username: "plain"})
+	seedUser(t, store, testutil.UserOptions{Username: "root2", Role: user.RoleSuperAdmin})
+
+	tests := []struct {
+		name   string
+		limit  int
+		offset int
+		want   []string
+	}{
+		{"all", 10, 0, []string{"root2", "root1"}},
+		{"first page", 1, 0, []string{"root2"}},
+		{"second page", 1, 1, []string{"root1"}},
+		{"past the end", 10, 5, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admins, err := svc.ListAdmins(ctx, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := usernames(admins); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordByteLimit(t *testing.T) {
+	ctx := context.Background()
+	// Composition rules need an upper case letter, a lower case letter and
+	// a digit; the rest is padding.
+	prefix := "Aa1" + strings.Repeat("x", 69)
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"72 bytes", prefix, nil},
+		{"73 bytes", prefix + "y", user.ErrPasswordTooLong},
+		{"72 bytes of multi-byte runes", "Aa1" + strings.Repeat("é", 34) + "x", nil},
+		{"over 72 bytes but under 72 runes", "Aa1" + strings.Repeat("é", 35), user.ErrPasswordTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			if _, err := svc.CreateUser(ctx, "newcomer", tt.password); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateUser: got %v, want %v", err, tt.wantErr)
+			}
+			if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ChangePassword: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// legacyBcryptHasher hashes like bcrypt releases that accepted any length
+// and silently kept only the first 72 bytes.
+type legacyBcryptHasher struct{ *user.BcryptHasher }
+
+func (h legacyBcryptHasher) Hash(password string) ([]byte, error) {
+	if len(password) > 72 {
+		password = password[:72]
+	}
+	return h.BcryptHasher.Hash(password)
+}
+
+// TestLegacyLongPasswords checks that users who set a password over 72
+// bytes before the limit existed can still log in, change it and delete
+// their account, while new over-long passwords stay refused.
+func TestLegacyLongPasswords(t *testing.T) {
+	ctx := context.Background()
+	legacy := "Aa1" + strings.Repeat("x", 87)
+
+	tests := []struct {
+		name string
+		run  func(svc *user.UserService, u *user.User) error
+	}{
+		{"authenticate", func(svc *user.UserService, u *user.User) error {
+			_, err := svc.AuthenticateUser(ctx, u.Username, legacy)
+			return err
+		}},
+		{"verify password", func(svc *user.UserService, u *user.User) error {
+			ok, err := svc.VerifyPassword(ctx, u.ID, legacy)
+			if err == nil && !ok {
+				return user.ErrInvalidCredentials
+			}
+			return err
+		}},
+		{"change password", func(svc *user.UserService, u *user.User) error {
+			return svc.ChangePassword(ctx, u.Username, legacy, "Shorter123")
+		}},
+		{"delete own account", func(svc *user.UserService, u *user.User) error {
+			return svc.DeleteOwnAccount(ctx, u.Username, legacy)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			u := seedUser(t, store, testutil.UserOptions{})
+			if err := u.PasswordHash.SetWithHasher(legacyBcryptHasher{user.NewBcryptHasher(4)}, legacy); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UpdateUser(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.run(svc, u); err != nil {
+				t.Fatalf("legacy 90-byte password: %v", err)
+			}
+		})
+	}
+
+	t.Run("cannot be set again", func(t *testing.T) {
+		svc, store := newService(t)
+		u := seedUser(t, store, testutil.UserOptions{})
+		if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, legacy); !errors.Is(err, user.ErrPasswordTooLong) {
+			t.Fatalf("got %v, want ErrPasswordTooLong", err)
+		}
+	})
+}
+
+func TestApproveUserIdempotent(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		required     int
+		repeat       bool
+		approver     string
+		wantErr      error
+		wantApproved bool
+	}{
+		{name: "first approval", required: 1, approver: "ann", wantApproved: true},
+		{name: "repeated approval", required: 1, repeat: true, approver: "ann", wantApproved: true},
+		{name: "repeat while more approvals needed", required: 2, repeat: true, approver: "ann", wantApproved: false},
+		{name: "unauthorized", required: 1, approver: "val", wantErr: user.ErrUnauthorized},
+		{name: "unauthorized after approval", required: 1, repeat: true, approver: "val", wantErr: user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t, user.WithRequiredApprovals(tt.required))
+			admins := map[string]*user.User{
+				"ann": seedUser(t, store, testutil.UserOptions{Username: "ann", Role: user.RoleApprover}),
+				"val": seedUser(t, store, testutil.UserOptions{Username: "val", Role: user.RoleViewer}),
+			}
+			pending := seedUser(t, store, testutil.UserOptions{Pending: true})
+
+			if tt.repeat {
+				if _, err := svc.ApproveUserIdempotent(ctx, pending.ID, admins["ann"].ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := svc.ApproveUserIdempotent(ctx, pending.ID, admins[tt.approver].ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if got != nil {
+					t.Errorf("returned %+v alongside an error", got)
+				}
+				return
+			}
+			if got.ID != pending.ID || got.IsApproved() != tt.wantApproved {
+				t.Errorf("returned user %d approved=%v, want %d approved=%v", got.ID, got.IsApproved(), pending.ID, tt.wantApproved)
+			}
+		})
+	}
+}
+
+func TestUsernameLength(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		opts     []user.Option
+		username string
+		wantErr  error
+	}{
+		{"default minimum", nil, "abc", nil},
+		{"below default minimum", nil, "ab", user.ErrInvalidUsername},
+		{"default maximum", nil, strings.Repeat("a", 50), nil},
+		{"above default maximum", nil, strings.Repeat("a", 51), user.ErrInvalidUsername},
+		{"custom minimum", []user.Option{user.WithUsernameLength(5, 10)}, "abcd", user.ErrInvalidUsername},
+		{"custom maximum", []user.Option{user.WithUsernameLength(5, 10)}, strings.Repeat("a", 11), user.ErrInvalidUsername},
+		{"within custom range", []user.Option{user.WithUsernameLength(2, 4)}, "ab", nil},
+		{"counts characters, not bytes", []user.Option{user.WithUnicodeUsernames(true), user.WithUsernameLength(2, 4)}, "éééé", nil},
+		{"surrounding space not counted", nil, "  ab  ", user.ErrInvalidUsername},
+		{"min above max is ignored", []user.Option{user.WithUsernameLength(10, 5)}, "abc", nil},
+		{"non-positive min is ignored", []user.Option{user.WithUsernameLength(0, 5)}, strings.Repeat("a", 50), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, tt.opts...)
+
+			if err := svc.ValidateNewUser(ctx, tt.username, testutil.DefaultPassword); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSuspendUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		suspend   time.Duration
+		advance   time.Duration
+		lift      bool
+		wantLogin error
+	}{
+		{name: "during suspension", suspend: time.Hour, advance: 30 * time.Minute, wantLogin: user.ErrUserSuspended},
+		{name: "after expiry", suspend: time.Hour, advance: 2 * time.Hour},
+		{name: "at expiry", suspend: time.Hour, advance: time.Hour},
+		{name: "lifted early", suspend: time.Hour, lift: true},
+		{name: "suspension in the past", suspend: -time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			svc, store := newService(t, user.WithClock(clock.Now))
+			admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			if err := svc.SuspendUser(ctx, u.ID, admin.ID, clock.Now().Add(tt.suspend)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.lift {
+				if err := svc.LiftSuspension(ctx, u.ID, admin.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock.Advance(tt.advance)
+
+			if _, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword); !errors.Is(err, tt.wantLogin) {
+				t.Fatalf("got %v, want %v", err, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestSuspendUserPermissions(t *testing.T) {
+	ctx := context.Background()
+	until := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		role    user.Role
+		self    bool
+		wantErr bool
+	}{
+		{name: "super admin", role: user.RoleSuperAdmin},
+		{name: "approver", role: user.RoleApprover, wantErr: true},
+		{name: "plain user", role: user.RoleUser, wantErr: true},
+		{name: "self", role: user.RoleSuperAdmin, self: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			actor := seedUser(t, store, testutil.UserOptions{Username: "actor", Role: tt.role})
+			target := seedUser(t, store, testutil.UserOptions{})
+			if tt.self {
+				target = actor
+			}
+
+			err := svc.SuspendUser(ctx, target.ID, actor.ID, until)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			got, err := svc.GetUserByID(ctx, target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if suspended := got.SuspendedUntil != nil; suspended == tt.wantErr {
+				t.Errorf("SuspendedUntil = %v after err = %v", got.SuspendedUntil, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetUsersByIDs(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	ann := seedUser(t, store, testutil.UserOptions{Username: "ann"})
+	ben := seedUser(t, store, testutil.UserOptions{Username: "ben"})
+
+	tests := []struct {
+		name string
+		ids  []int64
+		want map[int64]string
+	}{
+		{"none", nil, map[int64]string{}},
+		{"one", []int64{ann.ID}, map[int64]string{ann.ID: "ann"}},
+		{"several", []int64{ann.ID, ben.ID}, map[int64]string{ann.ID: "ann", ben.ID: "ben"}},
+		{"missing omitted", []int64{ann.ID, 9999}, map[int64]string{ann.ID: "ann"}},
+		{"duplicates collapse", []int64{ben.ID, ben.ID}, map[int64]string{ben.ID: "ben"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := svc.GetUsersByIDs(ctx, tt.ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(tt.want) {
+				t.Fatalf("got %d users, want %d", len(users), len(tt.want))
+			}
+			for id, name := range tt.want {
+				if u := users[id]; u == nil || u.Username != name {
+					t.Errorf("users[%d] = %+v, want %s", id, u, name)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		newName  string
+		unknown  bool
+		wantErr  error
+		wantName string
+	}{
+		{name: "free name", newName: "renamed", wantName: "renamed"},
+		{name: "own name, new case", newName: "ALICE", wantName: "ALICE"},
+		{name: "trimmed", newName: "  spaced  ", wantName: "spaced"},
+		{name: "taken", newName: "bob", wantErr: user.ErrUserAlreadyExists, wantName: "alice"},
+		{name: "taken in other case", newName: "Bob", wantErr: user.ErrUserAlreadyExists, wantName: "alice"},
+		{name: "reserved", newName: "root", wantErr: user.ErrReservedUsername, wantName: "alice"},
+		{name: "invalid", newName: "no spaces", wantErr: user.ErrInvalidUsername, wantName: "alice"},
+		{name: "unknown user", newName: "renamed", unknown: true, wantErr: user.ErrUserNotFound, wantName: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			alice := seedUser(t, store, testutil.UserOptions{Username: "alice"})
+			seedUser(t, store, testutil.UserOptions{Username: "bob"})
+
+			id := alice.ID
+			if tt.unknown {
+				id = 9999
+			}
+			if err := svc.ChangeUsername(ctx, id, tt.newName); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			got, err := svc.GetUserByID(ctx, alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Username != tt.wantName {
+				t.Errorf("Username = %q, want %q", got.Username, tt.wantName)
+			}
+			// The account stays reachable by its current name.
+			if _, err := svc.AuthenticateUser(ctx, tt.wantName, testutil.DefaultPassword); err != nil {
+				t.Errorf("login as %q: %v", tt.wantName, err)
+			}
+		})
+	}
+}
+
+func TestPasswordChangeRevokesSessions(t *testing.T) {
+	ctx := context.Background()
+	const newPassword = "N3w-Passw0rd-For-Test"
+
+	tests := []struct {
+		name         string
+		reset        bool
+		revokeDeploy bool
+	}{
+		{name: "change password"},
+		{name: "change password, deploy tokens too", revokeDeploy: true},
+		{name: "reset link", reset: true},
+		{name: "reset link, deploy tokens too", reset: true, revokeDeploy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t,
+				user.WithTokenManager(tokens),
+				user.WithRevokeDeployTokensOnPasswordChange(tt.revokeDeploy),
+				user.WithResetLinkSecret([]byte("reset-link-secret"), time.Hour))
+			u := seedUser(t, store, testutil.UserOptions{})
+
+			auth, refresh, err := tokens.CreateAuthTokenWithRefresh(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deploy, err := tokens.CreateDeployToken(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.reset {
+				link, err := svc.GenerateResetLink(ctx, u.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.ConsumeResetLink(ctx, link, newPassword); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := svc.ChangePassword(ctx, u.Username, testutil.DefaultPassword, newPassword); err != nil {
+				t.Fatal(err)
+			}
+
+			for scope, tok := range map[string]*token.Token{token.ScopeAuth: auth, token.ScopeRefresh: refresh} {
+				if _, err := tokens.ValidateToken(ctx, tok.PlainText, scope); !errors.Is(err, token.ErrTokenNotFound) {
+					t.Errorf("%s token after password change: got %v, want ErrTokenNotFound", scope, err)
+				}
+			}
+			_, err = tokens.ValidateToken(ctx, deploy.PlainText, token.ScopeDeploy)
+			if deployAlive := err == nil; deployAlive == tt.revokeDeploy {
+				t.Errorf("deploy token alive = %v (err %v), want %v", deployAlive, err, !tt.revokeDeploy)
+			}
+		})
+	}
+}
+
+func TestGetUserStats(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	svc, store := newService(t, user.WithClock(clock.Now))
+
+	boss := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+	seedUser(t, store, testutil.UserOptions{Role: user.RoleApprover})
+	seedUser(t, store, testutil.UserOptions{})
+	seedUser(t, store, testutil.UserOptions{Pending: true})
+	seedUser(t, store, testutil.UserOptions{Pending: true})
+	seedUser(t, store, testutil.UserOptions{Disabled: true, Status: "disabled"})
+	suspended := seedUser(t, store, testutil.UserOptions{})
+	lapsed := seedUser(t, store, testutil.UserOptions{})
+	viewer := seedUser(t, store, testutil.UserOptions{Role: user.RoleViewer})
+	scheduleDeletion(t, store, seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin}))
+	scheduleDeletion(t, store, seedUser(t, store, testutil.UserOptions{Pending: true}))
+
+	if err := svc.SuspendUser(ctx, suspended.ID, boss.ID, clock.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SuspendUser(ctx, lapsed.ID, boss.ID, clock.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Minute)
+
+	stats, err := svc.GetUserStats(ctx, viewer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want int
+	}{
+		{"total", stats.Total, 9},
+		{"pending", stats.Pending, 2},
+		{"approved", stats.Approved, 7},
+		{"suspended", stats.Suspended, 1},
+		{"admins", stats.Admins, 1},
+		{"pending deletion", stats.PendingDeletion, 2},
+		{"active", stats.ByStatus["active"], 6},
+		{"pending status", stats.ByStatus["pending"], 2},
+		{"disabled status", stats.ByStatus["disabled"], 1},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestGetUserStatsPermissions(t *testing.T) {
+	tests := []struct {
+		role    user.Role
+		wantErr error
+	}{
+		{user.RoleUser, user.ErrUnauthorized},
+		{user.RoleViewer, nil},
+		{user.RoleApprover, nil},
+		{user.RoleSuperAdmin, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			svc, store := newService(t)
+			caller := seedUser(t, store, testutil.UserOptions{Role: tt.role})
+
+			stats, err := svc.GetUserStats(context.Background(), caller.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && stats != nil {
+				t.Error("stats returned alongside an error")
+			}
+		})
+	}
+}
+
+func TestUnapproveUser(t *testing.T) {
+	ctx := context.Background()
+	tokens := newTokenService(t)
+	svc, store := newService(t, user.WithTokenManager(tokens))
+	approver := seedUser(t, store, testutil.UserOptions{Username: "ann", Role: user.RoleApprover})
+	u := seedUser(t, store, testutil.UserOptions{})
+
+	auth, refresh, err := tokens.CreateAuthTokenWithRefresh(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := tokens.CreateDeployToken(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := svc.UnapproveUser(ctx, u.ID, approver.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ApprovedAt != nil || got.ApprovedBy != nil {
+		t.Errorf("approval not cleared: approved_at %v, approved_by %v", got.ApprovedAt, got.ApprovedBy)
+	}
+	if _, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword); !errors.Is(err, user.ErrUserNotApproved) {
+		t.Fatalf("login after unapproval: got %v, want ErrUserNotApproved", err)
+	}
+	for scope, tok := range map[string]*token.Token{token.ScopeAuth: auth, token.ScopeRefresh: refresh} {
+		if _, err := tokens.ValidateToken(ctx, tok.PlainText, scope); !errors.Is(err, token.ErrTokenNotFound) {
+			t.Errorf("%s token: got %v, want ErrTokenNotFound", scope, err)
+		}
+	}
+	// Deploy tokens stay; an unapproved owner cannot use them anyway.
+	if _, err := tokens.ValidateToken(ctx, deploy.PlainText, token.ScopeDeploy); err != nil {
+		t.Errorf("deploy token: %v", err)
+	}
+
+	if err := svc.ApproveUser(ctx, u.ID, approver.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.AuthenticateUser(ctx, u.Username, testutil.DefaultPassword); err != nil {
+		t.Errorf("login after re-approval: %v", err)
+	}
+}
+
+func TestUnapproveUserErrors(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		role    user.Role
+		pending bool
+		missing bool
+		wantErr error
+	}{
+		{name: "viewer", role: user.RoleViewer, wantErr: user.ErrUnauthorized},
+		{name: "regular user", role: user.RoleUser, wantErr: user.ErrUnauthorized},
+		{name: "already pending", role: user.RoleApprover, pending: true, wantErr: user.ErrUserNotApproved},
+		{name: "no such user", role: user.RoleApprover, missing: true, wantErr: user.ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, store := newService(t)
+			caller := seedUser(t, store, testutil.UserOptions{Role: tt.role})
+			target := seedUser(t, store, testutil.UserOptions{Pending: tt.pending})
+			id := target.ID
+			if tt.missing {
+				id = target.ID + 100
+			}
+
+			if err := svc.UnapproveUser(ctx, id, caller.ID); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxListLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []user.Option
+		limit     int
+		wantLimit int
+	}{
+		{"default clamp", nil, 1000, user.DefaultMaxListLimit},
+		{"within default", nil, 50, 50},
+		{"raised ceiling", []user.Option{user.WithMaxListLimit(1000)}, 1000, 1000},
+		{"above raised ceiling", []user.Option{user.WithMaxListLimit(1000)}, 2000, 1000},
+		{"lowered ceiling", []user.Option{user.WithMaxListLimit(20)}, 50, 20},
+		{"hard ceiling", []user.Option{user.WithMaxListLimit(1 << 30)}, 1 << 30, user.HardMaxListLimit},
+		{"zero ignored", []user.Option{user.WithMaxListLimit(0)}, 1000, user.DefaultMaxListLimit},
+		{"negative ignored", []user.Option{user.WithMaxListLimit(-1)}, 1000, user.DefaultMaxListLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newService(t, tt.opts...)
+
+			page, err := svc.ListUsersPaged(context.Background(), tt.limit, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Limit != tt.wantLimit {
+				t.Errorf("Limit = %d, want %d", page.Limit, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestMaxListLimitAppliesToEveryList(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t, user.WithMaxListLimit(2))
+	boss := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+	for i := 0; i < 3; i++ {
+		seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+		seedUser(t, store, testutil.UserOptions{Pending: true})
+	}
+
+	tests := []struct {
+		name string
+		list func() ([]*user.User, error)
+	}{
+		{"ListUsers", func() ([]*user.User, error) { return svc.ListUsers(ctx, 100, 0) }},
+		{"ListUsersOrdered", func() ([]*user.User, error) { return svc.ListUsersOrdered(ctx, user.UserOrder{}, 100, 0) }},
+		{"ListPendingUsers", func() ([]*user.User, error) { return svc.ListPendingUsers(ctx, 100, 0) }},
+		{"ListAdmins", func() ([]*user.User, error) { return svc.ListAdmins(ctx, 100, 0) }},
+		{"SearchUsersByUsername", func() ([]*user.User, error) { return svc.SearchUsersByUsername(ctx, "user", 100, 0, boss.ID) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := tt.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 2 {
+				t.Errorf("listed %d users, want the ceiling of 2", len(users))
+			}
+		})
+	}
+}
+
+func TestFindTokenOwner(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		role     user.Role
+		unknown  bool
+		wantErr  error
+		wantUser bool
+	}{
+		{name: "super admin", role: user.RoleSuperAdmin, wantUser: true},
+		{name: "unknown token", role: user.RoleSuperAdmin, unknown: true, wantErr: token.ErrTokenNotFound},
+		{name: "approver", role: user.RoleApprover, wantErr: user.ErrUnauthorized},
+		{name: "viewer", role: user.RoleViewer, wantErr: user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var svc *user.UserService
+			tokens := newTokenService(t, token.WithAdminAuthorizer(func(ctx context.Context, adminID int64) error {
+				return svc.AuthorizeTokenLookup(ctx, adminID)
+			}))
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			caller := seedUser(t, store, testutil.UserOptions{Role: tt.role})
+			owner := seedUser(t, store, testutil.UserOptions{})
+
+			plaintext := "not-a-token"
+			if !tt.unknown {
+				deploy, err := tokens.CreateDeployToken(ctx, owner.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				plaintext = deploy.PlainText
+			}
+
+			got, err := svc.FindTokenOwner(ctx, plaintext, caller.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if (got != nil) != tt.wantUser {
+				t.Fatalf("got user %+v, want one: %v", got, tt.wantUser)
+			}
+			if got != nil && (got.ID != owner.ID || got.PasswordHash.IsSet()) {
+				t.Errorf("got user %d with hash set %v, want %d without hash", got.ID, got.PasswordHash.IsSet(), owner.ID)
+			}
+		})
+	}
+}
+
+func TestCanDeploy(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		opts    testutil.UserOptions
+		setup   func(svc *user.UserService, clock *fakeClock, u, admin *user.User) error
+		wantErr error
+	}{
+		{name: "approved and active"},
+		{name: "pending", opts: testutil.UserOptions{Pending: true}, wantErr: user.ErrUserNotApproved},
+		{name: "disabled", opts: testutil.UserOptions{Disabled: true}, wantErr: user.ErrUserDisabled},
+		{
+			name: "suspended",
+			setup: func(svc *user.UserService, clock *fakeClock, u, admin *user.User) error {
+				return svc.SuspendUser(ctx, u.ID, admin.ID, clock.Now().Add(time.Hour))
+			},
+			wantErr: user.ErrUserSuspended,
+		},
+		{
+			name: "suspension lapsed",
+			setup: func(svc *user.UserService, clock *fakeClock, u, admin *user.User) error {
+				if err := svc.SuspendUser(ctx, u.ID, admin.ID, clock.Now().Add(time.Hour)); err != nil {
+					return err
+				}
+				clock.Advance(2 * time.Hour)
+				return nil
+			},
+		},
+		{
+			name: "scheduled for deletion",
+			setup: func(svc *user.UserService, clock *fakeClock, u, admin *user.User) error {
+				return svc.ScheduleUserDeletion(ctx, u.ID, admin.ID, time.Hour)
+			},
+			wantErr: user.ErrUserDisabled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			svc, store := newService(t, user.WithClock(clock.Now))
+			admin := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			u := seedUser(t, store, tt.opts)
+			if tt.setup != nil {
+				if err := tt.setup(svc, clock, u, admin); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ok, err := svc.CanDeploy(ctx, u.ID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if ok != (tt.wantErr == nil) {
+				t.Errorf("CanDeploy = %v with error %v", ok, err)
+			}
+		})
+	}
+
+	svc, _ := newService(t)
+	if ok, err := svc.CanDeploy(ctx, 9999); ok || !errors.Is(err, user.ErrUserNotFound) {
+		t.Errorf("unknown user: got %v, %v; want false, ErrUserNotFound", ok, err)
+	}
+}
+
+func TestListUsersApprovedBy(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t)
+	ann := seedUser(t, store, testutil.UserOptions{Username: "ann", Role: user.RoleApprover})
+	bob := seedUser(t, store, testutil.UserOptions{Username: "bob", Role: user.RoleApprover})
+	viewer := seedUser(t, store, testutil.UserOptions{Role: user.RoleViewer})
+	plain := seedUser(t, store, testutil.UserOptions{})
+
+	approve := func(approver *user.User, username string) {
+		t.Helper()
+		u := seedUser(t, store, testutil.UserOptions{Username: username, Pending: true})
+		if err := svc.ApproveUser(ctx, u.ID, approver.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	approve(ann, "carol")
+	approve(ann, "dave")
+	approve(bob, "erin")
+	seedUser(t, store, testutil.UserOptions{Username: "frank", Pending: true})
+
+	tests := []struct {
+		name       string
+		approverID int64
+		callerID   int64
+		limit      int
+		want       []string
+		wantErr    error
+	}{
+		{name: "ann", approverID: ann.ID, callerID: viewer.ID, want: []string{"carol", "dave"}},
+		{name: "bob", approverID: bob.ID, callerID: viewer.ID, want: []string{"erin"}},
+		{name: "paged", approverID: ann.ID, callerID: viewer.ID, limit: 1},
+		{name: "approved nobody", approverID: viewer.ID, callerID: viewer.ID, want: []string{}},
+		{name: "no such approver", approverID: 9999, callerID: viewer.ID, want: []string{}},
+		{name: "unauthorized", approverID: ann.ID, callerID: plain.ID, wantErr: user.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := svc.ListUsersApprovedBy(ctx, tt.approverID, tt.limit, 0, tt.callerID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if users == nil {
+				t.Fatal("got a nil slice, want an empty one")
+			}
+			if tt.limit > 0 {
+				if len(users) != tt.limit {
+					t.Errorf("listed %d users, want %d", len(users), tt.limit)
+				}
+				return
+			}
+			got := usernames(users)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoApprove(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		opts         []user.Option
+		wantApproved bool
+		wantLogin    error
+	}{
+		{name: "default requires approval", wantLogin: user.ErrUserNotApproved},
+		{name: "explicitly off", opts: []user.Option{user.WithAutoApprove(false)}, wantLogin: user.ErrUserNotApproved},
+		{name: "auto approve", opts: []user.Option{user.WithAutoApprove(true)}, wantApproved: true},
+		{
+			name:         "bypasses approval policies",
+			opts:         []user.Option{user.WithAutoApprove(true), user.WithRequiredApprovals(2), user.WithRequireVerifiedEmail(true)},
+			wantApproved: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			svc, _ := newService(t, append(tt.opts, user.WithClock(clock.Now))...)
+
+			created, err := svc.CreateUser(ctx, "newcomer", testutil.DefaultPassword)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.IsApproved() != tt.wantApproved {
+				t.Errorf("approved = %v, want %v", created.IsApproved(), tt.wantApproved)
+			}
+			if tt.wantApproved {
+				if !created.ApprovedAt.Equal(clock.Now()) || created.Status != "active" || created.ApprovedBy != nil {
+					t.Errorf("approved_at %v, status %q, approved_by %v; want now, active and no approver",
+						created.ApprovedAt, created.Status, created.ApprovedBy)
+				}
+			}
+
+			if _, err := svc.AuthenticateUser(ctx, "newcomer", testutil.DefaultPassword); !errors.Is(err, tt.wantLogin) {
+				t.Fatalf("login: got %v, want %v", err, tt.wantLogin)
+			}
+		})
+	}
+}
+
+// lookupCountingStore counts bulk username lookups.
+type lookupCountingStore struct {
+	*usertest.MemoryUserStore
+	lookups int
+}
+
+func (s *lookupCountingStore) GetUsersByUsernames(ctx context.Context, names []string) (map[string]*user.User, error) {
+	s.lookups++
+	return s.MemoryUserStore.GetUsersByUsernames(ctx, names)
+}
+
+func TestCheckUsernamesBulk(t *testing.T) {
+	ctx := context.Background()
+	store := &lookupCountingStore{MemoryUserStore: usertest.NewMemoryUserStore()}
+	svc := user.NewUserService(store, user.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	seedUser(t, store, testutil.UserOptions{Username: "alice"})
+
+	names := []string{"newbie", "alice", "ALICE", "x", "bad name!", "admin", "carol", "Carol"}
+	results, err := svc.CheckUsernamesBulk(ctx, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.lookups != 1 {
+		t.Errorf("looked up usernames %d times, want once", store.lookups)
+	}
+
+	tests := []struct {
+		username string
+		wantErr  error
+	}{
+		{"newbie", nil},
+		{"alice", user.ErrUserAlreadyExists},
+		{"ALICE", user.ErrUserAlreadyExists},
+		{"x", user.ErrInvalidUsername},
+		{"bad name!", user.ErrInvalidUsername},
+		{"admin", user.ErrReservedUsername},
+		{"carol", nil},
+		{"Carol", user.ErrUserAlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			err, ok := results[tt.username]
+			if !ok {
+				t.Fatal("no result")
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if len(results) != len(names) {
+		t.Errorf("got %d results, want %d", len(results), len(names))
+	}
+}
+
+func TestRevokeAdminRevokesSessions(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		opts        []user.Option
+		wantRevoked bool
+	}{
+		{name: "default", wantRevoked: true},
+		{name: "enabled", opts: []user.Option{user.WithRevokeSessionsOnDemotion(true)}, wantRevoked: true},
+		{name: "disabled", opts: []user.Option{user.WithRevokeSessionsOnDemotion(false)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, append(tt.opts, user.WithTokenManager(tokens))...)
+			boss := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			demoted := seedUser(t, store, testutil.UserOptions{Role: user.RoleSuperAdmin})
+
+			auth, err := tokens.CreateAuthToken(ctx, int(demoted.ID), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deploy, err := tokens.CreateDeployToken(ctx, demoted.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.RevokeAdmin(ctx, demoted.ID, boss.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = tokens.ValidateToken(ctx, auth.PlainText, token.ScopeAuth)
+			if revoked := errors.Is(err, token.ErrTokenNotFound); revoked != tt.wantRevoked {
+				t.Errorf("auth token revoked = %v, want %v (error %v)", revoked, tt.wantRevoked, err)
+			}
+			if _, err := tokens.ValidateToken(ctx, deploy.PlainText, token.ScopeDeploy); err != nil {
+				t.Errorf("deploy token: %v", err)
+			}
+		})
+	}
+}
+
+func TestPurgeStalePending(t *testing.T) {
+	ctx := context.Background()
+	const olderThan = 7 * 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		olderThan  time.Duration
+		wantPurged int
+	}{
+		{"purges old pending", olderThan, 2},
+		{"zero cutoff is a no-op", 0, 0},
+		{"negative cutoff is a no-op", -time.Hour, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var now time.Time
+			svc, store := newService(t, user.WithClock(func() time.Time { return now }))
+
+			// Users seeded before boundary count as created more than
+			// olderThan ago once the clock is set past it.
+			oldPending := []*user.User{
+				seedUser(t, store, testutil.UserOptions{Pending: true}),
+				seedUser(t, store, testutil.UserOptions{Pending: true}),
+			}
+			oldApproved := seedUser(t, store, testutil.UserOptions{})
+			veteran := seedUser(t, store, testutil.UserOptions{})
+			partlyApproved := seedUser(t, store, testutil.UserOptions{Pending: true})
+			if _, err := store.RecordApproval(ctx, partlyApproved.ID, oldApproved.ID); err != nil {
+				t.Fatal(err)
+			}
+			boundary := time.Now()
+			recentPending := seedUser(t, store, testutil.UserOptions{Pending: true})
+			// Returned to pending after the boundary, so its old signup
+			// date does not count.
+			if err := store.UnapproveUser(ctx, veteran.ID); err != nil {
+				t.Fatal(err)
+			}
+			now = boundary.Add(olderThan)
+
+			purged, err := svc.PurgeStalePending(ctx, tt.olderThan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != tt.wantPurged {
+				t.Errorf("purged %d users, want %d", purged, tt.wantPurged)
+			}
+
+			for _, u := range oldPending {
+				_, err := store.GetUserByID(ctx, u.ID)
+				if gone := errors.Is(err, user.ErrNotFound); gone != (tt.wantPurged > 0) {
+					t.Errorf("old pending user %d removed = %v, want %v", u.ID, gone, tt.wantPurged > 0)
+				}
+			}
+			for _, u := range []*user.User{oldApproved, veteran, partlyApproved, recentPending} {
+				if _, err := store.GetUserByID(ctx, u.ID); err != nil {
+					t.Errorf("user %d: %v", u.ID, err)
+				}
+			}
+
+			// A scheduled rerun finds nothing left to purge.
+			if again, err := svc.PurgeStalePending(ctx, tt.olderThan); err != nil || again != 0 {
+				t.Errorf("second run purged %d, %v; want 0, nil", again, err)
+			}
+		})
+	}
+}
+
+// collapseSeparators is a Gmail-style normalizer: separators are ignored on
+// top of the default case folding.
+func collapseSeparators(username string) string {
+	return strings.NewReplacer(".", "", "-", "", "_", "").Replace(user.NormalizeUsername(username))
+}
+
+func TestUsernameNormalizer(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		normalizer user.UsernameNormalizer
+		existing   string
+		username   string
+		wantErr    error
+	}{
+		{"default keeps separators", nil, "john-doe", "johndoe", nil},
+		{"collapsed separators collide", collapseSeparators, "john-doe", "johndoe", user.ErrUserAlreadyExists},
+		{"collapsed underscore collides", collapseSeparators, "john-doe", "John_Doe", user.ErrUserAlreadyExists},
+		{"collapsed names still differ", collapseSeparators, "john-doe", "jane-doe", nil},
+		{"reserved after collapsing", collapseSeparators, "", "ad-min", user.ErrReservedUsername},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []user.Option
+			seedOpts := testutil.UserOptions{Username: tt.existing}
+			if tt.normalizer != nil {
+				opts = append(opts, user.WithUsernameNormalizer(tt.normalizer))
+				seedOpts.Normalizer = tt.normalizer
+			}
+			svc, store := newService(t, opts...)
+			if tt.existing != "" {
+				seedUser(t, store, seedOpts)
+			}
+
+			results, err := svc.CheckUsernamesBulk(ctx, []string{tt.username})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(results[tt.username], tt.wantErr) {
+				t.Errorf("CheckUsernamesBulk: got %v, want %v", results[tt.username], tt.wantErr)
+			}
+			if _, err := svc.CreateUser(ctx, tt.username, testutil.DefaultPassword); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateUser: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUsernameNormalizerAppliesToLookups(t *testing.T) {
+	ctx := context.Background()
+	svc, store := newService(t, user.WithUsernameNormalizer(collapseSeparators))
+	u := seedUser(t, store, testutil.UserOptions{Username: "john-doe", Normalizer: collapseSeparators})
+
+	for _, login := range []string{"john-doe", "johndoe", "JOHN_DOE", " john.doe "} {
+		got, err := svc.AuthenticateUser(ctx, login, testutil.DefaultPassword)
+		if err != nil {
+			t.Errorf("login as %q: %v", login, err)
+			continue
+		}
+		if got.ID != u.ID {
+			t.Errorf("login as %q reached user %d, want %d", login, got.ID, u.ID)
+		}
+	}
+}
+
+func TestSetUserRoleDemotion(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		from, to    user.Role
+		wantRevoked bool
+	}{
+		{user.RoleSuperAdmin, user.RoleUser, true},
+		{user.RoleSuperAdmin, user.RoleApprover, true},
+		{user.RoleApprover, user.RoleViewer, true},
+		{user.RoleViewer, user.RoleApprover, false},
+		{user.RoleUser, user.RoleSuperAdmin, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			tokens := newTokenService(t)
+			svc, store := newService(t, user.WithTokenManager(tokens))
+			boss := seedUser(t, store, testutil.UserOptions{Username: "boss", Role: user.RoleSuperAdmin})
+			target := seedUser(t, store, testutil.UserOptions{Role: tt.from})
+			auth, err := tokens.CreateAuthToken(ctx, int(target.ID), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := svc.SetUserRole(ctx, target.ID, tt.to, boss.ID); err != nil {
+				t.Fatal(err)
+			}
+			_, err = tokens.ValidateToken(ctx, auth.PlainText, token.ScopeAuth)
+			if revoked := errors.Is(err, token.ErrTokenNotFound); revoked != tt.wantRevoked {
+				t.Errorf("auth token revoked = %v, want %v (error %v)", revoked, tt.wantRevoked, err)
+			}
+
+			// The change is in the command log, so it can be undone.
+			if err := svc.UndoLastCommand(ctx, boss.ID); err != nil {
+				t.Fatalf("undo: %v", err)
+			}
+			got, err := store.GetUserByID(ctx, target.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Role != tt.from {
+				t.Errorf("role after undo = %q, want %q", got.Role, tt.from)
+			}
+		})
+	}
+}
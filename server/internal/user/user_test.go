@@ -0,0 +1,136 @@
+package user_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+func TestUserJSON(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	phone := "+15550100"
+	approver := int64(1)
+	u := &user.User{
+		ID:                 7,
+		Username:           "alice",
+		CreatedAt:          now,
+		ApprovedAt:         &now,
+		ApprovedBy:         &approver,
+		Role:               user.RoleSuperAdmin,
+		Status:             "active",
+		MustChangePassword: true,
+		Disabled:           true,
+		DeleteAfter:        &now,
+		SuspendedUntil:     &now,
+		Phone:              &phone,
+		Emails:             []user.Email{{Address: "alice@example.com", Primary: true}},
+	}
+
+	tests := []struct {
+		name    string
+		value   any
+		present []string
+		absent  []string
+	}{
+		{
+			name:    "default",
+			value:   u,
+			present: []string{"id", "username", "role", "status", "is_admin"},
+			absent:  []string{"phone", "disabled", "must_change_password", "suspended_until", "delete_after", "emails", "approved_by", "password_hash"},
+		},
+		{
+			name:    "default by value",
+			value:   *u,
+			present: []string{"is_admin"},
+			absent:  []string{"phone", "disabled"},
+		},
+		{
+			name:    "admin",
+			value:   u.Admin(),
+			present: []string{"is_admin", "phone", "disabled", "must_change_password", "suspended_until", "delete_after", "emails", "approved_by"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(encoded, &fields); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range tt.present {
+				if _, ok := fields[key]; !ok {
+					t.Errorf("%s missing from %s", key, encoded)
+				}
+			}
+			for _, key := range tt.absent {
+				if _, ok := fields[key]; ok {
+					t.Errorf("%s exposed in %s", key, encoded)
+				}
+			}
+			if isAdmin, ok := fields["is_admin"]; ok && isAdmin != true {
+				t.Errorf("is_admin = %v, want true", isAdmin)
+			}
+		})
+	}
+}
+
+func TestUserIsApproved(t *testing.T) {
+	now := time.Now()
+	var zero time.Time
+
+	tests := []struct {
+		name       string
+		approvedAt *time.Time
+		want       bool
+	}{
+		{"never approved", nil, false},
+		{"zero approval time", &zero, false},
+		{"approved", &now, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &user.User{ApprovedAt: tt.approvedAt}
+			if got := u.IsApproved(); got != tt.want {
+				t.Errorf("IsApproved() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminUserApproval(t *testing.T) {
+	approvedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	approver := int64(3)
+
+	tests := []struct {
+		name           string
+		user           *user.User
+		wantApprovedBy any
+		wantApprovedAt any
+	}{
+		{"approved", &user.User{ApprovedAt: &approvedAt, ApprovedBy: &approver}, float64(3), "2024-01-01T00:00:00Z"},
+		{"pending", &user.User{}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := json.Marshal(tt.user.Admin())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(encoded, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if got := fields["approved_by"]; got != tt.wantApprovedBy {
+				t.Errorf("approved_by = %v, want %v", got, tt.wantApprovedBy)
+			}
+			if got := fields["approved_at"]; got != tt.wantApprovedAt {
+				t.Errorf("approved_at = %v, want %v", got, tt.wantApprovedAt)
+			}
+		})
+	}
+}
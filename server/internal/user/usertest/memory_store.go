@@ -0,0 +1,945 @@
+// Package usertest provides in-memory implementations of the user package's
+// storage interfaces for tests that should not need a database.
+package usertest
+
+import (
+	"context"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samokw/zdeploy/server/internal/user"
+)
+
+var _ user.UserStore = (*MemoryUserStore)(nil)
+
+type identityKey struct {
+	provider string
+	subject  string
+}
+
+type memoryToken struct {
+	userID int64
+	scope  string
+	expiry time.Time
+}
+
+type approvalKey struct {
+	userID     int64
+	approverID int64
+}
+
+// MemoryUserStore is a concurrency-safe, map-backed user.UserStore. It
+// mirrors UserRepo's observable behavior: lookups, updates and deletes of
+// missing users return user.ErrNotFound, stale updates return
+// user.ErrConcurrentUpdate, and normalized usernames are unique.
+type MemoryUserStore struct {
+	mu              sync.Mutex
+	nextID          int64
+	users           map[int64]*user.User
+	passwordHistory map[int64][][]byte
+	approvals       map[approvalKey]struct{}
+	tokens          map[[32]byte]memoryToken
+	emails          map[int64][]user.Email
+	commands        []user.Command
+	identities      map[identityKey]int64
+	nextCommandID   int64
+	// usernameHistory holds each user's previous usernames, oldest first.
+	usernameHistory map[int64][]string
+	// pendingSince records when UnapproveUser returned a user to pending;
+	// users never unapproved have been pending since they were created.
+	pendingSince map[int64]time.Time
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:           make(map[int64]*user.User),
+		passwordHistory: make(map[int64][][]byte),
+		emails:          make(map[int64][]user.Email),
+		identities:      make(map[identityKey]int64),
+		approvals:       make(map[approvalKey]struct{}),
+		tokens:          make(map[[32]byte]memoryToken),
+		pendingSince:    make(map[int64]time.Time),
+		usernameHistory: make(map[int64][]string),
+	}
+}
+
+// clone copies u so callers never share state with the store.
+func clone(u *user.User) *user.User {
+	c := *u
+	if u.ApprovedAt != nil {
+		approvedAt := *u.ApprovedAt
+		c.ApprovedAt = &approvedAt
+	}
+	if u.ApprovedBy != nil {
+		approvedBy := *u.ApprovedBy
+		c.ApprovedBy = &approvedBy
+	}
+	if u.DeleteAfter != nil {
+		deleteAfter := *u.DeleteAfter
+		c.DeleteAfter = &deleteAfter
+	}
+	if u.EmailVerifiedAt != nil {
+		emailVerifiedAt := *u.EmailVerifiedAt
+		c.EmailVerifiedAt = &emailVerifiedAt
+	}
+	if u.SuspendedUntil != nil {
+		suspendedUntil := *u.SuspendedUntil
+		c.SuspendedUntil = &suspendedUntil
+	}
+	if u.Phone != nil {
+		phone := *u.Phone
+		c.Phone = &phone
+	}
+	if u.LockedUntil != nil {
+		lockedUntil := *u.LockedUntil
+		c.LockedUntil = &lockedUntil
+	}
+	if u.Emails != nil {
+		c.Emails = make([]user.Email, len(u.Emails))
+		for i, email := range u.Emails {
+			c.Emails[i] = email
+			if email.VerifiedAt != nil {
+				verifiedAt := *email.VerifiedAt
+				c.Emails[i].VerifiedAt = &verifiedAt
+			}
+		}
+	}
+	return &c
+}
+
+func (m *MemoryUserStore) usernameTaken(normalizedUsername string, exceptID int64) bool {
+	for id, u := range m.users {
+		if id != exceptID && u.NormalizedUsername == normalizedUsername {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryUserStore) insert(u *user.User) error {
+	if m.usernameTaken(u.NormalizedUsername, 0) {
+		return user.ErrUserAlreadyExists
+	}
+
+	m.nextID++
+	u.ID = m.nextID
+	u.CreatedAt = time.Now()
+	m.users[u.ID] = clone(u)
+	return nil
+}
+
+func (m *MemoryUserStore) CreateUser(ctx context.Context, u *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insert(u)
+}
+
+func (m *MemoryUserStore) CreateUserBootstrapAdmin(ctx context.Context, u *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.users) == 0 {
+		now := time.Now()
+		u.Role = user.RoleSuperAdmin
+		u.Status = "active"
+		u.ApprovedAt = &now
+	}
+	return m.insert(u)
+}
+
+func (m *MemoryUserStore) GetUserByIdentity(ctx context.Context, provider, subject string) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[m.identities[identityKey{provider, subject}]]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	return clone(u), nil
+}
+
+func (m *MemoryUserStore) CreateFederatedUser(ctx context.Context, u *user.User, provider, subject string) error {
+	return m.CreateUserWithIdentities(ctx, u, []user.Identity{{Provider: provider, Subject: subject}})
+}
+
+func (m *MemoryUserStore) CreateUserWithIdentities(ctx context.Context, u *user.User, identities []user.Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, identity := range identities {
+		if _, ok := m.identities[identityKey{identity.Provider, identity.Subject}]; ok {
+			return user.ErrIdentityExists
+		}
+	}
+	if err := m.insert(u); err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		m.identities[identityKey{identity.Provider, identity.Subject}] = u.ID
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) ListIdentities(ctx context.Context, userIDs []int64) (map[int64][]user.Identity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[int64]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+	identities := make(map[int64][]user.Identity)
+	for key, userID := range m.identities {
+		if wanted[userID] {
+			identities[userID] = append(identities[userID], user.Identity{Provider: key.provider, Subject: key.subject})
+		}
+	}
+	for _, list := range identities {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Provider != list[j].Provider {
+				return list[i].Provider < list[j].Provider
+			}
+			return list[i].Subject < list[j].Subject
+		})
+	}
+	return identities, nil
+}
+
+func (m *MemoryUserStore) CountUsers(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, u := range m.users {
+		if u.DeleteAfter == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryUserStore) CountPendingUsers(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, u := range m.users {
+		if u.ApprovedAt == nil && u.DeleteAfter == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryUserStore) CountAdmins(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, u := range m.users {
+		if u.IsAdmin() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryUserStore) GetUserStats(ctx context.Context, now time.Time) (*user.UserStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := &user.UserStats{ByStatus: make(map[string]int)}
+	for _, u := range m.users {
+		if u.DeleteAfter != nil {
+			stats.PendingDeletion++
+			continue
+		}
+		stats.Total++
+		stats.ByStatus[u.Status]++
+		if u.ApprovedAt == nil {
+			stats.Pending++
+		} else {
+			stats.Approved++
+		}
+		if u.IsSuspended(now) {
+			stats.Suspended++
+		}
+		if u.IsAdmin() {
+			stats.Admins++
+		}
+	}
+	return stats, nil
+}
+
+func (m *MemoryUserStore) GetUserByID(ctx context.Context, id int64) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	return clone(u), nil
+}
+
+func (m *MemoryUserStore) GetUsersByIDs(ctx context.Context, ids []int64) (map[int64]*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make(map[int64]*user.User, len(ids))
+	for _, id := range ids {
+		if u, ok := m.users[id]; ok {
+			users[id] = clone(u)
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryUserStore) GetUsersByUsernames(ctx context.Context, normalizedUsernames []string) (map[string]*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[string]bool, len(normalizedUsernames))
+	for _, name := range normalizedUsernames {
+		wanted[name] = true
+	}
+	users := make(map[string]*user.User, len(normalizedUsernames))
+	for _, u := range m.users {
+		if wanted[u.NormalizedUsername] {
+			users[u.NormalizedUsername] = clone(u)
+		}
+	}
+	return users, nil
+}
+
+func (m *MemoryUserStore) ListEmails(ctx context.Context, userID int64) ([]user.Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emails := append([]user.Email(nil), m.emails[userID]...)
+	sort.Slice(emails, func(i, j int) bool {
+		if emails[i].Primary != emails[j].Primary {
+			return emails[i].Primary
+		}
+		return emails[i].Address < emails[j].Address
+	})
+	return emails, nil
+}
+
+func (m *MemoryUserStore) AddEmail(ctx context.Context, userID int64, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return user.ErrNotFound
+	}
+	for _, emails := range m.emails {
+		for _, email := range emails {
+			if email.Address == address {
+				return user.ErrEmailTaken
+			}
+		}
+	}
+	primary := true
+	for _, email := range m.emails[userID] {
+		if email.Primary {
+			primary = false
+		}
+	}
+	m.emails[userID] = append(m.emails[userID], user.Email{Address: address, Primary: primary})
+	return nil
+}
+
+func (m *MemoryUserStore) MarkEmailVerified(ctx context.Context, userID int64, address string, verifiedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, email := range m.emails[userID] {
+		if email.Address == address {
+			m.emails[userID][i].VerifiedAt = &verifiedAt
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+func (m *MemoryUserStore) SetPrimaryEmail(ctx context.Context, userID int64, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emails := m.emails[userID]
+	found := false
+	for _, email := range emails {
+		if email.Address == address {
+			found = true
+		}
+	}
+	if !found {
+		return user.ErrNotFound
+	}
+	for i := range emails {
+		emails[i].Primary = emails[i].Address == address
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) RemoveEmail(ctx context.Context, userID int64, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emails := m.emails[userID]
+	for i, email := range emails {
+		if email.Address == address {
+			m.emails[userID] = append(emails[:i], emails[i+1:]...)
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+func (m *MemoryUserStore) GetUserByUsername(ctx context.Context, normalizedUsername string) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.NormalizedUsername == normalizedUsername {
+			return clone(u), nil
+		}
+	}
+	return nil, user.ErrNotFound
+}
+
+func (m *MemoryUserStore) UpdateUser(ctx context.Context, u *user.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.users[u.ID]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if existing.Version != u.Version {
+		return user.ErrConcurrentUpdate
+	}
+	if m.usernameTaken(u.NormalizedUsername, u.ID) {
+		return user.ErrUserAlreadyExists
+	}
+
+	u.Version++
+	updated := clone(u)
+	updated.CreatedAt = existing.CreatedAt
+	// Like UserRepo.UpdateUser, leave the failed-login bookkeeping alone.
+	updated.FailedLogins = existing.FailedLogins
+	updated.LockedUntil = existing.LockedUntil
+	m.users[u.ID] = updated
+	return nil
+}
+
+func (m *MemoryUserStore) ChangeUsername(ctx context.Context, userID int64, username, normalizedUsername string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return user.ErrNotFound
+	}
+	if m.usernameTaken(normalizedUsername, userID) {
+		return user.ErrUserAlreadyExists
+	}
+	m.usernameHistory[userID] = append(m.usernameHistory[userID], u.Username)
+	u.Username = username
+	u.NormalizedUsername = normalizedUsername
+	u.Version++
+	return nil
+}
+
+func (m *MemoryUserStore) DeleteUserByUsername(ctx context.Context, normalizedUsername string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, u := range m.users {
+		if u.NormalizedUsername == normalizedUsername {
+			delete(m.users, id)
+			delete(m.passwordHistory, id)
+			delete(m.pendingSince, id)
+			delete(m.usernameHistory, id)
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+func (m *MemoryUserStore) MergeUsers(ctx context.Context, keepID, mergeID int64) (int, []int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[mergeID]; !ok {
+		return 0, nil, user.ErrNotFound
+	}
+
+	moved := 0
+	for key, t := range m.tokens {
+		if t.userID == mergeID {
+			t.userID = keepID
+			m.tokens[key] = t
+			moved++
+		}
+	}
+
+	var reapproved []int64
+	for id, u := range m.users {
+		if u.ApprovedBy != nil && *u.ApprovedBy == mergeID {
+			approvedBy := keepID
+			u.ApprovedBy = &approvedBy
+			u.Version++
+			reapproved = append(reapproved, id)
+		}
+	}
+
+	for key := range m.approvals {
+		switch {
+		case key.userID == mergeID:
+			delete(m.approvals, key)
+		case key.approverID == mergeID:
+			delete(m.approvals, key)
+			if key.userID != keepID {
+				m.approvals[approvalKey{userID: key.userID, approverID: keepID}] = struct{}{}
+			}
+		}
+	}
+
+	keepHasPrimary := false
+	for _, e := range m.emails[keepID] {
+		keepHasPrimary = keepHasPrimary || e.Primary
+	}
+	for _, e := range m.emails[mergeID] {
+		e.Primary = e.Primary && !keepHasPrimary
+		m.emails[keepID] = append(m.emails[keepID], e)
+	}
+	delete(m.emails, mergeID)
+
+	for key, userID := range m.identities {
+		if userID == mergeID {
+			m.identities[key] = keepID
+		}
+	}
+
+	commands := m.commands[:0]
+	for _, cmd := range m.commands {
+		if cmd.TargetID == mergeID {
+			continue
+		}
+		if cmd.AdminID == mergeID {
+			cmd.AdminID = keepID
+		}
+		commands = append(commands, cmd)
+	}
+	m.commands = commands
+
+	m.usernameHistory[keepID] = append(m.usernameHistory[keepID], m.usernameHistory[mergeID]...)
+	delete(m.usernameHistory, mergeID)
+
+	delete(m.users, mergeID)
+	delete(m.passwordHistory, mergeID)
+	delete(m.pendingSince, mergeID)
+	return moved, reapproved, nil
+}
+
+func (m *MemoryUserStore) RecordFailedLogin(ctx context.Context, normalizedUsername string, maxFailures int, lockUntil time.Time) (int64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.NormalizedUsername != normalizedUsername {
+			continue
+		}
+		u.FailedLogins++
+		if u.FailedLogins < maxFailures {
+			return u.ID, false, nil
+		}
+		u.FailedLogins = 0
+		if u.LockedUntil == nil || u.LockedUntil.Before(lockUntil) {
+			u.LockedUntil = &lockUntil
+		}
+		return u.ID, true, nil
+	}
+	return 0, false, user.ErrNotFound
+}
+
+func (m *MemoryUserStore) ClearFailedLogins(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.FailedLogins = 0
+		u.LockedUntil = nil
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) PurgeScheduledDeletions(ctx context.Context, now time.Time) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged []int64
+	for id, u := range m.users {
+		if u.DeleteAfter != nil && !u.DeleteAfter.After(now) {
+			m.purge(id)
+			purged = append(purged, id)
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryUserStore) PurgeStalePending(ctx context.Context, pendingBefore time.Time) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	signedOff := make(map[int64]bool)
+	for key := range m.approvals {
+		signedOff[key.userID] = true
+	}
+
+	var purged []int64
+	for id, u := range m.users {
+		since, ok := m.pendingSince[id]
+		if !ok {
+			since = u.CreatedAt
+		}
+		if u.ApprovedAt == nil && since.Before(pendingBefore) && !signedOff[id] {
+			m.purge(id)
+			purged = append(purged, id)
+		}
+	}
+	return purged, nil
+}
+
+// purge removes a user and their tokens, as UserRepo's purges do in one
+// transaction. The caller holds m.mu.
+func (m *MemoryUserStore) purge(id int64) {
+	delete(m.users, id)
+	delete(m.passwordHistory, id)
+	delete(m.pendingSince, id)
+	delete(m.usernameHistory, id)
+	for key, t := range m.tokens {
+		if t.userID == id {
+			delete(m.tokens, key)
+		}
+	}
+}
+
+// AddToken registers a token so GetUserToken can resolve it, standing in for
+// the tokens table.
+func (m *MemoryUserStore) AddToken(plaintext, scope string, userID int64, expiry time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[sha256.Sum256([]byte(plaintext))] = memoryToken{
+		userID: userID,
+		scope:  scope,
+		expiry: expiry,
+	}
+}
+
+// UsernameHistory returns the usernames userID held before renames made
+// with ChangeUsername, oldest first.
+func (m *MemoryUserStore) UsernameHistory(userID int64) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.usernameHistory[userID]...)
+}
+
+// TokenCount returns how many tokens registered with AddToken belong to
+// userID.
+func (m *MemoryUserStore) TokenCount(userID int64) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, t := range m.tokens {
+		if t.userID == userID {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *MemoryUserStore) GetUserToken(ctx context.Context, scope, tokenPlainText string) (*user.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tok, ok := m.tokens[sha256.Sum256([]byte(tokenPlainText))]
+	if !ok || tok.scope != scope || !tok.expiry.After(time.Now()) {
+		return nil, user.ErrNotFound
+	}
+	u, ok := m.users[tok.userID]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	return clone(u), nil
+}
+
+func (m *MemoryUserStore) AddPasswordHistory(ctx context.Context, userID int64, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.passwordHistory[userID] = append(m.passwordHistory[userID], append([]byte(nil), hash...))
+	return nil
+}
+
+func (m *MemoryUserStore) ListPasswordHistory(ctx context.Context, userID int64, limit int) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := m.passwordHistory[userID]
+	var hashes [][]byte
+	for i := len(history) - 1; i >= 0 && len(hashes) < limit; i-- {
+		hashes = append(hashes, history[i])
+	}
+	return hashes, nil
+}
+
+func (m *MemoryUserStore) ApproveUser(ctx context.Context, userID, approvedBy int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return user.ErrNotFound
+	}
+	now := time.Now()
+	u.ApprovedAt = &now
+	u.ApprovedBy = &approvedBy
+	u.Version++
+	return nil
+}
+
+func (m *MemoryUserStore) UnapproveUser(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return user.ErrNotFound
+	}
+	u.ApprovedAt = nil
+	u.ApprovedBy = nil
+	u.Version++
+	m.pendingSince[userID] = time.Now()
+	for key := range m.approvals {
+		if key.userID == userID {
+			delete(m.approvals, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryUserStore) RecordApproval(ctx context.Context, userID, approverID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := approvalKey{userID: userID, approverID: approverID}
+	if _, ok := m.approvals[key]; ok {
+		return false, nil
+	}
+	m.approvals[key] = struct{}{}
+	return true, nil
+}
+
+func (m *MemoryUserStore) CountApprovals(ctx context.Context, userID int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for key := range m.approvals {
+		if key.userID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// list returns copies of the users matching keep, sorted by less and paged
+// by limit and offset.
+func (m *MemoryUserStore) list(keep func(*user.User) bool, less func(a, b *user.User) bool, limit, offset int) []*user.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matched []*user.User
+	for _, u := range m.users {
+		if keep(u) {
+			matched = append(matched, clone(u))
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return less(matched[i], matched[j])
+	})
+
+	if offset >= len(matched) {
+		return nil
+	}
+	matched = matched[offset:]
+	if limit < len(matched) {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+func newestFirst(a, b *user.User) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.ID > b.ID
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+func byID(a, b *user.User) bool {
+	return a.ID < b.ID
+}
+
+func (m *MemoryUserStore) ListUsers(ctx context.Context, limit, offset int) ([]*user.User, error) {
+	return m.list(notScheduledForDeletion, newestFirst, limit, offset), nil
+}
+
+func notScheduledForDeletion(u *user.User) bool {
+	return u.DeleteAfter == nil
+}
+
+func (m *MemoryUserStore) ListUsersAfterID(ctx context.Context, afterID int64, limit int) ([]*user.User, error) {
+	return m.list(func(u *user.User) bool { return u.ID > afterID }, byID, limit, 0), nil
+}
+
+func (m *MemoryUserStore) ListUsersOrdered(ctx context.Context, order user.UserOrder, limit, offset int) ([]*user.User, error) {
+	order, err := order.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	// compare orders a and b ascending, reporting unapproved users as
+	// missing so they sort last in either direction.
+	var compare func(a, b *user.User) (int, bool)
+	switch order.Column {
+	case user.SortByUsername:
+		compare = func(a, b *user.User) (int, bool) {
+			return strings.Compare(a.NormalizedUsername, b.NormalizedUsername), true
+		}
+	case user.SortByStatus:
+		compare = func(a, b *user.User) (int, bool) { return strings.Compare(a.Status, b.Status), true }
+	case user.SortByApprovedAt:
+		compare = func(a, b *user.User) (int, bool) {
+			if a.ApprovedAt == nil || b.ApprovedAt == nil {
+				return 0, false
+			}
+			return a.ApprovedAt.Compare(*b.ApprovedAt), true
+		}
+	default:
+		compare = func(a, b *user.User) (int, bool) { return a.CreatedAt.Compare(b.CreatedAt), true }
+	}
+
+	less := func(a, b *user.User) bool {
+		c, ok := compare(a, b)
+		if !ok {
+			if (a.ApprovedAt == nil) != (b.ApprovedAt == nil) {
+				return b.ApprovedAt == nil
+			}
+			c = 0
+		}
+		if c == 0 {
+			c = int(a.ID - b.ID)
+		}
+		if order.Direction == user.SortDesc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return m.list(notScheduledForDeletion, less, limit, offset), nil
+}
+
+func (m *MemoryUserStore) ListPendingUsers(ctx context.Context, limit, offset int) ([]*user.User, error) {
+	pending := func(u *user.User) bool {
+		return u.ApprovedAt == nil && u.DeleteAfter == nil
+	}
+	return m.list(pending, newestFirst, limit, offset), nil
+}
+
+func (m *MemoryUserStore) ListAdmins(ctx context.Context, limit, offset int) ([]*user.User, error) {
+	return m.list((*user.User).IsAdmin, newestFirst, limit, offset), nil
+}
+
+func (m *MemoryUserStore) ListUsersApprovedBetween(ctx context.Context, start, end time.Time, limit, offset int) ([]*user.User, error) {
+	if start.After(end) {
+		return []*user.User{}, nil
+	}
+
+	approvedBetween := func(u *user.User) bool {
+		return u.ApprovedAt != nil && !u.ApprovedAt.Before(start) && !u.ApprovedAt.After(end)
+	}
+	latestApprovalFirst := func(a, b *user.User) bool {
+		return a.ApprovedAt.After(*b.ApprovedAt)
+	}
+	return m.list(approvedBetween, latestApprovalFirst, limit, offset), nil
+}
+
+func (m *MemoryUserStore) ListUsersApprovedBy(ctx context.Context, approverID int64, limit, offset int) ([]*user.User, error) {
+	approvedBy := func(u *user.User) bool {
+		return u.ApprovedBy != nil && *u.ApprovedBy == approverID
+	}
+	latestApprovalFirst := func(a, b *user.User) bool {
+		return a.ApprovedAt.After(*b.ApprovedAt)
+	}
+	users := m.list(approvedBy, latestApprovalFirst, limit, offset)
+	if users == nil {
+		users = []*user.User{}
+	}
+	return users, nil
+}
+
+func (m *MemoryUserStore) SearchUsersByUsername(ctx context.Context, fragment string, limit, offset int) ([]*user.User, error) {
+	fragment = strings.ToLower(fragment)
+	contains := func(u *user.User) bool {
+		return strings.Contains(strings.ToLower(u.Username), fragment)
+	}
+	byUsername := func(a, b *user.User) bool {
+		return a.Username < b.Username
+	}
+	return m.list(contains, byUsername, limit, offset), nil
+}
+
+func (m *MemoryUserStore) RecordCommand(ctx context.Context, cmd *user.Command) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextCommandID++
+	cmd.ID = m.nextCommandID
+	cmd.CreatedAt = time.Now()
+	m.commands = append(m.commands, *cmd)
+	return nil
+}
+
+func (m *MemoryUserStore) LastCommand(ctx context.Context, adminID int64) (*user.Command, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.commands) - 1; i >= 0; i-- {
+		if cmd := m.commands[i]; cmd.AdminID == adminID && cmd.UndoneAt == nil {
+			return &cmd, nil
+		}
+	}
+	return nil, user.ErrNotFound
+}
+
+func (m *MemoryUserStore) MarkCommandUndone(ctx context.Context, commandID int64, undoneAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.commands {
+		if m.commands[i].ID == commandID && m.commands[i].UndoneAt == nil {
+			m.commands[i].UndoneAt = &undoneAt
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
@@ -0,0 +1,170 @@
+package usertest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/samokw/zdeploy/server/internal/user"
+	"github.com/samokw/zdeploy/server/internal/user/usertest"
+)
+
+func newUser(name string) *user.User {
+	return &user.User{
+		Username:           name,
+		NormalizedUsername: user.NormalizeUsername(name),
+		Role:               user.RoleUser,
+		Status:             "active",
+	}
+}
+
+func TestMemoryUserStoreErrors(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		run     func(store *usertest.MemoryUserStore, existing *user.User) error
+		wantErr error
+	}{
+		{
+			name: "get missing",
+			run: func(store *usertest.MemoryUserStore, _ *user.User) error {
+				_, err := store.GetUserByID(ctx, 9999)
+				return err
+			},
+			wantErr: user.ErrNotFound,
+		},
+		{
+			name: "update missing",
+			run: func(store *usertest.MemoryUserStore, _ *user.User) error {
+				missing := newUser("ghost")
+				missing.ID = 9999
+				return store.UpdateUser(ctx, missing)
+			},
+			wantErr: user.ErrNotFound,
+		},
+		{
+			name: "delete missing",
+			run: func(store *usertest.MemoryUserStore, _ *user.User) error {
+				return store.DeleteUserByUsername(ctx, "ghost")
+			},
+			wantErr: user.ErrNotFound,
+		},
+		{
+			name: "duplicate normalized username",
+			run: func(store *usertest.MemoryUserStore, _ *user.User) error {
+				return store.CreateUser(ctx, newUser("EXISTING"))
+			},
+			wantErr: user.ErrUserAlreadyExists,
+		},
+		{
+			name: "stale update",
+			run: func(store *usertest.MemoryUserStore, existing *user.User) error {
+				stale, err := store.GetUserByID(ctx, existing.ID)
+				if err != nil {
+					return err
+				}
+				if err := store.UpdateUser(ctx, existing); err != nil {
+					return err
+				}
+				return store.UpdateUser(ctx, stale)
+			},
+			wantErr: user.ErrConcurrentUpdate,
+		},
+		{
+			name: "update",
+			run: func(store *usertest.MemoryUserStore, existing *user.User) error {
+				return store.UpdateUser(ctx, existing)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := usertest.NewMemoryUserStore()
+			existing := newUser("existing")
+			if err := store.CreateUser(ctx, existing); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.run(store, existing); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	store := usertest.NewMemoryUserStore()
+	u := newUser("alice")
+	if err := store.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Role = user.RoleSuperAdmin
+	u.Status = "inactive"
+
+	again, err := store.GetUserByID(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Role != user.RoleUser || again.Status != "active" {
+		t.Errorf("stored user changed through a returned pointer: role %q, status %q", again.Role, again.Status)
+	}
+}
+
+func TestMemoryUserStoreConcurrentCreates(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		workers     int
+		sameName    bool
+		wantCreated int
+	}{
+		{"distinct names", 20, false, 20},
+		{"one name", 20, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := usertest.NewMemoryUserStore()
+
+			var wg sync.WaitGroup
+			errs := make([]error, tt.workers)
+			for i := 0; i < tt.workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					name := fmt.Sprintf("user%d", i)
+					if tt.sameName {
+						name = "contested"
+					}
+					errs[i] = store.CreateUser(ctx, newUser(name))
+				}(i)
+			}
+			wg.Wait()
+
+			created := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					created++
+				case !errors.Is(err, user.ErrUserAlreadyExists):
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+			if created != tt.wantCreated {
+				t.Errorf("created %d users, want %d", created, tt.wantCreated)
+			}
+			if n, _ := store.CountUsers(ctx); n != tt.wantCreated {
+				t.Errorf("CountUsers = %d, want %d", n, tt.wantCreated)
+			}
+		})
+	}
+}